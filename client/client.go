@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
 	"github.com/olekukonko/tablewriter"
 	"github.com/pcapme/pcap/api"
 	"github.com/pcapme/pcap/server"
@@ -24,9 +23,26 @@ type Client struct {
 	api    api.PCAPClient
 }
 
+// WindowSize, if at least 64 KiB, sets the HTTP/2 flow-control window in bytes, for each stream
+// and for each connection. Windows are advertised by the receiver, so this is what limits how much
+// packet data the server can send before waiting for the client; a larger window raises the
+// throughput of high-rate captures. Zero keeps the gRPC default, which sizes the window
+// dynamically.
+var WindowSize int32
+
+// dialOptions returns the options used to connect to the server.
+func dialOptions() []grpc.DialOption {
+	options := []grpc.DialOption{grpc.WithInsecure()}
+	if WindowSize > 0 {
+		options = append(options,
+			grpc.WithInitialWindowSize(WindowSize), grpc.WithInitialConnWindowSize(WindowSize))
+	}
+	return options
+}
+
 func NewUNIXSocketClient() *Client {
 	connection := new(Client)
-	socket, err := grpc.Dial("unix://"+server.DefaultSocketPath, grpc.WithInsecure())
+	socket, err := grpc.Dial("unix://"+server.DefaultSocketPath, dialOptions()...)
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
@@ -49,17 +65,7 @@ func (c *Client) LiveCapture(ifname string, filter string, format string) {
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
-	var writer *pcapgo.Writer
-	// XXX this should be moved after GetHeader below to get the snaplen.
-	switch format {
-	case "hex":
-	case "pcap":
-		writer = pcapgo.NewWriter(os.Stdout)
-		err = writer.WriteFileHeader(65536, layers.LinkTypeEthernet)
-		if err != nil {
-			log.Fatalf("%v", err)
-		}
-	}
+	var output pcapOutput
 	for {
 		reply, err := stream.Recv()
 		if err == io.EOF {
@@ -68,8 +74,13 @@ func (c *Client) LiveCapture(ifname string, filter string, format string) {
 		if err != nil {
 			log.Fatalf("%v", err)
 		}
-		header := reply.GetHeader()
-		if header != nil {
+		if header := reply.GetHeader(); header != nil && format == "pcap" && output.writer == nil {
+			if err := output.writeHeader(os.Stdout, header); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		if status := reply.GetStatus(); status != nil {
+			log.Printf("%s", status.Message)
 		}
 		packet := reply.GetData()
 		if packet != nil {
@@ -77,24 +88,50 @@ func (c *Client) LiveCapture(ifname string, filter string, format string) {
 			case "hex":
 				fmt.Println(hex.Dump(packet.Data))
 			case "pcap":
-				t := time.Unix(packet.Seconds, int64(packet.Microseconds*1000))
-				ci := gopacket.CaptureInfo{
-					Timestamp:      t,
-					CaptureLength:  len(packet.Data),
-					Length:         int(packet.OriginalLength),
-					InterfaceIndex: 1, // XXX
-				}
-				if writer != nil {
-					err := writer.WritePacket(ci, packet.Data)
-					if err != nil {
-						log.Fatalf("%v", err)
-					}
+				if err := output.writePacket(packet); err != nil {
+					log.Fatalf("%v", err)
 				}
 			}
 		}
 	}
 }
 
+// pcapOutput writes the packets of a capture as a pcap file, once the capture header has given
+// its link type, snaplen and timestamp precision.
+type pcapOutput struct {
+	writer    server.PcapWriter
+	precision api.CaptureHeader_TimestampPrecision
+}
+
+func (o *pcapOutput) writeHeader(w io.Writer, header *api.CaptureHeader) error {
+	o.precision = header.TimestampPrecision
+	o.writer = server.NewPcapWriter(w, o.precision == api.CaptureHeader_NANOSECONDS)
+	return o.writer.WriteFileHeader(header.Snaplen, layers.LinkType(header.Network))
+}
+
+// writePacket writes a packet, if the header has been written.
+func (o *pcapOutput) writePacket(packet *api.PacketData) error {
+	if o.writer == nil {
+		return nil
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:      packetTimestamp(packet, o.precision),
+		CaptureLength:  len(packet.Data),
+		Length:         int(packet.OriginalLength),
+		InterfaceIndex: 1, // XXX
+	}
+	return o.writer.WritePacket(ci, packet.Data)
+}
+
+// packetTimestamp returns the timestamp of a packet, whose fraction of a second is in
+// nanoseconds if the header says so.
+func packetTimestamp(packet *api.PacketData, precision api.CaptureHeader_TimestampPrecision) time.Time {
+	if precision == api.CaptureHeader_NANOSECONDS {
+		return time.Unix(packet.Seconds, int64(packet.Microseconds))
+	}
+	return time.Unix(packet.Seconds, int64(packet.Microseconds)*1000)
+}
+
 func (c *Client) Add(interfaces []string, filter string, name string, snaplen int32, duration uint32) {
 	// Contact the server and print out its response.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
@@ -134,6 +171,13 @@ func (c *Client) InterfaceList(all bool) {
 		log.Fatalf("Error listing interfaces: %v", err)
 	}
 	//log.Printf("Result: success=%t (%T): %+v", reply.Success, reply, reply)
+	if !reply.Success {
+		log.Fatalf("Error listing interfaces: %s", reply.Error)
+	}
+	if reply.Count == 0 {
+		log.Printf("No matching interfaces (of %d).", reply.Total)
+		return
+	}
 	data := make([][]string, 0, len(reply.Interfaces))
 	for _, iface := range reply.Interfaces {
 		data = append(
@@ -172,6 +216,8 @@ func Execute() {
 			// fmt.Printf("\n\ncmd: %+v\nargs:%+v\n\n", cmd, args)
 		},
 	}
+	rootCmd.PersistentFlags().Int32Var(&WindowSize, "window-size", 0,
+		"HTTP/2 flow-control window for receiving from the server, in bytes. (By default, sized dynamically.)")
 	var versionCmd = &cobra.Command{
 		Use:   "version",
 		Short: "Show version string.",
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pcapme/pcap/api"
+	"testing"
+	"time"
+)
+
+func TestPcapOutputRoundTrip(t *testing.T) {
+	data := []byte{1, 2, 3, 4}
+	for _, test := range []struct {
+		precision api.CaptureHeader_TimestampPrecision
+		fraction  uint32
+		timestamp time.Time
+		magic     uint32
+	}{
+		{api.CaptureHeader_MICROSECONDS, 123456, time.Unix(1500000000, 123456000), 0xa1b2c3d4},
+		{api.CaptureHeader_NANOSECONDS, 123456789, time.Unix(1500000000, 123456789), 0xa1b23c4d},
+	} {
+		var buf bytes.Buffer
+		var output pcapOutput
+		header := &api.CaptureHeader{Snaplen: 96, Network: uint32(layers.LinkTypeEthernet), TimestampPrecision: test.precision}
+		if err := output.writeHeader(&buf, header); err != nil {
+			t.Fatal(err)
+		}
+		packet := &api.PacketData{Seconds: 1500000000, Microseconds: test.fraction, OriginalLength: 100, Data: data}
+		if err := output.writePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+		if magic := binary.LittleEndian.Uint32(buf.Bytes()); magic != test.magic {
+			t.Errorf("%v: expected magic %x, got %x", test.precision, test.magic, magic)
+		}
+		reader, err := pcapgo.NewReader(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", test.precision, err)
+		}
+		if reader.LinkType() != layers.LinkTypeEthernet || reader.Snaplen() != 96 {
+			t.Errorf("%v: unexpected file header: link type %v, snaplen %d", test.precision, reader.LinkType(), reader.Snaplen())
+		}
+		read, ci, err := reader.ReadPacketData()
+		if err != nil {
+			t.Fatalf("%v: %v", test.precision, err)
+		}
+		if !ci.Timestamp.Equal(test.timestamp) || ci.Length != 100 || !bytes.Equal(read, data) {
+			t.Errorf("%v: expected the packet at %v, got %+v", test.precision, test.timestamp, ci)
+		}
+	}
+}
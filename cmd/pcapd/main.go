@@ -3,9 +3,31 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"github.com/pcapme/pcap/server"
+	"log"
 )
 
 func main() {
-	server.StartUnixSocketServer()
+	listen := flag.String("listen", "", "serve on this TCP address (such as :5050) instead of the unix socket")
+	certFile := flag.String("tls-cert", "", "TLS certificate file for the TCP listener")
+	keyFile := flag.String("tls-key", "", "TLS private key file for the TCP listener")
+	allowInsecure := flag.Bool("allow-insecure", false, "allow the TCP listener to serve without TLS")
+	flag.Parse()
+
+	if *listen == "" {
+		server.StartUnixSocketServer()
+		return
+	}
+	var tlsConfig *tls.Config
+	if *certFile != "" || *keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Unable to load TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+	server.ServerConfig.AllowInsecure = *allowInsecure
+	server.StartTCPServer(*listen, tlsConfig)
 }
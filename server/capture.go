@@ -0,0 +1,560 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// liveCapture holds the state of a single LiveCapture stream.
+type liveCapture struct {
+	// Packets read that passed the capture filter (before any other selection), reported by the
+	// Statistics RPC while the capture is running. Accessed atomically, so it comes first to be
+	// 64-bit aligned.
+	matched uint64
+
+	request *api.CaptureRequest
+	stream  api.PCAP_LiveCaptureServer
+	config  *Config
+	hooks   *Hooks
+	info    *CaptureInfo
+	span    Span
+
+	// Link-layer type of the capture handle, used to decode packets.
+	linkType layers.LinkType
+
+	// Link-layer type of the egress capture handle, if any.
+	egressLinkType layers.LinkType
+
+	// The BPF filter applied to the capture handle.
+	filter string
+
+	// If the client asked for packets in timestamp order, they pass through this buffer.
+	reorder *reorderBuffer
+
+	// If the client asked for a time slice, packets outside of it aren't forwarded.
+	window *timeWindow
+
+	// In first-packet-only mode, tracks the flows already forwarded.
+	flows *flowTracker
+
+	// If the client capped the packets forwarded per flow, counts the packets of each flow.
+	flowLimit *flowLimiter
+
+	// If an egress interface is also being captured, matches packets to measure forwarding latency.
+	latency *latencyMatcher
+
+	// If the client asked for identical summaries to be coalesced, holds the pending summary.
+	coalescer *summaryCoalescer
+
+	// If the client asked for sampling and the kernel can't do it, samples packets as they are
+	// read. The sampling mode in use is reported in the header.
+	sampler  *packetSampler
+	sampling string
+
+	// If the client asked for duplicate packets to be dropped, remembers the packets seen.
+	dedup *deduplicator
+
+	// Samples forwarded packets while the host is under heavy load, if configured.
+	throttle *cpuThrottle
+
+	// Set if the client limited the rate of packets it is sent.
+	limiter *rateLimiter
+
+	// If the client asked for packet data to be compressed (and the codec is supported), creates
+	// a compressor for each goroutine reading packets, which compresses them as they are read.
+	compression   api.CaptureRequest_Compression
+	newCompressor func() Compressor
+
+	// If the client asked for protocol hierarchy statistics, counts packets by protocol.
+	hierarchy *protocolHierarchy
+
+	// Additional destinations for captured packets, such as files.
+	sinks []PacketSink
+
+	// The stages queuePacket passes packets through, set up when the first packet is queued or
+	// the capture is described (whichever comes first), once the capture's options are known.
+	stages []packetStage
+
+	// The pcap file being written, if any.
+	outputFile string
+	fileSink   *fileSink
+
+	// The metadata sink, if the client asked for packet metadata to be sent.
+	metadataSink *metadataSink
+
+	// Closed to stop the capture early, such as when its file is finalized. Set by the capture
+	// loop if that is how the capture ended.
+	stop             chan struct{}
+	stopOnce         sync.Once
+	stoppedOnRequest bool
+
+	// Fires when the capture reaches its requested duration, or nears the deadline of its call.
+	deadline       <-chan time.Time
+	deadlineTimer  *time.Timer
+	deadlineReason string
+
+	// Why the capture ended, if it reached one of its limits (see reachLimit).
+	endReason string
+
+	// If the client asked for an offline source to be replayed in real time, delays packets as
+	// they are read.
+	pacer *replayPacer
+
+	// Delivers the result of the read outstanding on the reader goroutine, if any (see
+	// channelLoop and closeHandle).
+	pendingRead <-chan *packetData
+
+	// Identifies the capture to the Statistics RPC, which reads from statsHandles while the
+	// capture is running.
+	id           uint64
+	statsMu      sync.Mutex
+	statsHandles []*pcap.Handle
+
+	// The capture's effective request and pipeline, reported by the DescribeCapture RPC once the
+	// capture has started.
+	descriptionMu sync.Mutex
+	description   *api.CaptureRequest
+	pipeline      []*api.PipelineStage
+
+	// The interfaces being captured. The first is read from the capture handle, and the rest (if
+	// the client asked for additional interfaces) from handles of their own.
+	interfaces []string
+
+	// Exports metrics and events, if configured, and when the capture's counters were last
+	// exported.
+	otlp         *otlpExporter
+	otlpExported time.Time
+
+	// Closed once the capture has ended, after final is set to its record.
+	ended chan struct{}
+	final *api.CaptureRecord
+
+	// When the last packet was queued, used to decide when held packets should be flushed.
+	lastQueued time.Time
+
+	// Statistics, reported in the capture history when the capture ends.
+	started       time.Time
+	packets       uint64
+	bytes         uint64
+	kernelDropped uint64
+
+	// Whether kernelDropped has been read from the capture's handles (see tallyKernelDrops).
+	kernelDropsTallied bool
+}
+
+func newLiveCapture(in *api.CaptureRequest, stream api.PCAP_LiveCaptureServer, config *Config) *liveCapture {
+	capture := &liveCapture{
+		request:    in,
+		stream:     stream,
+		config:     config,
+		hooks:      config.Hooks,
+		info:       &CaptureInfo{Request: in, Peer: peerIdentity(stream.Context())},
+		span:       spanFromContext(stream.Context()),
+		throttle:   newCPUThrottle(config.Throttle),
+		limiter:    newRateLimiter(in.MaxPacketsPerSecond),
+		started:    time.Now(),
+		window:     newTimeWindow(in.WindowStartNanoseconds, in.WindowEndNanoseconds),
+		interfaces: []string{in.Interface},
+		stop:       make(chan struct{}),
+		ended:      make(chan struct{}),
+	}
+	if in.PreserveTiming {
+		capture.pacer = &replayPacer{}
+	}
+	if in.ReorderWindowNanoseconds > 0 {
+		capture.reorder = newReorderBuffer(time.Duration(in.ReorderWindowNanoseconds))
+	}
+	if len(in.EgressInterface) > 0 {
+		capture.latency = newLatencyMatcher(int(in.LatencyTableSize))
+	}
+	if in.Summarize && in.CoalesceWindowNanoseconds > 0 {
+		capture.coalescer = newSummaryCoalescer(time.Duration(in.CoalesceWindowNanoseconds))
+	}
+	if in.FirstPacketOnly {
+		capture.flows = newFlowTracker(time.Duration(in.FlowIdleTimeoutNanoseconds))
+	}
+	if in.MaxPacketsPerFlow > 0 {
+		capture.flowLimit = newFlowLimiter(in.MaxPacketsPerFlow, time.Duration(in.FlowIdleTimeoutNanoseconds))
+	}
+	if in.ProtocolHierarchyIntervalNanoseconds > 0 {
+		capture.hierarchy = newProtocolHierarchy(time.Duration(in.ProtocolHierarchyIntervalNanoseconds))
+	}
+	return capture
+}
+
+// openSinks opens any additional packet destinations the client requested. If any of them can't
+// be opened, those already opened are closed again.
+func (c *liveCapture) openSinks(snaplen int) (err error) {
+	defer func() {
+		if err != nil {
+			c.closeSinks()
+		}
+	}()
+	if len(c.request.OutputPath) > 0 {
+		path, err := outputPath(c.config.OutputDirectory, c.request.OutputPath)
+		if err != nil {
+			return err
+		}
+		options := fileOptions{
+			linkType:   c.linkType,
+			snaplen:    snaplen,
+			format:     formatPcapMicroseconds,
+			interfaces: c.interfaces,
+			comment:    c.request.FileComment,
+			bufferSize: int(c.request.FileBufferBytes),
+			maxBytes:   int64(c.request.MaxFileBytes),
+		}
+		if c.request.FileSnaplen > 0 {
+			options.snaplen = int(c.request.FileSnaplen)
+		}
+		switch c.request.OutputFormat {
+		case api.CaptureRequest_PCAP_NANOSECONDS:
+			options.format = formatPcapNanoseconds
+		case api.CaptureRequest_PCAPNG:
+			options.format = formatPcapng
+		}
+		sink, err := newFileSink(path, options, time.Duration(c.request.FlushIntervalNanoseconds))
+		if err != nil {
+			return err
+		}
+		c.sinks = append(c.sinks, sink)
+		c.outputFile = path
+		c.fileSink = sink
+	}
+	if len(c.request.CsvOutputPath) > 0 {
+		path, err := outputPath(c.config.OutputDirectory, c.request.CsvOutputPath)
+		if err != nil {
+			return err
+		}
+		sink, err := newCSVSink(path, c.linkType, c.request.Interface, c.request.CsvColumns)
+		if err != nil {
+			return err
+		}
+		c.sinks = append(c.sinks, sink)
+	}
+	if c.request.SendToCollector {
+		if len(c.config.CollectorAddress) == 0 {
+			return errors.New("no collector is configured on this server")
+		}
+		c.sinks = append(c.sinks, newTCPSink(c.config.CollectorAddress, c.linkType, snaplen,
+			c.config.CollectorReconnectInterval))
+	}
+	if c.request.SendMetadata {
+		if len(c.config.MetadataSocket) == 0 {
+			return errors.New("no metadata socket is configured on this server")
+		}
+		c.metadataSink = newMetadataSink(c.config.MetadataSocket, c.linkType, DefaultReconnectInterval)
+		c.sinks = append(c.sinks, c.metadataSink)
+	}
+	return nil
+}
+
+// closeSinks closes all packet destinations, returning the first error encountered.
+func (c *liveCapture) closeSinks() error {
+	var err error
+	for _, sink := range c.sinks {
+		if closeErr := sink.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	c.sinks = nil
+	return err
+}
+
+// queuePacket passes a packet through the capture's stages (see queueStages), then sends it to
+// the client, unless one of them drops or holds it.
+func (c *liveCapture) queuePacket(p *packetData) error {
+	for _, stage := range c.queueStages() {
+		if forward, err := stage.apply(p); !forward || err != nil {
+			return err
+		}
+	}
+	return c.sendPacket(p)
+}
+
+// countPacket adds a packet to the capture's statistics, which its limits apply to.
+func (c *liveCapture) countPacket(p *packetData) (bool, error) {
+	c.packets++
+	c.lastQueued = time.Now()
+	c.bytes += uint64(len(p.data))
+	return true, nil
+}
+
+// packetFlow returns the flow a packet belongs to, working it out once for all of the stages
+// that need it.
+func (c *liveCapture) packetFlow(p *packetData) flowKey {
+	if p.flow == nil {
+		key := newFlowKey(summarizePacket(p.data, p.ci, c.linkType))
+		p.flow = &key
+	}
+	return *p.flow
+}
+
+// queueEgressPacket matches a packet captured on the egress interface to the same packet captured
+// on the ingress interface, and sends a summary including the forwarding latency. Packets that
+// don't match aren't sent.
+func (c *liveCapture) queueEgressPacket(p *packetData) error {
+	key, ok := forwardingKey(p.data, c.egressLinkType)
+	if !ok {
+		return nil
+	}
+	latency, ok := c.latency.matchEgress(key, p.ci.Timestamp)
+	if !ok {
+		return nil
+	}
+	summary := summarizePacket(p.data, p.ci, c.egressLinkType)
+	if c.request.DecodeFields {
+		summary.DecodedLayers = decodeFields(p.data, c.egressLinkType)
+	}
+	summary.OptionalForwardingLatency = &api.PacketSummary_ForwardingLatencyNanoseconds{
+		ForwardingLatencyNanoseconds: int64(latency),
+	}
+	return c.stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Summary{Summary: summary},
+	})
+}
+
+// flushPackets sends any packets held in the reorder buffer, and any pending coalesced summary.
+func (c *liveCapture) flushPackets() error {
+	if c.reorder != nil {
+		if err := c.sendPackets(c.reorder.flush()); err != nil {
+			return err
+		}
+	}
+	if c.coalescer != nil {
+		if summary := c.coalescer.flush(); summary != nil {
+			return c.sendSummary(summary)
+		}
+	}
+	return nil
+}
+
+// holdWindow returns how long held packets may wait for newer packets before they should be
+// flushed, or zero if nothing is being held.
+func (c *liveCapture) holdWindow() time.Duration {
+	if c.reorder != nil && !c.reorder.empty() {
+		return c.reorder.window
+	}
+	if c.coalescer != nil && !c.coalescer.empty() {
+		return c.coalescer.window
+	}
+	return 0
+}
+
+// flushTimeout returns a channel that fires when held packets should be flushed because no
+// newer packets have arrived, or nil if nothing is being held.
+func (c *liveCapture) flushTimeout() <-chan time.Time {
+	if window := c.holdWindow(); window > 0 {
+		return time.After(window)
+	}
+	return nil
+}
+
+// flushDue returns true if held packets should be flushed because no newer packets have arrived.
+func (c *liveCapture) flushDue(now time.Time) bool {
+	window := c.holdWindow()
+	return window > 0 && now.Sub(c.lastQueued) >= window
+}
+
+// sendHierarchy sends a snapshot of the protocol hierarchy statistics.
+func (c *liveCapture) sendHierarchy() error {
+	return c.stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_ProtocolHierarchy{ProtocolHierarchy: c.hierarchy.snapshot()},
+	})
+}
+
+// finish sends any final statistics, once the capture has ended without error. Nothing is sent
+// if the client has gone away.
+func (c *liveCapture) finish() error {
+	if c.stream.Context().Err() != nil {
+		return nil
+	}
+	if c.flowLimit != nil && c.flowLimit.droppedTotal > 0 {
+		if err := c.sendCappedFlows(); err != nil {
+			return err
+		}
+	}
+	if c.fileSink != nil {
+		if err := c.sendOutputFiles(); err != nil {
+			return err
+		}
+	}
+	if c.hierarchy != nil {
+		if err := c.sendHierarchy(); err != nil {
+			return err
+		}
+	}
+	sampled, _ := c.sampledPackets()
+	if sampled > 0 || (c.limiter != nil && c.limiter.dropped > 0) || (c.metadataSink != nil && c.metadataSink.dropped > 0) {
+		if err := c.sendUnsentPackets(); err != nil {
+			return err
+		}
+	}
+	if len(c.endReason) > 0 {
+		return c.sendLimitReached()
+	}
+	return nil
+}
+
+// sendOutputFiles tells the client which files the capture was written to.
+func (c *liveCapture) sendOutputFiles() error {
+	files := c.fileSink.writtenFiles()
+	status := &api.CaptureStatus{
+		Message:     fmt.Sprintf("Wrote %d files: %s", len(files), strings.Join(files, ", ")),
+		OutputFiles: files,
+	}
+	if len(files) == 1 {
+		status.Message = "Wrote " + files[0]
+	}
+	log.Printf("%s: %s", c.request.Interface, status.Message)
+	return c.stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Status{Status: status},
+	})
+}
+
+// sendCappedFlows tells the client how many packets were dropped from each flow that exceeded
+// the per-flow limit, listing those with the most dropped and totalling the rest.
+func (c *liveCapture) sendCappedFlows() error {
+	flows, other := c.flowLimit.cappedFlows()
+	count := fmt.Sprintf("%d flows", len(c.flowLimit.dropped))
+	if c.flowLimit.untracked > 0 {
+		count = "more than " + count
+	}
+	status := &api.CaptureStatus{
+		Message: fmt.Sprintf("%d packets from %s exceeded the limit of %d packets per flow",
+			c.flowLimit.droppedTotal, count, c.request.MaxPacketsPerFlow),
+		CappedFlows:        flows,
+		OtherCappedPackets: other,
+	}
+	log.Printf("%s: %s", c.request.Interface, status.Message)
+	return c.stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Status{Status: status},
+	})
+}
+
+// sendThrottleStatus tells the client that adaptive throttling was engaged or released.
+func (c *liveCapture) sendThrottleStatus() error {
+	status := &api.CaptureStatus{
+		Throttled:        c.throttle.engaged,
+		SampleRate:       c.throttle.config.SampleRate,
+		ThrottledPackets: c.throttle.dropped,
+	}
+	if status.Throttled {
+		status.Message = "CPU load is high; adaptive throttling engaged"
+	} else {
+		status.Message = "CPU load is normal; adaptive throttling released"
+	}
+	log.Printf("%s: %s", c.request.Interface, status.Message)
+	c.span.AddEvent(status.Message, map[string]interface{}{"throttled_packets": status.ThrottledPackets})
+	c.otlp.event(c, status.Message, status.Throttled)
+	return c.stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Status{Status: status},
+	})
+}
+
+func (c *liveCapture) sendPackets(packets []*packetData) error {
+	for _, p := range packets {
+		if err := c.sendPacket(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendPacket forwards a single captured packet to the client.
+func (c *liveCapture) sendPacket(p *packetData) error {
+	data, ci := p.data, p.ci
+	c.hooks.packet(c.info, data, ci)
+	if c.request.Summarize {
+		summary := summarizePacket(data, ci, c.linkType)
+		summary.Interface = c.interfaceName(ci.InterfaceIndex)
+		if c.request.DecodeFields {
+			summary.DecodedLayers = decodeFields(data, c.linkType)
+		}
+		if c.coalescer != nil {
+			if summary = c.coalescer.add(summary, ci.Timestamp); summary == nil {
+				return nil
+			}
+		}
+		return c.sendSummary(summary)
+	}
+	packet := newPacketData(data, ci, int(c.request.MaxForwardBytes))
+	packet.Interface = c.interfaceName(ci.InterfaceIndex)
+	if c.newCompressor != nil {
+		// Compressed by the goroutine that read the packet (see compressPacket).
+		if p.compressErr != nil {
+			return p.compressErr
+		}
+		packet.Data = p.compressed
+	}
+	return c.stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Data{Data: packet},
+	})
+}
+
+func (c *liveCapture) sendSummary(summary *api.PacketSummary) error {
+	return c.stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Summary{Summary: summary},
+	})
+}
+
+// requestStop asks the capture loop to flush any held packets and return. It may be called more
+// than once; only the first call returns true.
+func (c *liveCapture) requestStop() (first bool) {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		first = true
+	})
+	return first
+}
+
+// record summarizes the capture for the capture history.
+func (c *liveCapture) record(err error) *api.CaptureRecord {
+	record := &api.CaptureRecord{
+		Interface:           c.request.Interface,
+		Filter:              c.filter,
+		StartSeconds:        c.started.Unix(),
+		DurationNanoseconds: int64(time.Since(c.started)),
+		Packets:             c.packets,
+		Bytes:               c.bytes,
+		DroppedPackets:      c.kernelDropped,
+		Peer:                c.info.Peer,
+	}
+	if len(c.request.OfflineSource) > 0 {
+		record.Interface = c.request.OfflineSource
+	}
+	if c.flows != nil {
+		record.Flows = c.flows.flows
+	}
+	if c.flowLimit != nil {
+		record.FlowCappedPackets = c.flowLimit.droppedTotal
+	}
+	if c.fileSink != nil {
+		record.OutputFiles = c.fileSink.writtenFiles()
+	}
+	if c.throttle != nil {
+		record.ThrottledPackets = c.throttle.dropped
+	}
+	record.SampledPackets, record.SampledPacketsEstimated = c.sampledPackets()
+	if c.limiter != nil {
+		record.RateLimitedPackets = c.limiter.dropped
+	}
+	if c.dedup != nil {
+		record.DuplicatePackets = c.dedup.dropped
+		record.DedupUntrackedPackets = c.dedup.untracked
+	}
+	if c.metadataSink != nil {
+		record.MetadataDroppedRecords = c.metadataSink.dropped
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/gopacket"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/metadata"
+	"testing"
+	"time"
+)
+
+// fakeCaptureStream records the replies sent on a LiveCapture stream.
+type fakeCaptureStream struct {
+	ctx     context.Context
+	replies []*api.CaptureReply
+}
+
+func newFakeCaptureStream() *fakeCaptureStream {
+	return &fakeCaptureStream{ctx: context.Background()}
+}
+
+func (f *fakeCaptureStream) Send(reply *api.CaptureReply) error {
+	f.replies = append(f.replies, reply)
+	return nil
+}
+
+func (f *fakeCaptureStream) SetHeader(metadata.MD) error  { return nil }
+func (f *fakeCaptureStream) SendHeader(metadata.MD) error { return nil }
+func (f *fakeCaptureStream) SetTrailer(metadata.MD)       {}
+func (f *fakeCaptureStream) Context() context.Context     { return f.ctx }
+func (f *fakeCaptureStream) SendMsg(m interface{}) error  { return nil }
+func (f *fakeCaptureStream) RecvMsg(m interface{}) error  { return nil }
+
+// packets returns the PacketData replies sent on the stream.
+func (f *fakeCaptureStream) packets() []*api.PacketData {
+	packets := make([]*api.PacketData, 0, len(f.replies))
+	for _, reply := range f.replies {
+		if data := reply.GetData(); data != nil {
+			packets = append(packets, data)
+		}
+	}
+	return packets
+}
+
+func TestOnPacketHookInvokedPerPacket(t *testing.T) {
+	var seen [][]byte
+	hooks := &Hooks{
+		OnPacket: func(info *CaptureInfo, data []byte, ci gopacket.CaptureInfo) {
+			if info.Request.Interface != "test0" {
+				t.Errorf("unexpected interface: %s", info.Request.Interface)
+			}
+			seen = append(seen, append([]byte(nil), data...))
+		},
+	}
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{Interface: "test0"}, stream, &Config{Hooks: hooks})
+	inputs := [][]byte{{1, 2, 3}, {4, 5}, {6}}
+	for _, data := range inputs {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+		if err := capture.sendPacket(&packetData{data: data, ci: ci}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(seen) != len(inputs) {
+		t.Fatalf("expected %d hook calls, got %d", len(inputs), len(seen))
+	}
+	for i := range inputs {
+		if !bytes.Equal(seen[i], inputs[i]) {
+			t.Errorf("packet %d: expected %v, got %v", i, inputs[i], seen[i])
+		}
+	}
+	if len(stream.packets()) != len(inputs) {
+		t.Errorf("expected %d packets forwarded, got %d", len(inputs), len(stream.packets()))
+	}
+}
+
+func TestCaptureWithoutHooks(t *testing.T) {
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{}, stream, &Config{})
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 1, Length: 1}
+	if err := capture.sendPacket(&packetData{data: []byte{1}, ci: ci}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaptureReorderWindow(t *testing.T) {
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{ReorderWindowNanoseconds: int64(time.Second)}, stream, &Config{})
+	base := time.Unix(1000, 0)
+	for _, offset := range []time.Duration{2, 1, 3} {
+		ci := gopacket.CaptureInfo{Timestamp: base.Add(offset * time.Millisecond), CaptureLength: 1, Length: 1}
+		if err := capture.queuePacket(&packetData{data: []byte{byte(offset)}, ci: ci}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(stream.packets()) != 0 {
+		t.Fatalf("expected packets to be held, got %d", len(stream.packets()))
+	}
+	if capture.flushTimeout() == nil {
+		t.Error("expected a flush timeout while packets are held")
+	}
+	if err := capture.flushPackets(); err != nil {
+		t.Fatal(err)
+	}
+	packets := stream.packets()
+	if len(packets) != 3 || packets[0].Data[0] != 1 || packets[1].Data[0] != 2 || packets[2].Data[0] != 3 {
+		t.Errorf("unexpected packet order: %+v", packets)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pcapme/pcap/api"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// clockStatusSource reports how well the host clock is synchronized. It is a variable so that
+// tests can substitute a fake source.
+var clockStatusSource = readClockStatus
+
+// captureClockStatus samples the host clock status for inclusion in a CaptureHeader. Hosts that
+// can't report synchronization information yield nil rather than an error, since a capture is
+// still useful without it.
+func captureClockStatus() *api.ClockStatus {
+	status, err := clockStatusSource()
+	if err != nil {
+		log.Printf("Clock status unavailable: %v", err)
+		return nil
+	}
+	return status
+}
+
+// sidecarPath returns the path of the sidecar file describing a capture's output file.
+func sidecarPath(outputFile string) string {
+	return outputFile + ".json"
+}
+
+// writeSidecar writes the capture header, with the host clock status at capture start, as JSON
+// next to the capture's output file, so that whoever analyzes the file later knows how far its
+// timestamps can be trusted. It is written to a temporary file, then renamed over any sidecar
+// left by an earlier capture to the same path. Failing to write it is logged, but doesn't fail the
+// capture; a stale sidecar is removed, so that it can't be taken to describe this capture.
+func writeSidecar(outputFile string, header *api.CaptureHeader) {
+	path := sidecarPath(outputFile)
+	if err := writeFileAtomically(path, header); err != nil {
+		log.Printf("Unable to write %s: %v", path, err)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to remove stale %s: %v", path, err)
+		}
+	}
+}
+
+// writeFileAtomically writes message as JSON to a temporary file beside path, then renames it to
+// path.
+func writeFileAtomically(path string, message proto.Message) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	marshaler := jsonpb.Marshaler{Indent: "  "}
+	err = file.Chmod(0640)
+	if err == nil {
+		err = marshaler.Marshal(file, message)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
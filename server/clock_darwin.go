@@ -0,0 +1,10 @@
+package server
+
+import (
+	"errors"
+	"github.com/pcapme/pcap/api"
+)
+
+func readClockStatus() (*api.ClockStatus, error) {
+	return nil, errors.New("clock status is not supported on this platform")
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"github.com/pcapme/pcap/api"
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+// See 'man adjtimex'.
+const (
+	timeError    = 5
+	statusUnsync = 0x0040
+	statusNano   = 0x2000
+)
+
+func readClockStatus() (*api.ClockStatus, error) {
+	var timex unix.Timex
+	state, err := unix.Adjtimex(&timex)
+	if err != nil {
+		return nil, err
+	}
+	offset := timex.Offset
+	if timex.Status&statusNano == 0 {
+		offset *= int64(time.Microsecond)
+	}
+	return &api.ClockStatus{
+		Source:                    "adjtimex",
+		Synchronized:              state != timeError && timex.Status&statusUnsync == 0,
+		OffsetNanoseconds:         offset,
+		MaxErrorNanoseconds:       timex.Maxerror * int64(time.Microsecond),
+		EstimatedErrorNanoseconds: timex.Esterror * int64(time.Microsecond),
+	}, nil
+}
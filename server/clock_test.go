@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureHeaderRecordsClockStatus(t *testing.T) {
+	defer func(source func() (*api.ClockStatus, error)) { clockStatusSource = source }(clockStatusSource)
+	clockStatusSource = func() (*api.ClockStatus, error) {
+		return &api.ClockStatus{Source: "mock", Synchronized: true, OffsetNanoseconds: -1500}, nil
+	}
+	header := newCaptureHeader(layers.LinkTypeEthernet, 128)
+	if header.Clock == nil {
+		t.Fatal("expected clock status in header")
+	}
+	if header.Clock.Source != "mock" || !header.Clock.Synchronized || header.Clock.OffsetNanoseconds != -1500 {
+		t.Errorf("unexpected clock status: %+v", header.Clock)
+	}
+}
+
+func TestCaptureHeaderWithoutClockStatus(t *testing.T) {
+	defer func(source func() (*api.ClockStatus, error)) { clockStatusSource = source }(clockStatusSource)
+	clockStatusSource = func() (*api.ClockStatus, error) {
+		return nil, errors.New("not supported")
+	}
+	header := newCaptureHeader(layers.LinkTypeEthernet, 128)
+	if header.Clock != nil {
+		t.Errorf("expected no clock status, got: %+v", header.Clock)
+	}
+}
+
+func TestOutputFileSidecarRecordsClockStatus(t *testing.T) {
+	defer func(source func() (*api.ClockStatus, error)) { clockStatusSource = source }(clockStatusSource)
+	clockStatusSource = func() (*api.ClockStatus, error) {
+		return &api.ClockStatus{Source: "mock", Synchronized: true, OffsetNanoseconds: -1500}, nil
+	}
+	dir, err := ioutil.TempDir("", "pcap-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(input)
+	// A sidecar left by an earlier capture, whose output file has since been removed, is replaced.
+	stale := `{"captureId": "1", "clock": {"source": "stale"}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "out.pcap.json"), []byte(stale), 0640); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Config{OfflineDirectory: os.TempDir(), OutputDirectory: dir})
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: input, OutputPath: "out.pcap"}, newFakeCaptureStream()); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 2 {
+		t.Errorf("expected only the output file and its sidecar, got %q", files)
+	}
+	file, err := os.Open(filepath.Join(dir, "out.pcap.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var header api.CaptureHeader
+	if err := jsonpb.Unmarshal(file, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Clock == nil || header.Clock.Source != "mock" || header.Clock.OffsetNanoseconds != -1500 {
+		t.Errorf("expected the sidecar to record the clock status, got %+v", header)
+	}
+	if header.Network != uint32(layers.LinkTypeEthernet) || header.CaptureId == 0 {
+		t.Errorf("expected the sidecar to hold the capture header, got %+v", header)
+	}
+}
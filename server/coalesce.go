@@ -0,0 +1,56 @@
+package server
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/pcapme/pcap/api"
+	"time"
+)
+
+// summaryCoalescer merges runs of identical packet summaries (such as a burst of keepalives) into
+// a single summary with a count. Summaries are identical if they differ only in their timestamps.
+// A run ends when a different summary arrives, or when a summary arrives more than the window
+// after the first summary in the run; the merged summary keeps the timestamp of the first.
+type summaryCoalescer struct {
+	window  time.Duration
+	pending *api.PacketSummary
+	key     *api.PacketSummary
+	first   time.Time
+}
+
+func newSummaryCoalescer(window time.Duration) *summaryCoalescer {
+	return &summaryCoalescer{window: window}
+}
+
+// coalesceKey returns a copy of the summary without its timestamp, for comparison.
+func coalesceKey(summary *api.PacketSummary) *api.PacketSummary {
+	key := proto.Clone(summary).(*api.PacketSummary)
+	key.Seconds = 0
+	key.Microseconds = 0
+	return key
+}
+
+// add merges the summary into the pending run if possible. If it starts a new run, the summary
+// for the previous run is returned so it can be sent.
+func (c *summaryCoalescer) add(summary *api.PacketSummary, timestamp time.Time) *api.PacketSummary {
+	key := coalesceKey(summary)
+	if c.pending != nil && timestamp.Sub(c.first) <= c.window && proto.Equal(key, c.key) {
+		c.pending.Count++
+		return nil
+	}
+	ready := c.pending
+	summary.Count = 1
+	c.pending, c.key, c.first = summary, key, timestamp
+	return ready
+}
+
+// flush ends the pending run, returning its summary (or nil if nothing is pending).
+func (c *summaryCoalescer) flush() *api.PacketSummary {
+	ready := c.pending
+	c.pending, c.key = nil, nil
+	return ready
+}
+
+// empty returns true if no summary is pending.
+func (c *summaryCoalescer) empty() bool {
+	return c.pending == nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"testing"
+	"time"
+)
+
+// summaries returns the PacketSummary replies sent on the stream.
+func summaries(stream *fakeCaptureStream) []*api.PacketSummary {
+	var result []*api.PacketSummary
+	for _, reply := range stream.replies {
+		if summary := reply.GetSummary(); summary != nil {
+			result = append(result, summary)
+		}
+	}
+	return result
+}
+
+func queueFixtures(t *testing.T, capture *liveCapture, inputs [][]byte, interval time.Duration) {
+	base := time.Unix(1500000000, 0)
+	for i, data := range inputs {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     base.Add(time.Duration(i) * interval),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		if err := capture.queuePacket(&packetData{data: data, ci: ci}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := capture.flushPackets(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdenticalSummariesCoalesce(t *testing.T) {
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{
+		Summarize:                 true,
+		CoalesceWindowNanoseconds: int64(time.Minute),
+	}, stream, &Config{})
+	capture.linkType = layers.LinkTypeEthernet
+	keepalive := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	other := udp4Fixture(t, "192.0.2.3", "192.0.2.2", 1000, 53)
+	queueFixtures(t, capture, [][]byte{keepalive, keepalive, keepalive, other, keepalive}, time.Second)
+	result := summaries(stream)
+	if len(result) != 3 {
+		t.Fatalf("expected 3 summaries, got %d", len(result))
+	}
+	for i, expected := range []struct {
+		source  string
+		count   uint32
+		seconds int64
+	}{
+		{"192.0.2.1", 3, 1500000000},
+		{"192.0.2.3", 1, 1500000003},
+		{"192.0.2.1", 1, 1500000004},
+	} {
+		if result[i].Source != expected.source || result[i].Count != expected.count || result[i].Seconds != expected.seconds {
+			t.Errorf("summary %d: unexpected %+v", i, result[i])
+		}
+	}
+}
+
+func TestCoalescingWindowEndsRun(t *testing.T) {
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{
+		Summarize:                 true,
+		CoalesceWindowNanoseconds: int64(1500 * time.Millisecond),
+	}, stream, &Config{})
+	capture.linkType = layers.LinkTypeEthernet
+	keepalive := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	queueFixtures(t, capture, [][]byte{keepalive, keepalive, keepalive}, time.Second)
+	result := summaries(stream)
+	if len(result) != 2 || result[0].Count != 2 || result[1].Count != 1 {
+		t.Errorf("unexpected summaries: %+v", result)
+	}
+}
+
+func TestSummariesWithoutCoalescing(t *testing.T) {
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{Summarize: true}, stream, &Config{})
+	capture.linkType = layers.LinkTypeEthernet
+	keepalive := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	queueFixtures(t, capture, [][]byte{keepalive, keepalive, keepalive}, time.Second)
+	result := summaries(stream)
+	if len(result) != 3 {
+		t.Fatalf("expected 3 summaries, got %d", len(result))
+	}
+	for i, summary := range result {
+		if summary.Count != 0 || summary.Seconds != 1500000000+int64(i) {
+			t.Errorf("summary %d: unexpected %+v", i, summary)
+		}
+	}
+}
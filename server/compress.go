@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/pcapme/pcap/api"
+	"sync"
+)
+
+// Compressor compresses the data of packets sent to the client, one packet at a time. A
+// compressor is only used by one goroutine at a time, so it may keep state (such as buffers)
+// between packets.
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+}
+
+var compressors = struct {
+	sync.RWMutex
+	codecs map[api.CaptureRequest_Compression]func() Compressor
+}{codecs: map[api.CaptureRequest_Compression]func() Compressor{
+	api.CaptureRequest_GZIP: newGzipCompressor,
+}}
+
+// RegisterCompressor allows programs embedding the server to support compression codecs it
+// doesn't implement itself (such as ZSTD), or to replace the built-in GZIP compressor. The
+// function creates a compressor for each goroutine compressing packets. It is typically called
+// from an init function.
+func RegisterCompressor(codec api.CaptureRequest_Compression, newCompressor func() Compressor) {
+	compressors.Lock()
+	defer compressors.Unlock()
+	compressors.codecs[codec] = newCompressor
+}
+
+// compressorFor returns the function creating compressors for the codec, or nil if the codec
+// isn't supported.
+func compressorFor(codec api.CaptureRequest_Compression) func() Compressor {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	return compressors.codecs[codec]
+}
+
+// gzipCompressor compresses each packet into a gzip stream of its own.
+type gzipCompressor struct {
+	buffer bytes.Buffer
+	writer *gzip.Writer
+}
+
+func newGzipCompressor() Compressor {
+	c := &gzipCompressor{}
+	c.writer = gzip.NewWriter(&c.buffer)
+	return c
+}
+
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	c.buffer.Reset()
+	c.writer.Reset(&c.buffer)
+	if _, err := c.writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), c.buffer.Bytes()...), nil
+}
+
+// setUpCompression chooses the codec the capture's packet data is compressed with. If the
+// requested codec isn't supported, packets are sent uncompressed, and the returned status warns
+// the client.
+func (c *liveCapture) setUpCompression() *api.CaptureStatus {
+	codec := c.request.Compression
+	if codec == api.CaptureRequest_NONE || c.request.Summarize {
+		return nil
+	}
+	c.newCompressor = compressorFor(codec)
+	if c.newCompressor == nil {
+		return &api.CaptureStatus{
+			Message: fmt.Sprintf("%v compression isn't supported by this server; packets are sent uncompressed", codec),
+		}
+	}
+	c.compression = codec
+	return nil
+}
+
+// packetCompressor returns a compressor for a goroutine reading packets to compress them with
+// (see compressPacket), or nil if the capture's packets aren't compressed.
+func (c *liveCapture) packetCompressor() Compressor {
+	if c.newCompressor == nil {
+		return nil
+	}
+	return c.newCompressor()
+}
+
+// compressPacket compresses the data a packet will be forwarded with, so that the goroutine
+// reading packets does the work rather than the capture loop. Every packet the capture forwards
+// must pass through here, which is why compressed captures are never read by pollLoop. Packets
+// that turn out not to be forwarded (such as those sampled out) are compressed anyway.
+func (c *liveCapture) compressPacket(p *packetData, compressor Compressor) {
+	if compressor == nil || p.err != nil {
+		return
+	}
+	data, ci := p.data, p.ci
+	if c.request.MaxPayloadBytes > 0 {
+		data, ci = trimPayload(data, ci, c.linkType, int(c.request.MaxPayloadBytes))
+	}
+	data = newPacketData(data, ci, int(c.request.MaxForwardBytes)).Data
+	p.compressed, p.compressErr = compressor.Compress(data)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"github.com/pcapme/pcap/api"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flateCodec is a codec number this server doesn't define, which tests register flateCompressor
+// for.
+const flateCodec = api.CaptureRequest_Compression(100)
+
+// flateCompressor stands in for a codec registered by a program embedding the server, counting
+// the packets each instance compresses.
+type flateCompressor struct {
+	mu      *sync.Mutex
+	packets *int
+}
+
+func (c flateCompressor) Compress(data []byte) ([]byte, error) {
+	c.mu.Lock()
+	*c.packets++
+	c.mu.Unlock()
+	var buffer bytes.Buffer
+	writer, _ := flate.NewWriter(&buffer, flate.BestSpeed)
+	writer.Write(data)
+	err := writer.Close()
+	return buffer.Bytes(), err
+}
+
+// registerFlate registers flateCompressor as flateCodec, returning the number of packets
+// compressed by each instance created so far (in order), and a function unregistering it.
+func registerFlate() (func() []int, func()) {
+	var mu sync.Mutex
+	var counts []*int
+	RegisterCompressor(flateCodec, func() Compressor {
+		mu.Lock()
+		defer mu.Unlock()
+		counts = append(counts, new(int))
+		return flateCompressor{&mu, counts[len(counts)-1]}
+	})
+	packets := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		result := make([]int, len(counts))
+		for i, count := range counts {
+			result[i] = *count
+		}
+		return result
+	}
+	return packets, func() {
+		compressors.Lock()
+		defer compressors.Unlock()
+		delete(compressors.codecs, flateCodec)
+	}
+}
+
+func decompress(t *testing.T, codec api.CaptureRequest_Compression, data []byte) []byte {
+	var reader io.Reader
+	switch codec {
+	case api.CaptureRequest_GZIP:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = gzipReader
+	case flateCodec:
+		reader = flate.NewReader(bytes.NewReader(data))
+	default:
+		return data
+	}
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decompressed
+}
+
+func TestLiveCaptureCompressesPacketData(t *testing.T) {
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		append(udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53), make([]byte, 1000)...),
+	}
+	input := writePcapFile(t, packets)
+	defer os.Remove(input)
+	flatePackets, unregister := registerFlate()
+	defer unregister()
+	for _, codec := range []api.CaptureRequest_Compression{api.CaptureRequest_GZIP, flateCodec} {
+		stream := newFakeCaptureStream()
+		s := &Server{Config: offlineConfig()}
+		if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: input, Compression: codec}, stream); err != nil {
+			t.Fatal(err)
+		}
+		if header := stream.replies[0].GetHeader(); header.Compression != codec {
+			t.Errorf("%v: header advertises %v", codec, header.Compression)
+		}
+		sent := stream.packets()
+		if len(sent) != len(packets) {
+			t.Fatalf("%v: expected %d packets, got %d", codec, len(packets), len(sent))
+		}
+		for i, packet := range sent {
+			if bytes.Equal(packet.Data, packets[i]) {
+				t.Errorf("%v: packet %d wasn't compressed", codec, i)
+			}
+			if !bytes.Equal(decompress(t, codec, packet.Data), packets[i]) {
+				t.Errorf("%v: packet %d doesn't decompress to the original", codec, i)
+			}
+			if packet.CapturedLength != uint32(len(packets[i])) || packet.OriginalLength != uint32(len(packets[i])) {
+				t.Errorf("%v: packet %d lengths don't describe the original", codec, i)
+			}
+		}
+		if len(sent[1].Data) >= len(packets[1]) {
+			t.Errorf("%v: expected the padded packet to shrink, got %d bytes", codec, len(sent[1].Data))
+		}
+	}
+	// Offline sources are read on a goroutine of their own, which compresses the packets.
+	if counts := flatePackets(); len(counts) != 1 || counts[0] != len(packets) {
+		t.Errorf("expected the reader to compress every packet, got %v", counts)
+	}
+}
+
+func TestLiveCaptureCompressesPacketsFromEachInterface(t *testing.T) {
+	eth0 := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	eth1 := udp4Fixture(t, "198.51.100.1", "198.51.100.2", 1000, 53)
+	defer fakeInterfaces(t, map[string][][]byte{"eth0": {eth0}, "eth1": {eth1}})()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeCaptureStream()
+	stream.ctx = ctx
+	result := make(chan error)
+	go func() {
+		s := &Server{}
+		result <- s.LiveCapture(&api.CaptureRequest{
+			Interface:       "eth0",
+			Interfaces:      []string{"eth1"},
+			Compression:     api.CaptureRequest_GZIP,
+			MaxForwardBytes: 20,
+		}, stream)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	stopCapture(t, cancel, result)
+	expected := map[string][]byte{"eth0": eth0[:20], "eth1": eth1[:20]}
+	sent := stream.packets()
+	if len(sent) != len(expected) {
+		t.Fatalf("expected %d packets, got %d", len(expected), len(sent))
+	}
+	for _, packet := range sent {
+		if !bytes.Equal(decompress(t, api.CaptureRequest_GZIP, packet.Data), expected[packet.Interface]) {
+			t.Errorf("%s: packet doesn't decompress to the forwarded bytes", packet.Interface)
+		}
+	}
+}
+
+func TestUnsupportedCompressionFallsBack(t *testing.T) {
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	input := writePcapFile(t, [][]byte{data})
+	defer os.Remove(input)
+	// This server doesn't include a ZSTD compressor.
+	for _, codec := range []api.CaptureRequest_Compression{api.CaptureRequest_ZSTD, flateCodec} {
+		stream := newFakeCaptureStream()
+		s := &Server{Config: offlineConfig()}
+		err := s.LiveCapture(&api.CaptureRequest{OfflineSource: input, Compression: codec}, stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header := stream.replies[0].GetHeader(); header.Compression != api.CaptureRequest_NONE {
+			t.Errorf("%v: expected no compression to be advertised, got %v", codec, header.Compression)
+		}
+		warned := false
+		for _, reply := range stream.replies {
+			if s := reply.GetStatus(); s != nil && strings.Contains(s.Message, codec.String()+" compression isn't supported") {
+				warned = true
+			}
+		}
+		if !warned {
+			t.Errorf("%v: expected a warning that the codec isn't supported", codec)
+		}
+		if sent := stream.packets(); len(sent) != 1 || !bytes.Equal(sent[0].Data, data) {
+			t.Errorf("%v: expected the packet to be sent uncompressed", codec)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc"
+	"time"
+)
+
+// Config holds settings that apply to the whole server, rather than to an individual capture.
+type Config struct {
+	// InitialWindowSize and InitialConnWindowSize set the HTTP/2 flow-control window, in bytes,
+	// for each stream and for each connection, respectively. Windows are advertised by the
+	// receiving side, so these only govern data the server receives from clients, such as
+	// requests; they don't affect the throughput of captures, whose packets the server sends.
+	// Clients receiving a high-rate stream should instead use the corresponding dial options
+	// (grpc.WithInitialWindowSize and grpc.WithInitialConnWindowSize, as set by the pcap client's
+	// --window-size flag). A larger window costs memory per stream. Zero (or any value below the
+	// 64 KiB minimum) keeps the gRPC default, which sizes the window dynamically.
+	InitialWindowSize     int32
+	InitialConnWindowSize int32
+
+	// WriteBufferSize is the size, in bytes, of the buffer replies are written through to each
+	// connection. gRPC flushes the buffer as soon as it has no more frames queued, so a single
+	// packet on a quiet stream is sent without waiting for the buffer to fill; buffering only
+	// coalesces replies sent faster than the connection drains them. A negative size writes each
+	// frame directly to the connection, trading throughput for the lowest possible latency. Zero
+	// keeps the gRPC default (32 KiB).
+	WriteBufferSize int
+
+	// Hooks, if set, are invoked at points of interest during each capture.
+	Hooks *Hooks
+
+	// Throttle, if set, enables adaptive throttling of captures based on CPU load.
+	Throttle *ThrottleConfig
+
+	// HistoryPath, if set, is the file that the statistics of completed captures are saved to.
+	// At most HistoryLimit records are retained (DefaultHistoryLimit, if zero).
+	HistoryPath  string
+	HistoryLimit int
+
+	// OutputDirectory is where captures requested with an output path are written. File output
+	// is disabled unless this is set.
+	OutputDirectory string
+
+	// OfflineDirectory is where offline sources naming saved capture files may be read from;
+	// files elsewhere (including those reached through symbolic links) are refused. Reading
+	// offline files is disabled unless this is set.
+	OfflineDirectory string
+
+	// AllowOfflineDescriptors allows offline sources reading from the server's standard input
+	// ("-") or from a descriptor it inherited ("fd:N"). Since any client could name any of the
+	// server's descriptors, these are disabled unless this is set.
+	AllowOfflineDescriptors bool
+
+	// MaxInterfaceAddresses limits the number of IP addresses InterfaceList reports for each
+	// interface (DefaultMaxInterfaceAddresses, if zero).
+	MaxInterfaceAddresses int
+
+	// On SIGQUIT, the stacks of all goroutines are written to the log. Since they may include
+	// packet data or filter contents, the dump can instead be appended to GoroutineDumpPath
+	// (made readable only by its owner, and not a symbolic link), or disabled entirely.
+	DisableGoroutineDump bool
+	GoroutineDumpPath    string
+
+	// CollectorAddress, if set, is a TCP address ("host:port") that captures requested with
+	// send_to_collector are streamed to in pcap format. The server initiates the connection, and
+	// reconnects (at most once per CollectorReconnectInterval) if it fails.
+	CollectorAddress           string
+	CollectorReconnectInterval time.Duration
+
+	// MetadataSocket, if set, is the path of a Unix datagram socket that captures requested with
+	// send_metadata send a record describing each packet to (see metadataSink). The consumer
+	// creates the socket; records it doesn't read fast enough are dropped.
+	MetadataSocket string
+
+	// Tracer, if set, creates a span for each RPC, continuing any trace propagated by the client.
+	Tracer Tracer
+
+	// OTLP, if set, exports the counters of each capture (periodically, and when it ends) and
+	// notable events to an OpenTelemetry collector.
+	OTLP *OTLPConfig
+
+	// InterfaceDefaults supplies default capture options for particular interfaces (keyed by
+	// name), used when a CaptureRequest leaves an option unset.
+	InterfaceDefaults map[string]*InterfaceDefaults
+
+	// MaxFilterLength and MaxFilterInstructions limit the capture filters clients may submit: the
+	// length of the combined filter expression, in bytes, and the number of BPF instructions it
+	// compiles to. Filters beyond either limit are rejected before they are applied, so that
+	// untrusted clients can't have the server compile (or the kernel run) pathologically large
+	// programs. Zero means no limit.
+	MaxFilterLength       int
+	MaxFilterInstructions int
+
+	// ActivateRetries is how many times activating a capture handle is retried, if it fails with
+	// an error likely to be transient (such as the device being busy), before the capture fails.
+	// Retries are ActivateRetryBackoff apart, doubling each time. Permanent errors (such as a
+	// missing device, or a lack of permission) aren't retried. Zero uses DefaultActivateRetries
+	// and DefaultActivateRetryBackoff; a negative number of retries disables them.
+	ActivateRetries      int
+	ActivateRetryBackoff time.Duration
+
+	// ProtocolFilters adds to (or overrides) the built-in filters that CaptureRequest protocols
+	// are matched against. Keys are lower-case protocol names.
+	ProtocolFilters map[string]string
+
+	// AllowInsecure allows StartTCPServer to serve without TLS, sending captured packets to any
+	// client that can connect, in the clear. It has no effect on the unix socket server.
+	AllowInsecure bool
+
+	// Reload, if set, is called on SIGHUP to obtain a new configuration. Captures started
+	// afterwards use the new settings, while running captures keep the ones they started with.
+	// Settings fixed when the server is created (the gRPC options, Tracer, OTLP and history) are
+	// not reloaded. If Reload returns an error, the current configuration is kept.
+	Reload func() (Config, error)
+}
+
+// InterfaceDefaults are the default capture options for an interface. Since a request can't
+// distinguish an omitted boolean option from false, boolean defaults can only enable an option.
+type InterfaceDefaults struct {
+	Snaplen         uint32
+	BufferSizeBytes uint32
+	PromiscuousMode bool
+	ImmediateMode   bool
+}
+
+// DefaultMaxInterfaceAddresses is the default limit on the IP addresses reported per interface.
+const DefaultMaxInterfaceAddresses = 256
+
+// ServerConfig is the configuration used by StartUnixSocketServer and StartTCPServer.
+var ServerConfig = Config{}
+
+// grpcServerOptions converts the configuration into options for grpc.NewServer().
+func (c *Config) grpcServerOptions() []grpc.ServerOption {
+	options := make([]grpc.ServerOption, 0, 2)
+	if c.InitialWindowSize > 0 {
+		options = append(options, grpc.InitialWindowSize(c.InitialWindowSize))
+	}
+	if c.InitialConnWindowSize > 0 {
+		options = append(options, grpc.InitialConnWindowSize(c.InitialConnWindowSize))
+	}
+	if c.WriteBufferSize > 0 {
+		options = append(options, grpc.WriteBufferSize(c.WriteBufferSize))
+	} else if c.WriteBufferSize < 0 {
+		options = append(options, grpc.WriteBufferSize(0))
+	}
+	if c.Tracer != nil {
+		options = append(options, tracingInterceptors(c.Tracer)...)
+	}
+	return options
+}
+
+// applyInterfaceDefaults returns the request with any options it leaves unset filled in from the
+// defaults for its interface. The request itself is not modified.
+func (c *Config) applyInterfaceDefaults(in *api.CaptureRequest) *api.CaptureRequest {
+	defaults, ok := c.InterfaceDefaults[in.Interface]
+	if !ok || defaults == nil {
+		return in
+	}
+	out := proto.Clone(in).(*api.CaptureRequest)
+	if out.Snaplen == 0 {
+		out.Snaplen = defaults.Snaplen
+	}
+	if out.BufferSizeBytes == 0 {
+		out.BufferSizeBytes = defaults.BufferSizeBytes
+	}
+	out.PromiscuousMode = out.PromiscuousMode || defaults.PromiscuousMode
+	out.ImmediateMode = out.ImmediateMode || defaults.ImmediateMode
+	return out
+}
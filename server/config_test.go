@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	benchmarkPacketSize  = 1500
+	benchmarkStreamCount = 1000
+)
+
+// floodServer replaces LiveCapture with a stream of fixed-size packets, so that benchmarks
+// measure the transport rather than libpcap.
+type floodServer struct {
+	Server
+}
+
+func (s *floodServer) LiveCapture(in *api.CaptureRequest, stream api.PCAP_LiveCaptureServer) error {
+	reply := &api.CaptureReply{
+		ReplyData: &api.CaptureReply_Data{Data: &api.PacketData{Data: make([]byte, benchmarkPacketSize)}},
+	}
+	for i := 0; i < benchmarkStreamCount; i++ {
+		if err := stream.Send(reply); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func benchmarkStreamWindow(b *testing.B, windowSize int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	config := Config{InitialWindowSize: windowSize, InitialConnWindowSize: windowSize}
+	s := grpc.NewServer(config.grpcServerOptions()...)
+	api.RegisterPCAPServer(s, &floodServer{})
+	go s.Serve(listener)
+	defer s.Stop()
+	dialOptions := []grpc.DialOption{grpc.WithInsecure()}
+	if windowSize > 0 {
+		dialOptions = append(dialOptions,
+			grpc.WithInitialWindowSize(windowSize), grpc.WithInitialConnWindowSize(windowSize))
+	}
+	conn, err := grpc.Dial(listener.Addr().String(), dialOptions...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	client := api.NewPCAPClient(conn)
+	b.SetBytes(benchmarkPacketSize * benchmarkStreamCount)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stream, err := client.LiveCapture(context.Background(), &api.CaptureRequest{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			_, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkStreamWindowDefault(b *testing.B) {
+	benchmarkStreamWindow(b, 0)
+}
+
+func BenchmarkStreamWindowLarge(b *testing.B) {
+	benchmarkStreamWindow(b, 8*1024*1024)
+}
+
+func TestInterfaceDefaultsApplyToOmittedOptions(t *testing.T) {
+	path := writePcapFile(t, nil)
+	defer os.Remove(path)
+	defer func() { openLiveHandle = openLive }()
+	var opened *api.CaptureRequest
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		opened = in
+		handle, err := pcap.OpenOffline(path)
+		return handle, nil, err
+	}
+	s := &Server{Config: Config{InterfaceDefaults: map[string]*InterfaceDefaults{
+		"eth10g": {Snaplen: 9018, BufferSizeBytes: 64 << 20, PromiscuousMode: true, ImmediateMode: true},
+	}}}
+	in := &api.CaptureRequest{Interface: "eth10g", Snaplen: 128}
+	if err := s.LiveCapture(in, newFakeCaptureStream()); err != nil {
+		t.Fatal(err)
+	}
+	if opened.Snaplen != 128 || opened.BufferSizeBytes != 64<<20 || !opened.PromiscuousMode || !opened.ImmediateMode {
+		t.Errorf("expected the defaults to fill in omitted options: %+v", opened)
+	}
+	if in.BufferSizeBytes != 0 {
+		t.Error("expected the client's request not to be modified")
+	}
+	if err := s.LiveCapture(&api.CaptureRequest{Interface: "eth0"}, newFakeCaptureStream()); err != nil {
+		t.Fatal(err)
+	}
+	if opened.BufferSizeBytes != 0 || opened.PromiscuousMode {
+		t.Errorf("expected no defaults for other interfaces: %+v", opened)
+	}
+}
+
+// latencyServer sends a single packet, stamped with the time it was sent, and then waits for the
+// client to go away.
+type latencyServer struct {
+	Server
+}
+
+func (s *latencyServer) LiveCapture(in *api.CaptureRequest, stream api.PCAP_LiveCaptureServer) error {
+	err := stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Header{Header: &api.CaptureHeader{}},
+	})
+	if err != nil {
+		return err
+	}
+	// Give the transport time to go idle, as it would between packets of a slow capture.
+	time.Sleep(10 * time.Millisecond)
+	sent := time.Now()
+	err = stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Data{Data: &api.PacketData{
+			Seconds:      sent.Unix(),
+			Microseconds: uint32(sent.Nanosecond() / 1000),
+			Data:         make([]byte, 64),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestSinglePacketIsDeliveredPromptly(t *testing.T) {
+	for _, writeBufferSize := range []int{0, -1} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := Config{WriteBufferSize: writeBufferSize}
+		s := grpc.NewServer(config.grpcServerOptions()...)
+		api.RegisterPCAPServer(s, &latencyServer{})
+		go s.Serve(listener)
+		conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := api.NewPCAPClient(conn).LiveCapture(ctx, &api.CaptureRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			reply, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if packet := reply.GetData(); packet != nil {
+				sent := time.Unix(packet.Seconds, int64(packet.Microseconds)*1000)
+				if latency := time.Since(sent); latency > 50*time.Millisecond {
+					t.Errorf("write buffer %d: packet took %v to arrive", writeBufferSize, latency)
+				}
+				break
+			}
+		}
+		cancel()
+		conn.Close()
+		s.Stop()
+	}
+}
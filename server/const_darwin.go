@@ -1,5 +1,16 @@
 package server
 
+import "github.com/google/gopacket/layers"
+
 const (
 	DefaultSocketPath = "/tmp/pcapd/socket"
 )
+
+// The link type of the loopback interface.
+const loopbackLinkType = layers.LinkTypeNull
+
+// BSD BPF has no source of random numbers, so packets can only be sampled in userspace.
+const bpfRandomSupported = false
+
+// What the server needs in order to capture, as reported when it lacks it.
+const capturePrivileges = "read access to /dev/bpf*"
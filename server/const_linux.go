@@ -1,5 +1,16 @@
 package server
 
+import "github.com/google/gopacket/layers"
+
 const (
 	DefaultSocketPath = "/run/pcapd/socket"
 )
+
+// The link type of the loopback interface.
+const loopbackLinkType = layers.LinkTypeEthernet
+
+// Linux extends BPF with a load of a random number, so capture filters can sample packets.
+const bpfRandomSupported = true
+
+// What the server needs in order to capture, as reported when it lacks it.
+const capturePrivileges = "root or CAP_NET_RAW"
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumns maps each available CSV column to a function producing its value.
+var csvColumns = map[string]func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string{
+	"timestamp": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		return ci.Timestamp.UTC().Format(time.RFC3339Nano)
+	},
+	"interface": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		return s.iface
+	},
+	"source": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		return summary.Source
+	},
+	"destination": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		return summary.Destination
+	},
+	"source_port": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		return formatPort(summary.SourcePort)
+	},
+	"destination_port": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		return formatPort(summary.DestinationPort)
+	},
+	"protocol": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		if len(summary.TransportProtocol) > 0 {
+			return summary.TransportProtocol
+		}
+		if len(summary.NetworkProtocol) > 0 {
+			return summary.NetworkProtocol
+		}
+		if len(summary.Layers) > 0 {
+			return summary.Layers[len(summary.Layers)-1]
+		}
+		return ""
+	},
+	"length": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		return strconv.Itoa(ci.Length)
+	},
+	"captured_length": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		return strconv.Itoa(ci.CaptureLength)
+	},
+	"flags": func(s *csvSink, summary *api.PacketSummary, ci gopacket.CaptureInfo) string {
+		return strings.Join(summary.TcpFlags, "|")
+	},
+}
+
+// DefaultCSVColumns are written if the client doesn't choose the columns.
+var DefaultCSVColumns = []string{
+	"timestamp", "interface", "source", "destination", "source_port", "destination_port",
+	"protocol", "length", "captured_length", "flags",
+}
+
+func formatPort(port uint32) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(port))
+}
+
+// csvSink writes a row of metadata for each packet to a CSV file, with a header row naming the
+// columns.
+type csvSink struct {
+	file     *os.File
+	writer   *csv.Writer
+	linkType layers.LinkType
+	iface    string
+	columns  []string
+}
+
+func newCSVSink(path string, linkType layers.LinkType, iface string, columns []string) (*csvSink, error) {
+	if len(columns) == 0 {
+		columns = DefaultCSVColumns
+	}
+	for _, column := range columns {
+		if _, ok := csvColumns[column]; !ok {
+			return nil, fmt.Errorf("unknown CSV column: %s", column)
+		}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	sink := &csvSink{
+		file:     file,
+		writer:   csv.NewWriter(file),
+		linkType: linkType,
+		iface:    iface,
+		columns:  columns,
+	}
+	if err := sink.writer.Write(columns); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *csvSink) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	summary := summarizePacket(data, ci, s.linkType)
+	row := make([]string, len(s.columns))
+	for i, column := range s.columns {
+		row[i] = csvColumns[column](s, summary, ci)
+	}
+	return s.writer.Write(row)
+}
+
+func (s *csvSink) Close() error {
+	s.writer.Flush()
+	err := s.writer.Error()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/csv"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func readCSV(t *testing.T, path string) [][]string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestCSVSinkWritesDecodedMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.csv")
+	sink, err := newCSVSink(path, layers.LinkTypeEthernet, "eth0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP("192.0.2.3"),
+		DstIP:    net.ParseIP("192.0.2.4"),
+	}
+	tcpLayer := &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true, ACK: true, Window: 1024}
+	tcpLayer.SetNetworkLayerForChecksum(ip)
+	tcp := serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip, tcpLayer)
+	timestamp := time.Unix(1500000000, 123456000)
+	for _, data := range [][]byte{udp, tcp} {
+		ci := gopacket.CaptureInfo{Timestamp: timestamp, CaptureLength: len(data), Length: len(data) + 10}
+		if err := sink.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rows := readCSV(t, path)
+	expected := [][]string{
+		DefaultCSVColumns,
+		{"2017-07-14T02:40:00.123456Z", "eth0", "192.0.2.1", "192.0.2.2", "1000", "53", "UDP",
+			strconv.Itoa(len(udp) + 10), strconv.Itoa(len(udp)), ""},
+		{"2017-07-14T02:40:00.123456Z", "eth0", "192.0.2.3", "192.0.2.4", "40000", "443", "TCP",
+			strconv.Itoa(len(tcp) + 10), strconv.Itoa(len(tcp)), "SYN|ACK"},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("unexpected rows:\n%q\nexpected:\n%q", rows, expected)
+	}
+}
+
+func TestCSVSinkSelectedColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := newCSVSink(filepath.Join(dir, "bad.csv"), layers.LinkTypeEthernet, "", []string{"bogus"}); err == nil {
+		t.Error("expected an error for an unknown column")
+	}
+	path := filepath.Join(dir, "out.csv")
+	sink, err := newCSVSink(path, layers.LinkTypeEthernet, "eth0", []string{"destination", "protocol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	if err := sink.WritePacket(captureInfoFor(data), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"destination", "protocol"}, {"192.0.2.2", "UDP"}}
+	if rows := readCSV(t, path); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("unexpected rows: %q", rows)
+	}
+}
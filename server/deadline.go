@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"github.com/pcapme/pcap/api"
+	"log"
+	"time"
+)
+
+// deadlineMargin is how long before the deadline of its call a capture ends, leaving time to send
+// its final statistics before the client gives up on the call.
+const deadlineMargin = 100 * time.Millisecond
+
+// captureDeadline returns when a capture started at now should end, and why: once the requested
+// duration has elapsed, or shortly before the deadline of its call, whichever is sooner. The time
+// is zero if the capture has neither.
+func captureDeadline(ctx context.Context, in *api.CaptureRequest, now time.Time) (time.Time, string) {
+	var deadline time.Time
+	var reason string
+	if in.DurationNanoseconds > 0 {
+		deadline, reason = now.Add(time.Duration(in.DurationNanoseconds)), "capture duration reached"
+	}
+	if callDeadline, ok := ctx.Deadline(); ok {
+		callDeadline = callDeadline.Add(-deadlineMargin)
+		if deadline.IsZero() || callDeadline.Before(deadline) {
+			deadline, reason = callDeadline, "call deadline reached"
+		}
+	}
+	return deadline, reason
+}
+
+// startDeadline arms the timer that ends the capture at its deadline, if it has one.
+func (c *liveCapture) startDeadline(now time.Time) {
+	deadline, reason := captureDeadline(c.stream.Context(), c.request, now)
+	if deadline.IsZero() {
+		return
+	}
+	c.deadlineTimer = time.NewTimer(deadline.Sub(now))
+	c.deadline = c.deadlineTimer.C
+	c.deadlineReason = reason
+}
+
+// stopDeadline releases the capture's deadline timer, if it has one.
+func (c *liveCapture) stopDeadline() {
+	if c.deadlineTimer != nil {
+		c.deadlineTimer.Stop()
+	}
+}
+
+// reachDeadline ends the capture at its deadline.
+func (c *liveCapture) reachDeadline() error {
+	return c.reachLimit(c.deadlineReason)
+}
+
+// countLimitReason returns why the capture should end, if it has captured as many packets or
+// bytes as the client asked for.
+func (c *liveCapture) countLimitReason() string {
+	if c.request.MaxPackets > 0 && c.packets >= c.request.MaxPackets {
+		return "packet limit reached"
+	}
+	if c.request.MaxBytes > 0 && c.bytes >= c.request.MaxBytes {
+		return "byte limit reached"
+	}
+	return ""
+}
+
+// reachLimit ends the capture for the given reason, flushing any held packets. The client is told
+// why once the capture has finished.
+func (c *liveCapture) reachLimit(reason string) error {
+	log.Printf("Stopped LiveCapture(%+v): %s.\n", c.request, reason)
+	c.endReason = reason
+	return c.flushPackets()
+}
+
+// sendLimitReached tells the client why the capture ended, with its statistics.
+func (c *liveCapture) sendLimitReached() error {
+	return c.stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Status{Status: &api.CaptureStatus{
+			Message: c.endReason,
+			Record:  c.record(nil),
+		}},
+	})
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"testing"
+	"time"
+)
+
+func TestCaptureDeadline(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	withDeadline, cancel := context.WithDeadline(context.Background(), now.Add(time.Minute))
+	defer cancel()
+	for _, test := range []struct {
+		ctx      context.Context
+		duration time.Duration
+		deadline time.Time
+		reason   string
+	}{
+		{context.Background(), 0, time.Time{}, ""},
+		{context.Background(), time.Second, now.Add(time.Second), "capture duration reached"},
+		{withDeadline, 0, now.Add(time.Minute - deadlineMargin), "call deadline reached"},
+		{withDeadline, time.Second, now.Add(time.Second), "capture duration reached"},
+		{withDeadline, time.Hour, now.Add(time.Minute - deadlineMargin), "call deadline reached"},
+	} {
+		in := &api.CaptureRequest{DurationNanoseconds: int64(test.duration)}
+		deadline, reason := captureDeadline(test.ctx, in, now)
+		if !deadline.Equal(test.deadline) || reason != test.reason {
+			t.Errorf("%v: expected %v (%q), got %v (%q)", test.duration, test.deadline, test.reason,
+				deadline, reason)
+		}
+	}
+}
+
+func TestLiveCaptureEndsCleanlyAtDeadline(t *testing.T) {
+	defer fakeIdleInterface(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})()
+	for _, test := range []struct {
+		timeout  time.Duration
+		duration time.Duration
+		reason   string
+	}{
+		{deadlineMargin + 50*time.Millisecond, 0, "call deadline reached"},
+		{time.Minute, 50 * time.Millisecond, "capture duration reached"},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+		stream := newFakeCaptureStream()
+		stream.ctx = ctx
+		s := &Server{}
+		err := s.LiveCapture(&api.CaptureRequest{
+			Interface:           "eth0",
+			DurationNanoseconds: int64(test.duration),
+		}, stream)
+		ended := ctx.Err()
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: expected the capture to end cleanly, got %v", test.reason, err)
+		}
+		if ended != nil {
+			t.Errorf("%s: expected the capture to end before its call's deadline", test.reason)
+		}
+		last := stream.replies[len(stream.replies)-1].GetStatus()
+		if last == nil || last.Message != test.reason || last.Record == nil {
+			t.Fatalf("%s: expected a final status, got %+v", test.reason, stream.replies[len(stream.replies)-1])
+		}
+		if last.Record.Packets != 1 || len(last.Record.Error) > 0 {
+			t.Errorf("%s: unexpected record: %+v", test.reason, last.Record)
+		}
+	}
+}
+
+func TestLiveCaptureEndsCleanlyAtCountLimits(t *testing.T) {
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	size := uint64(len(data))
+	defer fakeIdleInterface(t, [][]byte{data, data, data, data, data})()
+	for _, test := range []struct {
+		maxPackets uint64
+		maxBytes   uint64
+		duration   time.Duration
+		packets    int
+		reason     string
+	}{
+		{3, 0, 0, 3, "packet limit reached"},
+		{0, 2*size + 1, 0, 3, "byte limit reached"},
+		{2, 1, 0, 1, "byte limit reached"},
+		{2, 10 * size, time.Minute, 2, "packet limit reached"},
+		{10, 10 * size, 50 * time.Millisecond, 5, "capture duration reached"},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		stream := newFakeCaptureStream()
+		stream.ctx = ctx
+		s := &Server{}
+		err := s.LiveCapture(&api.CaptureRequest{
+			Interface:           "eth0",
+			MaxPackets:          test.maxPackets,
+			MaxBytes:            test.maxBytes,
+			DurationNanoseconds: int64(test.duration),
+		}, stream)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: expected the capture to end cleanly, got %v", test.reason, err)
+		}
+		if packets := len(stream.packets()); packets != test.packets {
+			t.Errorf("%s: expected %d packets, got %d", test.reason, test.packets, packets)
+		}
+		last := stream.replies[len(stream.replies)-1].GetStatus()
+		if last == nil || last.Message != test.reason || last.Record == nil {
+			t.Fatalf("%s: expected a final status, got %+v", test.reason, stream.replies[len(stream.replies)-1])
+		}
+		if last.Record.Packets != uint64(test.packets) {
+			t.Errorf("%s: unexpected record: %+v", test.reason, last.Record)
+		}
+	}
+}
+
+func TestLimitReachedRecordIncludesKernelDrops(t *testing.T) {
+	defer fakeInterfaces(t, map[string][][]byte{
+		"eth0": {udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)},
+		"eth1": nil,
+	})()
+	defer func() { handleStats = (*pcap.Handle).Stats }()
+	handleStats = func(*pcap.Handle) (*pcap.Stats, error) {
+		return &pcap.Stats{PacketsDropped: 3}, nil
+	}
+	stream := newFakeCaptureStream()
+	s := NewServer(Config{})
+	err := s.LiveCapture(&api.CaptureRequest{Interface: "eth0", Interfaces: []string{"eth1"}, MaxPackets: 1}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := stream.replies[len(stream.replies)-1].GetStatus()
+	if last == nil || last.Record == nil || last.Record.DroppedPackets != 6 {
+		t.Fatalf("expected the final status to count the drops on both interfaces, got %+v", last)
+	}
+	if history := s.history.query(0, 0); len(history) != 1 || history[0].DroppedPackets != 6 {
+		t.Errorf("expected the drops to be counted once in the history, got %+v", history)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"log"
+)
+
+// The network protocol reported for packets whose network layer couldn't be decoded, such as IP
+// packets with a version other than 4 or 6.
+const unknownNetworkProtocol = "Unknown"
+
+// maxIPHeaders limits how many nested IP headers (the packet's own, then those of the tunnels
+// within it) are inspected, so that a crafted packet nesting tunnels in tunnels can't bury the
+// flow it reports arbitrarily deep.
+const maxIPHeaders = 4
+
+// recoverDecodePanic logs a panic while inspecting a packet, so that a single malformed packet
+// can't end the capture. It must be deferred by the function doing the inspection, and returns
+// true if a panic was recovered.
+func recoverDecodePanic(r interface{}) bool {
+	if r == nil {
+		return false
+	}
+	log.Printf("Recovered from a panic while decoding a packet: %v", r)
+	return true
+}
+
+// summarizePacket decodes a captured packet and describes it in a PacketSummary. Packets that
+// can't be decoded are still summarized, as far as decoding got.
+func summarizePacket(data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType) (summary *api.PacketSummary) {
+	defer func() {
+		if recoverDecodePanic(recover()) && len(summary.NetworkProtocol) == 0 {
+			summary.NetworkProtocol = unknownNetworkProtocol
+		}
+	}()
+	summary = &api.PacketSummary{
+		Seconds:        ci.Timestamp.Unix(),
+		Microseconds:   uint32(ci.Timestamp.Nanosecond() / 1000),
+		OriginalLength: uint32(ci.Length),
+	}
+	packet := gopacket.NewPacket(data, linkTypeDecoder(linkType), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ipHeaders := 0
+decoding:
+	for _, layer := range packet.Layers() {
+		summary.Layers = append(summary.Layers, layer.LayerType().String())
+		switch l := layer.(type) {
+		case *layers.MPLS:
+			summary.MplsLabels = append(summary.MplsLabels, l.Label)
+		case *layers.VXLAN:
+			// The encapsulated Ethernet frame follows, so the flow reported will be the inner one.
+			summary.OptionalVxlanVni = &api.PacketSummary_VxlanVni{VxlanVni: l.VNI}
+		case *layers.IPv4:
+			if l.Version != 4 {
+				// gopacket decodes whatever follows an IPv4 EtherType as IPv4, regardless of
+				// its version; the layers after it can't be trusted either.
+				summary.NetworkProtocol = unknownNetworkProtocol
+				break decoding
+			}
+			if ipHeaders++; !enterIPHeader(summary, ipHeaders) {
+				break decoding
+			}
+			summary.NetworkProtocol = l.LayerType().String()
+			summary.Source = l.SrcIP.String()
+			summary.Destination = l.DstIP.String()
+		case *layers.IPv6:
+			if l.Version != 6 {
+				summary.NetworkProtocol = unknownNetworkProtocol
+				break decoding
+			}
+			if ipHeaders++; !enterIPHeader(summary, ipHeaders) {
+				break decoding
+			}
+			summary.NetworkProtocol = l.LayerType().String()
+			summary.Source = l.SrcIP.String()
+			summary.Destination = l.DstIP.String()
+			summary.OptionalFlowLabel = &api.PacketSummary_Ipv6FlowLabel{Ipv6FlowLabel: l.FlowLabel}
+		case *layers.TCP:
+			summary.TransportProtocol = l.LayerType().String()
+			summary.SourcePort = uint32(l.SrcPort)
+			summary.DestinationPort = uint32(l.DstPort)
+			summary.TcpFlags = tcpFlags(l)
+		case *layers.UDP:
+			summary.TransportProtocol = l.LayerType().String()
+			summary.SourcePort = uint32(l.SrcPort)
+			summary.DestinationPort = uint32(l.DstPort)
+		}
+	}
+	if len(summary.NetworkProtocol) == 0 && packet.ErrorLayer() != nil {
+		summary.NetworkProtocol = unknownNetworkProtocol
+	}
+	return summary
+}
+
+// enterIPHeader prepares the summary for the next of a packet's IP headers, given how many have
+// been seen. The flow reported is the innermost one, so an encapsulated header (such as IPv6 in
+// IPv4, IPv4 in IPv6, or a VXLAN payload) replaces the outer flow, whose endpoints are kept as the
+// tunnel's. It returns false if the header is nested too deeply to be inspected.
+func enterIPHeader(summary *api.PacketSummary, headers int) bool {
+	if headers > maxIPHeaders {
+		return false
+	}
+	if headers == 2 {
+		summary.TunnelSource = summary.Source
+		summary.TunnelDestination = summary.Destination
+	}
+	if headers > 1 {
+		summary.OptionalFlowLabel = nil
+		summary.TransportProtocol = ""
+		summary.SourcePort = 0
+		summary.DestinationPort = 0
+		summary.TcpFlags = nil
+	}
+	return true
+}
+
+// tcpFlags lists the flags set in a TCP header.
+func tcpFlags(tcp *layers.TCP) []string {
+	var flags []string
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{
+		{tcp.SYN, "SYN"}, {tcp.ACK, "ACK"}, {tcp.FIN, "FIN"}, {tcp.RST, "RST"}, {tcp.PSH, "PSH"},
+		{tcp.URG, "URG"}, {tcp.ECE, "ECE"}, {tcp.CWR, "CWR"}, {tcp.NS, "NS"},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+	return flags
+}
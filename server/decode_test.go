@@ -0,0 +1,299 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// serializePacket builds a packet fixture from the given layers, computing lengths and
+// checksums.
+func serializePacket(t *testing.T, layerList ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, options, layerList...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func captureInfoFor(data []byte) gopacket.CaptureInfo {
+	return gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+}
+
+func udp6Fixture(t *testing.T, flowLabel uint32) []byte {
+	ip := &layers.IPv6{
+		Version:    6,
+		FlowLabel:  flowLabel,
+		NextHeader: layers.IPProtocolUDP,
+		HopLimit:   64,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv6,
+		},
+		ip, udp, gopacket.Payload([]byte("payload")))
+}
+
+func udp4Fixture(t *testing.T, src, dst string, srcPort, dstPort int) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP(dst),
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip, udp, gopacket.Payload([]byte("payload")))
+}
+
+func TestSummaryReportsIPv6FlowLabel(t *testing.T) {
+	data := udp6Fixture(t, 0xbeef5)
+	summary := summarizePacket(data, captureInfoFor(data), layers.LinkTypeEthernet)
+	label, ok := summary.OptionalFlowLabel.(*api.PacketSummary_Ipv6FlowLabel)
+	if !ok {
+		t.Fatalf("expected a flow label in summary: %+v", summary)
+	}
+	if label.Ipv6FlowLabel != 0xbeef5 {
+		t.Errorf("expected flow label 0xbeef5, got %#x", label.Ipv6FlowLabel)
+	}
+	if summary.Source != "2001:db8::1" || summary.DestinationPort != 53 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestSummaryOmitsFlowLabelForIPv4(t *testing.T) {
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1234, 53)
+	summary := summarizePacket(data, captureInfoFor(data), layers.LinkTypeEthernet)
+	if summary.OptionalFlowLabel != nil {
+		t.Errorf("expected no flow label for IPv4: %+v", summary)
+	}
+	if summary.NetworkProtocol != "IPv4" || summary.TransportProtocol != "UDP" {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestSummaryReportsMPLSLabelStack(t *testing.T) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("198.51.100.1"),
+		DstIP:    net.ParseIP("198.51.100.2"),
+	}
+	udp := &layers.UDP{SrcPort: 4000, DstPort: 5000}
+	udp.SetNetworkLayerForChecksum(ip)
+	data := serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeMPLSUnicast,
+		},
+		&layers.MPLS{Label: 100, TTL: 64},
+		&layers.MPLS{Label: 200, TTL: 64, StackBottom: true},
+		ip, udp, gopacket.Payload([]byte("payload")))
+	summary := summarizePacket(data, captureInfoFor(data), layers.LinkTypeEthernet)
+	if len(summary.MplsLabels) != 2 || summary.MplsLabels[0] != 100 || summary.MplsLabels[1] != 200 {
+		t.Errorf("unexpected label stack: %v", summary.MplsLabels)
+	}
+	if summary.Source != "198.51.100.1" || summary.Destination != "198.51.100.2" ||
+		summary.SourcePort != 4000 || summary.DestinationPort != 5000 {
+		t.Errorf("unexpected inner flow: %+v", summary)
+	}
+}
+
+func TestSummaryReportsVXLANNetworkIdentifier(t *testing.T) {
+	inner := udp4Fixture(t, "10.0.0.1", "10.0.0.2", 3333, 80)
+	outerIP := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("192.0.2.10"),
+		DstIP:    net.ParseIP("192.0.2.20"),
+	}
+	outerUDP := &layers.UDP{SrcPort: 49152, DstPort: VXLANPort}
+	outerUDP.SetNetworkLayerForChecksum(outerIP)
+	data := serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		outerIP, outerUDP,
+		&layers.VXLAN{ValidIDFlag: true, VNI: 5001},
+		gopacket.Payload(inner))
+	summary := summarizePacket(data, captureInfoFor(data), layers.LinkTypeEthernet)
+	vni, ok := summary.OptionalVxlanVni.(*api.PacketSummary_VxlanVni)
+	if !ok || vni.VxlanVni != 5001 {
+		t.Fatalf("expected VNI 5001 in summary: %+v", summary)
+	}
+	if summary.Source != "10.0.0.1" || summary.Destination != "10.0.0.2" ||
+		summary.TransportProtocol != "UDP" || summary.SourcePort != 3333 || summary.DestinationPort != 80 {
+		t.Errorf("unexpected inner flow: %+v", summary)
+	}
+}
+
+// panicLayer is a layer that panics when inspected, like a buggy decoder might.
+type panicLayer struct{}
+
+func (panicLayer) LayerType() gopacket.LayerType { panic("malformed layer") }
+func (panicLayer) LayerContents() []byte         { return nil }
+func (panicLayer) LayerPayload() []byte          { return nil }
+
+func TestSummarizeUnknownIPVersion(t *testing.T) {
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	data[14] = 0x75 // IP version 7, with a 20-byte header.
+	summary := summarizePacket(data, captureInfoFor(data), layers.LinkTypeEthernet)
+	if summary.NetworkProtocol != unknownNetworkProtocol || len(summary.Source) != 0 {
+		t.Errorf("expected an unknown network layer, got %+v", summary)
+	}
+}
+
+func TestSummarizeRecoversFromDecodePanic(t *testing.T) {
+	linkType := layers.LinkType(147)
+	RegisterLinkTypeDecoder(linkType, gopacket.DecodeFunc(func(data []byte, p gopacket.PacketBuilder) error {
+		p.AddLayer(panicLayer{})
+		return nil
+	}))
+	defer func() {
+		linkTypeDecoders.Lock()
+		delete(linkTypeDecoders.decoders, linkType)
+		linkTypeDecoders.Unlock()
+	}()
+	data := []byte{0xde, 0xad, 0xbe, 0xef}
+	summary := summarizePacket(data, captureInfoFor(data), linkType)
+	if summary.NetworkProtocol != unknownNetworkProtocol || summary.OriginalLength != 4 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+	if trimmed, _ := trimPayload(data, captureInfoFor(data), linkType, 1); len(trimmed) != len(data) {
+		t.Errorf("expected an undecodable packet to be left untouched, got %d bytes", len(trimmed))
+	}
+	if _, ok := forwardingKey(data, linkType); ok {
+		t.Error("expected no forwarding key for an undecodable packet")
+	}
+}
+
+func TestLiveCaptureSurvivesMalformedPacket(t *testing.T) {
+	malformed := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	malformed[14] = 0x75
+	path := writePcapFile(t, [][]byte{malformed, udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53)})
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{Config: offlineConfig()}
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: path, Summarize: true}, stream); err != nil {
+		t.Fatal(err)
+	}
+	received := summaries(stream)
+	if len(received) != 2 {
+		t.Fatalf("expected 2 summaries, got %d", len(received))
+	}
+	if received[0].NetworkProtocol != unknownNetworkProtocol || received[1].NetworkProtocol != "IPv4" {
+		t.Errorf("unexpected network protocols: %q, %q", received[0].NetworkProtocol, received[1].NetworkProtocol)
+	}
+}
+
+// ipInIPFixture encapsulates packet, an IP packet without its link-layer header, in numbered
+// outer IPv4 headers, using protocol 41 for IPv6 payloads.
+func ipInIPFixture(t *testing.T, packet []byte, protocol layers.IPProtocol, tunnels int) []byte {
+	for i := tunnels; i > 0; i-- {
+		outer := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: protocol,
+			SrcIP:    net.IPv4(192, 0, 2, byte(2*i-1)),
+			DstIP:    net.IPv4(192, 0, 2, byte(2*i)),
+		}
+		packet = serializePacket(t, outer, gopacket.Payload(packet))
+		protocol = layers.IPProtocolIPv4
+	}
+	return serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		gopacket.Payload(packet))
+}
+
+func TestSummaryReportsInnerFlowOf6in4(t *testing.T) {
+	inner := udp6Fixture(t, 0xbeef5)[14:]
+	data := ipInIPFixture(t, inner, layers.IPProtocolIPv6, 1)
+	summary := summarizePacket(data, captureInfoFor(data), layers.LinkTypeEthernet)
+	if summary.NetworkProtocol != "IPv6" || summary.Source != "2001:db8::1" || summary.Destination != "2001:db8::2" ||
+		summary.TransportProtocol != "UDP" || summary.SourcePort != 5353 || summary.DestinationPort != 53 {
+		t.Errorf("unexpected inner flow: %+v", summary)
+	}
+	if summary.TunnelSource != "192.0.2.1" || summary.TunnelDestination != "192.0.2.2" {
+		t.Errorf("unexpected tunnel endpoints: %+v", summary)
+	}
+	expected := newFlowKey(&api.PacketSummary{
+		NetworkProtocol:   "IPv6",
+		Source:            "2001:db8::1",
+		Destination:       "2001:db8::2",
+		TransportProtocol: "UDP",
+		SourcePort:        5353,
+		DestinationPort:   53,
+	})
+	if key := newFlowKey(summary); key != expected {
+		t.Errorf("expected the flow key of the inner packet, got %+v", key)
+	}
+}
+
+func TestSummaryReportsInnerFlowOf4in6(t *testing.T) {
+	inner := udp4Fixture(t, "10.0.0.1", "10.0.0.2", 3333, 80)[14:]
+	outer := &layers.IPv6{
+		Version:    6,
+		FlowLabel:  0xbeef5,
+		NextHeader: layers.IPProtocolIPv4,
+		HopLimit:   64,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	data := serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv6,
+		},
+		outer, gopacket.Payload(inner))
+	summary := summarizePacket(data, captureInfoFor(data), layers.LinkTypeEthernet)
+	if summary.NetworkProtocol != "IPv4" || summary.Source != "10.0.0.1" || summary.DestinationPort != 80 {
+		t.Errorf("unexpected inner flow: %+v", summary)
+	}
+	if summary.OptionalFlowLabel != nil {
+		t.Errorf("expected the outer flow label to be dropped, got %+v", summary.OptionalFlowLabel)
+	}
+	if summary.TunnelSource != "2001:db8::1" || summary.TunnelDestination != "2001:db8::2" {
+		t.Errorf("unexpected tunnel endpoints: %+v", summary)
+	}
+}
+
+func TestSummaryLimitsTunnelNesting(t *testing.T) {
+	inner := udp4Fixture(t, "10.0.0.1", "10.0.0.2", 3333, 80)[14:]
+	data := ipInIPFixture(t, inner, layers.IPProtocolIPv4, 10)
+	summary := summarizePacket(data, captureInfoFor(data), layers.LinkTypeEthernet)
+	// The last header inspected is that of the third tunnel from the outside.
+	if summary.Source != "192.0.2.7" || summary.Destination != "192.0.2.8" || len(summary.TransportProtocol) > 0 {
+		t.Errorf("expected decoding to stop at %d IP headers, got %+v", maxIPHeaders, summary)
+	}
+	if summary.TunnelSource != "192.0.2.1" {
+		t.Errorf("unexpected tunnel endpoints: %+v", summary)
+	}
+}
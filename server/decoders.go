@@ -0,0 +1,36 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sync"
+)
+
+var linkTypeDecoders = struct {
+	sync.RWMutex
+	decoders map[layers.LinkType]gopacket.Decoder
+}{decoders: make(map[layers.LinkType]gopacket.Decoder)}
+
+// RegisterLinkTypeDecoder allows programs embedding the server to decode packets with link types
+// that gopacket doesn't support (or to replace gopacket's decoder), for use when packets are
+// summarized or otherwise inspected by the server. It is typically called from an init function.
+func RegisterLinkTypeDecoder(linkType layers.LinkType, decoder gopacket.Decoder) {
+	linkTypeDecoders.Lock()
+	defer linkTypeDecoders.Unlock()
+	linkTypeDecoders.decoders[linkType] = decoder
+}
+
+// linkTypeDecoder returns the decoder to use for packets with the given link type. Link types
+// that neither gopacket nor a registered decoder supports are decoded as a raw payload.
+func linkTypeDecoder(linkType layers.LinkType) gopacket.Decoder {
+	linkTypeDecoders.RLock()
+	decoder, ok := linkTypeDecoders.decoders[linkType]
+	linkTypeDecoders.RUnlock()
+	if ok {
+		return decoder
+	}
+	if layers.LinkTypeMetadata[linkType].Name == "UnknownLinkType" {
+		return gopacket.DecodePayload
+	}
+	return linkType
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"reflect"
+	"testing"
+)
+
+func TestRegisteredLinkTypeDecoderIsUsed(t *testing.T) {
+	// A fake link type with a 4-byte header, followed by an IPv4 packet.
+	linkType := layers.LinkType(200)
+	RegisterLinkTypeDecoder(linkType, gopacket.DecodeFunc(func(data []byte, p gopacket.PacketBuilder) error {
+		return layers.LayerTypeIPv4.Decode(data[4:], p)
+	}))
+	defer func() {
+		linkTypeDecoders.Lock()
+		delete(linkTypeDecoders.decoders, linkType)
+		linkTypeDecoders.Unlock()
+	}()
+	// Replace the 14-byte Ethernet header of the fixture with a 4-byte header.
+	data := append([]byte{0xde, 0xad, 0xbe, 0xef}, udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)[14:]...)
+	summary := summarizePacket(data, captureInfoFor(data), linkType)
+	if summary.Source != "192.0.2.1" || summary.Destination != "192.0.2.2" || summary.TransportProtocol != "UDP" {
+		t.Errorf("expected the registered decoder to be used, got %+v", summary)
+	}
+}
+
+func TestUnknownLinkTypeDecodesAsPayload(t *testing.T) {
+	data := []byte{1, 2, 3, 4}
+	summary := summarizePacket(data, captureInfoFor(data), layers.LinkType(201))
+	if !reflect.DeepEqual(summary.Layers, []string{"Payload"}) {
+		t.Errorf("expected a raw payload, got %+v", summary.Layers)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"hash/fnv"
+	"time"
+)
+
+// deduplicator drops packets that duplicate one seen within the window. Packets are compared by
+// hash, of the parts of the packet the scope selects. Packet timestamps are used as the clock, so
+// that offline captures behave the same as live ones. A duplicate doesn't extend the window of the
+// packet it duplicates, so a packet repeated steadily (rather than mirrored) isn't dropped
+// forever.
+//
+// Packets are remembered in two tables: those first seen in the current period (as long as the
+// window), and those seen in the period before. When a period ends, the older table is forgotten
+// all at once, rather than packet by packet. At most limit packets are remembered each period;
+// packets beyond it still have their duplicates looked for, but aren't remembered themselves.
+type deduplicator struct {
+	window      time.Duration
+	scope       api.CaptureRequest_DedupScope
+	linkType    layers.LinkType
+	limit       int
+	current     map[uint64]time.Time
+	previous    map[uint64]time.Time
+	periodStart time.Time
+
+	// Packets dropped as duplicates.
+	dropped uint64
+
+	// Packets that weren't remembered because the table was full, so that any duplicates of them
+	// weren't dropped.
+	untracked uint64
+}
+
+// maxDedupPackets limits the packets a deduplicator remembers in each period.
+const maxDedupPackets = 1 << 16
+
+// newDeduplicator returns a deduplicator for the request, or nil if it didn't ask for one.
+func newDeduplicator(in *api.CaptureRequest, linkType layers.LinkType) *deduplicator {
+	if in.DedupWindowNanoseconds <= 0 {
+		return nil
+	}
+	return &deduplicator{
+		window:   time.Duration(in.DedupWindowNanoseconds),
+		scope:    in.DedupScope,
+		linkType: linkType,
+		limit:    maxDedupPackets,
+		current:  make(map[uint64]time.Time),
+	}
+}
+
+// dedupKey hashes the parts of a packet that identify its duplicates in the scope. In the headers
+// scope, packets that aren't IP are hashed in full.
+func dedupKey(data []byte, linkType layers.LinkType, scope api.CaptureRequest_DedupScope) uint64 {
+	if scope == api.CaptureRequest_HEADERS {
+		if key, ok := forwardingKey(data, linkType); ok {
+			return key
+		}
+	}
+	hash := fnv.New64a()
+	hash.Write(data)
+	return hash.Sum64()
+}
+
+// duplicate records a packet, and returns true if it duplicates one seen within the window.
+func (d *deduplicator) duplicate(data []byte, timestamp time.Time) bool {
+	if elapsed := timestamp.Sub(d.periodStart); elapsed >= d.window {
+		// Packets from before the previous period are all older than the window.
+		d.previous = nil
+		if elapsed < 2*d.window {
+			d.previous = d.current
+		}
+		d.current = make(map[uint64]time.Time)
+		d.periodStart = timestamp
+	}
+	key := dedupKey(data, d.linkType, d.scope)
+	firstSeen, ok := d.current[key]
+	if !ok {
+		firstSeen, ok = d.previous[key]
+	}
+	if ok && timestamp.Sub(firstSeen) < d.window {
+		d.dropped++
+		return true
+	}
+	if len(d.current) >= d.limit {
+		d.untracked++
+		return false
+	}
+	d.current[key] = timestamp
+	return false
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// mirroredFixture returns a UDP packet as a SPAN port might mirror it after it has crossed a
+// router: with the given TTL (and so a different checksum), and optionally tagged with a VLAN.
+func mirroredFixture(t *testing.T, ttl uint8, vlan uint16) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      ttl,
+		Id:       4321,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("192.0.2.1"),
+		DstIP:    net.ParseIP("192.0.2.2"),
+	}
+	udp := &layers.UDP{SrcPort: 1000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	ethernet := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	if vlan == 0 {
+		return serializePacket(t, ethernet, ip, udp, gopacket.Payload([]byte("payload")))
+	}
+	ethernet.EthernetType = layers.EthernetTypeDot1Q
+	tag := &layers.Dot1Q{VLANIdentifier: vlan, Type: layers.EthernetTypeIPv4}
+	return serializePacket(t, ethernet, tag, ip, udp, gopacket.Payload([]byte("payload")))
+}
+
+func TestLiveCaptureDropsDuplicatesDifferingInTTL(t *testing.T) {
+	packets := [][]byte{
+		mirroredFixture(t, 64, 0),
+		mirroredFixture(t, 63, 0),
+		mirroredFixture(t, 62, 100),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.2", 1000, 53),
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	tests := []struct {
+		scope      api.CaptureRequest_DedupScope
+		forwarded  int
+		duplicates uint64
+	}{
+		{api.CaptureRequest_HEADERS, 2, 2},
+		{api.CaptureRequest_FULL, 4, 0},
+	}
+	for _, test := range tests {
+		stream := newFakeCaptureStream()
+		s := NewServer(offlineConfig())
+		in := &api.CaptureRequest{
+			OfflineSource:          path,
+			DedupWindowNanoseconds: int64(10 * time.Second),
+			DedupScope:             test.scope,
+		}
+		if err := s.LiveCapture(in, stream); err != nil {
+			t.Fatal(err)
+		}
+		header := stream.replies[0].GetHeader()
+		if header == nil || !header.Deduplicating || header.DedupScope != test.scope {
+			t.Errorf("%v: expected the header to report the scope, got %+v", test.scope, stream.replies[0])
+		}
+		received := stream.packets()
+		if len(received) != test.forwarded {
+			t.Errorf("%v: expected %d packets, got %d", test.scope, test.forwarded, len(received))
+		}
+		if len(received) > 0 && string(received[0].Data) != string(packets[0]) {
+			t.Errorf("%v: expected the first copy to be kept", test.scope)
+		}
+		history := s.history.query(0, 0)
+		if len(history) != 1 || history[0].DuplicatePackets != test.duplicates || history[0].Packets != uint64(test.forwarded) {
+			t.Errorf("%v: unexpected record: %+v", test.scope, history)
+		}
+	}
+}
+
+func TestDeduplicatorForgetsPacketsAfterWindow(t *testing.T) {
+	dedup := newDeduplicator(&api.CaptureRequest{DedupWindowNanoseconds: int64(time.Second)}, layers.LinkTypeEthernet)
+	data := mirroredFixture(t, 64, 0)
+	base := time.Unix(1500000000, 0)
+	if dedup.duplicate(data, base) {
+		t.Error("expected the first packet not to be a duplicate")
+	}
+	if !dedup.duplicate(mirroredFixture(t, 60, 0), base.Add(500*time.Millisecond)) {
+		t.Error("expected a copy within the window to be a duplicate")
+	}
+	// The copy doesn't extend the window.
+	if dedup.duplicate(data, base.Add(1100*time.Millisecond)) {
+		t.Error("expected a copy after the window not to be a duplicate")
+	}
+	if len(dedup.current) != 1 || dedup.dropped != 1 {
+		t.Errorf("expected 1 packet remembered and 1 dropped, got %d and %d", len(dedup.current), dedup.dropped)
+	}
+	// Packets from more than two periods ago are forgotten all at once.
+	dedup.duplicate(mirroredFixture(t, 64, 200), base.Add(3500*time.Millisecond))
+	if len(dedup.current) != 1 || dedup.previous != nil {
+		t.Errorf("expected only the latest packet to be remembered, got %d and %d", len(dedup.current), len(dedup.previous))
+	}
+	if newDeduplicator(&api.CaptureRequest{}, layers.LinkTypeEthernet) != nil {
+		t.Error("expected no deduplication without a window")
+	}
+}
+
+func TestDeduplicatorCountsPacketsBeyondTable(t *testing.T) {
+	full := api.CaptureRequest{DedupWindowNanoseconds: int64(time.Second), DedupScope: api.CaptureRequest_FULL}
+	dedup := newDeduplicator(&full, layers.LinkTypeEthernet)
+	base := time.Unix(1500000000, 0)
+	dedup.limit = 2
+	for vlan := uint16(1); vlan <= 3; vlan++ {
+		dedup.duplicate(mirroredFixture(t, 64, vlan), base)
+	}
+	if dedup.untracked != 1 || len(dedup.current) != 2 {
+		t.Errorf("expected 2 packets remembered and 1 untracked, got %d and %d", len(dedup.current), dedup.untracked)
+	}
+	if !dedup.duplicate(mirroredFixture(t, 64, 1), base) || dedup.duplicate(mirroredFixture(t, 64, 3), base) {
+		t.Error("expected only copies of the remembered packets to be duplicates")
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+)
+
+// DescribeCapture reports the effective request of a running capture, with which it could be
+// started again, and the stages its packets pass through.
+func (s *Server) DescribeCapture(ctx context.Context, in *api.DescribeCaptureRequest) (*api.DescribeCaptureReply, error) {
+	log.Printf("DescribeCapture(%+v)", in)
+	capture := s.captures.get(in.CaptureId)
+	if capture == nil {
+		return nil, status.Errorf(codes.NotFound, "no running capture has ID %d", in.CaptureId)
+	}
+	description, pipeline := capture.getDescription()
+	if description == nil {
+		return nil, status.Errorf(codes.Unavailable, "capture %d is still starting", in.CaptureId)
+	}
+	return &api.DescribeCaptureReply{Request: description, Pipeline: pipeline}, nil
+}
+
+// describe records the capture's effective request and pipeline, once its handles are open, its
+// filter set, its sinks open and its compression chosen. The effective request is the request as
+// the server applied it, given the snaplen of the capture handle and the warnings from opening it.
+func (c *liveCapture) describe(snaplen int, warnings []*api.PcapStatus) {
+	out := proto.Clone(c.request).(*api.CaptureRequest)
+	out.Filter = c.filter
+	out.MplsLabels = nil
+	out.VxlanVnis = nil
+	out.Endpoints = nil
+	out.Exclude = nil
+	out.Protocols = nil
+	out.Filters = nil
+	out.Compression = c.compression
+	if len(out.OfflineSource) == 0 {
+		out.Interface = c.interfaces[0]
+		out.Interfaces = nil
+		if len(c.interfaces) > 1 {
+			out.Interfaces = append(out.Interfaces, c.interfaces[1:]...)
+		}
+		out.Snaplen = uint32(snaplen)
+		out.TimeoutNanoseconds = int64(bufferTimeout(c.request))
+		if out.BufferSizeBytes == 0 {
+			out.BufferSizeBytes = DefaultCaptureBufferSize
+		}
+		for _, warning := range warnings {
+			if warning.Code == pcapWarningPromiscNotSupported {
+				out.PromiscuousMode = false
+			}
+		}
+	}
+	c.descriptionMu.Lock()
+	defer c.descriptionMu.Unlock()
+	c.description = out
+	c.pipeline = c.pipelineStages()
+}
+
+func (c *liveCapture) getDescription() (*api.CaptureRequest, []*api.PipelineStage) {
+	c.descriptionMu.Lock()
+	defer c.descriptionMu.Unlock()
+	return c.description, c.pipeline
+}
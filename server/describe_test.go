@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// describeCapture waits for a capture to start, and returns its description.
+func describeCapture(t *testing.T, s *Server, id uint64) *api.DescribeCaptureReply {
+	t.Helper()
+	waitForCapture(t, s, id)
+	for deadline := time.Now().Add(time.Second); ; {
+		reply, err := s.DescribeCapture(context.Background(), &api.DescribeCaptureRequest{CaptureId: id})
+		if err == nil {
+			return reply
+		}
+		if status.Code(err) != codes.Unavailable || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDescribeCaptureReportsEffectiveRequest(t *testing.T) {
+	defer fakeInterfaces(t, map[string][][]byte{
+		"eth0": {udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)},
+		"eth1": {udp4Fixture(t, "198.51.100.1", "198.51.100.2", 1000, 53)},
+	})()
+	s := NewServer(Config{
+		InterfaceDefaults: map[string]*InterfaceDefaults{
+			"eth0": {BufferSizeBytes: 1 << 20, PromiscuousMode: true},
+		},
+		ProtocolFilters: map[string]string{"custom": "udp port 9999"},
+	})
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeCaptureStream()
+	stream.ctx = ctx
+	result := make(chan error)
+	go func() {
+		result <- s.LiveCapture(&api.CaptureRequest{
+			Interface:          "eth0",
+			Interfaces:         []string{"bad0", "eth1"},
+			Protocols:          []string{"custom"},
+			Endpoints:          []*api.EndpointFilter{{Host: "192.0.2.1"}},
+			Filter:             "udp",
+			TimeoutNanoseconds: int64(time.Minute),
+			Compression:        flateCodec,
+		}, stream)
+	}()
+	reply := describeCapture(t, s, 1)
+	time.Sleep(20 * time.Millisecond)
+	stopCapture(t, cancel, result)
+	expectNoLeakedGoroutines(t, before)
+
+	described := reply.Request
+	if described.Filter != "((host 192.0.2.1)) and ((udp port 9999)) and (udp)" {
+		t.Errorf("unexpected filter: %q", described.Filter)
+	}
+	if len(described.Protocols) > 0 || len(described.Endpoints) > 0 {
+		t.Errorf("expected the expanded options to be cleared: %+v", described)
+	}
+	if described.Interface != "eth0" || !reflect.DeepEqual(described.Interfaces, []string{"eth1"}) {
+		t.Errorf("unexpected interfaces: %q, %q", described.Interface, described.Interfaces)
+	}
+	if described.BufferSizeBytes != 1<<20 || !described.PromiscuousMode {
+		t.Errorf("expected the interface defaults to be applied: %+v", described)
+	}
+	if described.TimeoutNanoseconds != int64(MaxBufferTimeout) {
+		t.Errorf("expected the buffer timeout to be clamped, got %v", time.Duration(described.TimeoutNanoseconds))
+	}
+	if described.Snaplen != 65535 {
+		t.Errorf("expected the snaplen of the handle, got %d", described.Snaplen)
+	}
+	if described.Compression != api.CaptureRequest_NONE {
+		t.Errorf("expected the unsupported codec to be replaced, got %v", described.Compression)
+	}
+}
+
+func TestDescribeCaptureUnknownCapture(t *testing.T) {
+	_, err := NewServer(Config{}).DescribeCapture(context.Background(), &api.DescribeCaptureRequest{CaptureId: 42})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+}
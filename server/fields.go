@@ -0,0 +1,100 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+)
+
+// decodeFields decodes a captured packet and returns the header fields of each layer whose
+// protocol has a message in the API. Other layers are skipped.
+func decodeFields(data []byte, linkType layers.LinkType) (decoded []*api.DecodedLayer) {
+	defer func() {
+		recoverDecodePanic(recover())
+	}()
+	packet := gopacket.NewPacket(data, linkTypeDecoder(linkType), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	for _, layer := range packet.Layers() {
+		if fields := layerFields(layer); fields != nil {
+			decoded = append(decoded, fields)
+		}
+	}
+	return decoded
+}
+
+func layerFields(layer gopacket.Layer) *api.DecodedLayer {
+	switch l := layer.(type) {
+	case *layers.Ethernet:
+		return &api.DecodedLayer{Fields: &api.DecodedLayer_Ethernet{Ethernet: &api.EthernetFields{
+			Source:       l.SrcMAC.String(),
+			Destination:  l.DstMAC.String(),
+			EthernetType: uint32(l.EthernetType),
+		}}}
+	case *layers.IPv4:
+		fields := &api.IPv4Fields{
+			Version:        uint32(l.Version),
+			Ihl:            uint32(l.IHL),
+			Tos:            uint32(l.TOS),
+			Length:         uint32(l.Length),
+			Id:             uint32(l.Id),
+			DontFragment:   l.Flags&layers.IPv4DontFragment != 0,
+			MoreFragments:  l.Flags&layers.IPv4MoreFragments != 0,
+			FragmentOffset: uint32(l.FragOffset),
+			Ttl:            uint32(l.TTL),
+			Protocol:       uint32(l.Protocol),
+			Checksum:       uint32(l.Checksum),
+			Source:         l.SrcIP.String(),
+			Destination:    l.DstIP.String(),
+		}
+		if len(l.Contents) > 20 {
+			fields.Options = l.Contents[20:]
+		}
+		return &api.DecodedLayer{Fields: &api.DecodedLayer_Ipv4{Ipv4: fields}}
+	case *layers.IPv6:
+		return &api.DecodedLayer{Fields: &api.DecodedLayer_Ipv6{Ipv6: &api.IPv6Fields{
+			Version:      uint32(l.Version),
+			TrafficClass: uint32(l.TrafficClass),
+			FlowLabel:    l.FlowLabel,
+			Length:       uint32(l.Length),
+			NextHeader:   uint32(l.NextHeader),
+			HopLimit:     uint32(l.HopLimit),
+			Source:       l.SrcIP.String(),
+			Destination:  l.DstIP.String(),
+		}}}
+	case *layers.TCP:
+		fields := &api.TCPFields{
+			SourcePort:      uint32(l.SrcPort),
+			DestinationPort: uint32(l.DstPort),
+			Seq:             l.Seq,
+			Ack:             l.Ack,
+			DataOffset:      uint32(l.DataOffset),
+			Flags:           tcpFlags(l),
+			Window:          uint32(l.Window),
+			Checksum:        uint32(l.Checksum),
+			Urgent:          uint32(l.Urgent),
+		}
+		for _, option := range l.Options {
+			fields.Options = append(fields.Options, &api.TCPOption{
+				Kind: uint32(option.OptionType),
+				Name: option.OptionType.String(),
+				Data: option.OptionData,
+			})
+		}
+		return &api.DecodedLayer{Fields: &api.DecodedLayer_Tcp{Tcp: fields}}
+	case *layers.UDP:
+		return &api.DecodedLayer{Fields: &api.DecodedLayer_Udp{Udp: &api.UDPFields{
+			SourcePort:      uint32(l.SrcPort),
+			DestinationPort: uint32(l.DstPort),
+			Length:          uint32(l.Length),
+			Checksum:        uint32(l.Checksum),
+		}}}
+	case *layers.ICMPv4:
+		return &api.DecodedLayer{Fields: &api.DecodedLayer_Icmpv4{Icmpv4: &api.ICMPv4Fields{
+			Type:     uint32(l.TypeCode.Type()),
+			Code:     uint32(l.TypeCode.Code()),
+			Checksum: uint32(l.Checksum),
+			Id:       uint32(l.Id),
+			Seq:      uint32(l.Seq),
+		}}}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLiveCaptureDecodesTCPFields(t *testing.T) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Flags:    layers.IPv4DontFragment,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP("192.0.2.1"),
+		DstIP:    net.ParseIP("192.0.2.2"),
+	}
+	tcp := &layers.TCP{
+		SrcPort: 40000,
+		DstPort: 22,
+		Seq:     1000,
+		Ack:     2000,
+		SYN:     true,
+		ACK:     true,
+		Window:  29200,
+		Options: []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+		},
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	data := serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip, tcp)
+	path := writePcapFile(t, [][]byte{data})
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{Config: offlineConfig()}
+	request := &api.CaptureRequest{OfflineSource: path, Summarize: true, DecodeFields: true}
+	if err := s.LiveCapture(request, stream); err != nil {
+		t.Fatal(err)
+	}
+	received := summaries(stream)
+	if len(received) != 1 {
+		t.Fatalf("expected 1 summary, got %d", len(received))
+	}
+	decoded := received[0].DecodedLayers
+	if len(decoded) != 3 {
+		t.Fatalf("expected Ethernet, IPv4 and TCP fields, got %+v", decoded)
+	}
+	if ipv4 := decoded[1].GetIpv4(); ipv4 == nil || !ipv4.DontFragment || ipv4.Ttl != 64 || ipv4.Source != "192.0.2.1" {
+		t.Errorf("unexpected IPv4 fields: %+v", decoded[1])
+	}
+	fields := decoded[2].GetTcp()
+	if fields == nil {
+		t.Fatalf("expected TCP fields, got %+v", decoded[2])
+	}
+	if fields.Seq != 1000 || fields.Ack != 2000 || fields.Window != 29200 || fields.DestinationPort != 22 {
+		t.Errorf("unexpected TCP fields: %+v", fields)
+	}
+	if !reflect.DeepEqual(fields.Flags, []string{"SYN", "ACK"}) {
+		t.Errorf("unexpected TCP flags: %v", fields.Flags)
+	}
+	if len(fields.Options) == 0 || fields.Options[0].Kind != uint32(layers.TCPOptionKindMSS) {
+		t.Errorf("expected an MSS option, got %+v", fields.Options)
+	}
+}
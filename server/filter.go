@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// captureFilter combines the raw BPF filter in the request with any structured criteria, such
+// that a packet must match all of them.
+//
+// Some BPF primitives (such as "mpls" and "vlan") change the offsets used by the rest of the
+// expression, so those clauses are placed first. This means the raw filter then applies to the
+// encapsulated packet, which is usually what is wanted.
+func captureFilter(in *api.CaptureRequest, config *Config) (string, error) {
+	clauses := make([]string, 0, 4)
+	for _, label := range in.MplsLabels {
+		clauses = append(clauses, fmt.Sprintf("mpls %d", label))
+	}
+	if len(in.VxlanVnis) > 0 {
+		clauses = append(clauses, vxlanFilter(in.VxlanVnis))
+	}
+	if len(in.Endpoints) > 0 {
+		endpoints := make([]string, len(in.Endpoints))
+		for i, endpoint := range in.Endpoints {
+			filter, err := endpointFilter(endpoint)
+			if err != nil {
+				return "", err
+			}
+			endpoints[i] = filter
+		}
+		clauses = append(clauses, "("+strings.Join(endpoints, " or ")+")")
+	}
+	if len(in.Exclude) > 0 {
+		excluded := make([]string, len(in.Exclude))
+		for i, endpoint := range in.Exclude {
+			filter, err := endpointFilter(endpoint)
+			if err != nil {
+				return "", err
+			}
+			excluded[i] = filter
+		}
+		clauses = append(clauses, "not ("+strings.Join(excluded, " or ")+")")
+	}
+	if len(in.Protocols) > 0 {
+		protocols := make([]string, len(in.Protocols))
+		for i, name := range in.Protocols {
+			filter, ok := config.protocolFilter(name)
+			if !ok {
+				return "", status.Errorf(codes.InvalidArgument, "unknown protocol: %q", name)
+			}
+			protocols[i] = "(" + filter + ")"
+		}
+		clauses = append(clauses, "("+strings.Join(protocols, " or ")+")")
+	}
+	if len(in.Filters) > 0 {
+		fragments := make([]string, len(in.Filters))
+		for i, fragment := range in.Filters {
+			fragments[i] = "(" + fragment + ")"
+		}
+		clauses = append(clauses, "("+strings.Join(fragments, " or ")+")")
+	}
+	if len(in.Filter) > 0 {
+		clauses = append(clauses, "("+in.Filter+")")
+	}
+	return strings.Join(clauses, " and "), nil
+}
+
+// checkFilterFragments compiles the raw filter and each of the filter fragments in the request
+// separately, so that if one is invalid the client can be told which. It also means none of them
+// can unbalance the parentheses of the combined filter: "tcp) or (udp" would compile once
+// combined, but would escape the clauses before it, such as the exclusions.
+func checkFilterFragments(in *api.CaptureRequest, linkType layers.LinkType, snaplen int) error {
+	if len(in.Filter) > 0 {
+		if _, err := pcap.CompileBPFFilter(linkType, snaplen, in.Filter); err != nil {
+			return status.Errorf(codes.InvalidArgument, "filter %q: %v", in.Filter, err)
+		}
+	}
+	for i, fragment := range in.Filters {
+		if _, err := pcap.CompileBPFFilter(linkType, snaplen, fragment); err != nil {
+			return status.Errorf(codes.InvalidArgument, "filter %d (%q): %v", i, fragment, err)
+		}
+	}
+	return nil
+}
+
+// compileBPFFilter can be replaced in tests, since the filter compiler may not be available.
+var compileBPFFilter = pcap.CompileBPFFilter
+
+// checkFilterLimits rejects a capture filter that is longer than the configured MaxFilterLength,
+// or that compiles to more than MaxFilterInstructions BPF instructions.
+func checkFilterLimits(filter string, config *Config, linkType layers.LinkType, snaplen int) error {
+	if err := checkFilterLength(filter, config); err != nil {
+		return err
+	}
+	if config.MaxFilterInstructions <= 0 || len(filter) == 0 {
+		return nil
+	}
+	instructions, err := compileBPFFilter(linkType, snaplen, filter)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid filter: %v", err)
+	}
+	return checkFilterInstructions(len(instructions), config)
+}
+
+func checkFilterLength(filter string, config *Config) error {
+	if config.MaxFilterLength > 0 && len(filter) > config.MaxFilterLength {
+		return status.Errorf(codes.InvalidArgument, "filter is %d bytes long, more than the limit of %d",
+			len(filter), config.MaxFilterLength)
+	}
+	return nil
+}
+
+func checkFilterInstructions(instructions int, config *Config) error {
+	if config.MaxFilterInstructions > 0 && instructions > config.MaxFilterInstructions {
+		return status.Errorf(codes.InvalidArgument,
+			"filter compiles to %d BPF instructions, more than the limit of %d",
+			instructions, config.MaxFilterInstructions)
+	}
+	return nil
+}
+
+// CompileFilter compiles a filter as a capture would, reporting whether it's valid. Filters the
+// capture would reject for exceeding the server's limits are reported as invalid; those too long
+// to accept aren't compiled at all.
+func (s *Server) CompileFilter(ctx context.Context, in *api.CompileFilterRequest) (*api.CompileFilterReply, error) {
+	log.Printf("CompileFilter(%+v)", in)
+	linkType := layers.LinkTypeEthernet
+	if in.HasLinkType {
+		linkType = layers.LinkType(in.LinkType)
+	}
+	snaplen := MaxSnaplen
+	if in.Snaplen != 0 {
+		snaplen = int(in.Snaplen)
+	}
+	config := s.config()
+	if err := checkFilterLength(in.Filter, &config); err != nil {
+		return &api.CompileFilterReply{Error: status.Convert(err).Message()}, nil
+	}
+	instructions, err := compileBPFFilter(linkType, snaplen, in.Filter)
+	if err != nil {
+		return &api.CompileFilterReply{Error: err.Error()}, nil
+	}
+	if err := checkFilterInstructions(len(instructions), &config); err != nil {
+		return &api.CompileFilterReply{Error: status.Convert(err).Message()}, nil
+	}
+	return &api.CompileFilterReply{Valid: true, Instructions: uint32(len(instructions))}, nil
+}
+
+// ProtocolFilters maps application protocol names to BPF filters matching their traffic. Programs
+// embedding the server may add to it before starting the server.
+var ProtocolFilters = map[string]string{
+	"4in6":   "ip6 proto 4",
+	"6in4":   "ip proto 41",
+	"bgp":    "tcp port 179",
+	"dhcp":   "udp port 67 or udp port 68",
+	"dhcpv6": "udp port 546 or udp port 547",
+	"dns":    "port 53",
+	"ftp":    "tcp port 20 or tcp port 21",
+	"http":   "tcp port 80",
+	"https":  "tcp port 443 or udp port 443",
+	"imap":   "tcp port 143 or tcp port 993",
+	"ldap":   "tcp port 389 or tcp port 636",
+	"mdns":   "udp port 5353",
+	"ntp":    "udp port 123",
+	"smtp":   "tcp port 25 or tcp port 465 or tcp port 587",
+	"snmp":   "udp port 161 or udp port 162",
+	"ssh":    "tcp port 22",
+	"syslog": "udp port 514",
+	"telnet": "tcp port 23",
+	"vxlan":  fmt.Sprintf("udp port %d", VXLANPort),
+}
+
+// protocolFilter looks up the filter matching an application protocol, preferring the server's
+// configured filters to the built-in ones.
+func (c *Config) protocolFilter(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if filter, ok := c.ProtocolFilters[name]; ok {
+		return filter, true
+	}
+	filter, ok := ProtocolFilters[name]
+	return filter, ok
+}
+
+// VXLANPort is the IANA-assigned UDP port for VXLAN.
+const VXLANPort = 4789
+
+// vxlanFilter matches VXLAN packets with any of the specified network identifiers, over IPv4 or
+// IPv6. The 24-bit VNI follows the 8-byte UDP header and 4 bytes of VXLAN flags, so it's the top
+// three bytes of the 32-bit word at udp[12]. libpcap can't index the UDP header of IPv6 packets,
+// so there it's found at ip6[52], after the 40-byte IPv6 header; "udp port" only matches IPv6
+// packets whose UDP header follows it directly.
+func vxlanFilter(vnis []uint32) string {
+	ipv4 := make([]string, len(vnis))
+	ipv6 := make([]string, len(vnis))
+	for i, vni := range vnis {
+		ipv4[i] = fmt.Sprintf("udp[12:4] >> 8 = %d", vni)
+		ipv6[i] = fmt.Sprintf("ip6[52:4] >> 8 = %d", vni)
+	}
+	return fmt.Sprintf("(udp port %d and (%s or %s))", VXLANPort, strings.Join(ipv4, " or "), strings.Join(ipv6, " or "))
+}
+
+var protocolNamePattern = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+// endpointFilter matches traffic to and/or from a host or subnet, optionally limited to
+// specific ports (on that endpoint) and a protocol. The host may be omitted, to match the ports
+// and protocol on any host.
+func endpointFilter(endpoint *api.EndpointFilter) (string, error) {
+	var qualifier string
+	switch endpoint.Direction {
+	case api.EndpointFilter_TO_OR_FROM:
+		qualifier = ""
+	case api.EndpointFilter_FROM:
+		qualifier = "src "
+	case api.EndpointFilter_TO:
+		qualifier = "dst "
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "invalid direction: %v", endpoint.Direction)
+	}
+	var clauses []string
+	if len(endpoint.Host) == 0 {
+		if len(endpoint.Protocol) == 0 && len(endpoint.Ports) == 0 {
+			return "", status.Errorf(codes.InvalidArgument, "endpoint filter needs a host, protocol, or ports")
+		}
+	} else if _, _, err := net.ParseCIDR(endpoint.Host); err == nil {
+		clauses = append(clauses, qualifier+"net "+endpoint.Host)
+	} else if ip := net.ParseIP(endpoint.Host); ip != nil {
+		clauses = append(clauses, qualifier+"host "+ip.String())
+	} else {
+		return "", status.Errorf(codes.InvalidArgument, "invalid host or subnet: %q", endpoint.Host)
+	}
+	if len(endpoint.Protocol) > 0 {
+		if !protocolNamePattern.MatchString(endpoint.Protocol) {
+			return "", status.Errorf(codes.InvalidArgument, "invalid protocol: %q", endpoint.Protocol)
+		}
+		clauses = append(clauses, endpoint.Protocol)
+	}
+	if len(endpoint.Ports) > 0 {
+		ports := make([]string, len(endpoint.Ports))
+		for i, port := range endpoint.Ports {
+			if port > 65535 {
+				return "", status.Errorf(codes.InvalidArgument, "invalid port: %d", port)
+			}
+			ports[i] = fmt.Sprintf("%sport %d", qualifier, port)
+		}
+		clauses = append(clauses, "("+strings.Join(ports, " or ")+")")
+	}
+	return "(" + strings.Join(clauses, " and ") + ")", nil
+}
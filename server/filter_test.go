@@ -0,0 +1,422 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCaptureFilterRawOnly(t *testing.T) {
+	filter, _ := captureFilter(&api.CaptureRequest{Filter: "tcp port 22"}, &Config{})
+	if filter != "(tcp port 22)" {
+		t.Errorf("unexpected filter: %q", filter)
+	}
+}
+
+func TestCaptureFilterMPLSLabelStack(t *testing.T) {
+	filter, _ := captureFilter(&api.CaptureRequest{Filter: "udp", MplsLabels: []uint32{100, 200}}, &Config{})
+	if filter != "mpls 100 and mpls 200 and (udp)" {
+		t.Errorf("unexpected filter: %q", filter)
+	}
+}
+
+func TestCaptureFilterVXLANNetworkIdentifiers(t *testing.T) {
+	filter, _ := captureFilter(&api.CaptureRequest{VxlanVnis: []uint32{100, 200}}, &Config{})
+	expected := "(udp port 4789 and (udp[12:4] >> 8 = 100 or udp[12:4] >> 8 = 200 or " +
+		"ip6[52:4] >> 8 = 100 or ip6[52:4] >> 8 = 200))"
+	if filter != expected {
+		t.Errorf("unexpected filter: %q", filter)
+	}
+}
+
+// vxlanFixture returns a VXLAN packet with the given network identifier, carried over UDP from
+// source to destination, which may be IPv4 or IPv6 addresses.
+func vxlanFixture(t *testing.T, source, destination string, vni uint32) []byte {
+	ethernet := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	var ip gopacket.NetworkLayer = &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(source),
+		DstIP:    net.ParseIP(destination),
+	}
+	if net.ParseIP(source).To4() == nil {
+		ethernet.EthernetType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      net.ParseIP(source),
+			DstIP:      net.ParseIP(destination),
+		}
+	}
+	udp := &layers.UDP{SrcPort: 49152, DstPort: VXLANPort}
+	udp.SetNetworkLayerForChecksum(ip)
+	inner := udp4Fixture(t, "10.0.0.1", "10.0.0.2", 3333, 80)
+	return serializePacket(t, ethernet, ip.(gopacket.SerializableLayer), udp,
+		&layers.VXLAN{ValidIDFlag: true, VNI: vni}, gopacket.Payload(inner))
+}
+
+func TestVXLANFilterMatchesIPv4AndIPv6(t *testing.T) {
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 65535, vxlanFilter([]uint32{100, 200}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		source, destination string
+		vni                 uint32
+		match               bool
+	}{
+		{"192.0.2.1", "192.0.2.2", 200, true},
+		{"192.0.2.1", "192.0.2.2", 300, false},
+		{"2001:db8::1", "2001:db8::2", 100, true},
+		{"2001:db8::1", "2001:db8::2", 300, false},
+	} {
+		data := vxlanFixture(t, test.source, test.destination, test.vni)
+		if bpf.Matches(captureInfoFor(data), data) != test.match {
+			t.Errorf("%s VNI %d: expected a match: %t", test.source, test.vni, test.match)
+		}
+	}
+}
+
+func TestCaptureFilterEndpoints(t *testing.T) {
+	filter, err := captureFilter(&api.CaptureRequest{
+		Endpoints: []*api.EndpointFilter{
+			{Host: "192.0.2.1", Direction: api.EndpointFilter_FROM, Protocol: "tcp", Ports: []uint32{80, 443}},
+			{Host: "198.51.100.0/24", Direction: api.EndpointFilter_TO},
+			{Host: "2001:db8::1"},
+		},
+	}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "((src host 192.0.2.1 and tcp and (src port 80 or src port 443)) or " +
+		"(dst net 198.51.100.0/24) or (host 2001:db8::1))"
+	if filter != expected {
+		t.Errorf("unexpected filter: %q", filter)
+	}
+}
+
+func TestCaptureFilterInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []*api.EndpointFilter{
+		{Host: "not a host"},
+		{Host: "192.0.2.1", Protocol: "tcp or 1=1"},
+		{Host: "192.0.2.1", Ports: []uint32{70000}},
+		{Direction: api.EndpointFilter_Direction(10), Host: "192.0.2.1"},
+		{},
+	} {
+		_, err := captureFilter(&api.CaptureRequest{Endpoints: []*api.EndpointFilter{endpoint}}, &Config{})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for %+v, got %v", endpoint, err)
+		}
+	}
+}
+
+func TestEndpointFilterFromHost(t *testing.T) {
+	filter, err := captureFilter(&api.CaptureRequest{
+		Endpoints: []*api.EndpointFilter{{Host: "192.0.2.1", Direction: api.EndpointFilter_FROM}},
+	}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, 65535, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromHost := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	toHost := udp4Fixture(t, "192.0.2.2", "192.0.2.1", 53, 1000)
+	if !bpf.Matches(captureInfoFor(fromHost), fromHost) {
+		t.Error("expected packet from host to match")
+	}
+	if bpf.Matches(captureInfoFor(toHost), toHost) {
+		t.Error("expected packet to host not to match")
+	}
+}
+
+func TestCaptureFilterFragments(t *testing.T) {
+	filter, err := captureFilter(&api.CaptureRequest{
+		Filter:  "udp",
+		Filters: []string{"host 192.0.2.1", "host 192.0.2.2"},
+	}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter != "((host 192.0.2.1) or (host 192.0.2.2)) and (udp)" {
+		t.Errorf("unexpected filter: %q", filter)
+	}
+}
+
+func TestCheckFilterFragmentsReportsInvalidFragment(t *testing.T) {
+	err := checkFilterFragments(&api.CaptureRequest{
+		Filters: []string{"host 192.0.2.1", "host and"},
+	}, layers.LinkTypeEthernet, 65535)
+	if err == nil || !strings.Contains(err.Error(), `filter 1 ("host and")`) {
+		t.Errorf("expected the second fragment to be reported, got %v", err)
+	}
+}
+
+func TestCheckFilterFragmentsRejectsUnbalancedFilter(t *testing.T) {
+	in := &api.CaptureRequest{
+		Filter:  "tcp) or (udp",
+		Exclude: []*api.EndpointFilter{{Host: "192.0.2.1"}},
+	}
+	filter, err := captureFilter(in, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Combined, the filter compiles, but udp packets would escape the exclusion.
+	if _, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, 65535, filter); err != nil {
+		t.Fatalf("expected %q to compile: %v", filter, err)
+	}
+	err = checkFilterFragments(in, layers.LinkTypeEthernet, 65535)
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "tcp) or (udp") {
+		t.Errorf("expected the unbalanced filter to be rejected, got %v", err)
+	}
+}
+
+func TestLiveCaptureFilterFragmentsMatchEither(t *testing.T) {
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "198.51.100.1", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "198.51.100.1", 1000, 53),
+		udp4Fixture(t, "198.51.100.1", "192.0.2.2", 53, 1000),
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{}
+	err := s.LiveCapture(&api.CaptureRequest{
+		OfflineSource: path,
+		Filters:       []string{"host 192.0.2.1", "host 192.0.2.2"},
+	}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := stream.packets()
+	if len(received) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(received))
+	}
+}
+
+func TestCaptureFilterExclude(t *testing.T) {
+	filter, err := captureFilter(&api.CaptureRequest{
+		Endpoints: []*api.EndpointFilter{{Host: "192.0.2.0/24"}},
+		Exclude: []*api.EndpointFilter{
+			{Protocol: "tcp", Ports: []uint32{22}},
+			{Host: "192.0.2.128/25"},
+		},
+	}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "((net 192.0.2.0/24)) and not ((tcp and (port 22)) or (net 192.0.2.128/25))"
+	if filter != expected {
+		t.Errorf("unexpected filter: %q", filter)
+	}
+	if _, err := captureFilter(&api.CaptureRequest{Exclude: []*api.EndpointFilter{{}}}, &Config{}); err == nil {
+		t.Error("expected an error for an empty exclusion")
+	}
+}
+
+func TestLiveCaptureExclude(t *testing.T) {
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "198.51.100.1", 1000, 53),
+		udp4Fixture(t, "192.0.2.1", "198.51.100.1", 1000, 22),
+		udp4Fixture(t, "203.0.113.1", "198.51.100.1", 1000, 53),
+		udp4Fixture(t, "192.0.2.2", "198.51.100.2", 1000, 123),
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{}
+	err := s.LiveCapture(&api.CaptureRequest{
+		OfflineSource: path,
+		Exclude: []*api.EndpointFilter{
+			{Protocol: "udp", Ports: []uint32{22}},
+			{Host: "203.0.113.0/24"},
+		},
+	}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := stream.packets()
+	if len(received) != 2 || !bytes.Equal(received[0].Data, packets[0]) || !bytes.Equal(received[1].Data, packets[3]) {
+		t.Errorf("expected only the packets that weren't excluded, got %d packets", len(received))
+	}
+}
+
+func TestCaptureFilterProtocols(t *testing.T) {
+	filter, err := captureFilter(&api.CaptureRequest{Protocols: []string{"DNS", "ssh"}}, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter != "((port 53) or (tcp port 22))" {
+		t.Errorf("unexpected filter: %q", filter)
+	}
+	if _, err := captureFilter(&api.CaptureRequest{Protocols: []string{"gopher"}}, &Config{}); err == nil {
+		t.Error("expected an error for an unknown protocol")
+	}
+}
+
+func TestLiveCaptureProtocolDNS(t *testing.T) {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP("192.0.2.1"),
+		DstIP:    net.ParseIP("192.0.2.2"),
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 53, SYN: true, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ip)
+	ethernet := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 80),
+		serializePacket(t, ethernet, ip, tcp),
+		udp4Fixture(t, "192.0.2.2", "192.0.2.1", 53, 1000),
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{}
+	err := s.LiveCapture(&api.CaptureRequest{OfflineSource: path, Protocols: []string{"dns"}}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := stream.packets()
+	if len(received) != 3 {
+		t.Fatalf("expected 3 DNS packets, got %d", len(received))
+	}
+	for i, index := range []int{0, 2, 3} {
+		if !bytes.Equal(received[i].Data, packets[index]) {
+			t.Errorf("packet %d: expected fixture packet %d", i, index)
+		}
+	}
+}
+
+func TestConfiguredProtocolFilters(t *testing.T) {
+	config := &Config{ProtocolFilters: map[string]string{"dns": "udp port 5353", "gopher": "tcp port 70"}}
+	filter, err := captureFilter(&api.CaptureRequest{Protocols: []string{"DNS", "gopher", "ssh"}}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter != "((udp port 5353) or (tcp port 70) or (tcp port 22))" {
+		t.Errorf("unexpected filter: %q", filter)
+	}
+}
+
+// fakeFilterCompiler compiles each word of a filter to one instruction.
+func fakeFilterCompiler() (restore func()) {
+	compileBPFFilter = func(linkType layers.LinkType, snaplen int, filter string) ([]pcap.BPFInstruction, error) {
+		return make([]pcap.BPFInstruction, len(strings.Fields(filter))), nil
+	}
+	return func() { compileBPFFilter = pcap.CompileBPFFilter }
+}
+
+func TestCheckFilterLimits(t *testing.T) {
+	defer fakeFilterCompiler()()
+	oversized := "host 192.0.2.1" + strings.Repeat(" or host 192.0.2.1", 10)
+	for _, test := range []struct {
+		filter string
+		config Config
+		err    string
+	}{
+		{"host 192.0.2.1", Config{}, ""},
+		{oversized, Config{}, ""},
+		{"host 192.0.2.1", Config{MaxFilterLength: 14, MaxFilterInstructions: 2}, ""},
+		{"", Config{MaxFilterLength: 1, MaxFilterInstructions: 1}, ""},
+		{oversized, Config{MaxFilterLength: 100}, "filter is 194 bytes long, more than the limit of 100"},
+		{oversized, Config{MaxFilterInstructions: 16},
+			"filter compiles to 32 BPF instructions, more than the limit of 16"},
+	} {
+		err := checkFilterLimits(test.filter, &test.config, layers.LinkTypeEthernet, 65535)
+		if len(test.err) == 0 {
+			if err != nil {
+				t.Errorf("%q: unexpected error: %v", test.filter, err)
+			}
+			continue
+		}
+		if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected %q, got %v", test.filter, test.err, err)
+		}
+	}
+}
+
+func TestLiveCaptureRejectsOversizedFilter(t *testing.T) {
+	path := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{Config: Config{OfflineDirectory: os.TempDir(), MaxFilterLength: 16}}
+	err := s.LiveCapture(&api.CaptureRequest{
+		OfflineSource: path,
+		Endpoints:     []*api.EndpointFilter{{Host: "192.0.2.1"}, {Host: "192.0.2.2"}},
+	}, stream)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected the filter to be rejected, got %v", err)
+	}
+	if len(stream.packets()) != 0 {
+		t.Error("expected no packets to be captured")
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	var linkType layers.LinkType
+	var snaplen int
+	compileBPFFilter = func(l layers.LinkType, s int, filter string) ([]pcap.BPFInstruction, error) {
+		linkType, snaplen = l, s
+		if strings.Contains(filter, "((") {
+			return nil, errors.New("syntax error")
+		}
+		return make([]pcap.BPFInstruction, len(strings.Fields(filter))), nil
+	}
+	defer func() { compileBPFFilter = pcap.CompileBPFFilter }()
+	s := &Server{Config: Config{MaxFilterInstructions: 4, MaxFilterLength: 100}}
+	for _, test := range []struct {
+		request  *api.CompileFilterRequest
+		expected api.CompileFilterReply
+		linkType layers.LinkType
+		snaplen  int
+	}{
+		{&api.CompileFilterRequest{Filter: "tcp port 22"},
+			api.CompileFilterReply{Valid: true, Instructions: 3}, layers.LinkTypeEthernet, MaxSnaplen},
+		{&api.CompileFilterRequest{Filter: "((", LinkType: uint32(layers.LinkTypeRaw), HasLinkType: true, Snaplen: 96},
+			api.CompileFilterReply{Error: "syntax error"}, layers.LinkTypeRaw, 96},
+		{&api.CompileFilterRequest{Filter: "tcp port 22 or udp"},
+			api.CompileFilterReply{Error: "filter compiles to 5 BPF instructions, more than the limit of 4"},
+			layers.LinkTypeEthernet, MaxSnaplen},
+		{&api.CompileFilterRequest{Filter: "ip", HasLinkType: true},
+			api.CompileFilterReply{Valid: true, Instructions: 1}, layers.LinkTypeNull, MaxSnaplen},
+		{&api.CompileFilterRequest{Filter: strings.Repeat("ip or ", 20) + "ip"},
+			api.CompileFilterReply{Error: "filter is 122 bytes long, more than the limit of 100"}, 0, 0},
+	} {
+		linkType, snaplen = 0, 0
+		reply, err := s.CompileFilter(context.Background(), test.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Valid != test.expected.Valid || reply.Error != test.expected.Error ||
+			reply.Instructions != test.expected.Instructions {
+			t.Errorf("%q: expected %+v, got %+v", test.request.Filter, test.expected, reply)
+		}
+		if linkType != test.linkType || snaplen != test.snaplen {
+			t.Errorf("%q: compiled for %v with snaplen %d", test.request.Filter, linkType, snaplen)
+		}
+	}
+}
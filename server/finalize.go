@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"sync"
+)
+
+// fileCaptures tracks the running captures that write to files, by the path of the file, so
+// that they can be finalized from another RPC.
+type fileCaptures struct {
+	mu       sync.Mutex
+	captures map[string]*liveCapture
+}
+
+func (f *fileCaptures) add(path string, capture *liveCapture) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.captures == nil {
+		f.captures = make(map[string]*liveCapture)
+	}
+	f.captures[path] = capture
+}
+
+func (f *fileCaptures) remove(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.captures, path)
+}
+
+func (f *fileCaptures) get(path string) *liveCapture {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.captures[path]
+}
+
+// rotate starts a new file for each running file capture, keeping the old file alongside it.
+func (f *fileCaptures) rotate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for path, capture := range f.captures {
+		if err := capture.fileSink.rotate(); err != nil {
+			log.Printf("Error rotating %s: %v", path, err)
+		}
+	}
+}
+
+// FinalizeCapture stops the capture writing to the requested file, and waits until the file has
+// been flushed and closed before reporting the capture's final statistics.
+func (s *Server) FinalizeCapture(ctx context.Context, in *api.FinalizeCaptureRequest) (*api.FinalizeCaptureReply, error) {
+	log.Printf("FinalizeCapture(%+v)", in)
+	path, err := outputPath(s.config().OutputDirectory, in.OutputPath)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	capture := s.fileCaptures.get(path)
+	if capture == nil {
+		return nil, status.Errorf(codes.NotFound, "no running capture is writing to %s", in.OutputPath)
+	}
+	capture.requestStop()
+	select {
+	case <-capture.ended:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return &api.FinalizeCaptureReply{Path: path, Record: capture.final}, nil
+}
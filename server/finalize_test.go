@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeIdleInterface makes live captures of any interface deliver the packets, then simulate an
+// idle interface until they are stopped. The returned function restores live captures.
+func fakeIdleInterface(t *testing.T, packets [][]byte) func() {
+	return fakeInterfaces(t, map[string][][]byte{anyInterface: packets})
+}
+
+// waitForFileCapture waits until the capture writing to path has started.
+func waitForFileCapture(t *testing.T, s *Server, path string) {
+	for deadline := time.Now().Add(time.Second); s.fileCaptures.get(path) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("capture did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// countPcapPackets returns the number of packets in a pcap file.
+func countPcapPackets(t *testing.T, path string) uint64 {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	var count uint64
+	for {
+		if _, _, err := reader.ReadPacketData(); err == io.EOF {
+			return count
+		} else if err != nil {
+			t.Fatalf("%s: packet %d: %v", path, count, err)
+		}
+		count++
+	}
+}
+
+func TestFinalizeCaptureClosesOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-finalize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	}
+	defer fakeIdleInterface(t, packets)()
+	s := NewServer(Config{OutputDirectory: dir})
+	result := make(chan error)
+	go func() {
+		in := &api.CaptureRequest{Interface: "eth0", OutputPath: "out.pcap"}
+		result <- s.LiveCapture(in, newFakeCaptureStream())
+	}()
+	path := filepath.Join(dir, "out.pcap")
+	waitForFileCapture(t, s, path)
+	reply, err := s.FinalizeCapture(context.Background(), &api.FinalizeCaptureRequest{OutputPath: "out.pcap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if reply.Path != path || reply.Record == nil || reply.Record.Error != "" {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+	count := countPcapPackets(t, reply.Path)
+	if count != reply.Record.Packets {
+		t.Errorf("expected %d packets in the file, got %d", reply.Record.Packets, count)
+	}
+	if s.fileCaptures.get(path) != nil {
+		t.Error("expected the finalized capture to be forgotten")
+	}
+}
+
+func TestFinalizeCaptureUnknownPath(t *testing.T) {
+	s := NewServer(Config{OutputDirectory: "/var/lib/pcapd"})
+	_, err := s.FinalizeCapture(context.Background(), &api.FinalizeCaptureRequest{OutputPath: "missing.pcap"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+}
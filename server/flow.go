@@ -0,0 +1,185 @@
+package server
+
+import (
+	"github.com/pcapme/pcap/api"
+	"sort"
+	"time"
+)
+
+// DefaultFlowIdleTimeout is how long a flow is remembered after its last packet, if the client
+// doesn't specify a timeout.
+const DefaultFlowIdleTimeout = 2 * time.Minute
+
+// flowKey identifies a flow by its 5-tuple. The endpoints are ordered so that both directions of
+// a connection map to the same key.
+type flowKey struct {
+	protocol string
+	lowHost  string
+	lowPort  uint32
+	highHost string
+	highPort uint32
+}
+
+func newFlowKey(summary *api.PacketSummary) flowKey {
+	key := flowKey{
+		protocol: summary.NetworkProtocol + "/" + summary.TransportProtocol,
+		lowHost:  summary.Source,
+		lowPort:  summary.SourcePort,
+		highHost: summary.Destination,
+		highPort: summary.DestinationPort,
+	}
+	if key.highHost < key.lowHost || (key.highHost == key.lowHost && key.highPort < key.lowPort) {
+		key.lowHost, key.highHost = key.highHost, key.lowHost
+		key.lowPort, key.highPort = key.highPort, key.lowPort
+	}
+	return key
+}
+
+// flowTracker remembers recently seen flows, so that only the first packet of each new flow is
+// forwarded. Packet timestamps are used as the clock, so that offline captures behave the same as
+// live ones. Flows idle for longer than the timeout are forgotten, which bounds the memory used.
+type flowTracker struct {
+	idleTimeout time.Duration
+	lastSeen    map[flowKey]time.Time
+	lastExpiry  time.Time
+
+	// The number of distinct flows seen, including those since expired.
+	flows uint64
+}
+
+func newFlowTracker(idleTimeout time.Duration) *flowTracker {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultFlowIdleTimeout
+	}
+	return &flowTracker{idleTimeout: idleTimeout, lastSeen: make(map[flowKey]time.Time)}
+}
+
+// first records a packet in the given flow, and returns true if it is the first packet of a flow
+// that wasn't already being tracked.
+func (f *flowTracker) first(key flowKey, timestamp time.Time) bool {
+	if timestamp.Sub(f.lastExpiry) >= f.idleTimeout {
+		f.expire(timestamp)
+	}
+	lastSeen, ok := f.lastSeen[key]
+	f.lastSeen[key] = timestamp
+	if ok && timestamp.Sub(lastSeen) < f.idleTimeout {
+		return false
+	}
+	f.flows++
+	return true
+}
+
+// expire forgets flows that have been idle for longer than the timeout.
+func (f *flowTracker) expire(now time.Time) {
+	for key, lastSeen := range f.lastSeen {
+		if now.Sub(lastSeen) >= f.idleTimeout {
+			delete(f.lastSeen, key)
+		}
+	}
+	f.lastExpiry = now
+}
+
+// flowLimiter caps the number of packets forwarded from each flow. Like flowTracker, it uses
+// packet timestamps as the clock, and forgets flows idle for longer than the timeout, so that a
+// flow's count starts again if it resumes after a pause.
+type flowLimiter struct {
+	limit       uint64
+	idleTimeout time.Duration
+	flows       map[flowKey]*flowCount
+	lastExpiry  time.Time
+
+	// Packets dropped from each flow that exceeded the limit, kept after the flow expires so that
+	// they can be reported at the end of the capture. At most maxCappedFlows flows are kept;
+	// packets dropped from flows capped after that are only counted in untracked.
+	dropped      map[flowKey]uint64
+	droppedTotal uint64
+	untracked    uint64
+}
+
+// maxCappedFlows limits the flows whose dropped packets are counted individually.
+const maxCappedFlows = 1024
+
+// reportedCappedFlows limits the flows listed when the capture ends, the rest being reported as a
+// single count.
+const reportedCappedFlows = 100
+
+type flowCount struct {
+	packets  uint64
+	lastSeen time.Time
+}
+
+func newFlowLimiter(limit uint32, idleTimeout time.Duration) *flowLimiter {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultFlowIdleTimeout
+	}
+	return &flowLimiter{
+		limit:       uint64(limit),
+		idleTimeout: idleTimeout,
+		flows:       make(map[flowKey]*flowCount),
+		dropped:     make(map[flowKey]uint64),
+	}
+}
+
+// allow records a packet in the given flow, and returns true if it is within the flow's limit.
+func (f *flowLimiter) allow(key flowKey, timestamp time.Time) bool {
+	if timestamp.Sub(f.lastExpiry) >= f.idleTimeout {
+		f.expire(timestamp)
+	}
+	count, ok := f.flows[key]
+	if !ok || timestamp.Sub(count.lastSeen) >= f.idleTimeout {
+		count = &flowCount{}
+		f.flows[key] = count
+	}
+	count.lastSeen = timestamp
+	if count.packets >= f.limit {
+		f.droppedTotal++
+		if _, tracked := f.dropped[key]; tracked || len(f.dropped) < maxCappedFlows {
+			f.dropped[key]++
+		} else {
+			f.untracked++
+		}
+		return false
+	}
+	count.packets++
+	return true
+}
+
+// expire forgets flows that have been idle for longer than the timeout.
+func (f *flowLimiter) expire(now time.Time) {
+	for key, count := range f.flows {
+		if now.Sub(count.lastSeen) >= f.idleTimeout {
+			delete(f.flows, key)
+		}
+	}
+	f.lastExpiry = now
+}
+
+// cappedFlows lists the flows that exceeded the limit, with the most packets dropped first, up to
+// reportedCappedFlows flows. It also returns the packets dropped from the flows not listed.
+func (f *flowLimiter) cappedFlows() ([]*api.CappedFlow, uint64) {
+	flows := make([]*api.CappedFlow, 0, len(f.dropped))
+	for key, dropped := range f.dropped {
+		flows = append(flows, &api.CappedFlow{
+			Protocol:        key.protocol,
+			Source:          key.lowHost,
+			SourcePort:      key.lowPort,
+			Destination:     key.highHost,
+			DestinationPort: key.highPort,
+			DroppedPackets:  dropped,
+		})
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].DroppedPackets != flows[j].DroppedPackets {
+			return flows[i].DroppedPackets > flows[j].DroppedPackets
+		}
+		return flows[i].String() < flows[j].String()
+	})
+	if len(flows) > reportedCappedFlows {
+		flows = flows[:reportedCappedFlows]
+	}
+	other := f.droppedTotal
+	for _, flow := range flows {
+		other -= flow.DroppedPackets
+	}
+	return flows, other
+}
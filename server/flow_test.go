@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"testing"
+	"time"
+)
+
+func TestFirstPacketOnlyForwardsFirstPacketOfEachFlow(t *testing.T) {
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{FirstPacketOnly: true}, stream, &Config{})
+	capture.linkType = layers.LinkTypeEthernet
+	flowA := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	replyA := udp4Fixture(t, "192.0.2.2", "192.0.2.1", 53, 1000)
+	flowB := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1001, 53)
+	inputs := [][]byte{flowA, replyA, flowA, flowB, flowB, replyA}
+	base := time.Unix(1500000000, 0)
+	for i, data := range inputs {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     base.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		if err := capture.queuePacket(&packetData{data: data, ci: ci}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := stream.packets()
+	if len(received) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(received))
+	}
+	if !bytes.Equal(received[0].Data, flowA) || !bytes.Equal(received[1].Data, flowB) {
+		t.Error("expected the first packet of each flow to be forwarded")
+	}
+	record := capture.record(nil)
+	if record.Flows != 2 || record.Packets != uint64(len(inputs)) {
+		t.Errorf("unexpected record: %+v", record)
+	}
+}
+
+func TestFlowTrackerForgetsIdleFlows(t *testing.T) {
+	flows := newFlowTracker(time.Minute)
+	key := flowKey{protocol: "IPv4/UDP", lowHost: "192.0.2.1", highHost: "192.0.2.2"}
+	other := flowKey{protocol: "IPv4/TCP", lowHost: "192.0.2.1", highHost: "192.0.2.2"}
+	base := time.Unix(1500000000, 0)
+	if !flows.first(key, base) {
+		t.Error("expected the first packet to start a flow")
+	}
+	if flows.first(key, base.Add(30*time.Second)) {
+		t.Error("expected a packet within the idle timeout to continue the flow")
+	}
+	flows.first(other, base.Add(2*time.Minute))
+	if _, ok := flows.lastSeen[key]; ok {
+		t.Error("expected the idle flow to be expired")
+	}
+	if !flows.first(key, base.Add(3*time.Minute)) {
+		t.Error("expected a packet after the idle timeout to start a new flow")
+	}
+	if flows.flows != 3 {
+		t.Errorf("expected 3 flows, got %d", flows.flows)
+	}
+}
+
+func TestMaxPacketsPerFlowCapsDominantFlow(t *testing.T) {
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{MaxPacketsPerFlow: 3}, stream, &Config{})
+	capture.linkType = layers.LinkTypeEthernet
+	dominant := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	reply := udp4Fixture(t, "192.0.2.2", "192.0.2.1", 53, 1000)
+	small := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1001, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.4", "192.0.2.2", 1000, 53),
+	}
+	var inputs [][]byte
+	for i := 0; i < 20; i++ {
+		// Replies count towards the same flow.
+		if i%2 == 0 {
+			inputs = append(inputs, dominant)
+		} else {
+			inputs = append(inputs, reply)
+		}
+		if i%5 == 0 {
+			inputs = append(inputs, small[i/5%len(small)])
+		}
+	}
+	base := time.Unix(1500000000, 0)
+	for i, data := range inputs {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     base.Add(time.Duration(i) * time.Millisecond),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		if err := capture.queuePacket(&packetData{data: data, ci: ci}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := capture.finish(); err != nil {
+		t.Fatal(err)
+	}
+	forwarded := make(map[string]int)
+	for _, packet := range stream.packets() {
+		forwarded[string(packet.Data)]++
+	}
+	if n := forwarded[string(dominant)] + forwarded[string(reply)]; n != 3 {
+		t.Errorf("expected the dominant flow to be capped at 3 packets, got %d", n)
+	}
+	for i, data := range small {
+		if forwarded[string(data)] == 0 {
+			t.Errorf("small flow %d: expected its packets to be forwarded", i)
+		}
+	}
+	record := capture.record(nil)
+	if record.FlowCappedPackets != 17 || record.Packets != uint64(len(inputs)) {
+		t.Errorf("unexpected record: %+v", record)
+	}
+	last := stream.replies[len(stream.replies)-1].GetStatus()
+	if last == nil || len(last.CappedFlows) != 1 {
+		t.Fatalf("expected a status listing the capped flow, got %+v", stream.replies[len(stream.replies)-1])
+	}
+	capped := last.CappedFlows[0]
+	if capped.Protocol != "IPv4/UDP" || capped.Source != "192.0.2.1" || capped.DestinationPort != 53 ||
+		capped.DroppedPackets != 17 {
+		t.Errorf("unexpected capped flow: %+v", capped)
+	}
+}
+
+func TestFlowLimiterResetsIdleFlows(t *testing.T) {
+	limiter := newFlowLimiter(1, time.Minute)
+	key := flowKey{protocol: "IPv4/UDP", lowHost: "192.0.2.1", highHost: "192.0.2.2"}
+	base := time.Unix(1500000000, 0)
+	if !limiter.allow(key, base) {
+		t.Error("expected the first packet to be allowed")
+	}
+	if limiter.allow(key, base.Add(30*time.Second)) {
+		t.Error("expected a packet over the limit to be dropped")
+	}
+	if !limiter.allow(key, base.Add(2*time.Minute)) {
+		t.Error("expected the count to start again after the flow was idle")
+	}
+	if limiter.dropped[key] != 1 {
+		t.Errorf("expected the drop to be remembered, got %d", limiter.dropped[key])
+	}
+}
+
+func TestFlowLimiterBoundsCappedFlows(t *testing.T) {
+	limiter := newFlowLimiter(1, time.Minute)
+	base := time.Unix(1500000000, 0)
+	flows := maxCappedFlows + 10
+	for i := 0; i < flows; i++ {
+		key := flowKey{protocol: "IPv4/UDP", lowHost: "192.0.2.1", lowPort: uint32(i), highHost: "192.0.2.2"}
+		// The first flow is dropped from most often, so it should be listed first.
+		drops := 2
+		if i == 0 {
+			drops = 5
+		}
+		for j := 0; j <= drops; j++ {
+			limiter.allow(key, base)
+		}
+	}
+	if len(limiter.dropped) != maxCappedFlows || limiter.untracked != 20 {
+		t.Errorf("expected %d flows tracked and 20 packets untracked, got %d and %d",
+			maxCappedFlows, len(limiter.dropped), limiter.untracked)
+	}
+	capped, other := limiter.cappedFlows()
+	if len(capped) != reportedCappedFlows || capped[0].SourcePort != 0 || capped[0].DroppedPackets != 5 {
+		t.Fatalf("unexpected capped flows: %d, first %+v", len(capped), capped[0])
+	}
+	if total := uint64(5 + 2*(flows-1)); other != total-5-2*(reportedCappedFlows-1) {
+		t.Errorf("expected the unlisted flows to total %d packets, got %d", total-5-2*(reportedCappedFlows-1), other)
+	}
+}
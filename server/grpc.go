@@ -1,18 +1,72 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"github.com/golang/protobuf/proto"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
 	"github.com/pcapme/pcap/api"
 	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"log"
 	"net"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
-type Server struct{}
+type Server struct {
+	Config   Config
+	configMu sync.RWMutex
+
+	history      *captureHistory
+	fileCaptures fileCaptures
+	captures     runningCaptures
+	otlp         *otlpExporter
+}
+
+// NewServer creates a server with the specified configuration.
+func NewServer(config Config) *Server {
+	history, err := newCaptureHistory(config.HistoryPath, config.HistoryLimit)
+	if err != nil {
+		log.Printf("Error loading capture history from %s: %v", config.HistoryPath, err)
+	}
+	return &Server{Config: config, history: history, otlp: newOTLPExporter(config.OTLP)}
+}
+
+// config returns a copy of the server's current configuration, which may be replaced at any
+// time by a reload.
+func (s *Server) config() Config {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.Config
+}
+
+// reload rotates the files being written by running captures, and replaces the configuration
+// with the one returned by Config.Reload, if set.
+func (s *Server) reload() {
+	s.fileCaptures.rotate()
+	config := s.config()
+	if config.Reload == nil {
+		return
+	}
+	newConfig, err := config.Reload()
+	if err != nil {
+		log.Printf("Error reloading configuration: %v", err)
+		return
+	}
+	if newConfig.Reload == nil {
+		newConfig.Reload = config.Reload
+	}
+	s.configMu.Lock()
+	s.Config = newConfig
+	s.configMu.Unlock()
+	log.Printf("Configuration reloaded")
+}
 
 // This channel will be closed when the server is gracefully stopping. Any streams in-progress
 // will then also be closed.
@@ -22,6 +76,17 @@ func init() {
 	ShuttingDown = make(chan int)
 }
 
+// checkNotShuttingDown rejects requests that arrive after the server has started shutting down,
+// but before the gRPC server has stopped accepting them.
+func checkNotShuttingDown() error {
+	select {
+	case <-ShuttingDown:
+		return status.Error(codes.Unavailable, "the server is shutting down")
+	default:
+		return nil
+	}
+}
+
 func (s *Server) Add(ctx context.Context, in *api.AddRequest) (*api.AddReply, error) {
 	log.Printf("Add(%+v)", in)
 	log.Printf("GetOptionalName() = %+v", in.GetOptionalName())
@@ -48,27 +113,60 @@ func (s *Server) InterfaceList(ctx context.Context, in *api.InterfaceListRequest
 	result := &api.InterfaceListReply{
 		Success: false,
 	}
-	interfaces, err := net.Interfaces()
+	if _, err := filepath.Match(in.NamePattern, ""); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid name pattern %q: %v", in.NamePattern, err)
+	}
+	interfaces, err := listInterfaces()
 	if err != nil {
+		log.Printf("Error listing interfaces: %v", err)
+		result.Error = err.Error()
 		return result, nil
 	}
 	resultInterfaces := make([]*api.Interface, 0, len(interfaces))
-	for _, iface := range interfaces {
+	maxAddresses := s.config().MaxInterfaceAddresses
+	if maxAddresses <= 0 {
+		maxAddresses = DefaultMaxInterfaceAddresses
+	}
+	permitted := capturePermitted()
+	for _, iface := range sortInterfaces(interfaces, in.Sort) {
 		isUp := iface.Flags&unix.IFF_UP != 0
 		if !(isUp || in.All) {
 			// Skip the interface if it it's UP, or if --all wasn't specified.
 			continue
 		}
-		resultInterface := &api.Interface{Name: iface.Name, Up: isUp}
+		if matched, _ := filepath.Match(in.NamePattern, iface.Name); len(in.NamePattern) > 0 && !matched {
+			continue
+		}
+		resultInterface := &api.Interface{
+			Name:             iface.Name,
+			Up:               isUp,
+			Index:            int32(iface.Index),
+			TimestampSources: interfaceTimestampSources(iface.Name),
+			Mtu:              uint32(iface.MTU),
+			Loopback:         iface.Flags&net.FlagLoopback != 0,
+			PointToPoint:     iface.Flags&net.FlagPointToPoint != 0,
+			Multicast:        iface.Flags&net.FlagMulticast != 0,
+			Broadcast:        iface.Flags&net.FlagBroadcast != 0,
+			Virtual:          interfaceVirtual(iface.Name),
+		}
 		resultInterface.EthernetAddresses = make([]*api.Address, 0, 8)
 		resultInterface.Ipv4Addresses = make([]*api.Address, 0, 8)
 		resultInterface.Ipv6Addresses = make([]*api.Address, 0, 8)
-		resultInterface.EthernetAddresses = append(
-			resultInterface.EthernetAddresses,
-			&api.Address{
-				Value: iface.HardwareAddr.String(),
-			})
-		addrs, _ := iface.Addrs()
+		if hasHardwareAddr(iface) {
+			resultInterface.EthernetAddresses = append(
+				resultInterface.EthernetAddresses,
+				&api.Address{
+					Value: iface.HardwareAddr.String(),
+				})
+		}
+		addrs, _ := interfaceAddrs(iface)
+		resultInterface.Usability = captureUsability(isUp, isUp && interfaceCarrier(iface.Name),
+			len(addrs) > 0, permitted)
+		sortAddrs(addrs)
+		if len(addrs) > maxAddresses {
+			addrs = addrs[:maxAddresses]
+			resultInterface.AddressesTruncated = true
+		}
 		for _, addr := range addrs {
 			address := strings.Split(addr.String(), "/")[0]
 			ip := net.ParseIP(address)
@@ -94,97 +192,469 @@ func (s *Server) InterfaceList(ctx context.Context, in *api.InterfaceListRequest
 	}
 	result.Success = true
 	result.Interfaces = resultInterfaces
+	result.Count = uint32(len(resultInterfaces))
+	result.Total = uint32(len(interfaces))
 	return result, nil
 }
 
+// listInterfaces, interfaceAddrs, interfaceVirtual, interfaceCarrier and capturePermitted can be
+// replaced in tests.
+var listInterfaces = net.Interfaces
+var interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) { return iface.Addrs() }
+var interfaceVirtual = isVirtualInterface
+var interfaceCarrier = hasCarrier
+var capturePermitted = canCapture
+
+// sortInterfaces returns a sorted copy of the interfaces, so clients see them in the same order
+// from one call to the next.
+func sortInterfaces(interfaces []net.Interface, key api.InterfaceListRequest_SortKey) []net.Interface {
+	sorted := append([]net.Interface(nil), interfaces...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if key == api.InterfaceListRequest_NAME && sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Index < sorted[j].Index
+	})
+	return sorted
+}
+
+// sortAddrs sorts addresses by IP, with IPv4 addresses first. Sorting happens before addresses
+// are truncated, so the same ones are kept each time.
+func sortAddrs(addrs []net.Addr) {
+	key := func(addr net.Addr) []byte {
+		ip := net.ParseIP(strings.Split(addr.String(), "/")[0])
+		if ip4 := ip.To4(); ip4 != nil {
+			return append([]byte{4}, ip4...)
+		}
+		return append([]byte{6}, ip...)
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return bytes.Compare(key(addrs[i]), key(addrs[j])) < 0
+	})
+}
+
+// hasHardwareAddr returns true if the interface has a (nonzero) hardware address. Loopback and
+// tunnel interfaces generally don't.
+func hasHardwareAddr(iface net.Interface) bool {
+	for _, b := range iface.HardwareAddr {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) CaptureHistory(ctx context.Context, in *api.CaptureHistoryRequest) (*api.CaptureHistoryReply, error) {
+	log.Printf("CaptureHistory(%+v)", in)
+	reply := &api.CaptureHistoryReply{}
+	if s.history != nil {
+		reply.Records = s.history.query(int(in.Limit), in.SinceSeconds)
+	}
+	return reply, nil
+}
+
 type packetData struct {
 	data []byte
 	ci   gopacket.CaptureInfo
 	err  error
+
+	// If the capture's packets are compressed, the data to forward, compressed by the goroutine
+	// reading the packet (see compressPacket).
+	compressed  []byte
+	compressErr error
+
+	// The packet's flow, once a stage has needed it (see packetFlow).
+	flow *flowKey
+}
+
+// newPacketData converts a captured packet into the form sent to the client. If maxForwardBytes
+// is nonzero, the data is trimmed to that length; the captured and original lengths are still
+// reported so the client can tell the packet was cut short.
+func newPacketData(data []byte, ci gopacket.CaptureInfo, maxForwardBytes int) *api.PacketData {
+	if maxForwardBytes > 0 && len(data) > maxForwardBytes {
+		data = data[:maxForwardBytes]
+	}
+	return &api.PacketData{
+		Seconds:        ci.Timestamp.Unix(),
+		Microseconds:   uint32(ci.Timestamp.Nanosecond() / 1000),
+		OriginalLength: uint32(ci.Length),
+		CapturedLength: uint32(ci.CaptureLength),
+		Data:           data,
+	}
 }
 
-func (s *Server) LiveCapture(in *api.CaptureRequest, stream api.PCAP_LiveCaptureServer) error {
-	log.Printf("LiveCapture(%+v)", in)
+// openLive opens and activates a capture handle on the requested interface. If libpcap warns that
+// promiscuous mode isn't supported, the capture is opened without it and the warning is returned
+// so that it can be reported to the client.
+func openLive(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+	handle, err := activateLive(in, in.PromiscuousMode)
+	if err == nil {
+		return handle, nil, nil
+	}
+	if code, ok := pcapCode(err); ok && code == pcapWarningPromiscNotSupported {
+		warning := newPcapStatus(err)
+		log.Printf("%s: %s; capturing without promiscuous mode", in.Interface, warning.Message)
+		handle, err = activateLive(in, false)
+		if err == nil {
+			return handle, []*api.PcapStatus{warning}, nil
+		}
+	}
+	return nil, nil, pcapStatusError(err)
+}
+
+// DefaultCaptureBufferSize is the size of the buffer libpcap captures into, if the client doesn't
+// specify a size.
+const DefaultCaptureBufferSize = 4 * 1024 * 1024
+
+func activateLive(in *api.CaptureRequest, promiscuous bool) (*pcap.Handle, error) {
 	inactiveHandle, err := pcap.NewInactiveHandle(in.Interface)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer inactiveHandle.CleanUp()
 	err = inactiveHandle.SetImmediateMode(in.ImmediateMode)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = inactiveHandle.SetSnapLen(int(in.Snaplen))
+	snaplen := int(in.Snaplen)
+	if snaplen == 0 {
+		snaplen = interfaceSnaplen(in.Interface)
+	}
+	err = inactiveHandle.SetSnapLen(snaplen)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	bufferSize := in.BufferSizeBytes
 	if bufferSize == 0 {
-		bufferSize = 1024 * 1024 * 4
+		bufferSize = DefaultCaptureBufferSize
 	}
 	err = inactiveHandle.SetBufferSize(int(bufferSize))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = inactiveHandle.SetPromisc(in.PromiscuousMode)
+	err = inactiveHandle.SetPromisc(promiscuous)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = inactiveHandle.SetRFMon(in.RfMonitor)
 	if err != nil {
 		log.Printf("%s: %s", in.Interface, err.Error())
 	}
-	err = inactiveHandle.SetTimeout(time.Duration(in.TimeoutNanoseconds))
+	err = inactiveHandle.SetTimeout(bufferTimeout(in))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// XXX: Need to implement listing supported timestamp sources, and setting the timestamp source.
-	// See also: 'man pcap_set_tstamp_type'.
-	handle, err := inactiveHandle.Activate()
+	err = setTimestampSource(inactiveHandle, in)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer handle.Close()
-	if len(in.Filter) > 0 {
-		err = handle.SetBPFFilter(in.Filter)
-		if err != nil {
-			return err
+	return inactiveHandle.Activate()
+}
+
+// openEgress opens the egress interface of a latency measurement, with the same options and
+// filter as the ingress interface.
+func openEgress(in *api.CaptureRequest, filter string, config *Config) (*pcap.Handle, error) {
+	egress := proto.Clone(in).(*api.CaptureRequest)
+	egress.Interface = in.EgressInterface
+	handle, warnings, err := openWithRetry(egress, config)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		log.Printf("%s: %s", egress.Interface, warning.Message)
+	}
+	if len(filter) > 0 {
+		if err = handle.SetBPFFilter(filter); err != nil {
+			handle.Close()
+			return nil, err
 		}
 	}
-	// XXX: Send over an api.CaptureHeader object.
+	return handle, nil
+}
+
+// readPackets reads packets from the handle until an error occurs (such as io.EOF once the handle
+// is closed), or until done is closed. The second channel is closed once the reader has exited.
+func readPackets(handle *pcap.Handle, done <-chan bool) (<-chan *packetData, <-chan struct{}) {
+	packets := make(chan *packetData)
+	finished := make(chan struct{})
+	go sendPacketsFrom(handle, 0, packets, done, finished, nil)
+	return packets, finished
+}
+
+// sendPacketsFrom sends the packets read from the handle to the channel (see readPackets), with
+// their interface index set to index, closing finished when it returns. If prepare is set, it is
+// called with each packet before it is sent.
+func sendPacketsFrom(handle *pcap.Handle, index int, packets chan<- *packetData, done <-chan bool,
+	finished chan<- struct{}, prepare func(*packetData)) {
+	defer close(finished)
 	for {
-		packet := make(chan *packetData)
-		go func() {
-			data, captureInfo, err := handle.ReadPacketData()
-			packet <- &packetData{data, captureInfo, err}
+		data, captureInfo, err := readPacketData(handle)
+		if err == pcap.NextErrorTimeoutExpired {
+			select {
+			case <-done:
+				return
+			default:
+				continue
+			}
+		}
+		captureInfo.InterfaceIndex = index
+		p := &packetData{data: data, ci: captureInfo, err: err}
+		if prepare != nil {
+			prepare(p)
+		}
+		select {
+		case packets <- p:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
 
+// closeAfterRead closes a handle read by sendPacketsFrom, once the reader (if it was started) has
+// been told to stop and has exited. gopacket waits for an outstanding read to return before
+// closing a handle. Live reads return within the buffer timeout, but on platforms where they can
+// block until a packet arrives, the handle is instead closed in the background once they do.
+func closeAfterRead(handle *pcap.Handle, finished <-chan struct{}) {
+	if finished == nil {
+		handle.Close()
+		return
+	}
+	select {
+	case <-finished:
+		handle.Close()
+	case <-time.After(MaxBufferTimeout):
+		go func() {
+			<-finished
+			handle.Close()
 		}()
-		select {
-		case _, running := <-ShuttingDown:
-			if running == false {
-				log.Printf("Stopped LiveCapture(%+v) via interrupt.\n", in)
-				return nil
-			}
-		case <-stream.Context().Done():
-			log.Println("Context().Done()")
-			// Connection closed by remote host.
-			return nil
-		case p := <-packet:
-			if p.err != nil {
-				return p.err
-			}
-			packetData := &api.PacketData{
-				Seconds:        p.ci.Timestamp.Unix(),
-				Microseconds:   uint32(p.ci.Timestamp.Nanosecond()) * 1000,
-				OriginalLength: uint32(p.ci.Length),
-				Data:           p.data,
+	}
+}
+
+// openLiveHandle and readPacketData can be replaced in tests, which can't open live captures.
+var openLiveHandle = openLive
+var readPacketData = (*pcap.Handle).ReadPacketData
+
+func (s *Server) LiveCapture(in *api.CaptureRequest, stream api.PCAP_LiveCaptureServer) (err error) {
+	log.Printf("LiveCapture(%+v) from %s", in, formatPeer(peerIdentity(stream.Context())))
+	if err = checkNotShuttingDown(); err != nil {
+		return err
+	}
+	in, err = resolveSource(in)
+	if err != nil {
+		return err
+	}
+	in, err = resolveInterfaceAddress(in)
+	if err != nil {
+		return err
+	}
+	if err = checkPreserveTiming(in); err != nil {
+		return err
+	}
+	config := s.config()
+	var handle *pcap.Handle
+	var warnings []*api.PcapStatus
+	var failures []*api.CaptureStatus
+	if len(in.OfflineSource) > 0 {
+		if _, err = captureInterfaces(in); err != nil {
+			return err
+		}
+		in = config.applyInterfaceDefaults(in)
+		handle, err = openOffline(in.OfflineSource, &config)
+	} else {
+		in, handle, warnings, failures, err = openFirstInterface(in, &config)
+	}
+	if err != nil {
+		return err
+	}
+	capture := newLiveCapture(in, stream, &config)
+	capture.otlp = s.otlp
+	defer capture.closeHandle(handle)
+	capture.id = s.captures.add(capture)
+	capture.setStatsHandles(handle)
+	defer func() {
+		s.captures.remove(capture.id, capture.final)
+		capture.setStatsHandles()
+	}()
+	capture.linkType = handle.LinkType()
+	capture.dedup = newDeduplicator(in, capture.linkType)
+	capture.hooks.captureStart(capture.info)
+	capture.span.SetAttributes(map[string]interface{}{
+		"interface":      in.Interface,
+		"offline_source": in.OfflineSource,
+		"link_type":      capture.linkType.String(),
+		"snaplen":        handle.SnapLen(),
+	})
+	capture.span.AddEvent("capture started", nil)
+	defer func() {
+		capture.tallyKernelDrops(handle)
+		if capture.kernelDropped > 0 {
+			capture.hooks.drop(capture.info, capture.kernelDropped, "kernel")
+		}
+		capture.hooks.captureEnd(capture.info, err)
+		record := capture.record(err)
+		capture.span.SetAttributes(map[string]interface{}{
+			"filter":            record.Filter,
+			"packets":           record.Packets,
+			"bytes":             record.Bytes,
+			"dropped_packets":   record.DroppedPackets,
+			"throttled_packets": record.ThrottledPackets,
+		})
+		capture.span.AddEvent("capture ended", map[string]interface{}{"error": record.Error})
+		capture.otlp.captureEnded(capture, record)
+		if len(record.Error) > 0 {
+			capture.otlp.event(capture, "capture failed: "+record.Error, true)
+		} else {
+			capture.otlp.event(capture, "capture ended", false)
+		}
+		log.Printf("Capture on %s from %s ended: %d packets, %d bytes", record.Interface,
+			formatPeer(record.Peer), record.Packets, record.Bytes)
+		if s.history != nil {
+			if historyErr := s.history.add(record); historyErr != nil {
+				log.Printf("Error saving capture history: %v", historyErr)
 			}
-			err = stream.Send(&api.CaptureReply{
-				ReplyData: &api.CaptureReply_Data{Data: packetData},
-			})
-			if err != nil {
-				return err
+		}
+		capture.final = record
+		close(capture.ended)
+	}()
+	capture.filter, err = captureFilter(in, capture.config)
+	if err != nil {
+		return err
+	}
+	err = checkFilterLimits(capture.filter, capture.config, capture.linkType, handle.SnapLen())
+	if err != nil {
+		return err
+	}
+	err = checkFilterFragments(in, capture.linkType, handle.SnapLen())
+	if err != nil {
+		return err
+	}
+	snaplenStatus, err := checkSnaplen(in, capture.filter, capture.linkType, handle.SnapLen())
+	if err != nil {
+		return err
+	}
+	err = capture.applyFilter(handle)
+	if err != nil {
+		return err
+	}
+	interfaceHandles, interfaceFailures := capture.openAdditionalInterfaces(capture.linkType, handle.SnapLen())
+	failures = append(failures, interfaceFailures...)
+	var interfaceReaders []<-chan struct{}
+	defer func() {
+		capture.setStatsHandles(handle)
+		capture.tallyKernelDrops(append([]*pcap.Handle{handle}, interfaceHandles...)...)
+		capture.closeAdditionalInterfaces(interfaceHandles, interfaceReaders)
+	}()
+	capture.setStatsHandles(append([]*pcap.Handle{handle}, interfaceHandles...)...)
+	var egressHandle *pcap.Handle
+	var egressReader <-chan struct{}
+	if capture.latency != nil {
+		egressHandle, err = openEgress(in, capture.filter, capture.config)
+		if err != nil {
+			return err
+		}
+		defer func() { closeAfterRead(egressHandle, egressReader) }()
+		capture.egressLinkType = egressHandle.LinkType()
+	}
+	err = capture.openSinks(handle.SnapLen())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := capture.closeSinks(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	if len(capture.outputFile) > 0 {
+		s.fileCaptures.add(capture.outputFile, capture)
+		defer s.fileCaptures.remove(capture.outputFile)
+	}
+	capture.otlp.event(capture, "capture started", false)
+	compressionStatus := capture.setUpCompression()
+	capture.describe(handle.SnapLen(), warnings)
+	header := newCaptureHeader(capture.linkType, handle.SnapLen())
+	header.Sampling = capture.sampling
+	header.CaptureId = capture.id
+	header.Compression = capture.compression
+	if capture.dedup != nil {
+		header.Deduplicating = true
+		header.DedupScope = capture.dedup.scope
+	}
+	if len(capture.request.Interfaces) > 0 || len(failures) > 0 {
+		header.Interfaces = capture.interfaces
+		for _, failure := range failures {
+			header.FailedInterfaces = append(header.FailedInterfaces, failure.Interface)
+		}
+	}
+	if len(capture.outputFile) > 0 {
+		writeSidecar(capture.outputFile, header)
+	}
+	err = stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Header{Header: header},
+	})
+	if err != nil {
+		return err
+	}
+	statuses := make([]*api.CaptureStatus, 0, len(failures)+len(warnings)+3)
+	statuses = append(statuses, failures...)
+	for _, warning := range warnings {
+		statuses = append(statuses, &api.CaptureStatus{Message: warning.Message, Pcap: warning})
+	}
+	if snaplenStatus != nil {
+		log.Printf("%s: %s", in.Interface, snaplenStatus.Message)
+		statuses = append(statuses, snaplenStatus)
+	}
+	if compressionStatus != nil {
+		log.Printf("%s: %s", in.Interface, compressionStatus.Message)
+		statuses = append(statuses, compressionStatus)
+	}
+	if len(in.OfflineSource) == 0 {
+		for _, name := range capture.interfaces {
+			if warning := vlanOffloadWarning(name, capture.filter); warning != nil {
+				log.Printf("%s", warning.Message)
+				statuses = append(statuses, warning)
 			}
 		}
 	}
+	for _, status := range statuses {
+		err = stream.Send(&api.CaptureReply{
+			ReplyData: &api.CaptureReply_Status{Status: status},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// Egress packets are only summarized (with their forwarding latency), so they aren't
+	// compressed.
+	var egressPacket <-chan *packetData
+	if egressHandle != nil {
+		done := make(chan bool)
+		defer close(done)
+		egressPacket, egressReader = readPackets(egressHandle, done)
+	}
+	var interfacePacket <-chan *packetData
+	if len(interfaceHandles) > 0 {
+		done := make(chan bool)
+		defer close(done)
+		interfacePacket, interfaceReaders = capture.readInterfaces(interfaceHandles, done)
+	}
+	capture.startDeadline(time.Now())
+	defer capture.stopDeadline()
+	// Compressed captures are read on a goroutine of their own, which compresses the packets, so
+	// that compression doesn't hold up the capture loop. So are captures of several interfaces
+	// (see pollLoop).
+	if pollable(in) && capture.newCompressor == nil && egressPacket == nil && interfacePacket == nil {
+		err = capture.pollLoop(handle)
+	} else {
+		err = capture.channelLoop(handle, egressPacket, interfacePacket)
+	}
+	if err != nil {
+		return err
+	}
+	// The final statistics include the kernel's drops, so they are read before the handles are
+	// closed.
+	capture.tallyKernelDrops(append([]*pcap.Handle{handle}, interfaceHandles...)...)
+	return capture.finish()
 }
@@ -0,0 +1,498 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewPacketDataTrimsForwardedBytes(t *testing.T) {
+	data := bytes.Repeat([]byte{0xab}, 100)
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 100, Length: 1500}
+	packet := newPacketData(data, ci, 64)
+	if len(packet.Data) != 64 {
+		t.Errorf("expected 64 forwarded bytes, got %d", len(packet.Data))
+	}
+	if packet.CapturedLength != 100 || packet.OriginalLength != 1500 {
+		t.Errorf("unexpected lengths: captured=%d original=%d", packet.CapturedLength, packet.OriginalLength)
+	}
+	if len(data) != 100 {
+		t.Errorf("captured data should be left intact, got %d bytes", len(data))
+	}
+}
+
+func TestNewPacketDataWithoutLimit(t *testing.T) {
+	data := bytes.Repeat([]byte{0xab}, 100)
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 100, Length: 100}
+	packet := newPacketData(data, ci, 0)
+	if !bytes.Equal(packet.Data, data) {
+		t.Errorf("expected all %d bytes to be forwarded, got %d", len(data), len(packet.Data))
+	}
+}
+
+func TestNewPacketDataTimestamp(t *testing.T) {
+	for _, nanoseconds := range []int{0, 1, 999, 1000, 123456789, 999999000, 999999999} {
+		timestamp := time.Unix(1500000000, int64(nanoseconds))
+		packet := newPacketData(nil, gopacket.CaptureInfo{Timestamp: timestamp}, 0)
+		if packet.Microseconds > 999999 {
+			t.Errorf("%d ns: microseconds out of range: %d", nanoseconds, packet.Microseconds)
+		}
+		received := time.Unix(packet.Seconds, int64(packet.Microseconds)*1000)
+		if !received.Equal(timestamp.Truncate(time.Microsecond)) {
+			t.Errorf("%d ns: expected %v, got %v", nanoseconds, timestamp.Truncate(time.Microsecond), received)
+		}
+	}
+}
+
+func TestLiveCapturePacketTimestamps(t *testing.T) {
+	timestamps := []time.Time{
+		time.Unix(1500000000, 123456789),
+		time.Unix(1500000001, 999999999),
+	}
+	input := writePcapFile(t, [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	})
+	defer os.Remove(input)
+	defer func() { openLiveHandle = openLive }()
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		handle, err := pcap.OpenOffline(input)
+		return handle, nil, err
+	}
+	defer func() { readPacketData = (*pcap.Handle).ReadPacketData }()
+	read := 0
+	readPacketData = func(h *pcap.Handle) ([]byte, gopacket.CaptureInfo, error) {
+		data, ci, err := h.ReadPacketData()
+		if err == nil {
+			ci.Timestamp = timestamps[read]
+			read++
+		}
+		return data, ci, err
+	}
+	stream := newFakeCaptureStream()
+	if err := (&Server{}).LiveCapture(&api.CaptureRequest{Interface: "eth0"}, stream); err != nil {
+		t.Fatal(err)
+	}
+	received := stream.packets()
+	if len(received) != len(timestamps) {
+		t.Fatalf("expected %d packets, got %d", len(timestamps), len(received))
+	}
+	for i, packet := range received {
+		expected := timestamps[i].Truncate(time.Microsecond)
+		if actual := time.Unix(packet.Seconds, int64(packet.Microseconds)*1000); !actual.Equal(expected) {
+			t.Errorf("packet %d: expected %v, got %v", i, expected, actual)
+		}
+	}
+}
+
+func TestInterfaceListLoopbackHasNoEthernetAddress(t *testing.T) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if len(loopback) == 0 {
+		t.Skip("no loopback interface")
+	}
+	s := &Server{}
+	reply, err := s.InterfaceList(context.Background(), &api.InterfaceListRequest{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range reply.Interfaces {
+		if iface.Name == loopback && len(iface.EthernetAddresses) != 0 {
+			t.Errorf("expected no ethernet addresses for %s, got %+v", loopback, iface.EthernetAddresses)
+		}
+	}
+}
+
+func TestInterfaceListNoMatchingInterfaces(t *testing.T) {
+	defer func() { listInterfaces = net.Interfaces }()
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Index: 1, Name: "down0"}}, nil
+	}
+	s := &Server{}
+	reply, err := s.InterfaceList(context.Background(), &api.InterfaceListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Success || reply.Count != 0 || reply.Total != 1 || len(reply.Interfaces) != 0 {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+}
+
+func TestInterfaceListEnumerationError(t *testing.T) {
+	defer func() { listInterfaces = net.Interfaces }()
+	listInterfaces = func() ([]net.Interface, error) {
+		return nil, errors.New("netlink failure")
+	}
+	s := &Server{}
+	reply, err := s.InterfaceList(context.Background(), &api.InterfaceListRequest{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Success || reply.Error != "netlink failure" {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+}
+
+func TestInterfaceListTruncatesAddresses(t *testing.T) {
+	defer func() {
+		listInterfaces = net.Interfaces
+		interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) { return iface.Addrs() }
+	}()
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Index: 1, Name: "many0", Flags: net.FlagUp}}, nil
+	}
+	interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) {
+		addrs := make([]net.Addr, 1000)
+		for i := range addrs {
+			addrs[i] = &net.IPNet{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Mask: net.CIDRMask(32, 32)}
+		}
+		return addrs, nil
+	}
+	s := &Server{Config: Config{MaxInterfaceAddresses: 100}}
+	reply, err := s.InterfaceList(context.Background(), &api.InterfaceListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Interfaces) != 1 {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+	iface := reply.Interfaces[0]
+	if len(iface.Ipv4Addresses) != 100 || !iface.AddressesTruncated {
+		t.Errorf("expected 100 addresses and truncation, got %d (truncated: %t)",
+			len(iface.Ipv4Addresses), iface.AddressesTruncated)
+	}
+}
+
+func TestInterfaceListSortsInterfacesAndAddresses(t *testing.T) {
+	defer func() {
+		listInterfaces = net.Interfaces
+		interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) { return iface.Addrs() }
+	}()
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 3, Name: "eth0", Flags: net.FlagUp},
+			{Index: 1, Name: "lo", Flags: net.FlagUp},
+			{Index: 2, Name: "wlan0", Flags: net.FlagUp},
+		}, nil
+	}
+	interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.IPv4(192, 0, 2, 10), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.IPv4(192, 0, 2, 9), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+	s := &Server{}
+	for _, test := range []struct {
+		sort     api.InterfaceListRequest_SortKey
+		expected []string
+	}{
+		{api.InterfaceListRequest_INDEX, []string{"lo", "wlan0", "eth0"}},
+		{api.InterfaceListRequest_NAME, []string{"eth0", "lo", "wlan0"}},
+	} {
+		for call := 0; call < 3; call++ {
+			reply, err := s.InterfaceList(context.Background(), &api.InterfaceListRequest{Sort: test.sort})
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, len(reply.Interfaces))
+			for i, iface := range reply.Interfaces {
+				names[i] = iface.Name
+			}
+			if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("sort %v: expected %v, got %v", test.sort, test.expected, names)
+			}
+			iface := reply.Interfaces[0]
+			if renderValues(iface.Ipv4Addresses) != "192.0.2.9,192.0.2.10" ||
+				renderValues(iface.Ipv6Addresses) != "2001:db8::1,fe80::1" {
+				t.Errorf("addresses not sorted: %v %v", iface.Ipv4Addresses, iface.Ipv6Addresses)
+			}
+		}
+	}
+}
+
+func renderValues(addresses []*api.Address) string {
+	values := make([]string, len(addresses))
+	for i, address := range addresses {
+		values[i] = address.Value
+	}
+	return strings.Join(values, ",")
+}
+
+// failingStream fails to send any replies, as if the client had gone away.
+type failingStream struct {
+	*fakeCaptureStream
+}
+
+func (f *failingStream) Send(reply *api.CaptureReply) error {
+	return errors.New("stream closed")
+}
+
+// openFileDescriptors counts the file descriptors open in this process.
+func openFileDescriptors(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("can't count open file descriptors")
+	}
+	return len(fds)
+}
+
+func TestLiveCaptureEarlyReturnsReleaseResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-early-return")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(input)
+	defer func() { openLiveHandle = openLive }()
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		return nil, nil, errors.New("no such device")
+	}
+	s := NewServer(Config{OutputDirectory: dir})
+	for i, test := range []struct {
+		name    string
+		request *api.CaptureRequest
+		stream  api.PCAP_LiveCaptureServer
+	}{
+		{"invalid endpoint", &api.CaptureRequest{
+			Endpoints: []*api.EndpointFilter{{Host: "bogus"}},
+		}, newFakeCaptureStream()},
+		{"invalid filter", &api.CaptureRequest{Filter: "(("}, newFakeCaptureStream()},
+		{"egress open failure", &api.CaptureRequest{EgressInterface: "eth1"}, newFakeCaptureStream()},
+		{"second sink failure", &api.CaptureRequest{
+			OutputPath:    "out.pcap",
+			CsvOutputPath: "missing/out.csv",
+		}, newFakeCaptureStream()},
+		{"collector not configured", &api.CaptureRequest{
+			OutputPath:      "out.pcap",
+			SendToCollector: true,
+		}, newFakeCaptureStream()},
+		{"metadata socket not configured", &api.CaptureRequest{
+			OutputPath:   "out.pcap",
+			SendMetadata: true,
+		}, newFakeCaptureStream()},
+		{"header send failure", &api.CaptureRequest{OutputPath: "out.pcap"},
+			&failingStream{newFakeCaptureStream()}},
+	} {
+		os.Remove(filepath.Join(dir, "out.pcap"))
+		test.request.OfflineSource = input
+		goroutines := runtime.NumGoroutine()
+		fds := openFileDescriptors(t)
+		if err := s.LiveCapture(test.request, test.stream); err == nil {
+			t.Errorf("%d: %s: expected an error", i, test.name)
+		}
+		if after := openFileDescriptors(t); after != fds {
+			t.Errorf("%d: %s: %d file descriptors open before, %d after", i, test.name, fds, after)
+		}
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if after := runtime.NumGoroutine(); after > goroutines {
+			t.Errorf("%d: %s: %d goroutines before, %d after", i, test.name, goroutines, after)
+		}
+	}
+}
+
+func TestCloseAfterReadDoesNotWaitForBlockedRead(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// Write only the file header, so that the read blocks, as a live read can.
+	writePcapFixture(t, w, nil)
+	before := runtime.NumGoroutine()
+	handle, err := pcap.OpenOffline(fmt.Sprintf("/dev/fd/%d", r.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	_, finished := readPackets(handle, done)
+	time.Sleep(20 * time.Millisecond)
+	close(done)
+	start := time.Now()
+	closeAfterRead(handle, finished)
+	if elapsed := time.Since(start); elapsed > 2*MaxBufferTimeout {
+		t.Errorf("expected closing the handle not to wait for the read, took %v", elapsed)
+	}
+	// Once the read returns, the reader exits and the handle is closed.
+	w.Close()
+	<-finished
+	expectNoLeakedGoroutines(t, before)
+}
+
+func TestLiveCaptureRejectedWhileShuttingDown(t *testing.T) {
+	input := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(input)
+	defer func() { ShuttingDown = make(chan int) }()
+	close(ShuttingDown)
+	s := NewServer(Config{})
+	stream := newFakeCaptureStream()
+	fds := openFileDescriptors(t)
+	err := s.LiveCapture(&api.CaptureRequest{OfflineSource: input}, stream)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable, got %v", err)
+	}
+	if len(stream.replies) > 0 {
+		t.Errorf("expected nothing to be sent, got %v", stream.replies)
+	}
+	if after := openFileDescriptors(t); after != fds {
+		t.Errorf("%d file descriptors open before, %d after", fds, after)
+	}
+}
+
+func TestInterfaceListReportsFlagsAndMTU(t *testing.T) {
+	defer func() {
+		listInterfaces = net.Interfaces
+		interfaceVirtual = isVirtualInterface
+	}()
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 1, Name: "lo", MTU: 65536, Flags: net.FlagUp | net.FlagLoopback},
+			{Index: 2, Name: "eth0", MTU: 1500, Flags: net.FlagUp | net.FlagBroadcast | net.FlagMulticast},
+			{Index: 3, Name: "tun0", MTU: 1400, Flags: net.FlagUp | net.FlagPointToPoint},
+		}, nil
+	}
+	interfaceVirtual = func(name string) bool { return name != "eth0" }
+	s := &Server{}
+	reply, err := s.InterfaceList(context.Background(), &api.InterfaceListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Interfaces) != 3 {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+	lo, eth0, tun0 := reply.Interfaces[0], reply.Interfaces[1], reply.Interfaces[2]
+	if lo.Mtu != 65536 || !lo.Loopback || lo.Multicast || !lo.Virtual {
+		t.Errorf("unexpected loopback interface: %+v", lo)
+	}
+	if eth0.Mtu != 1500 || eth0.Loopback || !eth0.Broadcast || !eth0.Multicast || eth0.Virtual {
+		t.Errorf("unexpected Ethernet interface: %+v", eth0)
+	}
+	if tun0.Index != 3 || !tun0.PointToPoint || tun0.Broadcast || !tun0.Virtual {
+		t.Errorf("unexpected tunnel interface: %+v", tun0)
+	}
+}
+
+func TestInterfaceListReportsUsability(t *testing.T) {
+	defer func() {
+		listInterfaces = net.Interfaces
+		interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) { return iface.Addrs() }
+		interfaceCarrier = hasCarrier
+		capturePermitted = canCapture
+	}()
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 1, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, Name: "eth1", Flags: net.FlagUp},
+			{Index: 3, Name: "eth2"},
+		}, nil
+	}
+	interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) {
+		if iface.Name == "eth0" {
+			return []net.Addr{&net.IPNet{IP: net.ParseIP("192.0.2.1"), Mask: net.CIDRMask(24, 32)}}, nil
+		}
+		return nil, nil
+	}
+	interfaceCarrier = func(name string) bool { return name == "eth0" }
+	for _, permitted := range []bool{true, false} {
+		capturePermitted = func() bool { return permitted }
+		s := &Server{}
+		reply, err := s.InterfaceList(context.Background(), &api.InterfaceListRequest{All: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Interfaces) != 3 {
+			t.Fatalf("unexpected reply: %+v", reply)
+		}
+		eth0, eth1, eth2 := reply.Interfaces[0].Usability, reply.Interfaces[1].Usability, reply.Interfaces[2].Usability
+		if eth0.Usable != permitted || !eth0.Up || !eth0.Carrier || !eth0.HasAddresses || eth0.CapturePermitted != permitted {
+			t.Errorf("unexpected usability of eth0: %+v", eth0)
+		}
+		if eth1.Usable != permitted || !eth1.Up || eth1.Carrier || eth1.HasAddresses {
+			t.Errorf("unexpected usability of eth1: %+v", eth1)
+		}
+		if eth2.Usable || eth2.Up || eth2.Carrier || eth2.HasAddresses {
+			t.Errorf("unexpected usability of eth2: %+v", eth2)
+		}
+		var permission []string
+		if !permitted {
+			permission = []string{"server isn't permitted to capture (needs " + capturePrivileges + ")"}
+		}
+		for _, test := range []struct {
+			usability *api.CaptureUsability
+			reasons   []string
+		}{
+			{eth0, permission},
+			{eth1, append([]string{"no link detected (such as an unplugged cable)", "no IP addresses assigned"}, permission...)},
+			{eth2, append([]string{"interface is down", "no IP addresses assigned"}, permission...)},
+		} {
+			if !reflect.DeepEqual(test.usability.Reasons, test.reasons) {
+				t.Errorf("permitted %v: expected reasons %q, got %q", permitted, test.reasons, test.usability.Reasons)
+			}
+		}
+	}
+}
+
+func TestInterfaceListNamePattern(t *testing.T) {
+	defer func() { listInterfaces = net.Interfaces }()
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 1, Name: "lo", Flags: net.FlagUp},
+			{Index: 2, Name: "eth0", Flags: net.FlagUp},
+			{Index: 3, Name: "eth1"},
+		}, nil
+	}
+	s := &Server{}
+	for _, test := range []struct {
+		request  *api.InterfaceListRequest
+		expected []string
+	}{
+		{&api.InterfaceListRequest{NamePattern: "eth*"}, []string{"eth0"}},
+		{&api.InterfaceListRequest{NamePattern: "eth*", All: true}, []string{"eth0", "eth1"}},
+		{&api.InterfaceListRequest{All: true}, []string{"lo", "eth0", "eth1"}},
+		{&api.InterfaceListRequest{NamePattern: "wlan*"}, nil},
+	} {
+		reply, err := s.InterfaceList(context.Background(), test.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, iface := range reply.Interfaces {
+			names = append(names, iface.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") || reply.Total != 3 {
+			t.Errorf("%+v: expected %v of 3, got %v of %d", test.request, test.expected, names, reply.Total)
+		}
+	}
+	_, err := s.InterfaceList(context.Background(), &api.InterfaceListRequest{NamePattern: "eth["})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected an invalid pattern to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+)
+
+// newCaptureHeader builds the header that is sent to the client before any packet data, with
+// what the client needs to write the packets to a pcap file of its own.
+func newCaptureHeader(linkType layers.LinkType, snaplen int) *api.CaptureHeader {
+	return &api.CaptureHeader{
+		Snaplen:            uint32(snaplen),
+		Network:            uint32(linkType),
+		Clock:              captureClockStatus(),
+		TimestampPrecision: api.CaptureHeader_MICROSECONDS,
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"os"
+	"testing"
+)
+
+func TestLiveCaptureSendsHeaderOnceBeforePackets(t *testing.T) {
+	path := writePcapFile(t, [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	})
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	if err := (&Server{Config: offlineConfig()}).LiveCapture(&api.CaptureRequest{OfflineSource: path}, stream); err != nil {
+		t.Fatal(err)
+	}
+	header := stream.replies[0].GetHeader()
+	if header == nil {
+		t.Fatalf("expected a header first, got %+v", stream.replies[0])
+	}
+	if layers.LinkType(header.Network) != layers.LinkTypeEthernet || header.Snaplen != 65535 ||
+		header.TimestampPrecision != api.CaptureHeader_MICROSECONDS {
+		t.Errorf("unexpected header: %+v", header)
+	}
+	for i, reply := range stream.replies[1:] {
+		if reply.GetHeader() != nil {
+			t.Errorf("reply %d: unexpected second header", i+1)
+		}
+	}
+	if len(stream.packets()) != 2 {
+		t.Errorf("expected 2 packets after the header, got %d", len(stream.packets()))
+	}
+}
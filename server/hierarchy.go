@@ -0,0 +1,98 @@
+package server
+
+import (
+	"github.com/pcapme/pcap/api"
+	"sort"
+	"time"
+)
+
+// protocolHierarchy counts packets by the nesting of their protocol layers. Packet timestamps
+// are used as the clock for snapshots, so that offline captures behave the same as live ones.
+type protocolHierarchy struct {
+	interval     time.Duration
+	nextSnapshot time.Time
+	root         protocolNode
+}
+
+type protocolNode struct {
+	packets  uint64
+	bytes    uint64
+	children map[string]*protocolNode
+}
+
+func newProtocolHierarchy(interval time.Duration) *protocolHierarchy {
+	return &protocolHierarchy{interval: interval}
+}
+
+// add counts a packet with the given layers, outermost first.
+func (h *protocolHierarchy) add(layerNames []string, length int) {
+	node := &h.root
+	node.packets++
+	node.bytes += uint64(length)
+	for _, name := range layerNames {
+		child, ok := node.children[name]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*protocolNode)
+			}
+			child = &protocolNode{}
+			node.children[name] = child
+		}
+		child.packets++
+		child.bytes += uint64(length)
+		node = child
+	}
+}
+
+// snapshotDue returns true if a snapshot should be sent before a packet with the given timestamp
+// is counted. The first packet starts the clock.
+func (h *protocolHierarchy) snapshotDue(timestamp time.Time) bool {
+	if h.nextSnapshot.IsZero() {
+		h.nextSnapshot = timestamp.Add(h.interval)
+		return false
+	}
+	if timestamp.Before(h.nextSnapshot) {
+		return false
+	}
+	for !timestamp.Before(h.nextSnapshot) {
+		h.nextSnapshot = h.nextSnapshot.Add(h.interval)
+	}
+	return true
+}
+
+// snapshot returns the counts so far, with the protocols at each level sorted by name.
+func (h *protocolHierarchy) snapshot() *api.ProtocolHierarchy {
+	return &api.ProtocolHierarchy{
+		Packets:   h.root.packets,
+		Bytes:     h.root.bytes,
+		Protocols: h.root.counts(&h.root),
+	}
+}
+
+func (n *protocolNode) counts(root *protocolNode) []*api.ProtocolCount {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make([]*api.ProtocolCount, len(names))
+	for i, name := range names {
+		child := n.children[name]
+		counts[i] = &api.ProtocolCount{
+			Name:           name,
+			Packets:        child.packets,
+			Bytes:          child.bytes,
+			PacketsPercent: percent(child.packets, root.packets),
+			BytesPercent:   percent(child.bytes, root.bytes),
+			Children:       child.counts(root),
+		}
+	}
+	return counts
+}
+
+func percent(part, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcp4Fixture(t *testing.T) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP("192.0.2.1"),
+		DstIP:    net.ParseIP("192.0.2.2"),
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	return serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip, tcp)
+}
+
+// arpFixture is an ARP request. It is padded to the minimum Ethernet frame size, and the padding
+// decodes as a payload.
+func arpFixture(t *testing.T) []byte {
+	return serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       layers.EthernetBroadcast,
+			EthernetType: layers.EthernetTypeARP,
+		},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   []byte{0, 1, 2, 3, 4, 5},
+			SourceProtAddress: []byte{192, 0, 2, 1},
+			DstHwAddress:      []byte{0, 0, 0, 0, 0, 0},
+			DstProtAddress:    []byte{192, 0, 2, 2},
+		})
+}
+
+// renderHierarchy describes the counts as "name:packets" entries, with children in brackets.
+func renderHierarchy(counts []*api.ProtocolCount) string {
+	entries := make([]string, len(counts))
+	for i, count := range counts {
+		entries[i] = fmt.Sprintf("%s:%d", count.Name, count.Packets)
+		if len(count.Children) > 0 {
+			entries[i] += "[" + renderHierarchy(count.Children) + "]"
+		}
+	}
+	return strings.Join(entries, " ")
+}
+
+func TestLiveCaptureProtocolHierarchy(t *testing.T) {
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 2000),
+		tcp4Fixture(t),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 2000),
+		arpFixture(t),
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{Config: offlineConfig()}
+	request := &api.CaptureRequest{
+		OfflineSource:                        path,
+		ProtocolHierarchyIntervalNanoseconds: int64(2 * time.Second),
+	}
+	if err := s.LiveCapture(request, stream); err != nil {
+		t.Fatal(err)
+	}
+	var snapshots []*api.ProtocolHierarchy
+	for _, reply := range stream.replies {
+		if snapshot := reply.GetProtocolHierarchy(); snapshot != nil {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	// The packets are a second apart, so there is one periodic snapshot, and one at the end.
+	if len(snapshots) != 2 {
+		t.Fatalf("expected 2 snapshots, got %d", len(snapshots))
+	}
+	if rendered := renderHierarchy(snapshots[0].Protocols); rendered != "Ethernet:2[IPv4:2[TCP:1 UDP:1[Payload:1]]]" {
+		t.Errorf("unexpected periodic snapshot: %s", rendered)
+	}
+	final := snapshots[1]
+	expected := "Ethernet:4[ARP:1[Payload:1] IPv4:3[TCP:1 UDP:2[Payload:2]]]"
+	if rendered := renderHierarchy(final.Protocols); rendered != expected {
+		t.Errorf("expected %s, got %s", expected, rendered)
+	}
+	var bytes uint64
+	for _, data := range packets {
+		bytes += uint64(len(data))
+	}
+	if final.Packets != 4 || final.Bytes != bytes {
+		t.Errorf("expected 4 packets and %d bytes, got %d and %d", bytes, final.Packets, final.Bytes)
+	}
+	ethernet := final.Protocols[0]
+	if ethernet.PacketsPercent != 100 || ethernet.BytesPercent != 100 {
+		t.Errorf("expected every packet to be Ethernet: %+v", ethernet)
+	}
+	ipv4 := ethernet.Children[1]
+	if ipv4.PacketsPercent != 75 || ipv4.Bytes != bytes-uint64(len(packets[3])) {
+		t.Errorf("unexpected IPv4 counts: %+v", ipv4)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pcapme/pcap/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultHistoryLimit is the number of capture records retained if no limit is configured.
+const DefaultHistoryLimit = 1000
+
+// captureHistory holds the final statistics of completed captures. If a path is configured, the
+// records are also appended to that file as JSON (one record per line), so that they survive a
+// restart of the server.
+type captureHistory struct {
+	mu      sync.Mutex
+	path    string
+	limit   int
+	records []*api.CaptureRecord
+}
+
+// newCaptureHistory creates a history, loading any records previously saved to path.
+func newCaptureHistory(path string, limit int) (*captureHistory, error) {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	history := &captureHistory{path: path, limit: limit}
+	if len(path) == 0 {
+		return history, nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return history, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := &api.CaptureRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return history, err
+		}
+		history.records = append(history.records, record)
+	}
+	history.trim()
+	return history, scanner.Err()
+}
+
+// trim discards the oldest records beyond the limit. Returns true if any were discarded.
+func (h *captureHistory) trim() bool {
+	excess := len(h.records) - h.limit
+	if excess <= 0 {
+		return false
+	}
+	h.records = append(h.records[:0:0], h.records[excess:]...)
+	return true
+}
+
+// add records a completed capture.
+func (h *captureHistory) add(record *api.CaptureRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, record)
+	if len(h.path) == 0 {
+		h.trim()
+		return nil
+	}
+	if h.trim() {
+		return h.rewrite()
+	}
+	file, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// rewrite replaces the history file with the retained records.
+func (h *captureHistory) rewrite() error {
+	file, err := ioutil.TempFile(filepath.Dir(h.path), filepath.Base(h.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	writer := bufio.NewWriter(file)
+	for _, record := range h.records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), h.path)
+}
+
+// query returns up to limit of the most recent records started at or after sinceSeconds.
+func (h *captureHistory) query(limit int, sinceSeconds int64) []*api.CaptureRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := make([]*api.CaptureRecord, 0, len(h.records))
+	for _, record := range h.records {
+		if record.StartSeconds >= sinceSeconds {
+			result = append(result, record)
+		}
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"github.com/pcapme/pcap/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompletedCaptureAppearsInHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writePcapFile(t, [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	})
+	defer os.Remove(path)
+	config := Config{HistoryPath: filepath.Join(dir, "history.json"), OfflineDirectory: os.TempDir()}
+	s := NewServer(config)
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: path}, newFakeCaptureStream()); err != nil {
+		t.Fatal(err)
+	}
+	// Load the history into a new server, to ensure it was persisted.
+	reply, err := NewServer(config).CaptureHistory(context.Background(), &api.CaptureHistoryRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(reply.Records))
+	}
+	record := reply.Records[0]
+	if record.Interface != path || record.Packets != 2 || len(record.Error) != 0 {
+		t.Errorf("unexpected record: %+v", record)
+	}
+}
+
+func TestCaptureHistoryRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.json")
+	history, err := newCaptureHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := history.add(&api.CaptureRecord{StartSeconds: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloaded, err := newCaptureHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := reloaded.query(0, 0)
+	if len(records) != 2 || records[0].StartSeconds != 2 || records[1].StartSeconds != 3 {
+		t.Errorf("expected the two most recent records, got %+v", records)
+	}
+	if records := reloaded.query(0, 3); len(records) != 1 {
+		t.Errorf("expected 1 record since 3, got %d", len(records))
+	}
+}
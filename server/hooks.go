@@ -0,0 +1,53 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/pcapme/pcap/api"
+)
+
+// CaptureInfo identifies the capture a hook is being invoked for.
+type CaptureInfo struct {
+	Request *api.CaptureRequest
+	// The client that started the capture, if known.
+	Peer *api.PeerIdentity
+}
+
+// Hooks allow programs embedding the server to run custom logic (metrics, alerting, custom
+// sinks) at points of interest during a capture. Any hook may be left nil. Hooks are called
+// synchronously from the capture loop, so OnPacket in particular must return quickly; the data
+// passed to it is only valid for the duration of the call.
+type Hooks struct {
+	// OnCaptureStart is called once the capture handle has been activated, before any packets
+	// are read.
+	OnCaptureStart func(info *CaptureInfo)
+	// OnPacket is called for each packet read from the capture handle.
+	OnPacket func(info *CaptureInfo, data []byte, ci gopacket.CaptureInfo)
+	// OnDrop is called whenever packets are discarded rather than forwarded to the client.
+	OnDrop func(info *CaptureInfo, count uint64, reason string)
+	// OnCaptureEnd is called when the capture finishes; err is nil if it ended cleanly.
+	OnCaptureEnd func(info *CaptureInfo, err error)
+}
+
+func (h *Hooks) captureStart(info *CaptureInfo) {
+	if h != nil && h.OnCaptureStart != nil {
+		h.OnCaptureStart(info)
+	}
+}
+
+func (h *Hooks) packet(info *CaptureInfo, data []byte, ci gopacket.CaptureInfo) {
+	if h != nil && h.OnPacket != nil {
+		h.OnPacket(info, data, ci)
+	}
+}
+
+func (h *Hooks) drop(info *CaptureInfo, count uint64, reason string) {
+	if h != nil && h.OnDrop != nil {
+		h.OnDrop(info, count, reason)
+	}
+}
+
+func (h *Hooks) captureEnd(info *CaptureInfo, err error) {
+	if h != nil && h.OnCaptureEnd != nil {
+		h.OnCaptureEnd(info, err)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"time"
+)
+
+// How often to check whether an interface has come up.
+var interfaceUpPollInterval = 100 * time.Millisecond
+
+// interfaceIsUp can be replaced in tests. An interface that doesn't exist (yet) isn't up.
+var interfaceIsUp = func(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	return err == nil && iface.Flags&net.FlagUp != 0
+}
+
+// waitForInterfaceUp polls until the named interface is up, or the timeout expires. A zero timeout
+// doesn't wait at all.
+func waitForInterfaceUp(name string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for !interfaceIsUp(name) {
+		if time.Now().After(deadline) {
+			return status.Errorf(codes.DeadlineExceeded,
+				"interface %s was not up after waiting %v", name, timeout)
+		}
+		select {
+		case <-time.After(interfaceUpPollInterval):
+		case <-ShuttingDown:
+			return status.Errorf(codes.Unavailable, "server is shutting down")
+		}
+	}
+	return nil
+}
+
+// resolveInterfaceAddress selects the interface that owns the request's interface address,
+// returning a copy of the request with the interface named.
+func resolveInterfaceAddress(in *api.CaptureRequest) (*api.CaptureRequest, error) {
+	if len(in.InterfaceAddress) == 0 {
+		return in, nil
+	}
+	if len(in.Interface) > 0 || len(in.OfflineSource) > 0 {
+		return nil, status.Error(codes.InvalidArgument,
+			"an interface address can't be combined with an interface or offline source")
+	}
+	ip := net.ParseIP(in.InterfaceAddress)
+	if ip == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid interface address: %s", in.InterfaceAddress)
+	}
+	interfaces, err := listInterfaces()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to list interfaces: %v", err)
+	}
+	for _, iface := range interfaces {
+		addrs, err := interfaceAddrs(iface)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if owned, ok := addr.(*net.IPNet); ok && owned.IP.Equal(ip) {
+				resolved := proto.Clone(in).(*api.CaptureRequest)
+				resolved.Interface = iface.Name
+				resolved.InterfaceAddress = ""
+				return resolved, nil
+			}
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "no interface has the address %s", in.InterfaceAddress)
+}
+
+// captureUsability assesses whether an interface can usefully be captured on, explaining each
+// problem found so that clients can show why.
+func captureUsability(up, carrier, hasAddresses, permitted bool) *api.CaptureUsability {
+	usability := &api.CaptureUsability{
+		Usable:           up && permitted,
+		Up:               up,
+		Carrier:          carrier,
+		HasAddresses:     hasAddresses,
+		CapturePermitted: permitted,
+	}
+	if !up {
+		usability.Reasons = append(usability.Reasons, "interface is down")
+	} else if !carrier {
+		usability.Reasons = append(usability.Reasons, "no link detected (such as an unplugged cable)")
+	}
+	if !hasAddresses {
+		usability.Reasons = append(usability.Reasons, "no IP addresses assigned")
+	}
+	if !permitted {
+		usability.Reasons = append(usability.Reasons, "server isn't permitted to capture (needs "+capturePrivileges+")")
+	}
+	return usability
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func fakeInterfaceUp(upAfter int) (calls *int, restore func()) {
+	calls = new(int)
+	savedIsUp, savedInterval := interfaceIsUp, interfaceUpPollInterval
+	interfaceIsUp = func(name string) bool {
+		*calls++
+		return *calls > upAfter
+	}
+	interfaceUpPollInterval = time.Millisecond
+	return calls, func() {
+		interfaceIsUp, interfaceUpPollInterval = savedIsUp, savedInterval
+	}
+}
+
+func TestWaitForInterfaceUpTimesOut(t *testing.T) {
+	_, restore := fakeInterfaceUp(1 << 30)
+	defer restore()
+	err := waitForInterfaceUp("tun0", 10*time.Millisecond)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestLiveCaptureWaitsForInterfaceUp(t *testing.T) {
+	calls, restore := fakeInterfaceUp(3)
+	defer restore()
+	path := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(path)
+	defer func() { openLiveHandle = openLive }()
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		if !interfaceIsUp(in.Interface) {
+			t.Error("opened the capture before the interface was up")
+		}
+		handle, err := pcap.OpenOffline(path)
+		return handle, nil, err
+	}
+	stream := newFakeCaptureStream()
+	s := &Server{}
+	err := s.LiveCapture(&api.CaptureRequest{
+		Interface:                     "tun0",
+		WaitForInterfaceUpNanoseconds: int64(time.Second),
+	}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *calls < 4 {
+		t.Errorf("expected to poll until the interface was up, polled %d times", *calls)
+	}
+	if len(stream.packets()) != 1 {
+		t.Error("expected the capture to succeed once the interface was up")
+	}
+}
+
+func TestLiveCaptureSelectsInterfaceByAddress(t *testing.T) {
+	defer func() {
+		listInterfaces = net.Interfaces
+		interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) { return iface.Addrs() }
+	}()
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 1, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, Name: "eth1", Flags: net.FlagUp},
+		}, nil
+	}
+	interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) {
+		if iface.Name == "eth0" {
+			return []net.Addr{&net.IPNet{IP: net.IPv4(192, 0, 2, 1), Mask: net.CIDRMask(24, 32)}}, nil
+		}
+		return []net.Addr{
+			&net.IPNet{IP: net.IPv4(198, 51, 100, 1), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+		}, nil
+	}
+	path := writePcapFile(t, nil)
+	defer os.Remove(path)
+	defer func() { openLiveHandle = openLive }()
+	var opened string
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		opened = in.Interface
+		handle, err := pcap.OpenOffline(path)
+		return handle, nil, err
+	}
+	s := &Server{}
+	for address, expected := range map[string]string{"192.0.2.1": "eth0", "2001:db8::1": "eth1"} {
+		opened = ""
+		if err := s.LiveCapture(&api.CaptureRequest{InterfaceAddress: address}, newFakeCaptureStream()); err != nil {
+			t.Fatal(err)
+		}
+		if opened != expected {
+			t.Errorf("%s: expected a capture on %s, got %q", address, expected, opened)
+		}
+	}
+	err := s.LiveCapture(&api.CaptureRequest{InterfaceAddress: "203.0.113.1"}, newFakeCaptureStream())
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for an address no interface has, got %v", err)
+	}
+}
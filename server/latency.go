@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"hash/fnv"
+	"time"
+)
+
+// DefaultLatencyTableSize is the number of ingress packets remembered while waiting for them to
+// be seen on the egress interface, if the client doesn't specify a size.
+const DefaultLatencyTableSize = 65536
+
+type ingressPacket struct {
+	timestamp time.Time
+	slot      int
+}
+
+// latencyMatcher correlates packets captured on an ingress interface with the same packets
+// captured after being forwarded out an egress interface, in order to measure forwarding latency.
+// The table is bounded; once it is full, the oldest unmatched ingress packets are forgotten.
+type latencyMatcher struct {
+	ingress map[uint64]ingressPacket
+	order   []uint64
+	next    int
+}
+
+func newLatencyMatcher(size int) *latencyMatcher {
+	if size <= 0 {
+		size = DefaultLatencyTableSize
+	}
+	return &latencyMatcher{
+		ingress: make(map[uint64]ingressPacket, size),
+		order:   make([]uint64, 0, size),
+	}
+}
+
+// addIngress remembers when a packet was seen on the ingress interface.
+func (m *latencyMatcher) addIngress(key uint64, timestamp time.Time) {
+	if len(m.order) < cap(m.order) {
+		m.order = append(m.order, key)
+	} else {
+		evicted := m.order[m.next]
+		if packet, ok := m.ingress[evicted]; ok && packet.slot == m.next {
+			delete(m.ingress, evicted)
+		}
+		m.order[m.next] = key
+	}
+	m.ingress[key] = ingressPacket{timestamp: timestamp, slot: m.next}
+	m.next = (m.next + 1) % cap(m.order)
+}
+
+// matchEgress looks up the ingress packet corresponding to a packet seen on the egress interface,
+// returning the time it took to be forwarded.
+func (m *latencyMatcher) matchEgress(key uint64, timestamp time.Time) (time.Duration, bool) {
+	packet, ok := m.ingress[key]
+	if !ok {
+		return 0, false
+	}
+	delete(m.ingress, key)
+	return timestamp.Sub(packet.timestamp), true
+}
+
+// forwardingKey hashes the parts of an IP packet that don't change when it is routed: the link
+// layer header, TTL (or hop limit) and header checksum are excluded.
+func forwardingKey(data []byte, linkType layers.LinkType) (key uint64, ok bool) {
+	defer func() {
+		if recoverDecodePanic(recover()) {
+			key, ok = 0, false
+		}
+	}()
+	packet := gopacket.NewPacket(data, linkTypeDecoder(linkType), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	hash := fnv.New64a()
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		var fields [3]byte
+		binary.BigEndian.PutUint16(fields[0:2], ip.Id)
+		fields[2] = byte(ip.Protocol)
+		hash.Write(ip.SrcIP.To4())
+		hash.Write(ip.DstIP.To4())
+		hash.Write(fields[:])
+		hash.Write(ip.Payload)
+	case *layers.IPv6:
+		var fields [5]byte
+		binary.BigEndian.PutUint32(fields[0:4], ip.FlowLabel)
+		fields[4] = byte(ip.NextHeader)
+		hash.Write(ip.SrcIP.To16())
+		hash.Write(ip.DstIP.To16())
+		hash.Write(fields[:])
+		hash.Write(ip.Payload)
+	default:
+		return 0, false
+	}
+	return hash.Sum64(), true
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"net"
+	"testing"
+	"time"
+)
+
+// forwardedFixture returns a packet as it would look after being routed: new MAC addresses, a
+// decremented TTL, and a recomputed checksum.
+func forwardedFixture(t *testing.T, src, dst string, srcPort, dstPort int, ttl uint8) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		Id:       1234,
+		TTL:      ttl,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP(dst),
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort)}
+	udp.SetNetworkLayerForChecksum(ip)
+	return serializePacket(t,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, byte(ttl)},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 5, byte(ttl)},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip, udp, gopacket.Payload([]byte("payload")))
+}
+
+func TestEgressPacketReportsForwardingLatency(t *testing.T) {
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{EgressInterface: "eth1"}, stream, &Config{})
+	capture.linkType = layers.LinkTypeEthernet
+	capture.egressLinkType = layers.LinkTypeEthernet
+	ingress := forwardedFixture(t, "192.0.2.1", "198.51.100.1", 1000, 53, 64)
+	other := forwardedFixture(t, "192.0.2.2", "198.51.100.1", 1000, 53, 64)
+	egress := forwardedFixture(t, "192.0.2.1", "198.51.100.1", 1000, 53, 63)
+	unmatched := forwardedFixture(t, "192.0.2.3", "198.51.100.1", 1000, 53, 63)
+	base := time.Unix(1500000000, 0)
+	for i, data := range [][]byte{ingress, other} {
+		ci := gopacket.CaptureInfo{Timestamp: base.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(data), Length: len(data)}
+		if err := capture.queuePacket(&packetData{data: data, ci: ci}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, data := range [][]byte{unmatched, egress} {
+		ci := gopacket.CaptureInfo{Timestamp: base.Add(250 * time.Microsecond), CaptureLength: len(data), Length: len(data)}
+		if err := capture.queueEgressPacket(&packetData{data: data, ci: ci}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var summaries []*api.PacketSummary
+	for _, reply := range stream.replies {
+		if summary := reply.GetSummary(); summary != nil {
+			summaries = append(summaries, summary)
+		}
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("expected one matched egress packet, got %d", len(summaries))
+	}
+	latency, ok := summaries[0].OptionalForwardingLatency.(*api.PacketSummary_ForwardingLatencyNanoseconds)
+	if !ok || latency.ForwardingLatencyNanoseconds != int64(250*time.Microsecond) {
+		t.Errorf("unexpected latency: %+v", summaries[0].OptionalForwardingLatency)
+	}
+	if summaries[0].Source != "192.0.2.1" {
+		t.Errorf("unexpected summary: %+v", summaries[0])
+	}
+}
+
+func TestLatencyMatcherIsBounded(t *testing.T) {
+	matcher := newLatencyMatcher(2)
+	base := time.Unix(1500000000, 0)
+	for key := uint64(1); key <= 3; key++ {
+		matcher.addIngress(key, base)
+	}
+	if len(matcher.ingress) != 2 {
+		t.Errorf("expected 2 remembered packets, got %d", len(matcher.ingress))
+	}
+	if _, ok := matcher.matchEgress(1, base); ok {
+		t.Error("expected the oldest packet to be forgotten")
+	}
+	if _, ok := matcher.matchEgress(3, base); !ok {
+		t.Error("expected the newest packet to match")
+	}
+}
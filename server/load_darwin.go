@@ -0,0 +1,11 @@
+package server
+
+import (
+	"errors"
+)
+
+func newSystemLoadSource() LoadSource {
+	return func() (float64, error) {
+		return 0, errors.New("CPU load is not supported on this platform")
+	}
+}
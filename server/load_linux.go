@@ -0,0 +1,55 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// newSystemLoadSource returns a LoadSource that computes the CPU utilization between calls
+// from the aggregate counters in /proc/stat.
+func newSystemLoadSource() LoadSource {
+	var lastIdle, lastTotal uint64
+	return func() (float64, error) {
+		idle, total, err := readProcStat()
+		if err != nil {
+			return 0, err
+		}
+		deltaIdle, deltaTotal := idle-lastIdle, total-lastTotal
+		lastIdle, lastTotal = idle, total
+		if deltaTotal == 0 {
+			return 0, nil
+		}
+		return 1 - float64(deltaIdle)/float64(deltaTotal), nil
+	}
+}
+
+func readProcStat() (idle, total uint64, err error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return 0, 0, errors.New("unable to read /proc/stat")
+	}
+	fields := strings.Fields(scanner.Text())
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, errors.New("unexpected format in /proc/stat")
+	}
+	for i, field := range fields[1:] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		total += value
+		// The fourth and fifth values are idle and iowait time.
+		if i == 3 || i == 4 {
+			idle += value
+		}
+	}
+	return idle, total, nil
+}
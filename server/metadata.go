@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+	"log"
+	"net"
+	"time"
+)
+
+// Metadata records are big-endian, one per datagram:
+//
+//	offset  size  field
+//	0       2     record length in bytes, including this field
+//	2       1     IP version: 4, 6, or 0 if the packet isn't IP
+//	3       1     IP protocol: 6 (TCP), 17 (UDP), or 0 if neither
+//	4       8     timestamp, in nanoseconds since the Unix epoch
+//	12      4     original length of the packet
+//	16      4     captured length of the packet
+//	20      2     interface index (the packet's position in the capture's interfaces)
+//	22      2     source port
+//	24      2     destination port
+//	26      1     address length n: 4 for IPv4, 16 for IPv6, or 0
+//	27      n     source address
+//	27+n    n     destination address
+//
+// Fields may be added at the end in future; consumers should use the record length rather than
+// assuming it.
+const metadataHeaderLength = 27
+
+// metadataSink sends a compact metadata record for each packet to a Unix datagram socket, for
+// co-located consumers that want the flow of every packet without the overhead of gRPC. Sends
+// never block the capture: records the consumer isn't keeping up with are dropped, as are those
+// sent while it isn't listening, and are counted. If the consumer goes away, the sink reconnects
+// (at most once per reconnect interval).
+type metadataSink struct {
+	path              string
+	linkType          layers.LinkType
+	reconnectInterval time.Duration
+
+	conn        *net.UnixConn
+	lastAttempt time.Time
+	record      []byte
+
+	// Records sent, and those dropped.
+	sent    uint64
+	dropped uint64
+}
+
+func newMetadataSink(path string, linkType layers.LinkType, reconnectInterval time.Duration) *metadataSink {
+	if reconnectInterval <= 0 {
+		reconnectInterval = DefaultReconnectInterval
+	}
+	sink := &metadataSink{
+		path:              path,
+		linkType:          linkType,
+		reconnectInterval: reconnectInterval,
+		record:            make([]byte, 0, metadataHeaderLength+2*net.IPv6len),
+	}
+	sink.connect(time.Now())
+	return sink
+}
+
+// connect connects to the consumer's socket.
+func (s *metadataSink) connect(now time.Time) bool {
+	s.lastAttempt = now
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: s.path, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Unable to connect to metadata socket %s: %v", s.path, err)
+		return false
+	}
+	s.conn = conn
+	return true
+}
+
+func (s *metadataSink) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// encodeMetadata appends the metadata record describing a packet to record.
+func encodeMetadata(record []byte, ci gopacket.CaptureInfo, data []byte, linkType layers.LinkType) []byte {
+	summary := summarizePacket(data, ci, linkType)
+	var version, protocol uint8
+	var source, destination net.IP
+	switch summary.NetworkProtocol {
+	case layers.LayerTypeIPv4.String():
+		version = 4
+		source = net.ParseIP(summary.Source).To4()
+		destination = net.ParseIP(summary.Destination).To4()
+	case layers.LayerTypeIPv6.String():
+		version = 6
+		source = net.ParseIP(summary.Source).To16()
+		destination = net.ParseIP(summary.Destination).To16()
+	}
+	if len(source) != len(destination) {
+		source, destination = nil, nil
+	}
+	switch summary.TransportProtocol {
+	case layers.LayerTypeTCP.String():
+		protocol = uint8(layers.IPProtocolTCP)
+	case layers.LayerTypeUDP.String():
+		protocol = uint8(layers.IPProtocolUDP)
+	}
+	start := len(record)
+	record = append(record, 0, 0, version, protocol)
+	record = appendUint64(record, uint64(ci.Timestamp.UnixNano()))
+	record = appendUint32(record, uint32(ci.Length))
+	record = appendUint32(record, uint32(ci.CaptureLength))
+	record = appendUint16(record, uint16(ci.InterfaceIndex))
+	record = appendUint16(record, uint16(summary.SourcePort))
+	record = appendUint16(record, uint16(summary.DestinationPort))
+	record = append(record, uint8(len(source)))
+	record = append(record, source...)
+	record = append(record, destination...)
+	binary.BigEndian.PutUint16(record[start:], uint16(len(record)-start))
+	return record
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// send makes a single attempt to send the record, without waiting for room in the consumer's
+// receive queue.
+func (s *metadataSink) send(record []byte) error {
+	raw, err := s.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	err = raw.Write(func(fd uintptr) bool {
+		_, sendErr = unix.Write(int(fd), record)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+func (s *metadataSink) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	now := time.Now()
+	if s.conn == nil {
+		if now.Sub(s.lastAttempt) < s.reconnectInterval || !s.connect(now) {
+			s.dropped++
+			return nil
+		}
+	}
+	s.record = encodeMetadata(s.record[:0], ci, data, s.linkType)
+	switch err := s.send(s.record); err {
+	case nil:
+		s.sent++
+	case unix.EAGAIN, unix.ENOBUFS:
+		// The consumer isn't keeping up.
+		s.dropped++
+	default:
+		log.Printf("Lost connection to metadata socket %s: %v", s.path, err)
+		s.disconnect()
+		s.dropped++
+	}
+	return nil
+}
+
+func (s *metadataSink) Close() error {
+	if s.dropped > 0 {
+		log.Printf("%d of %d packet metadata records could not be sent to %s", s.dropped,
+			s.sent+s.dropped, s.path)
+	}
+	s.disconnect()
+	return nil
+}
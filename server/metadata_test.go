@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// metadataRecord is a decoded metadata record (see metadataSink).
+type metadataRecord struct {
+	version, protocol   uint8
+	timestamp           time.Time
+	length, captured    uint32
+	index               uint16
+	sourcePort, dstPort uint16
+	source, destination net.IP
+}
+
+func decodeMetadata(t *testing.T, record []byte) metadataRecord {
+	if len(record) < metadataHeaderLength || int(binary.BigEndian.Uint16(record)) != len(record) {
+		t.Fatalf("malformed record: %x", record)
+	}
+	n := int(record[26])
+	if len(record) != metadataHeaderLength+2*n {
+		t.Fatalf("unexpected record length %d for %d-byte addresses", len(record), n)
+	}
+	return metadataRecord{
+		version:     record[2],
+		protocol:    record[3],
+		timestamp:   time.Unix(0, int64(binary.BigEndian.Uint64(record[4:]))),
+		length:      binary.BigEndian.Uint32(record[12:]),
+		captured:    binary.BigEndian.Uint32(record[16:]),
+		index:       binary.BigEndian.Uint16(record[20:]),
+		sourcePort:  binary.BigEndian.Uint16(record[22:]),
+		dstPort:     binary.BigEndian.Uint16(record[24:]),
+		source:      net.IP(record[27 : 27+n]),
+		destination: net.IP(record[27+n:]),
+	}
+}
+
+// listenMetadata creates a Unix datagram socket in a temporary directory for a metadataSink to
+// send to.
+func listenMetadata(t *testing.T) (*net.UnixConn, string, func()) {
+	dir, err := ioutil.TempDir("", "pcap-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "metadata.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return conn, path, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLiveCaptureSendsMetadata(t *testing.T) {
+	conn, path, cleanup := listenMetadata(t)
+	defer cleanup()
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp6Fixture(t, 0),
+	}
+	input := writePcapFile(t, packets)
+	defer os.Remove(input)
+	s := NewServer(Config{OfflineDirectory: os.TempDir(), MetadataSocket: path})
+	stream := newFakeCaptureStream()
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: input, SendMetadata: true}, stream); err != nil {
+		t.Fatal(err)
+	}
+	sent := stream.packets()
+	if len(sent) != len(packets) {
+		t.Fatalf("expected %d packets, got %d", len(packets), len(sent))
+	}
+	expected := []metadataRecord{
+		{version: 4, protocol: 17, sourcePort: 1000, dstPort: 53,
+			source: net.ParseIP("192.0.2.1").To4(), destination: net.ParseIP("192.0.2.2").To4()},
+		{version: 6, protocol: 17, sourcePort: 5353, dstPort: 53,
+			source: net.ParseIP("2001:db8::1"), destination: net.ParseIP("2001:db8::2")},
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 1024)
+	for i, want := range expected {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := decodeMetadata(t, buffer[:n])
+		if got.version != want.version || got.protocol != want.protocol || got.index != 0 ||
+			got.sourcePort != want.sourcePort || got.dstPort != want.dstPort ||
+			!got.source.Equal(want.source) || !got.destination.Equal(want.destination) ||
+			len(got.source) != len(want.source) {
+			t.Errorf("%d: unexpected record: %+v", i, got)
+		}
+		if got.length != uint32(len(packets[i])) || got.captured != uint32(len(sent[i].Data)) {
+			t.Errorf("%d: unexpected lengths %d and %d", i, got.length, got.captured)
+		}
+		if ts := time.Unix(sent[i].Seconds, int64(sent[i].Microseconds)*1000); !got.timestamp.Equal(ts) {
+			t.Errorf("%d: expected timestamp %v, got %v", i, ts, got.timestamp)
+		}
+	}
+}
+
+func TestMetadataSinkDropsWhenConsumerLags(t *testing.T) {
+	conn, path, cleanup := listenMetadata(t)
+	defer cleanup()
+	sink := newMetadataSink(path, layers.LinkTypeEthernet, 0)
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	const written = 10000
+	start := time.Now()
+	for i := 0; i < written; i++ {
+		if err := sink.WritePacket(captureInfoFor(data), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected writes not to wait for the consumer, took %v", elapsed)
+	}
+	if sink.dropped == 0 || sink.sent+sink.dropped != written {
+		t.Errorf("expected records to be dropped, sent %d and dropped %d", sink.sent, sink.dropped)
+	}
+	sink.Close()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	received := uint64(0)
+	buffer := make([]byte, 1024)
+	for {
+		if _, err := conn.Read(buffer); err != nil {
+			break
+		}
+		received++
+	}
+	if received != sink.sent {
+		t.Errorf("expected the %d records sent to be received, got %d", sink.sent, received)
+	}
+}
+
+func TestMetadataSinkReconnects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.sock")
+	sink := newMetadataSink(path, layers.LinkTypeEthernet, time.Nanosecond)
+	defer sink.Close()
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	sink.WritePacket(captureInfoFor(data), data)
+	if sink.dropped != 1 {
+		t.Errorf("expected the record to be dropped while nothing is listening")
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink.WritePacket(captureInfoFor(data), data)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 1024)
+	if n, err := conn.Read(buffer); err != nil || decodeMetadata(t, buffer[:n]).sourcePort != 1000 {
+		t.Errorf("expected the record to be sent after reconnecting (%v)", err)
+	}
+}
+
+func TestLiveCaptureReportsDroppedMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	input := writePcapFile(t, [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1000, 53),
+	})
+	defer os.Remove(input)
+	// Nothing is listening, so every record is dropped.
+	s := NewServer(Config{OfflineDirectory: os.TempDir(), MetadataSocket: filepath.Join(dir, "metadata.sock")})
+	stream := newFakeCaptureStream()
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: input, SendMetadata: true}, stream); err != nil {
+		t.Fatal(err)
+	}
+	last := stream.replies[len(stream.replies)-1].GetStatus()
+	if last == nil || last.MetadataDroppedRecords != 2 {
+		t.Errorf("expected the final status to report 2 dropped records, got %+v", last)
+	}
+	if history := s.history.query(0, 0); len(history) != 1 || history[0].MetadataDroppedRecords != 2 {
+		t.Errorf("expected the record to report 2 dropped records, got %+v", history)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"strings"
+	"time"
+)
+
+// captureInterfaces returns the interfaces a live capture request names, in order and without
+// duplicates: its interface (if set), followed by its additional interfaces.
+func captureInterfaces(in *api.CaptureRequest) ([]string, error) {
+	if len(in.Interfaces) > 0 && len(in.OfflineSource) > 0 {
+		return nil, status.Error(codes.InvalidArgument,
+			"additional interfaces can't be combined with an offline source")
+	}
+	names := make([]string, 0, 1+len(in.Interfaces))
+	seen := make(map[string]bool)
+	for _, name := range append([]string{in.Interface}, in.Interfaces...) {
+		if len(name) == 0 || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// openInterface waits for the requested interface to come up (if asked to), then opens it.
+func openInterface(in *api.CaptureRequest, config *Config) (*pcap.Handle, []*api.PcapStatus, error) {
+	err := waitForInterfaceUp(in.Interface, time.Duration(in.WaitForInterfaceUpNanoseconds))
+	if err != nil {
+		return nil, nil, err
+	}
+	return openWithRetry(in, config)
+}
+
+// interfaceFailure tells the client that one of several requested interfaces couldn't be
+// captured.
+func interfaceFailure(name string, err error) *api.CaptureStatus {
+	log.Printf("%s: unable to capture: %v", name, err)
+	if s, ok := status.FromError(err); ok {
+		err = fmt.Errorf("%s", s.Message())
+	}
+	return &api.CaptureStatus{
+		Message:   fmt.Sprintf("%s: unable to capture: %v", name, err),
+		Interface: name,
+	}
+}
+
+// openFirstInterface opens the first of the request's interfaces that can be captured. It
+// returns a copy of the request naming that interface (with its defaults applied) as the
+// interface, and the rest as additional interfaces, along with statuses describing the interfaces
+// that failed before it. If none of the interfaces can be captured, all of the failures are
+// reported in the error.
+func openFirstInterface(in *api.CaptureRequest, config *Config) (*api.CaptureRequest, *pcap.Handle, []*api.PcapStatus, []*api.CaptureStatus, error) {
+	names, err := captureInterfaces(in)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if len(names) <= 1 {
+		in = config.applyInterfaceDefaults(in)
+		handle, warnings, err := openInterface(in, config)
+		return in, handle, warnings, nil, err
+	}
+	var failures []*api.CaptureStatus
+	var firstErr error
+	for i, name := range names {
+		candidate := proto.Clone(in).(*api.CaptureRequest)
+		candidate.Interface = name
+		candidate.Interfaces = names[i+1:]
+		candidate = config.applyInterfaceDefaults(candidate)
+		handle, warnings, err := openInterface(candidate, config)
+		if err == nil {
+			return candidate, handle, warnings, failures, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		failures = append(failures, interfaceFailure(name, err))
+	}
+	messages := make([]string, len(failures))
+	for i, failure := range failures {
+		messages[i] = failure.Message
+	}
+	return nil, nil, nil, nil, status.Errorf(status.Code(firstErr), "no interface could be captured: %s",
+		strings.Join(messages, "; "))
+}
+
+// openAdditionalInterfaces opens the capture's additional interfaces with the same options and
+// filter as its first, whose handle has the given link type and snaplen. Interfaces that can't
+// be captured, including those with a different link type (whose packets couldn't be decoded
+// alike), are returned as failures rather than failing the capture.
+func (c *liveCapture) openAdditionalInterfaces(linkType layers.LinkType, snaplen int) ([]*pcap.Handle, []*api.CaptureStatus) {
+	var handles []*pcap.Handle
+	var failures []*api.CaptureStatus
+	for _, name := range c.request.Interfaces {
+		in := proto.Clone(c.request).(*api.CaptureRequest)
+		in.Interface = name
+		in.Interfaces = nil
+		in.Snaplen = uint32(snaplen)
+		handle, warnings, err := openInterface(in, c.config)
+		if err == nil && handle.LinkType() != linkType {
+			err = fmt.Errorf("link type %v differs from %v on %s", handle.LinkType(), linkType,
+				c.request.Interface)
+			handle.Close()
+		}
+		if err == nil && len(c.filter) > 0 {
+			if err = handle.SetBPFFilter(c.filter); err != nil {
+				handle.Close()
+			}
+		}
+		if err != nil {
+			failures = append(failures, interfaceFailure(name, err))
+			continue
+		}
+		for _, warning := range warnings {
+			log.Printf("%s: %s", name, warning.Message)
+		}
+		handles = append(handles, handle)
+		c.interfaces = append(c.interfaces, name)
+	}
+	return handles, failures
+}
+
+// closeAdditionalInterfaces closes the handles of the capture's additional interfaces, once their
+// readers (if they were started) have exited (see closeAfterRead).
+func (c *liveCapture) closeAdditionalInterfaces(handles []*pcap.Handle, readers []<-chan struct{}) {
+	for i, handle := range handles {
+		var reader <-chan struct{}
+		if i < len(readers) {
+			reader = readers[i]
+		}
+		closeAfterRead(handle, reader)
+	}
+}
+
+// readInterfaces reads packets from the handles of the capture's additional interfaces into one
+// channel, until done is closed. Each packet's interface index is its interface's position in
+// the capture's interfaces (where the first is read from the capture handle). The channels
+// returned for each handle are closed once its reader has exited.
+func (c *liveCapture) readInterfaces(handles []*pcap.Handle, done <-chan bool) (<-chan *packetData, []<-chan struct{}) {
+	packets := make(chan *packetData)
+	readers := make([]<-chan struct{}, len(handles))
+	for i, handle := range handles {
+		compressor := c.packetCompressor()
+		finished := make(chan struct{})
+		readers[i] = finished
+		go sendPacketsFrom(handle, i+1, packets, done, finished, func(p *packetData) {
+			c.compressPacket(p, compressor)
+		})
+	}
+	return packets, readers
+}
+
+// handleInterfacePacket processes a packet read from one of the capture's additional interfaces.
+// If reading from the interface fails, the client is told, and the capture carries on with the
+// rest.
+func (c *liveCapture) handleInterfacePacket(p *packetData) (bool, error) {
+	if p.err != nil && p.err != pcap.NextErrorTimeoutExpired {
+		return false, c.stream.Send(&api.CaptureReply{
+			ReplyData: &api.CaptureReply_Status{Status: interfaceFailure(c.interfaces[p.ci.InterfaceIndex], p.err)},
+		})
+	}
+	return c.processPacket(p)
+}
+
+// interfaceName returns the interface a packet was captured on, if the capture has several.
+func (c *liveCapture) interfaceName(index int) string {
+	if len(c.interfaces) < 2 || index < 0 || index >= len(c.interfaces) {
+		return ""
+	}
+	return c.interfaces[index]
+}
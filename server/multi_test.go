@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// anyInterface, as a key of the packets given to fakeInterfaces, stands for every interface not
+// named otherwise.
+const anyInterface = "*"
+
+// fakeInterfaces makes live captures of each named interface deliver its packets, then simulate
+// an idle interface. Other interfaces don't exist, unless anyInterface is given. The returned
+// function restores live captures.
+func fakeInterfaces(t *testing.T, packets map[string][][]byte) func() {
+	inputs := make(map[string]string)
+	for name, interfacePackets := range packets {
+		inputs[name] = writePcapFile(t, interfacePackets)
+	}
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		input, ok := inputs[in.Interface]
+		if !ok {
+			input, ok = inputs[anyInterface]
+		}
+		if !ok {
+			return nil, nil, status.Errorf(codes.NotFound, "%s: No such device exists", in.Interface)
+		}
+		handle, err := pcap.OpenOffline(input)
+		return handle, nil, err
+	}
+	readPacketData = func(h *pcap.Handle) ([]byte, gopacket.CaptureInfo, error) {
+		data, ci, err := h.ReadPacketData()
+		if err == io.EOF {
+			time.Sleep(time.Millisecond)
+			return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+		}
+		return data, ci, err
+	}
+	return func() {
+		openLiveHandle = openLive
+		readPacketData = (*pcap.Handle).ReadPacketData
+		for _, input := range inputs {
+			os.Remove(input)
+		}
+	}
+}
+
+func TestCaptureInterfaces(t *testing.T) {
+	names, err := captureInterfaces(&api.CaptureRequest{Interface: "eth0", Interfaces: []string{"eth1", "eth0", "", "eth2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"eth0", "eth1", "eth2"}) {
+		t.Errorf("unexpected interfaces: %v", names)
+	}
+	names, _ = captureInterfaces(&api.CaptureRequest{Interfaces: []string{"eth1"}})
+	if !reflect.DeepEqual(names, []string{"eth1"}) {
+		t.Errorf("unexpected interfaces: %v", names)
+	}
+	_, err = captureInterfaces(&api.CaptureRequest{OfflineSource: "in.pcap", Interfaces: []string{"eth1"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected offline captures of several interfaces to be rejected, got %v", err)
+	}
+}
+
+func TestLiveCaptureMergesInterfaces(t *testing.T) {
+	eth0 := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	eth1 := [][]byte{
+		udp4Fixture(t, "198.51.100.1", "198.51.100.2", 1000, 53),
+		udp4Fixture(t, "198.51.100.3", "198.51.100.4", 1000, 53),
+	}
+	defer fakeInterfaces(t, map[string][][]byte{"eth0": {eth0}, "eth1": eth1})()
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeCaptureStream()
+	stream.ctx = ctx
+	result := make(chan error)
+	go func() {
+		s := &Server{}
+		result <- s.LiveCapture(&api.CaptureRequest{
+			Interface:  "bad0",
+			Interfaces: []string{"eth0", "bad1", "eth1"},
+		}, stream)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	stopCapture(t, cancel, result)
+	expectNoLeakedGoroutines(t, before)
+
+	header := stream.replies[0].GetHeader()
+	if header == nil {
+		t.Fatal("expected a header")
+	}
+	if !reflect.DeepEqual(header.Interfaces, []string{"eth0", "eth1"}) {
+		t.Errorf("unexpected interfaces: %v", header.Interfaces)
+	}
+	if !reflect.DeepEqual(header.FailedInterfaces, []string{"bad0", "bad1"}) {
+		t.Errorf("unexpected failed interfaces: %v", header.FailedInterfaces)
+	}
+	var failed []string
+	for _, reply := range stream.replies {
+		if s := reply.GetStatus(); s != nil && len(s.Interface) > 0 {
+			if !strings.Contains(s.Message, "No such device exists") {
+				t.Errorf("unexpected status: %s", s.Message)
+			}
+			failed = append(failed, s.Interface)
+		}
+	}
+	if !reflect.DeepEqual(failed, []string{"bad0", "bad1"}) {
+		t.Errorf("expected statuses for the failed interfaces, got %v", failed)
+	}
+	counts := make(map[string]int)
+	for _, packet := range stream.packets() {
+		counts[packet.Interface]++
+	}
+	if !reflect.DeepEqual(counts, map[string]int{"eth0": 1, "eth1": 2}) {
+		t.Errorf("unexpected packets per interface: %v", counts)
+	}
+}
+
+func TestLiveCaptureOfOneInterfaceIsUntagged(t *testing.T) {
+	defer fakeInterfaces(t, map[string][][]byte{"eth0": {udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)}})()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeCaptureStream()
+	stream.ctx = ctx
+	result := make(chan error)
+	go func() {
+		s := &Server{}
+		result <- s.LiveCapture(&api.CaptureRequest{Interface: "eth0"}, stream)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	stopCapture(t, cancel, result)
+	if header := stream.replies[0].GetHeader(); len(header.Interfaces) > 0 || len(header.FailedInterfaces) > 0 {
+		t.Errorf("unexpected interfaces in header: %v, %v", header.Interfaces, header.FailedInterfaces)
+	}
+	packets := stream.packets()
+	if len(packets) != 1 || len(packets[0].Interface) > 0 {
+		t.Errorf("expected one untagged packet, got %v", packets)
+	}
+}
+
+func TestLiveCaptureFailsIfNoInterfaceCanBeCaptured(t *testing.T) {
+	defer fakeInterfaces(t, nil)()
+	s := &Server{}
+	err := s.LiveCapture(&api.CaptureRequest{Interface: "bad0", Interfaces: []string{"bad1"}}, newFakeCaptureStream())
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	for _, name := range []string{"bad0", "bad1"} {
+		if !strings.Contains(err.Error(), name+": unable to capture") {
+			t.Errorf("expected %s to be reported, got %v", name, err)
+		}
+	}
+}
+
+// fakeBusyInterfaces fakes a capture of eth0 and the busy interfaces, which always have another
+// packet ready. eth0 is read with idleRead.
+func fakeBusyInterfaces(t *testing.T, busyInterfaces []string, idleRead func(*pcap.Handle) ([]byte, gopacket.CaptureInfo, error)) func() {
+	busy := udp4Fixture(t, "198.51.100.1", "198.51.100.2", 1000, 53)
+	fakes := map[string][][]byte{"eth0": nil}
+	for _, name := range busyInterfaces {
+		fakes[name] = nil
+	}
+	restore := fakeInterfaces(t, fakes)
+	var first atomic.Value
+	open := openLiveHandle
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		handle, warnings, err := open(in)
+		if in.Interface == "eth0" {
+			first.Store(handle)
+		}
+		return handle, warnings, err
+	}
+	readPacketData = func(h *pcap.Handle) ([]byte, gopacket.CaptureInfo, error) {
+		if h == first.Load() {
+			return idleRead(h)
+		}
+		return busy, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(busy), Length: len(busy)}, nil
+	}
+	return restore
+}
+
+func TestBusyInterfacesDoNotStarveFirst(t *testing.T) {
+	first := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	busyInterfaces := []string{"eth1", "eth2", "eth3", "eth4"}
+	// eth0 is as busy as the others.
+	defer fakeBusyInterfaces(t, busyInterfaces, func(*pcap.Handle) ([]byte, gopacket.CaptureInfo, error) {
+		return first, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(first), Length: len(first)}, nil
+	})()
+	stream := newFakeCaptureStream()
+	in := &api.CaptureRequest{Interface: "eth0", Interfaces: busyInterfaces, MaxPackets: 500}
+	if err := (&Server{}).LiveCapture(in, stream); err != nil {
+		t.Fatal(err)
+	}
+	var fromFirst int
+	for _, packet := range stream.packets() {
+		if packet.Interface == "eth0" {
+			fromFirst++
+		}
+	}
+	// Each of the 5 interfaces should get around a fifth of the packets.
+	if fromFirst < 50 {
+		t.Errorf("expected eth0 to get its share of the 500 packets, but it got %d", fromFirst)
+	}
+}
+
+func TestQuietFirstInterfaceDoesNotLimitOthers(t *testing.T) {
+	busyInterfaces := []string{"eth1"}
+	// eth0 is idle, so each of its reads waits out the default buffer timeout.
+	defer fakeBusyInterfaces(t, busyInterfaces, func(*pcap.Handle) ([]byte, gopacket.CaptureInfo, error) {
+		time.Sleep(DefaultBufferTimeout)
+		return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+	})()
+	stream := newFakeCaptureStream()
+	in := &api.CaptureRequest{Interface: "eth0", Interfaces: busyInterfaces, MaxPackets: 1000}
+	start := time.Now()
+	if err := (&Server{}).LiveCapture(in, stream); err != nil {
+		t.Fatal(err)
+	}
+	// Reading eth0 between each of eth1's packets would take 10 seconds.
+	elapsed := time.Since(start)
+	if rate := float64(len(stream.packets())) / elapsed.Seconds(); rate < 2000 {
+		t.Errorf("expected eth1's packets to be captured as they arrive, got %.0f packets per second", rate)
+	}
+}
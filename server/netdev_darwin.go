@@ -0,0 +1,18 @@
+package server
+
+import "golang.org/x/sys/unix"
+
+// Virtual interfaces can't be told apart from hardware ones on this platform.
+func isVirtualInterface(name string) bool {
+	return false
+}
+
+// Carrier detection isn't supported on this platform; interfaces are assumed to have a link.
+func hasCarrier(name string) bool {
+	return true
+}
+
+// canCapture returns true if the server can open the BPF devices captures are read from.
+func canCapture() bool {
+	return unix.Access("/dev/bpf0", unix.R_OK) == nil
+}
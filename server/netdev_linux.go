@@ -0,0 +1,46 @@
+package server
+
+import (
+	"bufio"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// isVirtualInterface returns true if the named interface isn't backed by a hardware device, which
+// sysfs links to from each interface that is.
+func isVirtualInterface(name string) bool {
+	_, err := os.Stat(filepath.Join("/sys/class/net", name, "device"))
+	return os.IsNotExist(err)
+}
+
+// hasCarrier returns true if the named interface detects a link. sysfs can't tell while the
+// interface is down, so it is reported as having none.
+func hasCarrier(name string) bool {
+	carrier, err := ioutil.ReadFile(filepath.Join("/sys/class/net", name, "carrier"))
+	return err == nil && strings.TrimSpace(string(carrier)) == "1"
+}
+
+// canCapture returns true if the server runs as root, or has the CAP_NET_RAW capability that
+// opening capture sockets needs.
+func canCapture() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "CapEff:" {
+			capabilities, err := strconv.ParseUint(fields[1], 16, 64)
+			return err == nil && capabilities&(1<<unix.CAP_NET_RAW) != 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// openOffline opens a saved capture for reading. The source may be the path to a pcap file
+// within the configured OfflineDirectory (relative to it, or absolute), or, if the server allows
+// it, "-" for the server's standard input or "fd:N" to read from an already-open file descriptor
+// (such as a pipe from another capture tool). Files that don't exist, or that can't be read as
+// saved captures, are reported as gRPC errors saying so.
+func openOffline(source string, config *Config) (*pcap.Handle, error) {
+	switch {
+	case source == "-":
+		if !config.AllowOfflineDescriptors {
+			return nil, status.Error(codes.PermissionDenied, "reading offline sources from standard input is not enabled on this server")
+		}
+		return openOfflineDescriptor(0, source)
+	case strings.HasPrefix(source, "fd:"):
+		if !config.AllowOfflineDescriptors {
+			return nil, status.Error(codes.PermissionDenied, "reading offline sources from file descriptors is not enabled on this server")
+		}
+		fd, err := strconv.Atoi(strings.TrimPrefix(source, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid file descriptor: %s", source)
+		}
+		return openOfflineDescriptor(fd, source)
+	default:
+		path, err := offlinePath(config.OfflineDirectory, source)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "offline source %s doesn't exist", source)
+		} else if os.IsPermission(err) {
+			return nil, status.Errorf(codes.PermissionDenied, "offline source %s can't be read: %v", source, err)
+		}
+		handle, err := pcap.OpenOffline(path)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "offline source %s isn't a readable capture: %v", source, err)
+		}
+		return handle, nil
+	}
+}
+
+// openOfflineDescriptor reads a saved capture from one of the server's descriptors, leaving the
+// descriptor open. libpcap closes the descriptor it reads from when its handle is closed, so the
+// descriptor is duplicated, and libpcap opens the duplicate (through /dev/fd) as a descriptor of
+// its own. The duplicate is closed once the handle is open.
+func openOfflineDescriptor(fd int, source string) (*pcap.Handle, error) {
+	dup, err := unix.Dup(fd)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "offline source %s can't be read: %v", source, err)
+	}
+	defer unix.Close(dup)
+	handle, err := pcap.OpenOffline(fmt.Sprintf("/dev/fd/%d", dup))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "offline source %s isn't a readable capture: %v", source, err)
+	}
+	return handle, nil
+}
+
+// offlinePath returns the file an offline source names, provided it is within the directory once
+// any symbolic links are resolved.
+func offlinePath(directory string, name string) (string, error) {
+	if len(directory) == 0 {
+		return "", status.Error(codes.PermissionDenied, "reading offline sources from files is not enabled on this server")
+	}
+	root, err := filepath.EvalSymlinks(directory)
+	if err != nil {
+		return "", status.Errorf(codes.FailedPrecondition, "offline directory %s can't be used: %v", directory, err)
+	}
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(directory, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// The file may not exist; if its directory does, the file is reported missing below.
+		dir, dirErr := filepath.EvalSymlinks(filepath.Dir(path))
+		if dirErr != nil {
+			dir = filepath.Dir(filepath.Clean(path))
+		}
+		resolved = filepath.Join(dir, filepath.Base(path))
+	}
+	if !strings.HasPrefix(resolved, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+		return "", status.Errorf(codes.PermissionDenied, "offline source %s is outside the server's offline directory", name)
+	}
+	return resolved, nil
+}
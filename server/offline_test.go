@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pcapme/pcap/api"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePcapFixture writes the given packets to w as a pcap stream.
+func writePcapFixture(t *testing.T, w io.Writer, packets [][]byte) {
+	writer := pcapgo.NewWriter(w)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Error(err)
+		return
+	}
+	base := time.Unix(1500000000, 0)
+	for i, data := range packets {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     base.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		if err := writer.WritePacket(ci, data); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestOpenOfflineFromPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	}
+	go func() {
+		defer w.Close()
+		writePcapFixture(t, w, packets)
+	}()
+	config := &Config{AllowOfflineDescriptors: true}
+	handle, err := openOffline(fmt.Sprintf("fd:%d", r.Fd()), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	for i, expected := range packets {
+		data, _, err := handle.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("packet %d: data mismatch", i)
+		}
+	}
+	if _, _, err := handle.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	handle.Close()
+	// The descriptor named is left open.
+	if _, err := unix.FcntlInt(r.Fd(), unix.F_GETFD, 0); err != nil {
+		t.Errorf("expected the descriptor to stay open: %v", err)
+	}
+}
+
+func TestOpenOfflineInvalidDescriptor(t *testing.T) {
+	if _, err := openOffline("fd:bogus", &Config{AllowOfflineDescriptors: true}); err == nil {
+		t.Error("expected an error for an invalid file descriptor")
+	}
+}
+
+func TestOpenOfflineDescriptorsNeedOptIn(t *testing.T) {
+	for _, source := range []string{"-", "fd:0"} {
+		if _, err := openOffline(source, &Config{}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: expected PermissionDenied, got %v", source, err)
+		}
+	}
+}
+
+func TestOpenOfflineConfinesFilesToDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(outside)
+	inside := filepath.Join(dir, "in.pcap")
+	if err := os.Link(outside, inside); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link.pcap")); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{OfflineDirectory: dir}
+	for _, source := range []string{"in.pcap", inside} {
+		handle, err := openOffline(source, config)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		handle.Close()
+	}
+	for _, source := range []string{outside, "../" + filepath.Base(outside), "link.pcap"} {
+		if _, err := openOffline(source, config); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: expected PermissionDenied, got %v", source, err)
+		}
+	}
+	if _, err := openOffline("missing.pcap", config); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for a missing file, got %v", err)
+	}
+	if _, err := openOffline(inside, &Config{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected files to be refused without an offline directory, got %v", err)
+	}
+}
+
+// offlineConfig allows offline sources from the directory writePcapFile writes to.
+func offlineConfig() Config {
+	return Config{OfflineDirectory: os.TempDir()}
+}
+
+// writePcapFile writes the given packets to a temporary pcap file, returning its path.
+func writePcapFile(t *testing.T, packets [][]byte) string {
+	file, err := ioutil.TempFile("", "pcap-test-*.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writePcapFixture(t, file, packets)
+	return file.Name()
+}
+
+func TestLiveCaptureOfflineSource(t *testing.T) {
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{Config: offlineConfig()}
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: path}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.replies) == 0 || stream.replies[0].GetHeader() == nil {
+		t.Fatal("expected a header before any packets")
+	}
+	received := stream.packets()
+	if len(received) != len(packets) {
+		t.Fatalf("expected %d packets, got %d", len(packets), len(received))
+	}
+	for i := range packets {
+		if !bytes.Equal(received[i].Data, packets[i]) {
+			t.Errorf("packet %d: data mismatch", i)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pcapme/pcap/api"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OTLPConfig enables exporting capture metrics and events to an OpenTelemetry collector, using
+// the OTLP/HTTP protocol with JSON encoding.
+type OTLPConfig struct {
+	// Endpoint is the base URL of the collector, such as "http://localhost:4318". Metrics and
+	// logs are posted to the standard /v1/metrics and /v1/logs paths beneath it.
+	Endpoint string
+
+	// ResourceAttributes describe this server, such as "host.name" or "deployment.environment".
+	// The "service.name" attribute defaults to "pcapd".
+	ResourceAttributes map[string]string
+
+	// Timeout limits each export request (DefaultOTLPTimeout, if zero).
+	Timeout time.Duration
+
+	// Interval is how often the counters of running captures are exported (DefaultOTLPInterval,
+	// if zero). They are exported once more when each capture ends.
+	Interval time.Duration
+}
+
+// DefaultOTLPTimeout is how long an export to the collector may take, if not configured.
+const DefaultOTLPTimeout = 10 * time.Second
+
+// DefaultOTLPInterval is how often the counters of running captures are exported, if not
+// configured.
+const DefaultOTLPInterval = time.Minute
+
+// otlpQueueLength is how many exports may wait to be posted to the collector. Exports beyond it
+// are dropped, so that a slow collector can't accumulate them without bound.
+const otlpQueueLength = 256
+
+const otlpScope = "github.com/pcapme/pcap"
+
+// The OTLP JSON encoding of the messages exported. 64-bit integers are encoded as strings.
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeInfo struct {
+	Name string `json:"name"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otlpSum struct {
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Unit        string  `json:"unit"`
+	Sum         otlpSum `json:"sum"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScopeInfo `json:"scope"`
+	Metrics []otlpMetric  `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScopeInfo   `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+// Severity numbers defined by the OpenTelemetry log data model.
+const (
+	otlpSeverityInfo = 9
+	otlpSeverityWarn = 13
+)
+
+// aggregationTemporalityCumulative marks a sum as the running total since the start time.
+const aggregationTemporalityCumulative = 2
+
+// otlpExport is a request waiting to be posted to the collector.
+type otlpExport struct {
+	path    string
+	request interface{}
+}
+
+// otlpExporter posts metrics and events to a collector. Exports are posted one at a time by a
+// goroutine of its own, through a bounded queue, so that a slow or unreachable collector doesn't
+// hold up captures; failures, and exports dropped because the queue was full, are logged.
+type otlpExporter struct {
+	endpoint string
+	resource otlpResource
+	client   *http.Client
+	interval time.Duration
+	queue    chan otlpExport
+
+	// Exports dropped since the last one posted, updated atomically.
+	dropped uint64
+}
+
+// newOTLPExporter returns an exporter for the configuration, or nil if exporting is disabled.
+func newOTLPExporter(config *OTLPConfig) *otlpExporter {
+	if config == nil || len(config.Endpoint) == 0 {
+		return nil
+	}
+	attributes := map[string]string{"service.name": "pcapd"}
+	for key, value := range config.ResourceAttributes {
+		attributes[key] = value
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultOTLPTimeout
+	}
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultOTLPInterval
+	}
+	e := &otlpExporter{
+		endpoint: strings.TrimSuffix(config.Endpoint, "/"),
+		resource: otlpResource{Attributes: otlpAttributes(attributes)},
+		client:   &http.Client{Timeout: timeout},
+		interval: interval,
+		queue:    make(chan otlpExport, otlpQueueLength),
+	}
+	go e.run()
+	return e
+}
+
+// run posts the queued exports for the lifetime of the server.
+func (e *otlpExporter) run() {
+	for export := range e.queue {
+		if dropped := atomic.SwapUint64(&e.dropped, 0); dropped > 0 {
+			log.Printf("%d exports to the OTLP collector were dropped while it was slow", dropped)
+		}
+		e.post(export.path, export.request)
+	}
+}
+
+// enqueue queues a request to be posted to the collector, dropping it if the queue is full.
+func (e *otlpExporter) enqueue(path string, request interface{}) {
+	select {
+	case e.queue <- otlpExport{path: path, request: request}:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+// otlpAttributes converts attributes to OTLP key-values, sorted by key.
+func otlpAttributes(attributes map[string]string) []otlpKeyValue {
+	keyValues := make([]otlpKeyValue, 0, len(attributes))
+	for key, value := range attributes {
+		keyValues = append(keyValues, otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}})
+	}
+	sort.Slice(keyValues, func(i, j int) bool { return keyValues[i].Key < keyValues[j].Key })
+	return keyValues
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// captureAttributes identify a capture in its metrics and events.
+func captureAttributes(capture *liveCapture) []otlpKeyValue {
+	source := capture.request.Interface
+	if len(capture.request.OfflineSource) > 0 {
+		source = capture.request.OfflineSource
+	}
+	return otlpAttributes(map[string]string{
+		"pcap.capture.id": strconv.FormatUint(capture.id, 10),
+		"pcap.interface":  source,
+		"pcap.filter":     capture.filter,
+	})
+}
+
+// event exports a notable event during a capture as a log record.
+func (e *otlpExporter) event(capture *liveCapture, message string, warning bool) {
+	if e == nil {
+		return
+	}
+	record := otlpLogRecord{
+		TimeUnixNano:   otlpTime(time.Now()),
+		SeverityNumber: otlpSeverityInfo,
+		SeverityText:   "INFO",
+		Body:           otlpAnyValue{StringValue: message},
+		Attributes:     captureAttributes(capture),
+	}
+	if warning {
+		record.SeverityNumber = otlpSeverityWarn
+		record.SeverityText = "WARN"
+	}
+	request := otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: e.resource,
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScopeInfo{Name: otlpScope},
+			LogRecords: []otlpLogRecord{record},
+		}},
+	}}}
+	e.enqueue("/v1/logs", request)
+}
+
+// captureRunning exports the counters of a running capture, if the interval has passed since
+// they were last exported. It's called from the capture loop, which owns the counters.
+func (e *otlpExporter) captureRunning(capture *liveCapture, now time.Time) {
+	if e == nil {
+		return
+	}
+	last := capture.otlpExported
+	if last.IsZero() {
+		last = capture.started
+	}
+	if now.Sub(last) < e.interval {
+		return
+	}
+	capture.otlpExported = now
+	e.captureEnded(capture, capture.record(nil))
+}
+
+// captureEnded exports the counters of a capture as metrics; those of a running capture are the
+// totals so far.
+func (e *otlpExporter) captureEnded(capture *liveCapture, record *api.CaptureRecord) {
+	if e == nil {
+		return
+	}
+	attributes := captureAttributes(capture)
+	start := otlpTime(capture.started)
+	now := otlpTime(time.Now())
+	sum := func(name string, description string, unit string, value uint64) otlpMetric {
+		return otlpMetric{
+			Name:        name,
+			Description: description,
+			Unit:        unit,
+			Sum: otlpSum{
+				AggregationTemporality: aggregationTemporalityCumulative,
+				IsMonotonic:            true,
+				DataPoints: []otlpNumberDataPoint{{
+					Attributes:        attributes,
+					StartTimeUnixNano: start,
+					TimeUnixNano:      now,
+					AsInt:             strconv.FormatUint(value, 10),
+				}},
+			},
+		}
+	}
+	request := otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: e.resource,
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScopeInfo{Name: otlpScope},
+			Metrics: []otlpMetric{
+				sum("pcap.capture.packets", "Packets captured", "{packet}", record.Packets),
+				sum("pcap.capture.bytes", "Bytes captured", "By", record.Bytes),
+				sum("pcap.capture.dropped_packets", "Packets dropped by the kernel", "{packet}", record.DroppedPackets),
+				sum("pcap.capture.throttled_packets", "Packets not forwarded due to adaptive throttling",
+					"{packet}", record.ThrottledPackets),
+			},
+		}},
+	}}}
+	e.enqueue("/v1/metrics", request)
+}
+
+func (e *otlpExporter) post(path string, request interface{}) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		log.Printf("Error encoding OTLP export: %v", err)
+		return
+	}
+	response, err := e.client.Post(e.endpoint+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error exporting to OTLP collector: %v", err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		log.Printf("Error exporting to OTLP collector: %s returned %s", path, response.Status)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pcapme/pcap/api"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// otlpReceiver is a mock OpenTelemetry collector, which decodes the requests posted to it. Requests
+// beyond the first ten that haven't been received are discarded.
+type otlpReceiver struct {
+	metrics chan otlpMetricsRequest
+	logs    chan otlpLogsRequest
+}
+
+func newOTLPReceiver(t *testing.T) (*otlpReceiver, *httptest.Server) {
+	receiver := &otlpReceiver{metrics: make(chan otlpMetricsRequest, 10), logs: make(chan otlpLogsRequest, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/metrics":
+			var request otlpMetricsRequest
+			err = json.Unmarshal(body, &request)
+			select {
+			case receiver.metrics <- request:
+			default:
+			}
+		case "/v1/logs":
+			var request otlpLogsRequest
+			err = json.Unmarshal(body, &request)
+			select {
+			case receiver.logs <- request:
+			default:
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: %v", r.URL.Path, err)
+		}
+	}))
+	return receiver, server
+}
+
+func attributeValue(attributes []otlpKeyValue, key string) string {
+	for _, attribute := range attributes {
+		if attribute.Key == key {
+			return attribute.Value.StringValue
+		}
+	}
+	return ""
+}
+
+func TestOTLPExportsCaptureMetrics(t *testing.T) {
+	receiver, collector := newOTLPReceiver(t)
+	defer collector.Close()
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	s := NewServer(Config{OfflineDirectory: os.TempDir(), OTLP: &OTLPConfig{
+		Endpoint:           collector.URL + "/",
+		ResourceAttributes: map[string]string{"host.name": "probe1"},
+	}})
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: path}, newFakeCaptureStream()); err != nil {
+		t.Fatal(err)
+	}
+	var request otlpMetricsRequest
+	select {
+	case request = <-receiver.metrics:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics were exported")
+	}
+	if len(request.ResourceMetrics) != 1 || len(request.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("unexpected request: %+v", request)
+	}
+	resource := request.ResourceMetrics[0].Resource.Attributes
+	if attributeValue(resource, "host.name") != "probe1" || attributeValue(resource, "service.name") != "pcapd" {
+		t.Errorf("unexpected resource attributes: %+v", resource)
+	}
+	values := make(map[string]string)
+	for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		if len(metric.Sum.DataPoints) != 1 || !metric.Sum.IsMonotonic {
+			t.Fatalf("%s: unexpected sum: %+v", metric.Name, metric.Sum)
+		}
+		point := metric.Sum.DataPoints[0]
+		if attributeValue(point.Attributes, "pcap.interface") != path {
+			t.Errorf("%s: unexpected attributes: %+v", metric.Name, point.Attributes)
+		}
+		values[metric.Name] = point.AsInt
+	}
+	if values["pcap.capture.packets"] != "2" || values["pcap.capture.dropped_packets"] != "0" ||
+		values["pcap.capture.throttled_packets"] != "0" ||
+		values["pcap.capture.bytes"] != strconv.Itoa(len(packets[0])+len(packets[1])) {
+		t.Errorf("unexpected metrics: %v", values)
+	}
+	events := make(map[string]bool)
+	for len(events) < 2 {
+		select {
+		case request := <-receiver.logs:
+			for _, record := range request.ResourceLogs[0].ScopeLogs[0].LogRecords {
+				events[record.Body.StringValue] = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected start and end events, got %v", events)
+		}
+	}
+	if !events["capture started"] || !events["capture ended"] {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
+
+func TestOTLPDisabledWithoutEndpoint(t *testing.T) {
+	if newOTLPExporter(nil) != nil || newOTLPExporter(&OTLPConfig{}) != nil {
+		t.Error("expected exporting to be disabled")
+	}
+}
+
+// metricValues maps the names of the metrics in a request to their values.
+func metricValues(request otlpMetricsRequest) map[string]string {
+	values := make(map[string]string)
+	for _, resourceMetrics := range request.ResourceMetrics {
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			for _, metric := range scopeMetrics.Metrics {
+				for _, point := range metric.Sum.DataPoints {
+					values[metric.Name] = point.AsInt
+				}
+			}
+		}
+	}
+	return values
+}
+
+func TestOTLPExportsRunningCaptureMetrics(t *testing.T) {
+	defer fakeIdleInterface(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})()
+	receiver, collector := newOTLPReceiver(t)
+	defer collector.Close()
+	s := NewServer(Config{OTLP: &OTLPConfig{Endpoint: collector.URL, Interval: 20 * time.Millisecond}})
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeCaptureStream()
+	stream.ctx = ctx
+	result := make(chan error)
+	go func() {
+		result <- s.LiveCapture(&api.CaptureRequest{Interface: "eth0"}, stream)
+	}()
+	defer stopCapture(t, cancel, result)
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case request := <-receiver.metrics:
+			if values := metricValues(request); values["pcap.capture.packets"] == "1" {
+				return
+			}
+		case <-result:
+			t.Fatal("the capture ended")
+		case <-deadline:
+			t.Fatal("no metrics were exported while the capture was running")
+		}
+	}
+}
+
+func TestOTLPDropsExportsWhenCollectorIsSlow(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer collector.Close()
+	defer close(release)
+	e := newOTLPExporter(&OTLPConfig{Endpoint: collector.URL})
+	capture := newLiveCapture(&api.CaptureRequest{Interface: "eth0"}, newFakeCaptureStream(), &Config{})
+	e.event(capture, "capture started", false)
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was exported")
+	}
+	// The first export is in progress, so the rest wait in the queue, until it's full.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < otlpQueueLength+3; i++ {
+			e.event(capture, "throttled", true)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exporting waited for the collector")
+	}
+	if dropped := atomic.LoadUint64(&e.dropped); dropped != 3 {
+		t.Errorf("expected 3 exports to be dropped, got %d", dropped)
+	}
+}
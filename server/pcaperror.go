@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"reflect"
+	"regexp"
+)
+
+// Return codes from pcap_activate(), as defined in pcap/pcap.h.
+const (
+	pcapWarning                    = 1
+	pcapWarningPromiscNotSupported = 2
+	pcapWarningTstampTypeNotSup    = 3
+	pcapError                      = -1
+	pcapErrorActivated             = -4
+	pcapErrorNoSuchDevice          = -5
+	pcapErrorRFMonNotSupported     = -6
+	pcapErrorPermDenied            = -8
+	pcapErrorIfaceNotUp            = -9
+	pcapErrorPromiscPermDenied     = -11
+)
+
+var pcapCodeNames = map[int32]string{
+	pcapWarning:                    "PCAP_WARNING",
+	pcapWarningPromiscNotSupported: "PCAP_WARNING_PROMISC_NOTSUP",
+	pcapWarningTstampTypeNotSup:    "PCAP_WARNING_TSTAMP_TYPE_NOTSUP",
+	pcapError:                      "PCAP_ERROR",
+	pcapErrorActivated:             "PCAP_ERROR_ACTIVATED",
+	pcapErrorNoSuchDevice:          "PCAP_ERROR_NO_SUCH_DEVICE",
+	pcapErrorRFMonNotSupported:     "PCAP_ERROR_RFMON_NOTSUP",
+	pcapErrorPermDenied:            "PCAP_ERROR_PERM_DENIED",
+	pcapErrorIfaceNotUp:            "PCAP_ERROR_IFACE_NOT_UP",
+	pcapErrorPromiscPermDenied:     "PCAP_ERROR_PROMISC_PERM_DENIED",
+}
+
+// pcapCode extracts the libpcap return code from an error returned by gopacket when activating
+// a handle. gopacket doesn't export its activation error type, but it is an integer holding the
+// value returned by pcap_activate().
+func pcapCode(err error) (int32, bool) {
+	value := reflect.ValueOf(err)
+	if !value.IsValid() || value.Kind() != reflect.Int ||
+		value.Type().PkgPath() != "github.com/google/gopacket/pcap" {
+		return 0, false
+	}
+	return int32(value.Int()), true
+}
+
+// newPcapStatus describes a libpcap error or warning. Errors that didn't come from libpcap
+// activation are reported as PCAP_ERROR.
+func newPcapStatus(err error) *api.PcapStatus {
+	code, ok := pcapCode(err)
+	if !ok {
+		code = pcapError
+	}
+	name, ok := pcapCodeNames[code]
+	if !ok {
+		name = fmt.Sprintf("PCAP_CODE_%d", code)
+	}
+	return &api.PcapStatus{
+		Code:    code,
+		Name:    name,
+		Warning: code > 0,
+		Message: err.Error(),
+	}
+}
+
+// transientPcapErrorPattern matches the messages of generic libpcap errors caused by conditions
+// that may clear up by themselves, such as another process holding the device.
+var transientPcapErrorPattern = regexp.MustCompile(`(?i)busy|temporarily unavailable|no buffer space|cannot allocate memory`)
+
+// pcapStatusError converts a libpcap error into a gRPC error, with the libpcap status attached
+// as a detail so clients can tell what went wrong without parsing the message. Errors that are
+// already gRPC errors are returned as they are.
+func pcapStatusError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	pcapStatus := newPcapStatus(err)
+	code := codes.Unknown
+	switch pcapStatus.Code {
+	case pcapErrorNoSuchDevice:
+		code = codes.NotFound
+	case pcapErrorPermDenied, pcapErrorPromiscPermDenied:
+		code = codes.PermissionDenied
+	case pcapErrorIfaceNotUp, pcapErrorRFMonNotSupported:
+		code = codes.FailedPrecondition
+	case pcapError:
+		if transientPcapErrorPattern.MatchString(pcapStatus.Message) {
+			code = codes.Unavailable
+		}
+	}
+	s, detailsErr := status.New(code, err.Error()).WithDetails(pcapStatus)
+	if detailsErr != nil {
+		return status.Error(code, err.Error())
+	}
+	return s.Err()
+}
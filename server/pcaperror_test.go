@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"testing"
+)
+
+func TestNewPcapStatusForOtherErrors(t *testing.T) {
+	pcapStatus := newPcapStatus(errors.New("something went wrong"))
+	if pcapStatus.Code != pcapError || pcapStatus.Name != "PCAP_ERROR" || pcapStatus.Warning {
+		t.Errorf("unexpected status: %+v", pcapStatus)
+	}
+}
+
+func TestPcapStatusErrorAttachesDetails(t *testing.T) {
+	err := pcapStatusError(errors.New("something went wrong"))
+	s, ok := status.FromError(err)
+	if !ok || s.Code() != codes.Unknown {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	details := s.Details()
+	if len(details) != 1 {
+		t.Fatalf("expected one detail, got %d", len(details))
+	}
+	if pcapStatus, ok := details[0].(*api.PcapStatus); !ok || pcapStatus.Code != pcapError {
+		t.Errorf("unexpected detail: %+v", details[0])
+	}
+}
+
+func TestLiveCaptureReportsPromiscuousWarning(t *testing.T) {
+	path := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(path)
+	warning := &api.PcapStatus{
+		Code:    pcapWarningPromiscNotSupported,
+		Name:    "PCAP_WARNING_PROMISC_NOTSUP",
+		Warning: true,
+		Message: "Cannot set as promisc",
+	}
+	defer func() { openLiveHandle = openLive }()
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		handle, err := pcap.OpenOffline(path)
+		return handle, []*api.PcapStatus{warning}, err
+	}
+	stream := newFakeCaptureStream()
+	s := &Server{}
+	err := s.LiveCapture(&api.CaptureRequest{Interface: "eth0", PromiscuousMode: true}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported *api.PcapStatus
+	for _, reply := range stream.replies {
+		if s := reply.GetStatus(); s != nil && s.Pcap != nil {
+			reported = s.Pcap
+		}
+	}
+	if reported == nil || reported.Code != pcapWarningPromiscNotSupported || !reported.Warning {
+		t.Errorf("expected the promiscuous mode warning to be reported, got %+v", reported)
+	}
+	if len(stream.packets()) != 1 {
+		t.Errorf("expected the capture to continue after the warning")
+	}
+}
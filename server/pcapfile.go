@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/sys/unix"
+	"io"
+	"runtime"
+)
+
+// Version identifies the build of the server in the files it writes. It's set when building with
+// -ldflags "-X github.com/pcapme/pcap/server.Version=...".
+var Version = "dev"
+
+// Magic numbers identifying the timestamp resolution of a pcap file.
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+)
+
+// pcapFileWriter writes pcap files like pcapgo.Writer, but can also write the nanosecond variant
+// of the format, which pcapgo.Writer doesn't support.
+type pcapFileWriter struct {
+	w           io.Writer
+	nanoseconds bool
+	snaplen     uint32
+	buf         [16]byte
+}
+
+func newPcapFileWriter(w io.Writer, nanoseconds bool) *pcapFileWriter {
+	return &pcapFileWriter{w: w, nanoseconds: nanoseconds}
+}
+
+// PcapWriter writes pcap files. WriteFileHeader must be called once, before any packets are
+// written.
+type PcapWriter interface {
+	WriteFileHeader(snaplen uint32, linkType layers.LinkType) error
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+// NewPcapWriter returns a PcapWriter for pcap files with microsecond or nanosecond timestamps, for
+// clients saving the packets they receive.
+func NewPcapWriter(w io.Writer, nanoseconds bool) PcapWriter {
+	return newPcapFileWriter(w, nanoseconds)
+}
+
+// WriteFileHeader writes the pcap file header. It must be called exactly once, before any packets
+// are written.
+func (w *pcapFileWriter) WriteFileHeader(snaplen uint32, linkType layers.LinkType) error {
+	var buf [24]byte
+	magic := uint32(pcapMagicMicroseconds)
+	if w.nanoseconds {
+		magic = pcapMagicNanoseconds
+	}
+	binary.LittleEndian.PutUint32(buf[0:4], magic)
+	binary.LittleEndian.PutUint16(buf[4:6], 2)
+	binary.LittleEndian.PutUint16(buf[6:8], 4)
+	binary.LittleEndian.PutUint32(buf[16:20], snaplen)
+	binary.LittleEndian.PutUint32(buf[20:24], uint32(linkType))
+	w.snaplen = snaplen
+	_, err := w.w.Write(buf[:])
+	return err
+}
+
+// WritePacket writes a packet record, with its timestamp in the units given by the file's magic.
+// The lengths in the record are derived from the data actually written: packets longer than the
+// file's snaplen are truncated to it, and the original length is never less than the captured
+// length, which readers would treat as a malformed record.
+func (w *pcapFileWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	length := ci.Length
+	if length < len(data) {
+		length = len(data)
+	}
+	if w.snaplen > 0 && len(data) > int(w.snaplen) {
+		data = data[:w.snaplen]
+	}
+	fraction := ci.Timestamp.Nanosecond()
+	if !w.nanoseconds {
+		fraction /= 1000
+	}
+	binary.LittleEndian.PutUint32(w.buf[0:4], uint32(ci.Timestamp.Unix()))
+	binary.LittleEndian.PutUint32(w.buf[4:8], uint32(fraction))
+	binary.LittleEndian.PutUint32(w.buf[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(w.buf[12:16], uint32(length))
+	if _, err := w.w.Write(w.buf[:]); err != nil {
+		return fmt.Errorf("error writing packet header: %v", err)
+	}
+	_, err := w.w.Write(data)
+	return err
+}
+
+// ngFileWriter writes pcapng files with pcapgo.NgWriter, describing each of the capture's
+// interfaces so that packets can be attributed to them by interface index. Packets are truncated
+// to the snaplen, and have their lengths made consistent, as pcapFileWriter does (NgWriter
+// rejects packets whose lengths don't match their data).
+type ngFileWriter struct {
+	w       *pcapgo.NgWriter
+	snaplen int
+}
+
+// hostOS describes the operating system the server runs on, including its kernel release where
+// that is known.
+func hostOS() string {
+	var name unix.Utsname
+	if err := unix.Uname(&name); err != nil {
+		return runtime.GOOS
+	}
+	return runtime.GOOS + " " + string(bytes.TrimRight(name.Release[:], "\x00"))
+}
+
+// ngSectionInfo describes the host and application that wrote a pcapng file, along with the
+// client's comment (if any), for its section header.
+func ngSectionInfo(comment string) pcapgo.NgSectionInfo {
+	return pcapgo.NgSectionInfo{
+		Hardware:    runtime.GOARCH,
+		OS:          hostOS(),
+		Application: "pcapd " + Version,
+		Comment:     comment,
+	}
+}
+
+// newNgFileWriter writes the pcapng section header and interface descriptions. Interfaces are
+// described in order, matching the interface indexes of the packets to be written.
+func newNgFileWriter(w io.Writer, snaplen uint32, linkType layers.LinkType, interfaces []string, comment string) (*ngFileWriter, error) {
+	if len(interfaces) == 0 {
+		interfaces = []string{""}
+	}
+	describe := func(name string) pcapgo.NgInterface {
+		return pcapgo.NgInterface{
+			Name:                name,
+			OS:                  runtime.GOOS,
+			LinkType:            linkType,
+			SnapLength:          snaplen,
+			TimestampResolution: 9,
+		}
+	}
+	options := pcapgo.NgWriterOptions{SectionInfo: ngSectionInfo(comment)}
+	writer, err := pcapgo.NewNgWriterInterface(w, describe(interfaces[0]), options)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range interfaces[1:] {
+		if _, err := writer.AddInterface(describe(name)); err != nil {
+			return nil, err
+		}
+	}
+	// NgWriter buffers in front of its writer; flush the header, so that writes reach it as
+	// they are made.
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	return &ngFileWriter{w: writer, snaplen: int(snaplen)}, nil
+}
+
+// WritePacket writes an enhanced packet block, passing it straight through to the underlying
+// writer (which does any buffering).
+func (w *ngFileWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if ci.Length < len(data) {
+		ci.Length = len(data)
+	}
+	if w.snaplen > 0 && len(data) > w.snaplen {
+		data = data[:w.snaplen]
+	}
+	ci.CaptureLength = len(data)
+	if err := w.w.WritePacket(ci, data); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
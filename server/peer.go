@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"log"
+	"net"
+)
+
+// peerCredInfo holds the credentials of the process at the other end of a unix socket.
+type peerCredInfo struct {
+	uid uint32
+	pid int32
+}
+
+func (peerCredInfo) AuthType() string {
+	return "peercred"
+}
+
+// peerCredentials is an insecure transport that records the credentials of clients connecting
+// over a unix socket, so that captures can be attributed to the process that started them.
+type peerCredentials struct{}
+
+func (peerCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return conn, nil, nil
+}
+
+func (peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn, nil, nil
+	}
+	info, err := unixPeerCredentials(unixConn)
+	if err != nil {
+		log.Printf("Unable to identify unix socket peer: %v", err)
+		return conn, nil, nil
+	}
+	return conn, info, nil
+}
+
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (c peerCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+func (peerCredentials) OverrideServerName(string) error {
+	return nil
+}
+
+// peerIdentity identifies the client of an RPC, or returns nil if the context has no peer.
+func peerIdentity(ctx context.Context) *api.PeerIdentity {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	identity := &api.PeerIdentity{}
+	if p.Addr != nil {
+		identity.Address = p.Addr.String()
+	}
+	if info, ok := p.AuthInfo.(peerCredInfo); ok {
+		identity.CredentialsKnown = true
+		identity.Uid = info.uid
+		identity.Pid = info.pid
+	}
+	return identity
+}
+
+// formatPeer describes a client for the log.
+func formatPeer(identity *api.PeerIdentity) string {
+	switch {
+	case identity == nil:
+		return "unknown peer"
+	case identity.CredentialsKnown && len(identity.Address) > 0:
+		return fmt.Sprintf("%s (pid %d, uid %d)", identity.Address, identity.Pid, identity.Uid)
+	case identity.CredentialsKnown:
+		return fmt.Sprintf("pid %d (uid %d)", identity.Pid, identity.Uid)
+	case len(identity.Address) > 0:
+		return identity.Address
+	}
+	return "unknown peer"
+}
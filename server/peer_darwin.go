@@ -0,0 +1,12 @@
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// unixPeerCredentials isn't implemented on macOS, whose LOCAL_PEERCRED option isn't exposed by
+// the version of golang.org/x/sys in use.
+func unixPeerCredentials(conn *net.UnixConn) (peerCredInfo, error) {
+	return peerCredInfo{}, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+// unixPeerCredentials reads the credentials of the connecting process with SO_PEERCRED.
+func unixPeerCredentials(conn *net.UnixConn) (peerCredInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return peerCredInfo{}, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return peerCredInfo{}, err
+	}
+	if credErr != nil {
+		return peerCredInfo{}, credErr
+	}
+	return peerCredInfo{uid: cred.Uid, pid: cred.Pid}, nil
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLiveCaptureRecordsUnixSocketPeer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	dir, err := ioutil.TempDir("", "pcap-peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "pcapd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(offlineConfig())
+	grpcServer := grpc.NewServer(grpc.Creds(peerCredentials{}))
+	api.RegisterPCAPServer(grpcServer, s)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := api.NewPCAPClient(conn)
+
+	input := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(input)
+	output := captureLog(func() {
+		stream, err := client.LiveCapture(context.Background(), &api.CaptureRequest{OfflineSource: input})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			if _, err := stream.Recv(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	reply, err := client.CaptureHistory(context.Background(), &api.CaptureHistoryRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Records) != 1 {
+		t.Fatalf("expected one capture record, got %d", len(reply.Records))
+	}
+	peer := reply.Records[0].Peer
+	if peer == nil || !peer.CredentialsKnown || peer.Uid != uint32(os.Getuid()) || peer.Pid != int32(os.Getpid()) {
+		t.Errorf("expected this process to be recorded as the peer, got %+v", peer)
+	}
+	if !strings.Contains(output, formatPeer(peer)) {
+		t.Errorf("expected the peer to be logged, got: %s", output)
+	}
+}
+
+func TestFormatPeer(t *testing.T) {
+	for _, test := range []struct {
+		identity *api.PeerIdentity
+		expected string
+	}{
+		{nil, "unknown peer"},
+		{&api.PeerIdentity{}, "unknown peer"},
+		{&api.PeerIdentity{Address: "192.0.2.1:5000"}, "192.0.2.1:5000"},
+		{&api.PeerIdentity{CredentialsKnown: true, Uid: 1000, Pid: 42}, "pid 42 (uid 1000)"},
+	} {
+		if actual := formatPeer(test.identity); actual != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.identity, test.expected, actual)
+		}
+	}
+}
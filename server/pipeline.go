@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pcapme/pcap/api"
+	"strconv"
+	"time"
+)
+
+// stage returns a pipeline stage with parameters given as alternating names and values.
+func stage(name string, parameters ...string) *api.PipelineStage {
+	s := &api.PipelineStage{Name: name, Parameters: make(map[string]string)}
+	for i := 0; i+1 < len(parameters); i += 2 {
+		s.Parameters[parameters[i]] = parameters[i+1]
+	}
+	return s
+}
+
+// sinkStage describes one of the capture's sinks.
+func sinkStage(sink PacketSink, outputFormat api.CaptureRequest_OutputFormat) *api.PipelineStage {
+	switch sink := sink.(type) {
+	case *fileSink:
+		return stage("sink", "type", "file", "path", sink.path, "format", outputFormat.String())
+	case *csvSink:
+		return stage("sink", "type", "csv", "path", sink.file.Name())
+	case *tcpSink:
+		return stage("sink", "type", "collector", "address", sink.address)
+	case *metadataSink:
+		return stage("sink", "type", "metadata", "path", sink.path)
+	}
+	return stage("sink", "type", fmt.Sprintf("%T", sink))
+}
+
+// packetStage is one of the stages queuePacket passes packets through. Its description, if it has
+// one, is reported by DescribeCapture. apply returns false if the packet goes no further, having
+// been dropped, or held to be sent later.
+type packetStage struct {
+	description *api.PipelineStage
+	apply       func(p *packetData) (bool, error)
+}
+
+// queueStages returns the stages queuePacket passes packets through, in order.
+func (c *liveCapture) queueStages() []packetStage {
+	if c.stages == nil {
+		c.stages = c.newQueueStages()
+	}
+	return c.stages
+}
+
+func (c *liveCapture) newQueueStages() []packetStage {
+	var stages []packetStage
+	add := func(description *api.PipelineStage, apply func(p *packetData) (bool, error)) {
+		stages = append(stages, packetStage{description: description, apply: apply})
+	}
+	if c.sampler != nil {
+		rate := strconv.FormatUint(uint64(c.request.SampleRate), 10)
+		add(stage("sampling", "rate", rate, "mode", c.sampling), func(p *packetData) (bool, error) {
+			// As if the kernel had discarded the packet.
+			if !c.sampler.allow() {
+				c.hooks.drop(c.info, 1, "sampling")
+				return false, nil
+			}
+			return true, nil
+		})
+	}
+	if c.dedup != nil {
+		add(stage("dedup", "window", c.dedup.window.String(), "scope", c.dedup.scope.String()),
+			func(p *packetData) (bool, error) {
+				if c.dedup.duplicate(p.data, p.ci.Timestamp) {
+					c.hooks.drop(c.info, 1, "duplicate")
+					return false, nil
+				}
+				return true, nil
+			})
+	}
+	// Packets are counted here, towards the limits, whether or not they are limited.
+	var limits *api.PipelineStage
+	if c.request.MaxPackets > 0 || c.request.MaxBytes > 0 {
+		limits = stage("limits")
+		if c.request.MaxPackets > 0 {
+			limits.Parameters["max_packets"] = strconv.FormatUint(c.request.MaxPackets, 10)
+		}
+		if c.request.MaxBytes > 0 {
+			limits.Parameters["max_bytes"] = strconv.FormatUint(c.request.MaxBytes, 10)
+		}
+	}
+	add(limits, c.countPacket)
+	if c.hierarchy != nil {
+		add(stage("protocol_hierarchy", "interval", c.hierarchy.interval.String()),
+			func(p *packetData) (bool, error) {
+				if c.hierarchy.snapshotDue(p.ci.Timestamp) {
+					if err := c.sendHierarchy(); err != nil {
+						return false, err
+					}
+				}
+				c.hierarchy.add(summarizePacket(p.data, p.ci, c.linkType).Layers, p.ci.Length)
+				return true, nil
+			})
+	}
+	if c.request.MaxPayloadBytes > 0 {
+		maxPayloadBytes := int(c.request.MaxPayloadBytes)
+		add(stage("payload_trim", "max_payload_bytes", strconv.Itoa(maxPayloadBytes)),
+			func(p *packetData) (bool, error) {
+				p.data, p.ci = trimPayload(p.data, p.ci, c.linkType, maxPayloadBytes)
+				return true, nil
+			})
+	}
+	if c.latency != nil {
+		add(stage("latency", "egress_interface", c.request.EgressInterface,
+			"table_size", strconv.Itoa(cap(c.latency.order))), func(p *packetData) (bool, error) {
+			if key, ok := forwardingKey(p.data, c.linkType); ok {
+				c.latency.addIngress(key, p.ci.Timestamp)
+			}
+			return true, nil
+		})
+	}
+	for _, sink := range c.sinks {
+		sink := sink
+		add(sinkStage(sink, c.request.OutputFormat), func(p *packetData) (bool, error) {
+			return true, sink.WritePacket(p.ci, p.data)
+		})
+	}
+	if c.flows != nil {
+		add(stage("first_packet_only", "idle_timeout", c.flows.idleTimeout.String()),
+			func(p *packetData) (bool, error) {
+				return c.flows.first(c.packetFlow(p), p.ci.Timestamp), nil
+			})
+	}
+	if c.flowLimit != nil {
+		add(stage("flow_cap", "max_packets_per_flow", strconv.FormatUint(c.flowLimit.limit, 10),
+			"idle_timeout", c.flowLimit.idleTimeout.String()), func(p *packetData) (bool, error) {
+			if !c.flowLimit.allow(c.packetFlow(p), p.ci.Timestamp) {
+				c.hooks.drop(c.info, 1, "flow cap")
+				return false, nil
+			}
+			return true, nil
+		})
+	}
+	if c.throttle != nil {
+		add(stage("throttle",
+			"high", strconv.FormatFloat(c.throttle.config.High, 'g', -1, 64),
+			"low", strconv.FormatFloat(c.throttle.config.Low, 'g', -1, 64),
+			"sample_rate", strconv.FormatUint(uint64(c.throttle.config.SampleRate), 10)),
+			func(p *packetData) (bool, error) {
+				if c.throttle.update(time.Now()) {
+					if err := c.sendThrottleStatus(); err != nil {
+						return false, err
+					}
+				}
+				if !c.throttle.allow() {
+					c.hooks.drop(c.info, 1, "throttle")
+					return false, nil
+				}
+				return true, nil
+			})
+	}
+	if c.limiter != nil {
+		add(stage("rate_limit", "packets_per_second", strconv.FormatUint(uint64(c.request.MaxPacketsPerSecond), 10)),
+			func(p *packetData) (bool, error) {
+				return c.limitRate()
+			})
+	}
+	if c.reorder != nil {
+		add(stage("reorder", "window", c.reorder.window.String()), func(p *packetData) (bool, error) {
+			// The packets the buffer releases are sent in timestamp order.
+			return false, c.sendPackets(c.reorder.push(p))
+		})
+	}
+	return stages
+}
+
+// pipelineStages lists the stages the capture's packets pass through, in the order they are
+// applied: by the capture handle, then processPacket, the stages of queuePacket, and sendPacket.
+func (c *liveCapture) pipelineStages() []*api.PipelineStage {
+	var stages []*api.PipelineStage
+	if len(c.filter) > 0 {
+		appliedBy := "kernel"
+		if len(c.request.OfflineSource) > 0 {
+			appliedBy = "libpcap"
+		}
+		stages = append(stages, stage("filter", "expression", c.filter, "applied_by", appliedBy))
+	}
+	if c.sampling == samplingKernel {
+		rate := strconv.FormatUint(uint64(c.request.SampleRate), 10)
+		stages = append(stages, stage("sampling", "rate", rate, "mode", c.sampling))
+	}
+	if c.window != nil {
+		window := stage("time_window")
+		if !c.window.start.IsZero() {
+			window.Parameters["start"] = c.window.start.UTC().Format(time.RFC3339Nano)
+		}
+		if !c.window.end.IsZero() {
+			window.Parameters["end"] = c.window.end.UTC().Format(time.RFC3339Nano)
+		}
+		stages = append(stages, window)
+	}
+	for _, queueStage := range c.queueStages() {
+		if queueStage.description != nil {
+			stages = append(stages, queueStage.description)
+		}
+	}
+	if c.hooks != nil && c.hooks.OnPacket != nil {
+		stages = append(stages, stage("hooks", "on_packet", "true"))
+	}
+	if c.request.Summarize {
+		stages = append(stages, stage("summarize", "decode_fields", strconv.FormatBool(c.request.DecodeFields)))
+		if c.coalescer != nil {
+			stages = append(stages, stage("coalesce", "window", c.coalescer.window.String()))
+		}
+		return stages
+	}
+	if c.request.MaxForwardBytes > 0 {
+		stages = append(stages, stage("forward_trim",
+			"max_forward_bytes", strconv.FormatUint(uint64(c.request.MaxForwardBytes), 10)))
+	}
+	if c.newCompressor != nil {
+		stages = append(stages, stage("compression", "codec", c.compression.String()))
+	}
+	return stages
+}
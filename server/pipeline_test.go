@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func stageNames(stages []*api.PipelineStage) []string {
+	names := make([]string, len(stages))
+	for i, stage := range stages {
+		names[i] = stage.Name
+	}
+	return names
+}
+
+func TestDescribeCaptureReportsPipeline(t *testing.T) {
+	defer fakeIdleInterface(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})()
+	dir, err := ioutil.TempDir("", "pcap-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hooks := &Hooks{OnPacket: func(*CaptureInfo, []byte, gopacket.CaptureInfo) {}}
+	s := NewServer(Config{OutputDirectory: dir, Hooks: hooks})
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeCaptureStream()
+	stream.ctx = ctx
+	result := make(chan error)
+	go func() {
+		result <- s.LiveCapture(&api.CaptureRequest{
+			Interface:                            "eth0",
+			DedupWindowNanoseconds:               int64(time.Second),
+			ProtocolHierarchyIntervalNanoseconds: int64(time.Minute),
+			MaxPackets:                           1000,
+			MaxPayloadBytes:                      64,
+			CsvOutputPath:                        "out.csv",
+			MaxPacketsPerFlow:                    10,
+			MaxPacketsPerSecond:                  100,
+			ReorderWindowNanoseconds:             int64(10 * time.Millisecond),
+			MaxForwardBytes:                      128,
+			Compression:                          api.CaptureRequest_GZIP,
+		}, stream)
+	}()
+	reply := describeCapture(t, s, 1)
+	time.Sleep(20 * time.Millisecond)
+	stopCapture(t, cancel, result)
+	expectNoLeakedGoroutines(t, before)
+
+	expected := []*api.PipelineStage{
+		stage("dedup", "window", "1s", "scope", "HEADERS"),
+		stage("limits", "max_packets", "1000"),
+		stage("protocol_hierarchy", "interval", "1m0s"),
+		stage("payload_trim", "max_payload_bytes", "64"),
+		stage("sink", "type", "csv", "path", filepath.Join(dir, "out.csv")),
+		stage("flow_cap", "max_packets_per_flow", "10", "idle_timeout", DefaultFlowIdleTimeout.String()),
+		stage("rate_limit", "packets_per_second", "100"),
+		stage("reorder", "window", "10ms"),
+		stage("hooks", "on_packet", "true"),
+		stage("forward_trim", "max_forward_bytes", "128"),
+		stage("compression", "codec", "GZIP"),
+	}
+	if !reflect.DeepEqual(reply.Pipeline, expected) {
+		t.Errorf("expected stages %q, got %q", stageNames(expected), stageNames(reply.Pipeline))
+		for i := 0; i < len(reply.Pipeline) && i < len(expected); i++ {
+			if !reflect.DeepEqual(reply.Pipeline[i], expected[i]) {
+				t.Errorf("stage %d: expected %+v, got %+v", i, expected[i], reply.Pipeline[i])
+			}
+		}
+	}
+}
+
+func TestPipelineStagesOfOfflineSummaries(t *testing.T) {
+	in := &api.CaptureRequest{
+		OfflineSource:          "in.pcap",
+		SampleRate:             4,
+		WindowStartNanoseconds: int64(1500000000 * time.Second),
+		Summarize:              true,
+		DecodeFields:           true,
+	}
+	capture := newLiveCapture(in, newFakeCaptureStream(), &Config{})
+	capture.linkType = layers.LinkTypeEthernet
+	capture.filter = "udp"
+	capture.sampler = newPacketSampler(in.SampleRate)
+	capture.sampling = samplingUserspace
+	expected := []*api.PipelineStage{
+		stage("filter", "expression", "udp", "applied_by", "libpcap"),
+		stage("time_window", "start", "2017-07-14T02:40:00Z"),
+		stage("sampling", "rate", "4", "mode", samplingUserspace),
+		stage("summarize", "decode_fields", "true"),
+	}
+	if stages := capture.pipelineStages(); !reflect.DeepEqual(stages, expected) {
+		t.Errorf("unexpected stages: %+v", stages)
+	}
+}
+
+func TestQueueStagesDropWherePipelineSaysTheyDo(t *testing.T) {
+	in := &api.CaptureRequest{
+		Interface:              "eth0",
+		SampleRate:             2,
+		DedupWindowNanoseconds: int64(time.Second),
+		DedupScope:             api.CaptureRequest_FULL,
+		MaxPackets:             100,
+		MaxPayloadBytes:        1,
+		MaxPacketsPerFlow:      1,
+	}
+	// The stages that drop packets report them to the hooks.
+	drops := make(map[string]uint64)
+	hooks := &Hooks{OnDrop: func(info *CaptureInfo, count uint64, reason string) { drops[reason] += count }}
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(in, stream, &Config{Hooks: hooks})
+	capture.linkType = layers.LinkTypeEthernet
+	capture.sampler = newPacketSampler(in.SampleRate)
+	capture.sampling = samplingUserspace
+	capture.dedup = newDeduplicator(in, capture.linkType)
+	names := stageNames(capture.pipelineStages())
+	if expected := []string{"sampling", "dedup", "limits", "payload_trim", "flow_cap"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected stages %q, got %q", expected, names)
+	}
+	// Record which of the stages stopped each packet.
+	var stoppedBy string
+	stages := capture.queueStages()
+	for i := range stages {
+		name := "count"
+		if stages[i].description != nil {
+			name = stages[i].description.Name
+		}
+		apply := stages[i].apply
+		stages[i].apply = func(p *packetData) (bool, error) {
+			forward, err := apply(p)
+			if !forward {
+				stoppedBy = name
+			}
+			return forward, err
+		}
+	}
+	// The sampler keeps every other packet, starting with the first.
+	other := udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1000, 2000)
+	inputs := [][]byte{
+		mirroredFixture(t, 64, 0),
+		other,
+		mirroredFixture(t, 64, 0),
+		other,
+		mirroredFixture(t, 63, 0),
+		other,
+		other,
+	}
+	var results []string
+	base := time.Unix(1500000000, 0)
+	for i, data := range inputs {
+		stoppedBy = "sent"
+		ci := gopacket.CaptureInfo{Timestamp: base.Add(time.Duration(i) * time.Millisecond), CaptureLength: len(data), Length: len(data)}
+		if err := capture.queuePacket(&packetData{data: data, ci: ci}); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, stoppedBy)
+	}
+	expected := []string{"sent", "sampling", "dedup", "sampling", "flow_cap", "sampling", "sent"}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected the packets to be stopped by %q, got %q", expected, results)
+	}
+	sent := stream.packets()
+	if len(sent) != 2 || len(sent[1].Data) != 14+20+8+1 {
+		t.Errorf("expected 2 packets, the second with its payload trimmed, got %+v", sent)
+	}
+	if capture.packets != 3 {
+		t.Errorf("expected the 3 packets past dedup to count towards the limits, got %d", capture.packets)
+	}
+	expectedDrops := map[string]uint64{"sampling": 3, "duplicate": 1, "flow cap": 1}
+	if !reflect.DeepEqual(drops, expectedDrops) {
+		t.Errorf("expected drops %v to be reported, got %v", expectedDrops, drops)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pcapme/pcap/api"
+	"log"
+	"strings"
+	"time"
+)
+
+// rateLimitReportInterval is how often, at most, the client is told that packets are being held
+// back by the rate limit.
+const rateLimitReportInterval = time.Second
+
+// rateLimiter bounds the packets sent to a client to a rate per second, allowing bursts of up to
+// a second's worth of packets. Packets beyond the rate aren't sent.
+type rateLimiter struct {
+	rate       float64
+	tokens     float64
+	last       time.Time
+	dropped    uint64
+	lastReport time.Time
+}
+
+// newRateLimiter returns a limiter for the rate, or nil if the rate is zero (no limit).
+func newRateLimiter(rate uint32) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+// allow returns true if a packet sent at now is within the rate.
+func (r *rateLimiter) allow(now time.Time) bool {
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.rate {
+			r.tokens = r.rate
+		}
+	}
+	r.last = now
+	if r.tokens < 1 {
+		r.dropped++
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// reportDue returns true if the client should be told about the packets dropped so far, which it
+// is when dropping starts, then at most once per rateLimitReportInterval.
+func (r *rateLimiter) reportDue(now time.Time) bool {
+	if now.Sub(r.lastReport) < rateLimitReportInterval {
+		return false
+	}
+	r.lastReport = now
+	return true
+}
+
+// limitRate returns true if the packet may be sent to the client, telling the client (now and
+// then) about the packets that weren't.
+func (c *liveCapture) limitRate() (bool, error) {
+	now := time.Now()
+	if c.limiter.allow(now) {
+		return true, nil
+	}
+	c.hooks.drop(c.info, 1, "rate limit")
+	if !c.limiter.reportDue(now) {
+		return false, nil
+	}
+	return false, c.sendUnsentPackets()
+}
+
+// sendUnsentPackets tells the client how many of the captured packets it hasn't been sent, due
+// to sampling or the rate limit, so that it knows the capture is incomplete. Metadata records
+// the consumer wasn't sent are reported too.
+func (c *liveCapture) sendUnsentPackets() error {
+	status := &api.CaptureStatus{}
+	var reasons []string
+	if len(c.sampling) > 0 {
+		status.SampledPackets, status.SampledPacketsEstimated = c.sampledPackets()
+		if status.SampledPacketsEstimated {
+			reasons = append(reasons, fmt.Sprintf("about %d sampled out by the kernel", status.SampledPackets))
+		} else {
+			reasons = append(reasons, fmt.Sprintf("%d sampled out", status.SampledPackets))
+		}
+	}
+	if c.limiter != nil {
+		status.RateLimitedPackets = c.limiter.dropped
+		reasons = append(reasons, fmt.Sprintf("%d over the limit of %d packets per second",
+			status.RateLimitedPackets, c.request.MaxPacketsPerSecond))
+	}
+	if c.metadataSink != nil && c.metadataSink.dropped > 0 {
+		status.MetadataDroppedRecords = c.metadataSink.dropped
+		reasons = append(reasons, fmt.Sprintf("%d metadata records not sent to %s",
+			status.MetadataDroppedRecords, c.metadataSink.path))
+	}
+	status.Message = "Packets not sent: " + strings.Join(reasons, ", ")
+	log.Printf("%s: %s", c.request.Interface, status.Message)
+	return c.stream.Send(&api.CaptureReply{
+		ReplyData: &api.CaptureReply_Status{Status: status},
+	})
+}
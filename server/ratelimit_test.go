@@ -0,0 +1,66 @@
+package server
+
+import (
+	"github.com/pcapme/pcap/api"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Error("expected a rate of zero to mean no limit")
+	}
+	r := newRateLimiter(2)
+	now := time.Unix(1500000000, 0)
+	for i, test := range []struct {
+		elapsed time.Duration
+		allowed bool
+	}{
+		{0, true},
+		{0, true},
+		{0, false},
+		{250 * time.Millisecond, false},
+		{250 * time.Millisecond, true},
+		{10 * time.Second, true},
+		{0, true},
+		{0, false},
+	} {
+		now = now.Add(test.elapsed)
+		if allowed := r.allow(now); allowed != test.allowed {
+			t.Errorf("%d: expected %v, got %v", i, test.allowed, allowed)
+		}
+	}
+	if r.dropped != 3 {
+		t.Errorf("expected 3 packets to be dropped, got %d", r.dropped)
+	}
+}
+
+func TestLiveCaptureLimitsPacketRate(t *testing.T) {
+	packets := make([][]byte, 5)
+	for i := range packets {
+		packets[i] = udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000+i, 53)
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{Config: offlineConfig()}
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: path, MaxPacketsPerSecond: 2}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if received := stream.packets(); len(received) != 2 {
+		t.Errorf("expected 2 of 5 packets, got %d", len(received))
+	}
+	var statuses []*api.CaptureStatus
+	for _, reply := range stream.replies {
+		if status := reply.GetStatus(); status != nil {
+			statuses = append(statuses, status)
+		}
+	}
+	if len(statuses) != 2 || statuses[0].RateLimitedPackets != 1 || statuses[1].RateLimitedPackets != 3 {
+		t.Fatalf("expected the limiting to be reported as it started and at the end, got %+v", statuses)
+	}
+	if last := statuses[1]; last.Message != "Packets not sent: 3 over the limit of 2 packets per second" {
+		t.Errorf("unexpected message: %q", last.Message)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"github.com/google/gopacket/pcap"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// handlePacket processes the result of reading from the capture handle. It returns true once the
+// capture has ended.
+func (c *liveCapture) handlePacket(p *packetData) (bool, error) {
+	// The capture handle reads the first of the capture's interfaces, whatever index gopacket
+	// gives it (see readInterfaces).
+	p.ci.InterfaceIndex = 0
+	return c.processPacket(p)
+}
+
+// processPacket processes a packet read from any of the capture's interfaces.
+func (c *liveCapture) processPacket(p *packetData) (bool, error) {
+	c.otlp.captureRunning(c, time.Now())
+	if p.err == pcap.NextErrorTimeoutExpired {
+		// The buffer timeout expired without any packets arriving.
+		return false, nil
+	}
+	if p.err == io.EOF {
+		// End of an offline capture.
+		return true, c.flushPackets()
+	}
+	if p.err != nil {
+		return true, p.err
+	}
+	atomic.AddUint64(&c.matched, 1)
+	if c.window.after(p.ci.Timestamp) {
+		log.Printf("Stopped LiveCapture(%+v) at the end of the time window.\n", c.request)
+		return true, c.flushPackets()
+	}
+	if c.window.before(p.ci.Timestamp) {
+		return false, nil
+	}
+	if err := c.queuePacket(p); err != nil {
+		return false, err
+	}
+	if reason := c.countLimitReason(); len(reason) > 0 {
+		return true, c.reachLimit(reason)
+	}
+	return false, nil
+}
+
+// stopOnRequest ends the capture once it has been asked to stop, flushing any held packets.
+func (c *liveCapture) stopOnRequest() error {
+	log.Printf("Stopped LiveCapture(%+v) on request.\n", c.request)
+	c.stoppedOnRequest = true
+	return c.flushPackets()
+}
+
+// handleEgressPacket processes a packet read from the egress handle. It returns true once the
+// egress handle has no more packets.
+func (c *liveCapture) handleEgressPacket(p *packetData) (bool, error) {
+	if p.err == io.EOF {
+		return true, nil
+	}
+	if p.err != nil {
+		return true, p.err
+	}
+	return false, c.queueEgressPacket(p)
+}
+
+// pollLoop reads packets from the capture handle on the calling goroutine. The handle must have a
+// positive timeout (see pollable), so that each read returns within the timeout even if no packets
+// arrive; shutdown and cancellation are checked between reads. Captures that also read the egress
+// interface or additional interfaces use channelLoop instead: waiting out the timeout on a quiet
+// capture handle between each of their packets would limit them to one packet per timeout.
+func (c *liveCapture) pollLoop(handle *pcap.Handle) error {
+	for {
+		select {
+		case _, running := <-ShuttingDown:
+			if running == false {
+				log.Printf("Stopped LiveCapture(%+v) via interrupt.\n", c.request)
+				return c.flushPackets()
+			}
+		case <-c.stream.Context().Done():
+			log.Println("Context().Done()")
+			// Connection closed by remote host.
+			return nil
+		case <-c.stop:
+			return c.stopOnRequest()
+		case <-c.deadline:
+			return c.reachDeadline()
+		default:
+		}
+		if c.flushDue(time.Now()) {
+			if err := c.flushPackets(); err != nil {
+				return err
+			}
+		}
+		data, captureInfo, err := readPacketData(handle)
+		done, err := c.handlePacket(&packetData{data: data, ci: captureInfo, err: err})
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// channelLoop reads packets from the capture handle on a separate goroutine, for handles whose
+// reads may block indefinitely, and for captures that read other interfaces too, whose packets
+// are handled as they arrive alongside it. At most one read is outstanding at a time. The reader can always
+// deliver its result and exit, even after the capture loop has returned.
+func (c *liveCapture) channelLoop(handle *pcap.Handle, egress <-chan *packetData, interfaces <-chan *packetData) error {
+	packet := make(chan *packetData, 1)
+	compressor := c.packetCompressor()
+	// The reader may outlive the loop, so it reads with the function in use when the loop began.
+	read := readPacketData
+	for {
+		if c.pendingRead == nil {
+			c.pendingRead = packet
+			go func() {
+				data, captureInfo, err := read(handle)
+				if err == nil && c.pacer != nil {
+					c.pacer.wait(captureInfo.Timestamp, c.ended)
+				}
+				p := &packetData{data: data, ci: captureInfo, err: err}
+				c.compressPacket(p, compressor)
+				packet <- p
+			}()
+		}
+		select {
+		case _, running := <-ShuttingDown:
+			if running == false {
+				log.Printf("Stopped LiveCapture(%+v) via interrupt.\n", c.request)
+				return c.flushPackets()
+			}
+		case <-c.stream.Context().Done():
+			log.Println("Context().Done()")
+			// Connection closed by remote host.
+			return nil
+		case <-c.stop:
+			return c.stopOnRequest()
+		case <-c.deadline:
+			return c.reachDeadline()
+		case <-c.flushTimeout():
+			if err := c.flushPackets(); err != nil {
+				return err
+			}
+		case p := <-egress:
+			closed, err := c.handleEgressPacket(p)
+			if err != nil {
+				return err
+			}
+			if closed {
+				egress = nil
+			}
+		case p := <-interfaces:
+			done, err := c.handleInterfacePacket(p)
+			if done || err != nil {
+				return err
+			}
+		case p := <-packet:
+			c.pendingRead = nil
+			done, err := c.handlePacket(p)
+			if done || err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// closeHandle closes the capture handle once the capture has ended. gopacket waits for an
+// outstanding read to return before closing a handle, which could take indefinitely for a read
+// from a quiet pipe; in that case, the handle is closed in the background once the read returns.
+func (c *liveCapture) closeHandle(handle *pcap.Handle) {
+	if c.pendingRead == nil {
+		handle.Close()
+		return
+	}
+	go func(pending <-chan *packetData) {
+		<-pending
+		handle.Close()
+	}(c.pendingRead)
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPollLoopStopsPromptlyWithoutLeaking(t *testing.T) {
+	path := writePcapFile(t, nil)
+	defer os.Remove(path)
+	defer func() { openLiveHandle = openLive }()
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		handle, err := pcap.OpenOffline(path)
+		return handle, nil, err
+	}
+	// Simulate an idle interface, whose reads return when the buffer timeout expires.
+	defer func() { readPacketData = (*pcap.Handle).ReadPacketData }()
+	readPacketData = func(h *pcap.Handle) ([]byte, gopacket.CaptureInfo, error) {
+		time.Sleep(time.Millisecond)
+		return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+	}
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeCaptureStream()
+	stream.ctx = ctx
+	in := &api.CaptureRequest{Interface: "eth0"}
+	if !pollable(in) {
+		t.Fatal("expected a live capture with the default timeout to be pollable")
+	}
+	result := make(chan error)
+	go func() {
+		s := &Server{}
+		result <- s.LiveCapture(in, stream)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("capture did not stop promptly")
+	}
+	expectNoLeakedGoroutines(t, before)
+}
+
+// expectNoLeakedGoroutines waits briefly for the number of goroutines to return to what it was
+// before a capture.
+func expectNoLeakedGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("expected no leaked goroutines: %d before, %d after", before, after)
+	}
+}
+
+// stopCapture cancels a running capture, and expects it to return promptly without an error.
+func stopCapture(t *testing.T, cancel context.CancelFunc, result <-chan error) {
+	t.Helper()
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("capture did not stop promptly")
+	}
+}
+
+func TestLiveCaptureOnQuietInterfaceStopsWithoutLeaking(t *testing.T) {
+	for _, timeout := range []int64{0, -int64(50 * time.Millisecond)} {
+		in := &api.CaptureRequest{Interface: "lo", TimeoutNanoseconds: timeout}
+		handle, _, err := openLive(in)
+		if err != nil {
+			t.Skipf("can't capture on the loopback interface: %v", err)
+		}
+		handle.Close()
+		before := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(context.Background())
+		stream := newFakeCaptureStream()
+		stream.ctx = ctx
+		result := make(chan error)
+		go func() {
+			s := &Server{}
+			result <- s.LiveCapture(in, stream)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		stopCapture(t, cancel, result)
+		expectNoLeakedGoroutines(t, before)
+	}
+}
+
+func TestOfflineCaptureFromQuietPipeStops(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// Write only the file header, so that the capture's first read blocks.
+	writePcapFixture(t, w, nil)
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeCaptureStream()
+	stream.ctx = ctx
+	result := make(chan error)
+	go func() {
+		s := &Server{Config: Config{AllowOfflineDescriptors: true}}
+		result <- s.LiveCapture(&api.CaptureRequest{OfflineSource: fmt.Sprintf("fd:%d", r.Fd())}, stream)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	stopCapture(t, cancel, result)
+	// Once the pipe is closed, the outstanding read returns and the handle is closed.
+	w.Close()
+	expectNoLeakedGoroutines(t, before)
+}
+
+func TestOfflineCapturesAreNotPollable(t *testing.T) {
+	if pollable(&api.CaptureRequest{OfflineSource: "-"}) {
+		t.Error("expected offline captures to use a reader goroutine")
+	}
+	if !pollable(&api.CaptureRequest{Interface: "eth0", TimeoutNanoseconds: -1}) {
+		t.Error("expected live captures to be pollable, even if blocking reads are requested")
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"container/heap"
+	"time"
+)
+
+// reorderBuffer holds packets briefly so that packets read from several handles can be emitted
+// in timestamp order, even if goroutine scheduling delivers them out of order. A packet is
+// released once a packet with a timestamp more than the window newer than it has been seen, or
+// when no packets have arrived for the duration of the window. Packets will therefore be delayed
+// by up to the window, and packets that arrive more than the window late may still be emitted
+// out of order.
+type reorderBuffer struct {
+	window  time.Duration
+	newest  time.Time
+	packets packetHeap
+}
+
+func newReorderBuffer(window time.Duration) *reorderBuffer {
+	return &reorderBuffer{window: window}
+}
+
+// push adds a packet to the buffer, and returns any packets that are now ready to be emitted.
+func (b *reorderBuffer) push(p *packetData) []*packetData {
+	heap.Push(&b.packets, p)
+	if p.ci.Timestamp.After(b.newest) {
+		b.newest = p.ci.Timestamp
+	}
+	watermark := b.newest.Add(-b.window)
+	ready := make([]*packetData, 0, 1)
+	for len(b.packets) > 0 && !b.packets[0].ci.Timestamp.After(watermark) {
+		ready = append(ready, heap.Pop(&b.packets).(*packetData))
+	}
+	return ready
+}
+
+// flush empties the buffer, returning all held packets in timestamp order.
+func (b *reorderBuffer) flush() []*packetData {
+	ready := make([]*packetData, 0, len(b.packets))
+	for len(b.packets) > 0 {
+		ready = append(ready, heap.Pop(&b.packets).(*packetData))
+	}
+	return ready
+}
+
+func (b *reorderBuffer) empty() bool {
+	return len(b.packets) == 0
+}
+
+// packetHeap implements heap.Interface, ordering packets by timestamp.
+type packetHeap []*packetData
+
+func (h packetHeap) Len() int            { return len(h) }
+func (h packetHeap) Less(i, j int) bool  { return h[i].ci.Timestamp.Before(h[j].ci.Timestamp) }
+func (h packetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *packetHeap) Push(x interface{}) { *h = append(*h, x.(*packetData)) }
+
+func (h *packetHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	p := old[n-1]
+	*h = old[:n-1]
+	return p
+}
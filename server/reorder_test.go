@@ -0,0 +1,46 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"testing"
+	"time"
+)
+
+func TestReorderBufferOrdersInterleavedSources(t *testing.T) {
+	base := time.Unix(1000, 0)
+	at := func(ms int) *packetData {
+		return &packetData{ci: gopacket.CaptureInfo{Timestamp: base.Add(time.Duration(ms) * time.Millisecond)}}
+	}
+	// Two sources with interleaved timestamps, delivered in bursts from each source.
+	arrivals := []*packetData{at(0), at(2), at(4), at(1), at(3), at(5), at(8), at(6), at(10), at(7), at(9)}
+	buffer := newReorderBuffer(5 * time.Millisecond)
+	output := make([]*packetData, 0, len(arrivals))
+	for _, p := range arrivals {
+		output = append(output, buffer.push(p)...)
+	}
+	output = append(output, buffer.flush()...)
+	if len(output) != len(arrivals) {
+		t.Fatalf("expected %d packets, got %d", len(arrivals), len(output))
+	}
+	for i := 1; i < len(output); i++ {
+		if output[i].ci.Timestamp.Before(output[i-1].ci.Timestamp) {
+			t.Errorf("packet %d (%v) emitted before packet %d (%v)",
+				i-1, output[i-1].ci.Timestamp, i, output[i].ci.Timestamp)
+		}
+	}
+	if !buffer.empty() {
+		t.Error("expected buffer to be empty after flush")
+	}
+}
+
+func TestReorderBufferReleasesPacketsOutsideWindow(t *testing.T) {
+	base := time.Unix(1000, 0)
+	buffer := newReorderBuffer(time.Millisecond)
+	if ready := buffer.push(&packetData{ci: gopacket.CaptureInfo{Timestamp: base}}); len(ready) != 0 {
+		t.Errorf("expected packet to be held, got %d released", len(ready))
+	}
+	ready := buffer.push(&packetData{ci: gopacket.CaptureInfo{Timestamp: base.Add(10 * time.Millisecond)}})
+	if len(ready) != 1 || !ready[0].ci.Timestamp.Equal(base) {
+		t.Errorf("expected the first packet to be released, got %+v", ready)
+	}
+}
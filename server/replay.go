@@ -0,0 +1,44 @@
+package server
+
+import (
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// checkPreserveTiming rejects requests to preserve the timing of packets from a live interface,
+// which arrive in real time anyway.
+func checkPreserveTiming(in *api.CaptureRequest) error {
+	if in.PreserveTiming && len(in.OfflineSource) == 0 {
+		return status.Error(codes.InvalidArgument, "timing can only be preserved when reading an offline source")
+	}
+	return nil
+}
+
+// replayPacer delays the packets replayed from an offline source, so that they are delivered
+// with the same gaps between them as their timestamps. Packets timestamped earlier than the one
+// before them aren't delayed.
+type replayPacer struct {
+	first time.Time
+	start time.Time
+}
+
+// wait blocks until the packet with the timestamp is due, or until cancel is closed. The first
+// packet is due immediately.
+func (p *replayPacer) wait(timestamp time.Time, cancel <-chan struct{}) {
+	if p.start.IsZero() {
+		p.first, p.start = timestamp, time.Now()
+		return
+	}
+	delay := timestamp.Sub(p.first) - time.Since(p.start)
+	if delay <= 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-cancel:
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// writeTimedPcapFile writes packets with the given gaps between their timestamps to a temporary
+// pcap file, returning its path.
+func writeTimedPcapFile(t *testing.T, data []byte, gaps ...time.Duration) string {
+	file, err := ioutil.TempFile("", "pcap-test-*.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Unix(1500000000, 0)
+	for i := 0; i <= len(gaps); i++ {
+		if i > 0 {
+			timestamp = timestamp.Add(gaps[i-1])
+		}
+		ci := gopacket.CaptureInfo{Timestamp: timestamp, CaptureLength: len(data), Length: len(data)}
+		if err := writer.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return file.Name()
+}
+
+func TestLiveCapturePreservesTiming(t *testing.T) {
+	path := writeTimedPcapFile(t, udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		30*time.Millisecond, 30*time.Millisecond)
+	defer os.Remove(path)
+	for _, preserve := range []bool{false, true} {
+		stream := newFakeCaptureStream()
+		s := &Server{Config: offlineConfig()}
+		start := time.Now()
+		err := s.LiveCapture(&api.CaptureRequest{OfflineSource: path, PreserveTiming: preserve}, stream)
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stream.packets()) != 3 {
+			t.Fatalf("expected 3 packets, got %d", len(stream.packets()))
+		}
+		if preserve && elapsed < 60*time.Millisecond {
+			t.Errorf("expected the replay to take the 60ms between the packets, took %v", elapsed)
+		}
+		if !preserve && elapsed >= 60*time.Millisecond {
+			t.Errorf("expected the file to be read as fast as possible, took %v", elapsed)
+		}
+	}
+}
+
+func TestLiveCaptureReplayStopsDuringGap(t *testing.T) {
+	path := writeTimedPcapFile(t, udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53), time.Hour)
+	defer os.Remove(path)
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newFakeCaptureStream()
+	stream.ctx = ctx
+	result := make(chan error)
+	go func() {
+		s := &Server{Config: offlineConfig()}
+		result <- s.LiveCapture(&api.CaptureRequest{OfflineSource: path, PreserveTiming: true}, stream)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	stopCapture(t, cancel, result)
+	expectNoLeakedGoroutines(t, before)
+	if len(stream.packets()) != 1 {
+		t.Errorf("expected only the first packet before the gap, got %d", len(stream.packets()))
+	}
+}
+
+func TestPreserveTimingNeedsOfflineSource(t *testing.T) {
+	s := &Server{}
+	err := s.LiveCapture(&api.CaptureRequest{Interface: "eth0", PreserveTiming: true}, newFakeCaptureStream())
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestLiveCaptureOfflineSourceErrors(t *testing.T) {
+	corrupt, err := ioutil.TempFile("", "pcap-test-*.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(corrupt.Name())
+	corrupt.WriteString("not a capture file")
+	corrupt.Close()
+	for _, test := range []struct {
+		source string
+		code   codes.Code
+	}{
+		{filepath.Join(os.TempDir(), "nonexistent", "capture.pcap"), codes.NotFound},
+		{corrupt.Name(), codes.InvalidArgument},
+	} {
+		s := &Server{Config: offlineConfig()}
+		err := s.LiveCapture(&api.CaptureRequest{OfflineSource: test.source}, newFakeCaptureStream())
+		if status.Code(err) != test.code {
+			t.Errorf("%s: expected %v, got %v", test.source, test.code, err)
+		}
+	}
+}
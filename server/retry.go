@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"time"
+)
+
+// Defaults for retrying the activation of capture handles (see Config.ActivateRetries).
+const (
+	DefaultActivateRetries      = 3
+	DefaultActivateRetryBackoff = 100 * time.Millisecond
+)
+
+// activateRetries returns how many times to retry activation, and how long to wait before the
+// first retry.
+func (c *Config) activateRetries() (int, time.Duration) {
+	retries, backoff := c.ActivateRetries, c.ActivateRetryBackoff
+	if retries == 0 {
+		retries = DefaultActivateRetries
+	}
+	if backoff <= 0 {
+		backoff = DefaultActivateRetryBackoff
+	}
+	return retries, backoff
+}
+
+// transientOpenError returns true if opening a capture handle failed in a way that may succeed
+// if tried again.
+func transientOpenError(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.ResourceExhausted
+}
+
+// openWithRetry opens a live capture handle, retrying transient failures with exponential
+// backoff up to the configured number of times. If the handle still can't be opened, the error
+// says how many attempts were made. Retries stop if the server starts shutting down.
+func openWithRetry(in *api.CaptureRequest, config *Config) (*pcap.Handle, []*api.PcapStatus, error) {
+	retries, backoff := config.activateRetries()
+	for attempt := 1; ; attempt++ {
+		handle, warnings, err := openLiveHandle(in)
+		if err == nil || !transientOpenError(err) {
+			return handle, warnings, err
+		}
+		if attempt > retries {
+			return nil, nil, attemptsError(err, attempt)
+		}
+		log.Printf("%s: unable to capture (%v); retrying in %v", in.Interface, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ShuttingDown:
+			return nil, nil, attemptsError(err, attempt)
+		}
+		backoff *= 2
+	}
+}
+
+// attemptsError adds the number of attempts made to a gRPC error, keeping its code and details.
+func attemptsError(err error, attempts int) error {
+	s := status.Convert(err).Proto()
+	s.Message = fmt.Sprintf("%s (after %d attempts)", s.Message, attempts)
+	return status.ErrorProto(s)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingOpens makes live captures fail with err the first failures times they are opened, then
+// open the input file. It returns a function counting the attempts so far.
+func failingOpens(t *testing.T, input string, failures int, err error) func() int {
+	attempts := 0
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		attempts++
+		if attempts <= failures {
+			return nil, nil, err
+		}
+		handle, err := pcap.OpenOffline(input)
+		return handle, nil, err
+	}
+	return func() int { return attempts }
+}
+
+func TestOpenWithRetryRetriesTransientFailures(t *testing.T) {
+	input := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(input)
+	defer func() { openLiveHandle = openLive }()
+	busy := pcapStatusError(errors.New("eth0: socket: Device or resource busy"))
+	if status.Code(busy) != codes.Unavailable {
+		t.Fatalf("expected a busy device to be unavailable, got %v", busy)
+	}
+	config := &Config{ActivateRetryBackoff: time.Millisecond}
+	attempts := failingOpens(t, input, 2, busy)
+	handle, _, err := openWithRetry(&api.CaptureRequest{Interface: "eth0"}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle.Close()
+	if attempts() != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts())
+	}
+
+	attempts = failingOpens(t, input, 10, busy)
+	_, _, err = openWithRetry(&api.CaptureRequest{Interface: "eth0"}, config)
+	if status.Code(err) != codes.Unavailable || !strings.HasSuffix(err.Error(), "busy (after 4 attempts)") {
+		t.Errorf("expected the attempts to be reported, got %v", err)
+	}
+	if attempts() != 1+DefaultActivateRetries {
+		t.Errorf("expected %d attempts, got %d", 1+DefaultActivateRetries, attempts())
+	}
+
+	attempts = failingOpens(t, input, 10, busy)
+	config.ActivateRetries = -1
+	if _, _, err = openWithRetry(&api.CaptureRequest{Interface: "eth0"}, config); attempts() != 1 {
+		t.Errorf("expected retries to be disabled, got %d attempts (%v)", attempts(), err)
+	}
+}
+
+func TestOpenWithRetryGivesUpOnPermanentFailures(t *testing.T) {
+	defer func() { openLiveHandle = openLive }()
+	for _, err := range []error{
+		status.Error(codes.NotFound, "eth0: No such device exists"),
+		status.Error(codes.PermissionDenied, "eth0: You don't have permission to capture on that device"),
+		pcapStatusError(errors.New("eth0: something went wrong")),
+	} {
+		attempts := failingOpens(t, "", 10, err)
+		_, _, openErr := openWithRetry(&api.CaptureRequest{Interface: "eth0"}, &Config{})
+		if openErr != err || attempts() != 1 {
+			t.Errorf("%v: expected no retries, got %d attempts (%v)", err, attempts(), openErr)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"log"
+	"sync/atomic"
+)
+
+// Sampling modes, reported in the CaptureHeader.
+const (
+	samplingKernel    = "kernel"
+	samplingUserspace = "userspace"
+)
+
+// BPF opcodes, and the offset of the Linux random number extension, as defined in
+// linux/filter.h.
+const (
+	bpfLdAbsW  = 0x20
+	bpfAluModK = 0x94
+	bpfJeqK    = 0x15
+	bpfRetK    = 0x06
+
+	bpfRandomOffset = 0xfffff000 + 56
+)
+
+// packetSampler keeps one of every rate packets, for when sampling can't be done by the kernel.
+// The packets it discards are counted, so that the client can be told.
+type packetSampler struct {
+	rate    uint64
+	counter uint64
+	dropped uint64
+}
+
+func newPacketSampler(rate uint32) *packetSampler {
+	return &packetSampler{rate: uint64(rate)}
+}
+
+func (s *packetSampler) allow() bool {
+	s.counter++
+	if s.counter%s.rate != 1 {
+		s.dropped++
+		return false
+	}
+	return true
+}
+
+// samplingOffloadable returns true if the requested sampling can be done by the capture filter.
+// Offline captures are filtered by libpcap in userspace, which doesn't support the extension.
+// Captures of several interfaces are sampled in userspace too, so that the packets of every
+// interface are sampled alike.
+func samplingOffloadable(in *api.CaptureRequest) bool {
+	return in.SampleRate > 1 && bpfRandomSupported && len(in.OfflineSource) == 0 && len(in.Interfaces) == 0
+}
+
+// samplingProgram prepends a random sampling predicate to a compiled filter program, so that
+// the kernel discards all but (on average) one of every rate packets before applying it.
+func samplingProgram(filter []pcap.BPFInstruction, rate uint32) []pcap.BPFInstruction {
+	program := []pcap.BPFInstruction{
+		{Code: bpfLdAbsW, K: bpfRandomOffset},
+		{Code: bpfAluModK, K: rate},
+		// Jumps are relative, so the filter is unaffected by the instructions before it.
+		{Code: bpfJeqK, Jt: 1, K: 0},
+		{Code: bpfRetK, K: 0},
+	}
+	return append(program, filter...)
+}
+
+// kernelFilter returns the filter program the kernel applies to a live capture handle; tests
+// replace it, since they can't open live captures.
+var kernelFilter = attachedFilter
+
+// checkKernelSampling returns an error unless the kernel is applying the sampling program. If
+// libpcap applied it in userspace, where the random number extension can't be loaded, it would
+// discard every packet.
+func checkKernelSampling(handle *pcap.Handle, program []pcap.BPFInstruction) error {
+	attached, err := kernelFilter(handle)
+	if err != nil {
+		return err
+	}
+	// libpcap may rewrite the program's loads (as for cooked captures), which would change the
+	// random number load into another.
+	if len(attached) == 0 || attached[0] != program[0] {
+		return errors.New("the sampling program isn't attached to the capture socket")
+	}
+	return nil
+}
+
+// applyFilter sets the capture filter on the handle, sampling packets within it if the client
+// asked for sampling and the kernel can do it. Otherwise, packets are sampled as they are read.
+func (c *liveCapture) applyFilter(handle *pcap.Handle) error {
+	rate := c.request.SampleRate
+	if samplingOffloadable(c.request) {
+		filter := []pcap.BPFInstruction{{Code: bpfRetK, K: uint32(handle.SnapLen())}}
+		var err error
+		if len(c.filter) > 0 {
+			filter, err = handle.CompileBPFFilter(c.filter)
+		}
+		program := samplingProgram(filter, rate)
+		if err == nil {
+			err = handle.SetBPFInstructionFilter(program)
+		}
+		if err == nil {
+			err = checkKernelSampling(handle, program)
+		}
+		if err == nil {
+			c.sampling = samplingKernel
+			return nil
+		}
+		log.Printf("%s: unable to sample packets in the kernel; sampling in userspace: %v",
+			c.request.Interface, err)
+		if len(c.filter) == 0 {
+			// Replace the sampling program, which may have been set without taking effect.
+			if err := handle.SetBPFInstructionFilter(filter); err != nil {
+				return err
+			}
+		}
+	}
+	if len(c.filter) > 0 {
+		if err := handle.SetBPFFilter(c.filter); err != nil {
+			return err
+		}
+	}
+	if rate > 1 {
+		c.sampler = newPacketSampler(rate)
+		c.sampling = samplingUserspace
+	}
+	return nil
+}
+
+// sampledPackets returns the number of packets sampled out so far, and whether it's an estimate.
+// The kernel doesn't count the packets it samples out, so they are estimated from those it kept:
+// on average, rate-1 packets are discarded for each one kept.
+func (c *liveCapture) sampledPackets() (uint64, bool) {
+	switch c.sampling {
+	case samplingUserspace:
+		return c.sampler.dropped, false
+	case samplingKernel:
+		return atomic.LoadUint64(&c.matched) * uint64(c.request.SampleRate-1), true
+	}
+	return 0, false
+}
@@ -0,0 +1,11 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/gopacket/pcap"
+)
+
+// attachedFilter isn't needed, since BSD BPF can't sample packets (see bpfRandomSupported).
+func attachedFilter(handle *pcap.Handle) ([]pcap.BPFInstruction, error) {
+	return nil, errors.New("attached filters can't be read on this platform")
+}
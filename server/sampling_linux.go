@@ -0,0 +1,52 @@
+package server
+
+// #cgo LDFLAGS: -lpcap
+// #include <pcap.h>
+import "C"
+
+import (
+	"errors"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/sys/unix"
+	"reflect"
+	"unsafe"
+)
+
+// attachedFilter returns the filter program attached to the socket of a live capture handle. It
+// is empty if libpcap is filtering in userspace instead, as it does (only warning on standard
+// error) when the kernel rejects a program.
+func attachedFilter(handle *pcap.Handle) ([]pcap.BPFInstruction, error) {
+	// gopacket doesn't expose the handle's descriptor.
+	cptr := reflect.ValueOf(handle).Elem().FieldByName("cptr")
+	fd := int(C.pcap_fileno((*C.pcap_t)(unsafe.Pointer(cptr.Pointer()))))
+	if fd < 0 {
+		return nil, errors.New("capture handle has no descriptor")
+	}
+	// Asked with a zero length, the kernel reports the number of instructions attached.
+	var length uint32
+	if err := getFilter(fd, nil, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	filter := make([]unix.SockFilter, length)
+	size := length * unix.SizeofSockFilter
+	if err := getFilter(fd, &filter[0], &size); err != nil {
+		return nil, err
+	}
+	instructions := make([]pcap.BPFInstruction, len(filter))
+	for i, f := range filter {
+		instructions[i] = pcap.BPFInstruction{Code: f.Code, Jt: f.Jt, Jf: f.Jf, K: f.K}
+	}
+	return instructions, nil
+}
+
+func getFilter(fd int, filter *unix.SockFilter, length *uint32) error {
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_GET_FILTER,
+		uintptr(unsafe.Pointer(filter)), uintptr(unsafe.Pointer(length)), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSamplingOffloadedWhereSupported(t *testing.T) {
+	if samplingOffloadable(&api.CaptureRequest{Interface: "eth0", SampleRate: 4}) != bpfRandomSupported {
+		t.Errorf("expected live captures to sample in the kernel if BPF supports it (%t)", bpfRandomSupported)
+	}
+	if samplingOffloadable(&api.CaptureRequest{OfflineSource: "in.pcap", SampleRate: 4}) {
+		t.Error("expected offline captures to sample in userspace")
+	}
+	if samplingOffloadable(&api.CaptureRequest{Interface: "eth0", SampleRate: 1}) {
+		t.Error("expected no sampling at a rate of 1")
+	}
+}
+
+func TestSamplingProgramPrecedesFilter(t *testing.T) {
+	filter := []pcap.BPFInstruction{
+		{Code: 0x28, K: 12},
+		{Code: bpfJeqK, Jt: 0, Jf: 1, K: 0x800},
+		{Code: bpfRetK, K: 65535},
+		{Code: bpfRetK, K: 0},
+	}
+	program := samplingProgram(filter, 10)
+	expected := []pcap.BPFInstruction{
+		{Code: bpfLdAbsW, K: 0xfffff038},
+		{Code: bpfAluModK, K: 10},
+		{Code: bpfJeqK, Jt: 1, Jf: 0, K: 0},
+		{Code: bpfRetK, K: 0},
+	}
+	if !reflect.DeepEqual(program[:4], expected) {
+		t.Errorf("unexpected sampling predicate: %+v", program[:4])
+	}
+	if !reflect.DeepEqual(program[4:], filter) {
+		t.Errorf("expected the filter to follow the predicate unchanged: %+v", program[4:])
+	}
+}
+
+func TestLiveCaptureSamplesOfflineSourceInUserspace(t *testing.T) {
+	packets := make([][]byte, 6)
+	for i := range packets {
+		packets[i] = udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000+i, 53)
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{Config: offlineConfig()}
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: path, SampleRate: 3}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if header := stream.replies[0].GetHeader(); header == nil || header.Sampling != samplingUserspace {
+		t.Errorf("expected userspace sampling to be reported, got %+v", stream.replies[0])
+	}
+	if received := stream.packets(); len(received) != 2 {
+		t.Errorf("expected 2 of 6 packets, got %d", len(received))
+	}
+	last := stream.replies[len(stream.replies)-1].GetStatus()
+	if last == nil || last.SampledPackets != 4 {
+		t.Errorf("expected the 4 packets sampled out to be reported, got %+v", last)
+	}
+}
+
+func TestKernelSampledPacketsAreEstimated(t *testing.T) {
+	capture := newLiveCapture(&api.CaptureRequest{Interface: "eth0", SampleRate: 4}, newFakeCaptureStream(), &Config{})
+	capture.sampling = samplingKernel
+	capture.matched = 5
+	record := capture.record(nil)
+	if record.SampledPackets != 15 || !record.SampledPacketsEstimated {
+		t.Errorf("expected an estimate of 15 packets sampled out, got %+v", record)
+	}
+	if err := capture.sendUnsentPackets(); err != nil {
+		t.Fatal(err)
+	}
+	status := capture.stream.(*fakeCaptureStream).replies[0].GetStatus()
+	if status == nil || status.SampledPackets != 15 || !status.SampledPacketsEstimated {
+		t.Errorf("expected the status to report the estimate, got %+v", status)
+	}
+}
+
+func TestKernelSamplingFallsBackUnlessAttached(t *testing.T) {
+	packets := make([][]byte, 6)
+	for i := range packets {
+		packets[i] = udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000+i, 53)
+	}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	defer func() { kernelFilter = attachedFilter }()
+	for _, test := range []struct {
+		name     string
+		attached func(*pcap.Handle) ([]pcap.BPFInstruction, error)
+		sampling string
+	}{
+		// libpcap filters offline handles in userspace, as it does live ones whose program the
+		// kernel rejected: the handle has no socket to attach it to.
+		{"userspace", attachedFilter, samplingUserspace},
+		{"rewritten", func(*pcap.Handle) ([]pcap.BPFInstruction, error) {
+			return []pcap.BPFInstruction{{Code: bpfLdAbsW, K: bpfRandomOffset - 16}}, nil
+		}, samplingUserspace},
+		{"attached", func(*pcap.Handle) ([]pcap.BPFInstruction, error) {
+			return samplingProgram(nil, 3), nil
+		}, samplingKernel},
+	} {
+		kernelFilter = test.attached
+		handle, err := pcap.OpenOffline(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		capture := newLiveCapture(&api.CaptureRequest{Interface: "eth0", SampleRate: 3}, newFakeCaptureStream(), &Config{})
+		if err := capture.applyFilter(handle); err != nil {
+			t.Fatal(err)
+		}
+		if !bpfRandomSupported {
+			test.sampling = samplingUserspace
+		}
+		if capture.sampling != test.sampling {
+			t.Errorf("%s: expected %s sampling, got %q", test.name, test.sampling, capture.sampling)
+		}
+		if capture.sampling == samplingUserspace {
+			// The sampling program was replaced, rather than left to discard every packet.
+			read := 0
+			for ; read < len(packets); read++ {
+				if _, _, err := handle.ReadPacketData(); err != nil {
+					break
+				}
+			}
+			if read != len(packets) || capture.sampler == nil {
+				t.Errorf("%s: expected all %d packets to be read for the sampler, got %d", test.name, len(packets), read)
+			}
+		}
+		handle.Close()
+	}
+}
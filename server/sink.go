@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval is how often file output is flushed to disk, if the client doesn't
+// specify an interval.
+const DefaultFlushInterval = time.Second
+
+// DefaultFileBufferSize is how much file output is buffered in memory, if the client doesn't
+// specify a size.
+const DefaultFileBufferSize = 64 * 1024
+
+// PacketSink receives each captured packet, in addition to the client stream.
+type PacketSink interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+	Close() error
+}
+
+// fileFormat is the format of the files a fileSink writes.
+type fileFormat int
+
+const (
+	formatPcapMicroseconds fileFormat = iota
+	formatPcapNanoseconds
+	formatPcapng
+)
+
+// fileOptions describe the files a fileSink writes.
+type fileOptions struct {
+	linkType layers.LinkType
+	snaplen  int
+	format   fileFormat
+
+	// The interfaces described in pcapng files, in the order of the packets' interface indexes.
+	interfaces []string
+	// The comment in the section header of pcapng files.
+	comment string
+
+	// Zero uses DefaultFileBufferSize, and a negative size disables buffering.
+	bufferSize int
+
+	// If nonzero, once a file reaches this size, it is closed and the next packet starts a new
+	// file (see numberedPath).
+	maxBytes int64
+}
+
+// fileSink writes packets to a pcap file, with either microsecond or nanosecond timestamps, or to
+// a pcapng file. The file is synced to disk periodically, so that a crash loses at most the
+// packets captured during the last flush interval. Shorter intervals improve durability at the
+// cost of throughput.
+//
+// Packets are buffered in memory until the buffer fills or the next flush, so that bursts of
+// small packets become fewer, larger writes.
+type fileSink struct {
+	mu      sync.Mutex
+	file    *os.File
+	buffer  *bufio.Writer
+	counter *countingWriter
+	writer  packetFileWriter
+	dirty   bool
+	done    chan bool
+
+	path    string
+	options fileOptions
+
+	// The file being written, and all of those written so far (including it), in order. Files
+	// started because the last one reached maxBytes are numbered in sequence.
+	current  string
+	files    []string
+	sequence int
+}
+
+// packetFileWriter writes packet records to a capture file, after its header.
+type packetFileWriter interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func newFileSink(path string, options fileOptions, flushInterval time.Duration) (*fileSink, error) {
+	if options.bufferSize == 0 {
+		options.bufferSize = DefaultFileBufferSize
+	}
+	sink := &fileSink{
+		done:    make(chan bool),
+		path:    path,
+		options: options,
+		current: path,
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+	go sink.flushPeriodically(flushInterval)
+	return sink, nil
+}
+
+// open creates the sink's current file, and writes the file header to it (or to the buffer in
+// front of it).
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.current, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	var out io.Writer = file
+	var buffer *bufio.Writer
+	if s.options.bufferSize > 0 {
+		buffer = bufio.NewWriterSize(file, s.options.bufferSize)
+		out = buffer
+	}
+	counter := &countingWriter{w: out}
+	var writer packetFileWriter
+	snaplen := uint32(s.options.snaplen)
+	if s.options.format == formatPcapng {
+		writer, err = newNgFileWriter(counter, snaplen, s.options.linkType, s.options.interfaces, s.options.comment)
+	} else {
+		pcapWriter := newPcapFileWriter(counter, s.options.format == formatPcapNanoseconds)
+		writer, err = pcapWriter, pcapWriter.WriteFileHeader(snaplen, s.options.linkType)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.buffer = buffer
+	s.counter = counter
+	s.writer = writer
+	s.dirty = buffer != nil
+	s.files = append(s.files, s.current)
+	return nil
+}
+
+// numberedPath returns the name of the nth file (counting from zero) written by a sink rotating
+// files by size: the first is the path itself, and the rest are numbered before the extension
+// (so "out.pcapng" is followed by "out.1.pcapng", "out.2.pcapng", and so on).
+func numberedPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	extension := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, extension), n, extension)
+}
+
+// close writes out and closes the current file. The caller must hold the lock.
+func (s *fileSink) close() error {
+	err := s.sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sync writes out any buffered packets, and syncs the file to disk. The caller must hold the
+// lock.
+func (s *fileSink) sync() error {
+	s.dirty = false
+	if s.buffer != nil {
+		if err := s.buffer.Flush(); err != nil {
+			return err
+		}
+	}
+	return s.file.Sync()
+}
+
+// rotate closes the current file, renames it with a timestamp suffix, and starts a new file at
+// the original path. If the file has already been moved away (by logrotate, for example), it is
+// left where it is.
+func (s *fileSink) rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.close(); err != nil {
+		return err
+	}
+	rotated := s.current + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.Rename(s.current, rotated); err == nil {
+		s.files[len(s.files)-1] = rotated
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileSink) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty = true
+	if err := s.writer.WritePacket(ci, data); err != nil {
+		return err
+	}
+	if s.options.maxBytes <= 0 || s.counter.n < s.options.maxBytes {
+		return nil
+	}
+	if err := s.close(); err != nil {
+		return err
+	}
+	s.sequence++
+	s.current = numberedPath(s.path, s.sequence)
+	return s.open()
+}
+
+// writtenFiles returns the files written so far, in order.
+func (s *fileSink) writtenFiles() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.files...)
+}
+
+func (s *fileSink) flushPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+// flush writes out any buffered packets and syncs the file to disk, if anything has been written
+// since the last flush.
+func (s *fileSink) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.sync()
+}
+
+func (s *fileSink) Close() error {
+	close(s.done)
+	err := s.flush()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// outputPath resolves a client-supplied output file name within the configured output
+// directory, refusing names that would escape it.
+func outputPath(directory string, name string) (string, error) {
+	if len(directory) == 0 {
+		return "", errors.New("file output is not enabled on this server")
+	}
+	path := filepath.Join(directory, filepath.Clean("/"+name))
+	if !strings.HasPrefix(path, filepath.Clean(directory)+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid output path: %s", name)
+	}
+	return path, nil
+}
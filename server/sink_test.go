@@ -0,0 +1,566 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pcapme/pcap/api"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSinkFlushesWithinInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	interval := 10 * time.Millisecond
+	path := filepath.Join(dir, "out.pcap")
+	sink, err := newFileSink(path, fileOptions{linkType: layers.LinkTypeEthernet, snaplen: 65535}, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	if err := sink.WritePacket(captureInfoFor(data), data); err != nil {
+		t.Fatal(err)
+	}
+	// The file header (24 bytes) and the packet, with its record header (16 bytes), should reach
+	// the file without the sink being closed.
+	deadline := time.Now().Add(50 * interval)
+	for {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(contents) == 24+16+len(data) && bytes.HasSuffix(contents, data) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("packet was not flushed to disk: the file has %d bytes", len(contents))
+		}
+		time.Sleep(interval / 2)
+	}
+}
+
+func TestOutputPathStaysInDirectory(t *testing.T) {
+	if _, err := outputPath("", "out.pcap"); err == nil {
+		t.Error("expected an error when file output is disabled")
+	}
+	path, err := outputPath("/var/lib/pcapd", "../../etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/var/lib/pcapd/etc/passwd" {
+		t.Errorf("unexpected path: %s", path)
+	}
+}
+
+func TestLiveCaptureWritesOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	}
+	input := writePcapFile(t, packets)
+	defer os.Remove(input)
+	s := NewServer(Config{OfflineDirectory: os.TempDir(), OutputDirectory: dir})
+	request := &api.CaptureRequest{OfflineSource: input, OutputPath: "out.pcap", MaxForwardBytes: 14}
+	stream := newFakeCaptureStream()
+	if err := s.LiveCapture(request, stream); err != nil {
+		t.Fatal(err)
+	}
+	for _, packet := range stream.packets() {
+		if len(packet.Data) != 14 {
+			t.Errorf("expected forwarded data to be trimmed, got %d bytes", len(packet.Data))
+		}
+	}
+	file, err := os.Open(filepath.Join(dir, "out.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range packets {
+		data, _, err := reader.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if len(data) != len(expected) {
+			t.Errorf("packet %d: expected %d bytes in file, got %d", i, len(expected), len(data))
+		}
+	}
+}
+
+func TestLiveCaptureOutputFileSnaplen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	}
+	input := writePcapFile(t, packets)
+	defer os.Remove(input)
+	s := NewServer(Config{OfflineDirectory: os.TempDir(), OutputDirectory: dir})
+	request := &api.CaptureRequest{OfflineSource: input, OutputPath: "out.pcap", FileSnaplen: 20}
+	stream := newFakeCaptureStream()
+	if err := s.LiveCapture(request, stream); err != nil {
+		t.Fatal(err)
+	}
+	if header := stream.replies[0].GetHeader(); header.Snaplen != 65535 {
+		t.Errorf("expected the stream to keep the capture snaplen, got %d", header.Snaplen)
+	}
+	for _, packet := range stream.packets() {
+		if len(packet.Data) <= 20 {
+			t.Errorf("expected forwarded data not to be truncated, got %d bytes", len(packet.Data))
+		}
+	}
+	file, err := os.Open(filepath.Join(dir, "out.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Snaplen() != 20 {
+		t.Errorf("expected the file to advertise a snaplen of 20, got %d", reader.Snaplen())
+	}
+	for i, expected := range packets {
+		data, ci, err := reader.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if len(data) != 20 || ci.Length != len(expected) {
+			t.Errorf("packet %d: expected 20 of %d bytes in file, got %d of %d", i, len(expected), len(data), ci.Length)
+		}
+	}
+}
+
+func TestFileSinkTimestampPrecision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	ci := captureInfoFor(data)
+	ci.Timestamp = time.Unix(1500000000, 123456789)
+	for _, test := range []struct {
+		nanoseconds bool
+		expected    int
+	}{
+		{false, 123456000},
+		{true, 123456789},
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("out-%t.pcap", test.nanoseconds))
+		options := fileOptions{linkType: layers.LinkTypeEthernet, snaplen: 65535}
+		if test.nanoseconds {
+			options.format = formatPcapNanoseconds
+		}
+		sink, err := newFileSink(path, options, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := pcapgo.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, readCI, err := reader.ReadPacketData()
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if readCI.Timestamp.Unix() != 1500000000 || readCI.Timestamp.Nanosecond() != test.expected {
+			t.Errorf("nanoseconds=%t: expected %d ns, got %v", test.nanoseconds, test.expected, readCI.Timestamp)
+		}
+	}
+}
+
+func TestLiveCaptureWritesWellFormedTruncatedRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const snaplen = 48
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp6Fixture(t, 1),
+	}
+	input, err := ioutil.TempFile(dir, "in-*.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := pcapgo.NewWriter(input)
+	if err := writer.WriteFileHeader(snaplen, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range packets {
+		ci := captureInfoFor(data[:snaplen])
+		ci.Length = len(data)
+		if err := writer.WritePacket(ci, data[:snaplen]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	input.Close()
+	s := NewServer(Config{OfflineDirectory: os.TempDir(), OutputDirectory: dir})
+	request := &api.CaptureRequest{OfflineSource: input.Name(), OutputPath: "out.pcap"}
+	if err := s.LiveCapture(request, newFakeCaptureStream()); err != nil {
+		t.Fatal(err)
+	}
+	output, err := ioutil.ReadFile(filepath.Join(dir, "out.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output) < 24 || binary.LittleEndian.Uint32(output[16:20]) != snaplen {
+		t.Fatalf("unexpected file header: %x", output[:24])
+	}
+	records := output[24:]
+	for i, data := range packets {
+		if len(records) < 16 {
+			t.Fatalf("packet %d: missing record", i)
+		}
+		included := binary.LittleEndian.Uint32(records[8:12])
+		original := binary.LittleEndian.Uint32(records[12:16])
+		if included != snaplen || original != uint32(len(data)) {
+			t.Errorf("packet %d: expected incl_len %d and orig_len %d, got %d and %d",
+				i, snaplen, len(data), included, original)
+		}
+		records = records[16:]
+		if uint32(len(records)) < included {
+			t.Fatalf("packet %d: record is shorter than its incl_len", i)
+		}
+		records = records[included:]
+	}
+	if len(records) != 0 {
+		t.Errorf("expected no trailing data, got %d bytes", len(records))
+	}
+}
+
+func TestPcapFileWriterNormalizesLengths(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newPcapFileWriter(&buf, false)
+	if err := writer.WriteFileHeader(64, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 100)
+	// Data beyond the snaplen, and an original length shorter than the data.
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 100, Length: 90}
+	if err := writer.WritePacket(ci, data); err != nil {
+		t.Fatal(err)
+	}
+	record := buf.Bytes()[24:]
+	if included, original := binary.LittleEndian.Uint32(record[8:12]), binary.LittleEndian.Uint32(record[12:16]); included != 64 || original != 100 {
+		t.Errorf("expected incl_len 64 and orig_len 100, got %d and %d", included, original)
+	}
+	if len(record) != 16+64 {
+		t.Errorf("expected 64 bytes of packet data, got %d", len(record)-16)
+	}
+}
+
+// readPcapPackets returns the data of each packet in a pcap file.
+func readPcapPackets(t *testing.T, path string) [][]byte {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets [][]byte
+	for {
+		data, _, err := reader.ReadPacketData()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("packet %d: %v", len(packets), err)
+		}
+		packets = append(packets, data)
+	}
+}
+
+func TestFileSinkBufferLosesNoPacketsAcrossFlushes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.pcap")
+	// A buffer smaller than two packets, so that records straddle the point where it fills.
+	sink, err := newFileSink(path, fileOptions{linkType: layers.LinkTypeEthernet, snaplen: 65535, bufferSize: 100}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written [][]byte
+	for i := 0; i < 10; i++ {
+		data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000+i, 53)
+		if err := sink.WritePacket(captureInfoFor(data), data); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, data)
+		if i == 4 {
+			if err := sink.flush(); err != nil {
+				t.Fatal(err)
+			}
+			if packets := readPcapPackets(t, path); len(packets) != len(written) {
+				t.Errorf("expected %d packets on disk after a flush, got %d", len(written), len(packets))
+			}
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	packets := readPcapPackets(t, path)
+	if len(packets) != len(written) {
+		t.Fatalf("expected %d packets, got %d", len(written), len(packets))
+	}
+	for i := range written {
+		if !bytes.Equal(packets[i], written[i]) {
+			t.Errorf("packet %d: data mismatch", i)
+		}
+	}
+}
+
+func benchmarkFileSink(b *testing.B, bufferSize int) {
+	dir, err := ioutil.TempDir("", "pcap-sink")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sink, err := newFileSink(filepath.Join(dir, "out.pcap"), fileOptions{linkType: layers.LinkTypeEthernet, snaplen: 65535, bufferSize: bufferSize}, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	data := bytes.Repeat([]byte{0xab}, 128)
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sink.WritePacket(ci, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFileSinkUnbuffered(b *testing.B) {
+	benchmarkFileSink(b, -1)
+}
+
+func BenchmarkFileSinkBuffered(b *testing.B) {
+	benchmarkFileSink(b, DefaultFileBufferSize)
+}
+
+func TestNumberedPath(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		n        int
+		expected string
+	}{
+		{"/out/capture.pcapng", 0, "/out/capture.pcapng"},
+		{"/out/capture.pcapng", 1, "/out/capture.1.pcapng"},
+		{"/out/capture.pcapng", 12, "/out/capture.12.pcapng"},
+		{"/out/capture", 2, "/out/capture.2"},
+	} {
+		if path := numberedPath(test.path, test.n); path != test.expected {
+			t.Errorf("%s, %d: expected %s, got %s", test.path, test.n, test.expected, path)
+		}
+	}
+}
+
+// readNgPackets returns the packets in a pcapng file, along with the name of the interface each
+// was captured on.
+func readNgPackets(t *testing.T, path string) ([][]byte, []string) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets [][]byte
+	var interfaces []string
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			return packets, interfaces
+		}
+		if err != nil {
+			t.Fatalf("%s: packet %d: %v", path, len(packets), err)
+		}
+		intf, err := reader.Interface(ci.InterfaceIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, data)
+		interfaces = append(interfaces, intf.Name)
+	}
+}
+
+func TestFileSinkRotatesBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	options := fileOptions{
+		linkType:   layers.LinkTypeEthernet,
+		snaplen:    65535,
+		format:     formatPcapng,
+		interfaces: []string{"eth0"},
+		maxBytes:   400,
+	}
+	sink, err := newFileSink(filepath.Join(dir, "out.pcapng"), options, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := sink.WritePacket(captureInfoFor(data), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := sink.writtenFiles()
+	if len(files) < 3 {
+		t.Fatalf("expected the capture to be split across several files, got %v", files)
+	}
+	total := 0
+	for i, path := range files {
+		if expected := numberedPath(filepath.Join(dir, "out.pcapng"), i); path != expected {
+			t.Errorf("file %d: expected %s, got %s", i, expected, path)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(files)-1 && info.Size() < options.maxBytes {
+			t.Errorf("%s: rotated at %d bytes, before reaching %d", path, info.Size(), options.maxBytes)
+		}
+		packets, interfaces := readNgPackets(t, path)
+		for j, packet := range packets {
+			if !bytes.Equal(packet, data) || interfaces[j] != "eth0" {
+				t.Errorf("%s: packet %d: unexpected packet on %q", path, j, interfaces[j])
+			}
+		}
+		total += len(packets)
+	}
+	if total != 10 {
+		t.Errorf("expected 10 packets across the files, got %d", total)
+	}
+}
+
+func TestLiveCaptureWritesPcapngOnShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	eth0 := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	eth1 := udp4Fixture(t, "198.51.100.1", "198.51.100.2", 1000, 53)
+	defer fakeInterfaces(t, map[string][][]byte{"eth0": {eth0, eth0}, "eth1": {eth1, eth1}})()
+	defer func() { ShuttingDown = make(chan int) }()
+	s := NewServer(Config{OutputDirectory: dir})
+	stream := newFakeCaptureStream()
+	result := make(chan error)
+	go func() {
+		result <- s.LiveCapture(&api.CaptureRequest{
+			Interface:    "eth0",
+			Interfaces:   []string{"eth1"},
+			OutputPath:   "out.pcapng",
+			OutputFormat: api.CaptureRequest_PCAPNG,
+			MaxFileBytes: 300,
+		}, stream)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(ShuttingDown)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, reply := range stream.replies {
+		if status := reply.GetStatus(); status != nil && len(status.OutputFiles) > 0 {
+			files = status.OutputFiles
+		}
+	}
+	if len(files) < 2 {
+		t.Fatalf("expected the capture to be split across several files, got %v", files)
+	}
+	counts := make(map[string]int)
+	for _, path := range files {
+		packets, interfaces := readNgPackets(t, path)
+		for i, packet := range packets {
+			if interfaces[i] == "eth0" && bytes.Equal(packet, eth0) || interfaces[i] == "eth1" && bytes.Equal(packet, eth1) {
+				counts[interfaces[i]]++
+			} else {
+				t.Errorf("%s: packet %d: unexpected packet on %q", path, i, interfaces[i])
+			}
+		}
+	}
+	if counts["eth0"] != 2 || counts["eth1"] != 2 {
+		t.Errorf("expected every packet to be written, got %v", counts)
+	}
+}
+
+func TestNgFileWriterDescribesHost(t *testing.T) {
+	defer func(version string) { Version = version }(Version)
+	Version = "1.2.3"
+	var buf bytes.Buffer
+	writer, err := newNgFileWriter(&buf, 65535, layers.LinkTypeEthernet, []string{"eth0"}, "lab capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now()}, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := pcapgo.NewNgReader(&buf, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := reader.SectionInfo()
+	if info.Application != "pcapd 1.2.3" || info.Comment != "lab capture" || info.Hardware != runtime.GOARCH {
+		t.Errorf("unexpected section info: %+v", info)
+	}
+	if !strings.HasPrefix(info.OS, runtime.GOOS) {
+		t.Errorf("expected the OS to be described, got %q", info.OS)
+	}
+}
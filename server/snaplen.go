@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"regexp"
+)
+
+// MaxSnaplen is the largest snaplen chosen automatically, matching libpcap's default.
+const MaxSnaplen = 262144
+
+// Link-layer header lengths, used to choose a snaplen. Ethernet allows for an 802.1Q tag.
+var linkHeaderLengths = map[layers.LinkType]int{
+	layers.LinkTypeEthernet: 14 + 4,
+	layers.LinkTypeNull:     4,
+	layers.LinkTypeLoop:     4,
+	layers.LinkTypeRaw:      0,
+	layers.LinkTypeLinuxSLL: 16,
+}
+
+// autoSnaplen returns a snaplen large enough for a full packet of the given MTU on the link type,
+// or zero (selecting the libpcap default) if the link-layer header length isn't known.
+func autoSnaplen(mtu int, linkType layers.LinkType) int {
+	headerLength, ok := linkHeaderLengths[linkType]
+	if !ok || mtu <= 0 {
+		return 0
+	}
+	snaplen := mtu + headerLength
+	if snaplen > MaxSnaplen {
+		snaplen = MaxSnaplen
+	}
+	return snaplen
+}
+
+// guessLinkType predicts the link type libpcap will report for an interface, before the capture
+// handle is activated (at which point the snaplen can no longer be changed).
+func guessLinkType(iface *net.Interface) layers.LinkType {
+	if iface.Flags&net.FlagLoopback != 0 {
+		return loopbackLinkType
+	}
+	if len(iface.HardwareAddr) == 6 {
+		return layers.LinkTypeEthernet
+	}
+	return layers.LinkTypeRaw
+}
+
+// interfaceSnaplen chooses a snaplen for capturing full packets on the named interface, based on
+// its MTU and link type. Note that with receive offloads (such as GRO) enabled, the kernel may
+// deliver packets larger than the MTU, which will then be truncated; request a larger snaplen
+// explicitly if that matters.
+func interfaceSnaplen(name string) int {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0
+	}
+	return autoSnaplen(iface.MTU, guessLinkType(iface))
+}
+
+var (
+	tcpFilterPattern       = regexp.MustCompile(`\btcp\b`)
+	transportFilterPattern = regexp.MustCompile(`\b(udp|port|portrange|icmp|icmp6)\b`)
+	ipv6FilterPattern      = regexp.MustCompile(`\b(ip6|icmp6)\b`)
+	networkFilterPattern   = regexp.MustCompile(`\b(ip|host|net|proto)\b`)
+)
+
+// minimumSnaplen estimates the number of bytes that must be captured for the headers that the
+// filter matches on (or that summaries report) to be present, assuming headers without options.
+// It returns zero if the link-layer header length isn't known.
+func minimumSnaplen(in *api.CaptureRequest, filter string, linkType layers.LinkType) int {
+	length, ok := linkHeaderLengths[linkType]
+	if !ok {
+		return 0
+	}
+	if linkType == layers.LinkTypeEthernet {
+		// Without the allowance for a tag; each VLAN the filter matches on adds one.
+		length = 14 + 4*len(vlanFilterPattern.FindAllString(filter, -1))
+	}
+	length += 4 * len(in.MplsLabels)
+	network, transport := 0, 0
+	switch {
+	case in.Summarize || tcpFilterPattern.MatchString(filter):
+		network, transport = 20, 20
+	case transportFilterPattern.MatchString(filter):
+		network, transport = 20, 8
+	case networkFilterPattern.MatchString(filter):
+		network = 20
+	}
+	if ipv6FilterPattern.MatchString(filter) {
+		network = 40
+	}
+	if len(in.VxlanVnis) > 0 {
+		// The VNI is in the VXLAN header, after the outer UDP header and an IP header that may be
+		// IPv6.
+		return length + 40 + 8 + 8
+	}
+	return length + network + transport
+}
+
+// checkSnaplen returns a warning if the snaplen is too short for the headers that the filter
+// matches on (or that summaries report). Such captures tend to match nothing, or to be summarized
+// without their transport details. If the client asked for a strict check, it's an error instead.
+func checkSnaplen(in *api.CaptureRequest, filter string, linkType layers.LinkType, snaplen int) (*api.CaptureStatus, error) {
+	minimum := minimumSnaplen(in, filter, linkType)
+	if minimum == 0 || snaplen <= 0 || snaplen >= minimum {
+		return nil, nil
+	}
+	message := fmt.Sprintf("snaplen %d is too short for the headers this capture needs (at least %d bytes)",
+		snaplen, minimum)
+	if in.StrictSnaplen {
+		return nil, status.Error(codes.InvalidArgument, message)
+	}
+	return &api.CaptureStatus{Message: message}, nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAutoSnaplen(t *testing.T) {
+	for _, test := range []struct {
+		mtu      int
+		linkType layers.LinkType
+		expected int
+	}{
+		{1500, layers.LinkTypeEthernet, 1518},
+		{9000, layers.LinkTypeEthernet, 9018},
+		{1420, layers.LinkTypeRaw, 1420},
+		{65536, layers.LinkTypeNull, 65540},
+		{1 << 20, layers.LinkTypeEthernet, MaxSnaplen},
+		{1500, layers.LinkTypeIEEE80211Radio, 0},
+	} {
+		if snaplen := autoSnaplen(test.mtu, test.linkType); snaplen != test.expected {
+			t.Errorf("MTU %d, %v: expected %d, got %d", test.mtu, test.linkType, test.expected, snaplen)
+		}
+	}
+}
+
+func TestGuessLinkType(t *testing.T) {
+	ethernet := &net.Interface{HardwareAddr: net.HardwareAddr{0, 1, 2, 3, 4, 5}}
+	if linkType := guessLinkType(ethernet); linkType != layers.LinkTypeEthernet {
+		t.Errorf("expected Ethernet, got %v", linkType)
+	}
+	if linkType := guessLinkType(&net.Interface{Name: "tun0"}); linkType != layers.LinkTypeRaw {
+		t.Errorf("expected a raw link type, got %v", linkType)
+	}
+	if linkType := guessLinkType(&net.Interface{Flags: net.FlagLoopback}); linkType != loopbackLinkType {
+		t.Errorf("expected the loopback link type, got %v", linkType)
+	}
+}
+
+func TestCheckSnaplen(t *testing.T) {
+	for _, test := range []struct {
+		filter  string
+		request *api.CaptureRequest
+		snaplen int
+		warn    bool
+	}{
+		{"tcp port 22", &api.CaptureRequest{}, 14, true},
+		{"tcp port 22", &api.CaptureRequest{}, 54, false},
+		{"udp port 53", &api.CaptureRequest{}, 41, true},
+		{"udp port 53", &api.CaptureRequest{}, 42, false},
+		{"ip6 and udp", &api.CaptureRequest{}, 42, true},
+		{"vlan 10 and tcp", &api.CaptureRequest{}, 54, true},
+		{"", &api.CaptureRequest{}, 14, false},
+		{"", &api.CaptureRequest{Summarize: true}, 40, true},
+		{"", &api.CaptureRequest{VxlanVnis: []uint32{100}}, 69, true},
+		{"", &api.CaptureRequest{VxlanVnis: []uint32{100}}, 70, false},
+	} {
+		warning, err := checkSnaplen(test.request, test.filter, layers.LinkTypeEthernet, test.snaplen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (warning != nil) != test.warn {
+			t.Errorf("%q with snaplen %d: expected a warning: %t, got %+v", test.filter, test.snaplen, test.warn, warning)
+		}
+	}
+	_, err := checkSnaplen(&api.CaptureRequest{StrictSnaplen: true}, "tcp port 22", layers.LinkTypeEthernet, 14)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected a strict check to fail, got %v", err)
+	}
+}
+
+func TestLiveCaptureWarnsAboutShortSnaplen(t *testing.T) {
+	file, err := ioutil.TempFile("", "pcap-test-*.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if err := pcapgo.NewWriter(file).WriteFileHeader(14, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	stream := newFakeCaptureStream()
+	s := &Server{Config: offlineConfig()}
+	if err := s.LiveCapture(&api.CaptureRequest{OfflineSource: file.Name(), Summarize: true}, stream); err != nil {
+		t.Fatal(err)
+	}
+	var warned bool
+	for _, reply := range stream.replies {
+		if status := reply.GetStatus(); status != nil && strings.Contains(status.Message, "snaplen 14") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Error("expected a warning about the snaplen")
+	}
+}
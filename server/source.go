@@ -0,0 +1,46 @@
+package server
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// resolveSource translates a libpcap source string in the request into the interface or offline
+// source it names, returning a copy of the request. Supported sources are "file://<path>",
+// "if://<interface>", and "rpcap://<interface>" for a local interface. Remote rpcap sources
+// ("rpcap://host[:port]/<interface>") need pcap_open(), which gopacket doesn't provide.
+func resolveSource(in *api.CaptureRequest) (*api.CaptureRequest, error) {
+	if len(in.Source) == 0 {
+		return in, nil
+	}
+	if len(in.Interface) > 0 || len(in.OfflineSource) > 0 {
+		return nil, status.Error(codes.InvalidArgument,
+			"a source can't be combined with an interface or offline source")
+	}
+	resolved := proto.Clone(in).(*api.CaptureRequest)
+	resolved.Source = ""
+	var name string
+	switch {
+	case strings.HasPrefix(in.Source, "file://"):
+		resolved.OfflineSource = strings.TrimPrefix(in.Source, "file://")
+		name = resolved.OfflineSource
+	case strings.HasPrefix(in.Source, "if://"):
+		resolved.Interface = strings.TrimPrefix(in.Source, "if://")
+		name = resolved.Interface
+	case strings.HasPrefix(in.Source, "rpcap://"):
+		resolved.Interface = strings.TrimPrefix(in.Source, "rpcap://")
+		if strings.Contains(resolved.Interface, "/") {
+			return nil, status.Errorf(codes.Unimplemented, "remote rpcap sources are not supported: %s", in.Source)
+		}
+		name = resolved.Interface
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported source: %s", in.Source)
+	}
+	if len(name) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "source doesn't name an interface or file: %s", in.Source)
+	}
+	return resolved, nil
+}
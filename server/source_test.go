@@ -0,0 +1,51 @@
+package server
+
+import (
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"testing"
+)
+
+func TestResolveSource(t *testing.T) {
+	for _, test := range []struct {
+		source        string
+		iface         string
+		offlineSource string
+		code          codes.Code
+	}{
+		{"file:///tmp/in.pcap", "", "/tmp/in.pcap", codes.OK},
+		{"if://eth0", "eth0", "", codes.OK},
+		{"rpcap://eth0", "eth0", "", codes.OK},
+		{"rpcap://192.0.2.1:2002/eth0", "", "", codes.Unimplemented},
+		{"file://", "", "", codes.InvalidArgument},
+		{"eth0", "", "", codes.InvalidArgument},
+	} {
+		resolved, err := resolveSource(&api.CaptureRequest{Source: test.source})
+		if status.Code(err) != test.code {
+			t.Errorf("%s: expected %v, got %v", test.source, test.code, err)
+			continue
+		}
+		if err == nil && (resolved.Interface != test.iface || resolved.OfflineSource != test.offlineSource) {
+			t.Errorf("%s: unexpected request: %+v", test.source, resolved)
+		}
+	}
+	if _, err := resolveSource(&api.CaptureRequest{Source: "if://eth0", Interface: "eth1"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected a source and an interface to be rejected, got %v", err)
+	}
+}
+
+func TestLiveCaptureFileSource(t *testing.T) {
+	packets := [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)}
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{Config: offlineConfig()}
+	if err := s.LiveCapture(&api.CaptureRequest{Source: "file://" + path}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if received := stream.packets(); len(received) != len(packets) {
+		t.Errorf("expected %d packets, got %d", len(packets), len(received))
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStatisticsInterval is how often statistics are reported, if the client doesn't specify
+// an interval.
+const DefaultStatisticsInterval = time.Second
+
+// endedCapturesRemembered is how many of the most recently ended captures the registry keeps the
+// records of, so that stopping a capture just after it ended isn't an error.
+const endedCapturesRemembered = 64
+
+// runningCaptures tracks the running captures by ID, so that their statistics can be reported
+// by another RPC.
+type runningCaptures struct {
+	mu       sync.Mutex
+	nextID   uint64
+	captures map[uint64]*liveCapture
+
+	// The final records of recently ended captures, and their IDs, oldest first.
+	ended    map[uint64]*api.CaptureRecord
+	endedIDs []uint64
+}
+
+// add registers a capture, returning its ID.
+func (r *runningCaptures) add(capture *liveCapture) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.captures == nil {
+		r.captures = make(map[uint64]*liveCapture)
+	}
+	r.nextID++
+	r.captures[r.nextID] = capture
+	return r.nextID
+}
+
+// remove unregisters a capture once it has ended, remembering its final record.
+func (r *runningCaptures) remove(id uint64, final *api.CaptureRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.captures, id)
+	if r.ended == nil {
+		r.ended = make(map[uint64]*api.CaptureRecord)
+	}
+	r.ended[id] = final
+	r.endedIDs = append(r.endedIDs, id)
+	if len(r.endedIDs) > endedCapturesRemembered {
+		delete(r.ended, r.endedIDs[0])
+		r.endedIDs = r.endedIDs[1:]
+	}
+}
+
+func (r *runningCaptures) get(id uint64) *liveCapture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.captures[id]
+}
+
+// lookup returns the running capture with the ID, or if it has recently ended, its final record.
+// It returns false if neither is known.
+func (r *runningCaptures) lookup(id uint64) (*liveCapture, *api.CaptureRecord, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if capture, ok := r.captures[id]; ok {
+		return capture, nil, true
+	}
+	final, ok := r.ended[id]
+	return nil, final, ok
+}
+
+// handleStats can be replaced in tests, since offline handles have no statistics.
+var handleStats = (*pcap.Handle).Stats
+
+var errCaptureEnded = errors.New("capture has ended")
+
+// setStatsHandles makes the statistics of the capture's handles available, until they are
+// cleared (with no handles) or replaced before any of the handles are closed.
+func (c *liveCapture) setStatsHandles(handles ...*pcap.Handle) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	c.statsHandles = handles
+}
+
+// stats reads the statistics of the capture's handles, totalled over all of its interfaces, or
+// fails if the capture has ended.
+func (c *liveCapture) stats() (*pcap.Stats, error) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	if len(c.statsHandles) == 0 {
+		return nil, errCaptureEnded
+	}
+	total := &pcap.Stats{}
+	for _, handle := range c.statsHandles {
+		stats, err := handleStats(handle)
+		if err != nil {
+			return nil, err
+		}
+		total.PacketsReceived += stats.PacketsReceived
+		total.PacketsDropped += stats.PacketsDropped
+		total.PacketsIfDropped += stats.PacketsIfDropped
+	}
+	return total, nil
+}
+
+// tallyKernelDrops adds the packets the kernel dropped on each of the capture's handles to the
+// capture's statistics. Only the first call counts, so that it can be made as soon as the capture
+// has ended, and again on the way out for captures that failed first.
+func (c *liveCapture) tallyKernelDrops(handles ...*pcap.Handle) {
+	if c.kernelDropsTallied {
+		return
+	}
+	c.kernelDropsTallied = true
+	for _, handle := range handles {
+		if stats, err := handleStats(handle); err == nil {
+			c.kernelDropped += uint64(stats.PacketsDropped)
+		}
+	}
+}
+
+// Statistics reports the libpcap statistics of a running capture at the requested interval, until
+// the capture ends.
+func (s *Server) Statistics(in *api.StatisticsRequest, stream api.PCAP_StatisticsServer) error {
+	log.Printf("Statistics(%+v)", in)
+	capture := s.captures.get(in.CaptureId)
+	if capture == nil {
+		return status.Errorf(codes.NotFound, "no running capture has ID %d", in.CaptureId)
+	}
+	interval := time.Duration(in.IntervalNanoseconds)
+	if interval <= 0 {
+		interval = DefaultStatisticsInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stats, err := capture.stats()
+		if err == errCaptureEnded {
+			return nil
+		} else if err != nil {
+			return status.Errorf(codes.Unavailable, "statistics are not available: %v", err)
+		}
+		reply := &api.StatisticsReply{
+			PacketsReceived:  uint32(stats.PacketsReceived),
+			PacketsDropped:   uint32(stats.PacketsDropped),
+			PacketsIfDropped: uint32(stats.PacketsIfDropped),
+			PacketsMatched:   atomic.LoadUint64(&capture.matched),
+		}
+		if reply.PacketsReceived > 0 {
+			reply.MatchRatio = float64(reply.PacketsMatched) / float64(reply.PacketsReceived)
+		}
+		err = stream.Send(reply)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-capture.ended:
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeStatisticsStream collects the replies sent by the Statistics RPC.
+type fakeStatisticsStream struct {
+	*fakeCaptureStream
+	mu      sync.Mutex
+	replies []*api.StatisticsReply
+}
+
+func (f *fakeStatisticsStream) Send(reply *api.StatisticsReply) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies = append(f.replies, reply)
+	return nil
+}
+
+func (f *fakeStatisticsStream) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.replies)
+}
+
+func TestStatisticsReportsRunningCapture(t *testing.T) {
+	defer fakeIdleInterface(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})()
+	defer func() { handleStats = (*pcap.Handle).Stats }()
+	var mu sync.Mutex
+	calls := 0
+	handleStats = func(*pcap.Handle) (*pcap.Stats, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return &pcap.Stats{PacketsReceived: 10 * calls, PacketsDropped: calls, PacketsIfDropped: 2 * calls}, nil
+	}
+	s := NewServer(Config{})
+	captureStream := newFakeCaptureStream()
+	result := make(chan error)
+	go func() {
+		result <- s.LiveCapture(&api.CaptureRequest{Interface: "eth0"}, captureStream)
+	}()
+	var capture *liveCapture
+	for deadline := time.Now().Add(time.Second); capture == nil; capture = s.captures.get(1) {
+		if time.Now().After(deadline) {
+			t.Fatal("capture did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	statsStream := &fakeStatisticsStream{fakeCaptureStream: newFakeCaptureStream()}
+	statsResult := make(chan error)
+	go func() {
+		in := &api.StatisticsRequest{CaptureId: 1, IntervalNanoseconds: int64(time.Millisecond)}
+		statsResult <- s.Statistics(in, statsStream)
+	}()
+	for deadline := time.Now().Add(time.Second); statsStream.count() < 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("statistics were not reported periodically")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	capture.requestStop()
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-statsResult; err != nil {
+		t.Fatalf("expected the statistics stream to end with the capture, got %v", err)
+	}
+	if header := captureStream.replies[0].GetHeader(); header == nil || header.CaptureId != 1 {
+		t.Errorf("expected the header to carry the capture ID, got %+v", captureStream.replies[0])
+	}
+	first := statsStream.replies[0]
+	if first.PacketsReceived != 10 || first.PacketsDropped != 1 || first.PacketsIfDropped != 2 {
+		t.Errorf("unexpected statistics: %+v", first)
+	}
+	err := s.Statistics(&api.StatisticsRequest{CaptureId: 1}, statsStream)
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound once the capture has ended, got %v", err)
+	}
+}
+
+func TestStatisticsUnknownCapture(t *testing.T) {
+	stream := &fakeStatisticsStream{fakeCaptureStream: newFakeCaptureStream()}
+	err := NewServer(Config{}).Statistics(&api.StatisticsRequest{CaptureId: 42}, stream)
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func TestStatisticsAfterHandleReleased(t *testing.T) {
+	capture := newLiveCapture(&api.CaptureRequest{}, newFakeCaptureStream(), &Config{})
+	if _, err := capture.stats(); err != errCaptureEnded {
+		t.Errorf("expected %v, got %v", errCaptureEnded, err)
+	}
+}
+
+func TestStatisticsTotalInterfaces(t *testing.T) {
+	defer func() { handleStats = (*pcap.Handle).Stats }()
+	handleStats = func(*pcap.Handle) (*pcap.Stats, error) {
+		return &pcap.Stats{PacketsReceived: 10, PacketsDropped: 1, PacketsIfDropped: 2}, nil
+	}
+	capture := newLiveCapture(&api.CaptureRequest{Interface: "eth0"}, newFakeCaptureStream(), &Config{})
+	capture.setStatsHandles(&pcap.Handle{}, &pcap.Handle{})
+	stats, err := capture.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.PacketsReceived != 20 || stats.PacketsDropped != 2 || stats.PacketsIfDropped != 4 {
+		t.Errorf("expected statistics totalled over both handles, got %+v", stats)
+	}
+	capture.setStatsHandles()
+	if _, err := capture.stats(); err != errCaptureEnded {
+		t.Errorf("expected %v, got %v", errCaptureEnded, err)
+	}
+}
+
+func TestStatisticsReportsMatchRatio(t *testing.T) {
+	// Simulate a selective filter: the kernel examined 8 packets, of which the 2 read matched.
+	defer fakeIdleInterface(t, [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+	})()
+	defer func() { handleStats = (*pcap.Handle).Stats }()
+	handleStats = func(*pcap.Handle) (*pcap.Stats, error) {
+		return &pcap.Stats{PacketsReceived: 8}, nil
+	}
+	s := NewServer(Config{})
+	result := make(chan error)
+	go func() {
+		result <- s.LiveCapture(&api.CaptureRequest{Interface: "eth0"}, newFakeCaptureStream())
+	}()
+	var capture *liveCapture
+	for deadline := time.Now().Add(time.Second); capture == nil || atomic.LoadUint64(&capture.matched) < 2; capture = s.captures.get(1) {
+		if time.Now().After(deadline) {
+			t.Fatal("capture did not read its packets")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	statsStream := &fakeStatisticsStream{fakeCaptureStream: newFakeCaptureStream()}
+	statsResult := make(chan error)
+	go func() {
+		statsResult <- s.Statistics(&api.StatisticsRequest{CaptureId: 1}, statsStream)
+	}()
+	for deadline := time.Now().Add(time.Second); statsStream.count() < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("statistics were not reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	capture.requestStop()
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-statsResult; err != nil {
+		t.Fatal(err)
+	}
+	reply := statsStream.replies[0]
+	if reply.PacketsReceived <= uint32(reply.PacketsMatched) || reply.PacketsMatched != 2 || reply.MatchRatio != 0.25 {
+		t.Errorf("expected 2 of 8 packets examined to match, got %+v", reply)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+)
+
+// StopCapture stops one running capture, and waits until it has ended before reporting its final
+// statistics. Other captures keep running. A capture that has already ended, or is ending for
+// another reason (such as reaching a limit, or an earlier request to stop it), is reported as
+// already stopped rather than as an error.
+func (s *Server) StopCapture(ctx context.Context, in *api.StopCaptureRequest) (*api.StopCaptureReply, error) {
+	log.Printf("StopCapture(%+v)", in)
+	capture, final, ok := s.captures.lookup(in.CaptureId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no capture has ID %d", in.CaptureId)
+	}
+	if capture == nil {
+		log.Printf("Capture %d has already stopped", in.CaptureId)
+		return &api.StopCaptureReply{Record: final, AlreadyStopped: true}, nil
+	}
+	first := capture.requestStop()
+	select {
+	case <-capture.ended:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return &api.StopCaptureReply{
+		Record:         capture.final,
+		AlreadyStopped: !first || !capture.stoppedOnRequest,
+	}, nil
+}
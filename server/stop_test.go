@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForCapture waits until the capture with the ID has started.
+func waitForCapture(t *testing.T, s *Server, id uint64) {
+	for deadline := time.Now().Add(time.Second); s.captures.get(id) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("capture %d did not start", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStopCaptureLeavesOthersRunning(t *testing.T) {
+	defer fakeInterfaces(t, map[string][][]byte{
+		"eth0": {udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)},
+		"eth1": {udp4Fixture(t, "198.51.100.1", "198.51.100.2", 1000, 53)},
+	})()
+	s := NewServer(Config{})
+	var results []chan error
+	for _, name := range []string{"eth0", "eth1"} {
+		result := make(chan error)
+		results = append(results, result)
+		go func(name string) {
+			result <- s.LiveCapture(&api.CaptureRequest{Interface: name}, newFakeCaptureStream())
+		}(name)
+		waitForCapture(t, s, uint64(len(results)))
+	}
+	time.Sleep(20 * time.Millisecond)
+	reply, err := s.StopCapture(context.Background(), &api.StopCaptureRequest{CaptureId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-results[0]; err != nil {
+		t.Fatalf("expected the stopped capture to end cleanly, got %v", err)
+	}
+	if reply.Record == nil || reply.Record.Interface != "eth0" || reply.Record.Packets != 1 {
+		t.Errorf("unexpected record: %+v", reply.Record)
+	}
+	select {
+	case err := <-results[1]:
+		t.Fatalf("expected the other capture to keep running, but it ended: %v", err)
+	default:
+	}
+	if s.captures.get(2) == nil {
+		t.Fatal("expected the other capture to still be registered")
+	}
+	if _, err := s.StopCapture(context.Background(), &api.StopCaptureRequest{CaptureId: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-results[1]; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopCaptureUnknownCapture(t *testing.T) {
+	_, err := NewServer(Config{}).StopCapture(context.Background(), &api.StopCaptureRequest{CaptureId: 42})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func TestStopCaptureAfterItEnded(t *testing.T) {
+	defer fakeIdleInterface(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})()
+	s := NewServer(Config{})
+	if err := s.LiveCapture(&api.CaptureRequest{Interface: "eth0", MaxPackets: 1}, newFakeCaptureStream()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		reply, err := s.StopCapture(context.Background(), &api.StopCaptureRequest{CaptureId: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reply.AlreadyStopped || reply.Record == nil || reply.Record.Packets != 1 {
+			t.Errorf("expected the capture to be reported as already stopped, got %+v", reply)
+		}
+	}
+}
+
+func TestStopCaptureRacesNaturalEnd(t *testing.T) {
+	packets := make([][]byte, 5)
+	for i := range packets {
+		packets[i] = udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	}
+	defer fakeIdleInterface(t, packets)()
+	read := readPacketData
+	readPacketData = func(h *pcap.Handle) ([]byte, gopacket.CaptureInfo, error) {
+		time.Sleep(100 * time.Microsecond)
+		return read(h)
+	}
+	s := NewServer(Config{})
+	const captures, stoppers = 50, 8
+	stoppedOnRequest := 0
+	for i := 0; i < captures; i++ {
+		id := uint64(i + 1)
+		result := make(chan error, 1)
+		go func() {
+			result <- s.LiveCapture(&api.CaptureRequest{
+				Interface:  "eth0",
+				MaxPackets: uint64(len(packets)),
+			}, newFakeCaptureStream())
+		}()
+		for deadline := time.Now().Add(time.Second); ; {
+			if _, _, ok := s.captures.lookup(id); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("capture %d did not start", id)
+			}
+			time.Sleep(10 * time.Microsecond)
+		}
+		var wg sync.WaitGroup
+		replies := make(chan *api.StopCaptureReply, stoppers)
+		// Stop some captures sooner than others, so that some are stopped on request and the rest
+		// end on their own first.
+		delay := time.Duration(i%10) * 500 * time.Microsecond
+		for j := 0; j < stoppers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				time.Sleep(delay)
+				reply, err := s.StopCapture(context.Background(), &api.StopCaptureRequest{CaptureId: id})
+				if err != nil {
+					t.Errorf("capture %d: %v", id, err)
+					return
+				}
+				replies <- reply
+			}()
+		}
+		wg.Wait()
+		close(replies)
+		if err := <-result; err != nil {
+			t.Fatalf("capture %d: expected it to end cleanly, got %v", id, err)
+		}
+		stopped := 0
+		for reply := range replies {
+			if reply.Record == nil {
+				t.Errorf("capture %d: expected its record", id)
+			}
+			if !reply.AlreadyStopped {
+				stopped++
+			}
+		}
+		if stopped > 1 {
+			t.Errorf("capture %d: %d requests claim to have stopped it", id, stopped)
+		}
+		stoppedOnRequest += stopped
+	}
+	t.Logf("%d of %d captures were stopped on request; the rest ended on their own", stoppedOnRequest, captures)
+}
+
+func TestRunningCapturesForgetOldCaptures(t *testing.T) {
+	var r runningCaptures
+	for i := 0; i <= endedCapturesRemembered; i++ {
+		id := r.add(&liveCapture{})
+		r.remove(id, &api.CaptureRecord{Packets: id})
+	}
+	if _, _, ok := r.lookup(1); ok {
+		t.Error("expected the oldest capture to be forgotten")
+	}
+	if _, final, ok := r.lookup(2); !ok || final.Packets != 2 {
+		t.Errorf("expected the record of capture 2, got %+v", final)
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"log"
+	"net"
+)
+
+var errInsecureTCP = errors.New("refusing to serve captures over TCP without TLS (AllowInsecure is not set)")
+
+// StartTCPServer serves the API on a TCP address, using ServerConfig. Since captured packets are
+// sensitive, clients must connect with TLS, unless ServerConfig.AllowInsecure is set and
+// tlsConfig is nil.
+func StartTCPServer(addr string, tlsConfig *tls.Config) {
+	options, err := tcpServerOptions(&ServerConfig, tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to Listen(): %v", err)
+	}
+	serve(listener, options)
+}
+
+// tcpServerOptions returns the options for a gRPC server listening on TCP, with TLS if it's
+// configured.
+func tcpServerOptions(config *Config, tlsConfig *tls.Config) ([]grpc.ServerOption, error) {
+	options := config.grpcServerOptions()
+	if tlsConfig != nil {
+		return append(options, grpc.Creds(credentials.NewTLS(tlsConfig))), nil
+	}
+	if !config.AllowInsecure {
+		return nil, errInsecureTCP
+	}
+	log.Printf("Warning: serving captures over TCP without TLS")
+	return options, nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCertificate creates a certificate for 127.0.0.1, returning it along with a pool that
+// trusts it.
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTCPServerRequiresTLS(t *testing.T) {
+	if _, err := tcpServerOptions(&Config{}, nil); err != errInsecureTCP {
+		t.Errorf("expected an insecure listener to be refused, got %v", err)
+	}
+	if _, err := tcpServerOptions(&Config{AllowInsecure: true}, nil); err != nil {
+		t.Errorf("expected AllowInsecure to allow an insecure listener, got %v", err)
+	}
+}
+
+func TestTCPServerServesOverTLS(t *testing.T) {
+	certificate, pool := selfSignedCertificate(t)
+	options, err := tcpServerOptions(&Config{}, &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(options...)
+	defer s.Stop()
+	api.RegisterPCAPServer(s, NewServer(Config{}))
+	go s.Serve(listener)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	creds := credentials.NewTLS(&tls.Config{RootCAs: pool})
+	conn, err := grpc.DialContext(ctx, listener.Addr().String(), grpc.WithTransportCredentials(creds), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := api.NewPCAPClient(conn).CaptureHistory(ctx, &api.CaptureHistoryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
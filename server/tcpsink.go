@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReconnectInterval is the minimum time between attempts to connect to the collector.
+const DefaultReconnectInterval = 5 * time.Second
+
+const collectorTimeout = 5 * time.Second
+
+// collectorQueueLength is how many packets may wait to be sent to the collector. Packets beyond
+// it are dropped, so that a slow collector can't hold up the capture.
+const collectorQueueLength = 1024
+
+// dialCollector connects to the collector; tests replace it to simulate slow collectors.
+var dialCollector = func(ctx context.Context, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: collectorTimeout}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// collectorPacket is a packet waiting to be sent to the collector.
+type collectorPacket struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// tcpSink streams packets in pcap format to a collector over a TCP connection initiated by the
+// server, as expected by tools such as Wireshark's "TCP@host:port" remote capture. Each connection
+// begins with a pcap file header. The sink connects and sends packets from a goroutine of its own,
+// through a bounded queue, so the capture never waits for the collector. Packets that don't fit
+// in the queue, and those that arrive while the sink is disconnected, are dropped until it
+// reconnects; failures don't end the capture.
+type tcpSink struct {
+	address           string
+	linkType          layers.LinkType
+	snaplen           int
+	reconnectInterval time.Duration
+
+	queue  chan collectorPacket
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+
+	// Only used by the sending goroutine.
+	ctx         context.Context
+	conn        net.Conn
+	writer      *pcapFileWriter
+	lastAttempt time.Time
+
+	// Packets that couldn't be sent to the collector, updated atomically.
+	dropped uint64
+}
+
+func newTCPSink(address string, linkType layers.LinkType, snaplen int, reconnectInterval time.Duration) *tcpSink {
+	if reconnectInterval <= 0 {
+		reconnectInterval = DefaultReconnectInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &tcpSink{
+		address:           address,
+		linkType:          linkType,
+		snaplen:           snaplen,
+		reconnectInterval: reconnectInterval,
+		queue:             make(chan collectorPacket, collectorQueueLength),
+		cancel:            cancel,
+		ctx:               ctx,
+	}
+	sink.done.Add(1)
+	go sink.run()
+	return sink
+}
+
+// run connects to the collector, then sends it the queued packets until the sink is closed.
+func (s *tcpSink) run() {
+	defer s.done.Done()
+	defer s.disconnect()
+	s.connect(time.Now())
+	for packet := range s.queue {
+		s.send(packet)
+	}
+}
+
+// connect opens a connection to the collector and writes the pcap file header.
+func (s *tcpSink) connect(now time.Time) bool {
+	s.lastAttempt = now
+	conn, err := dialCollector(s.ctx, s.address)
+	if err != nil {
+		log.Printf("Unable to connect to collector %s: %v", s.address, err)
+		return false
+	}
+	writer := newPcapFileWriter(conn, false)
+	conn.SetWriteDeadline(now.Add(collectorTimeout))
+	if err := writer.WriteFileHeader(uint32(s.snaplen), s.linkType); err != nil {
+		log.Printf("Unable to write to collector %s: %v", s.address, err)
+		conn.Close()
+		return false
+	}
+	s.conn, s.writer = conn, writer
+	return true
+}
+
+func (s *tcpSink) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.writer = nil, nil
+	}
+}
+
+// send writes a packet to the collector, reconnecting first if necessary.
+func (s *tcpSink) send(packet collectorPacket) {
+	now := time.Now()
+	if s.conn == nil {
+		if now.Sub(s.lastAttempt) < s.reconnectInterval || !s.connect(now) {
+			atomic.AddUint64(&s.dropped, 1)
+			return
+		}
+	}
+	s.conn.SetWriteDeadline(now.Add(collectorTimeout))
+	if err := s.writer.WritePacket(packet.ci, packet.data); err != nil {
+		log.Printf("Lost connection to collector %s: %v", s.address, err)
+		s.disconnect()
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// WritePacket queues a packet to be sent to the collector, dropping it if the queue is full.
+func (s *tcpSink) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	select {
+	case s.queue <- collectorPacket{ci: ci, data: append([]byte(nil), data...)}:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+	return nil
+}
+
+// Close sends the packets still queued (unless the collector is unreachable), then closes the
+// connection. A connection attempt in progress is abandoned.
+func (s *tcpSink) Close() error {
+	s.cancel()
+	close(s.queue)
+	s.done.Wait()
+	if dropped := atomic.LoadUint64(&s.dropped); dropped > 0 {
+		log.Printf("%d packets could not be sent to collector %s", dropped, s.address)
+	}
+	return nil
+}
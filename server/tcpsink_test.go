@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// acceptOne accepts a connection, and reads the given number of packets from the pcap stream
+// sent on it.
+func acceptOne(listener net.Listener, packets int) chan [][]byte {
+	result := make(chan [][]byte, 1)
+	go func() {
+		var received [][]byte
+		defer func() { result <- received }()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader, err := pcapgo.NewReader(conn)
+		if err != nil || reader.LinkType() != layers.LinkTypeEthernet {
+			return
+		}
+		for i := 0; i < packets; i++ {
+			data, _, err := reader.ReadPacketData()
+			if err != nil {
+				return
+			}
+			received = append(received, data)
+		}
+	}()
+	return result
+}
+
+// waitForDropped waits for the sink to have dropped the given number of packets, returning false
+// if it doesn't within a second.
+func waitForDropped(sink *tcpSink, dropped uint64) bool {
+	for deadline := time.Now().Add(time.Second); atomic.LoadUint64(&sink.dropped) != dropped; {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func TestTCPSinkSendsPcapStream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	result := acceptOne(listener, 2)
+	sink := newTCPSink(listener.Addr().String(), layers.LinkTypeEthernet, 65535, 0)
+	packets := [][]byte{
+		udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53),
+		udp4Fixture(t, "192.0.2.3", "192.0.2.4", 1001, 53),
+	}
+	for _, data := range packets {
+		if err := sink.WritePacket(captureInfoFor(data), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	received := <-result
+	sink.Close()
+	if len(received) != len(packets) {
+		t.Fatalf("expected %d packets, got %d", len(packets), len(received))
+	}
+	for i := range packets {
+		if !bytes.Equal(received[i], packets[i]) {
+			t.Errorf("packet %d: data mismatch", i)
+		}
+	}
+}
+
+func TestTCPSinkReconnects(t *testing.T) {
+	// Find a free port, then leave nothing listening on it.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	sink := newTCPSink(address, layers.LinkTypeEthernet, 65535, time.Nanosecond)
+	defer sink.Close()
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	if err := sink.WritePacket(captureInfoFor(data), data); err != nil {
+		t.Fatal(err)
+	}
+	if !waitForDropped(sink, 1) {
+		t.Errorf("expected the packet to be dropped while disconnected")
+	}
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("unable to listen on %s again: %v", address, err)
+	}
+	defer listener.Close()
+	result := acceptOne(listener, 1)
+	if err := sink.WritePacket(captureInfoFor(data), data); err != nil {
+		t.Fatal(err)
+	}
+	if received := <-result; len(received) != 1 || !bytes.Equal(received[0], data) {
+		t.Error("expected the packet to be sent after reconnecting")
+	}
+}
+
+func TestTCPSinkDoesNotWaitForSlowCollector(t *testing.T) {
+	release := make(chan struct{})
+	dial := dialCollector
+	defer func() { dialCollector = dial }()
+	dialCollector = func(ctx context.Context, address string) (net.Conn, error) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil, errors.New("unreachable")
+	}
+	sink := newTCPSink("192.0.2.1:9", layers.LinkTypeEthernet, 65535, 0)
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)
+	start := time.Now()
+	for i := 0; i < collectorQueueLength+10; i++ {
+		if err := sink.WritePacket(captureInfoFor(data), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected writes not to wait for the collector, took %v", elapsed)
+	}
+	// The packets beyond the queue are dropped at once.
+	if dropped := atomic.LoadUint64(&sink.dropped); dropped != 10 {
+		t.Errorf("expected 10 packets dropped, got %d", dropped)
+	}
+	close(release)
+	sink.Close()
+	if dropped := atomic.LoadUint64(&sink.dropped); dropped != collectorQueueLength+10 {
+		t.Errorf("expected every packet to be dropped once the collector proved unreachable, got %d", dropped)
+	}
+}
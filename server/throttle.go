@@ -0,0 +1,87 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// LoadSource reports the current CPU utilization of the host, as a fraction between 0 and 1.
+type LoadSource func() (float64, error)
+
+// ThrottleConfig configures adaptive throttling, which samples the packets forwarded to clients
+// when the host is too busy, to keep a capture from starving colocated workloads.
+type ThrottleConfig struct {
+	// Throttling engages when CPU utilization rises above High, and is released once it falls
+	// below Low.
+	High float64
+	Low  float64
+	// While throttled, one of every SampleRate packets is forwarded.
+	SampleRate uint32
+	// How often to check the CPU utilization. Defaults to one second.
+	Interval time.Duration
+	// Where to get the CPU utilization from. Defaults to the overall system CPU usage, if the
+	// platform supports it.
+	Source LoadSource
+}
+
+// cpuThrottle tracks the throttling state of a single capture.
+type cpuThrottle struct {
+	config    ThrottleConfig
+	source    LoadSource
+	lastCheck time.Time
+	engaged   bool
+	counter   uint64
+	dropped   uint64
+}
+
+func newCPUThrottle(config *ThrottleConfig) *cpuThrottle {
+	if config == nil || config.SampleRate <= 1 {
+		return nil
+	}
+	throttle := &cpuThrottle{config: *config, source: config.Source}
+	if throttle.config.Interval <= 0 {
+		throttle.config.Interval = time.Second
+	}
+	if throttle.source == nil {
+		throttle.source = newSystemLoadSource()
+	}
+	return throttle
+}
+
+// update checks the CPU utilization if the check interval has elapsed, and returns true if the
+// throttle was engaged or released as a result.
+func (t *cpuThrottle) update(now time.Time) bool {
+	if now.Sub(t.lastCheck) < t.config.Interval {
+		return false
+	}
+	t.lastCheck = now
+	load, err := t.source()
+	if err != nil {
+		log.Printf("Unable to read CPU load; adaptive throttling disabled: %v", err)
+		t.source = func() (float64, error) { return 0, nil }
+		load = 0
+	}
+	switch {
+	case !t.engaged && load > t.config.High:
+		t.engaged = true
+	case t.engaged && load < t.config.Low:
+		t.engaged = false
+	default:
+		return false
+	}
+	t.counter = 0
+	return true
+}
+
+// allow returns true if the next packet should be forwarded.
+func (t *cpuThrottle) allow() bool {
+	if !t.engaged {
+		return true
+	}
+	t.counter++
+	if t.counter%uint64(t.config.SampleRate) == 1 {
+		return true
+	}
+	t.dropped++
+	return false
+}
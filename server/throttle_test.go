@@ -0,0 +1,60 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/pcapme/pcap/api"
+	"testing"
+	"time"
+)
+
+func TestThrottleEngagesAboveThreshold(t *testing.T) {
+	load := 0.1
+	config := &ThrottleConfig{
+		High:       0.9,
+		Low:        0.5,
+		SampleRate: 10,
+		Interval:   time.Nanosecond,
+		Source:     func() (float64, error) { return load, nil },
+	}
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{}, stream, &Config{Throttle: config})
+	send := func(count int) {
+		for i := 0; i < count; i++ {
+			ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: 1, Length: 1}
+			if err := capture.queuePacket(&packetData{data: []byte{0}, ci: ci}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send(10)
+	if len(stream.packets()) != 10 {
+		t.Fatalf("expected all packets below threshold, got %d", len(stream.packets()))
+	}
+	load = 0.95
+	send(100)
+	if forwarded := len(stream.packets()) - 10; forwarded != 10 {
+		t.Errorf("expected 1 in 10 packets while throttled, got %d of 100", forwarded)
+	}
+	statuses := 0
+	for _, reply := range stream.replies {
+		if status := reply.GetStatus(); status != nil {
+			statuses++
+			if !status.Throttled {
+				t.Errorf("expected throttled status, got %+v", status)
+			}
+		}
+	}
+	if statuses != 1 {
+		t.Errorf("expected one status reply, got %d", statuses)
+	}
+	// Throttled packets are recorded apart from the kernel's drops.
+	if record := capture.record(nil); record.ThrottledPackets != 90 || record.DroppedPackets != 0 {
+		t.Errorf("expected 90 throttled packets and none dropped, got %+v", record)
+	}
+	load = 0.1
+	before := len(stream.packets())
+	send(10)
+	if forwarded := len(stream.packets()) - before; forwarded != 10 {
+		t.Errorf("expected throttling to be released, got %d of 10 packets", forwarded)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pcapme/pcap/api"
+	"log"
+	"time"
+)
+
+// The packet buffer timeout bounds how long libpcap may hold captured packets, hoping to deliver
+// them in a batch, before returning them to the server (unless immediate mode is enabled). It is
+// not a read timeout: on some platforms a read may still block indefinitely if no packets arrive,
+// and on others (such as Linux with TPACKET_V3) a timeout of zero means packets are only delivered
+// once the kernel buffer fills, which can delay a quiet capture indefinitely. Timeouts are
+// therefore clamped to this range.
+const (
+	MinBufferTimeout     = time.Millisecond
+	MaxBufferTimeout     = time.Second
+	DefaultBufferTimeout = 10 * time.Millisecond
+)
+
+// bufferTimeout returns the timeout to set on the capture handle for the request. A zero timeout
+// selects DefaultBufferTimeout (see bufferTimeoutWarning). Negative timeouts, which gopacket would treat as blocking reads,
+// are replaced by their magnitude: a blocking read holds the handle's lock until a packet arrives,
+// so a capture on a quiet interface could never be stopped (nor its handle closed).
+func bufferTimeout(in *api.CaptureRequest) time.Duration {
+	timeout := time.Duration(in.TimeoutNanoseconds)
+	if timeout == 0 {
+		if warning := bufferTimeoutWarning(in); len(warning) > 0 {
+			log.Printf("%s: %s", in.Interface, warning)
+		}
+		return DefaultBufferTimeout
+	}
+	if timeout < 0 {
+		timeout = -timeout
+	}
+	if timeout < MinBufferTimeout {
+		timeout = MinBufferTimeout
+	} else if timeout > MaxBufferTimeout {
+		log.Printf("%s: buffer timeout %v is too long; using %v", in.Interface, timeout, MaxBufferTimeout)
+		timeout = MaxBufferTimeout
+	}
+	return timeout
+}
+
+// bufferTimeoutWarning explains the timeout used for a request that didn't ask for one without
+// immediate mode. libpcap would take a zero timeout to mean packets may be held until the capture
+// buffer fills, which isn't what such clients are likely to expect. With immediate mode, packets
+// are delivered as they arrive, so the timeout doesn't matter.
+func bufferTimeoutWarning(in *api.CaptureRequest) string {
+	if in.TimeoutNanoseconds != 0 || in.ImmediateMode {
+		return ""
+	}
+	return fmt.Sprintf("no buffer timeout requested; using %v so that packets aren't held until "+
+		"the capture buffer fills", DefaultBufferTimeout)
+}
+
+// pollable returns true if reads from the capture handle for the request will return once the
+// buffer timeout expires, rather than blocking until a packet arrives. This is the case for live
+// captures, which always have a positive timeout (see bufferTimeout), and for which gopacket waits
+// on the handle's selectable file descriptor. Offline captures may be reading from a pipe, which
+// can block indefinitely.
+func pollable(in *api.CaptureRequest) bool {
+	return len(in.OfflineSource) == 0
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBufferTimeout(t *testing.T) {
+	for _, test := range []struct {
+		timeout   time.Duration
+		immediate bool
+		expected  time.Duration
+	}{
+		{0, false, DefaultBufferTimeout},
+		{0, true, DefaultBufferTimeout},
+		{time.Nanosecond, false, MinBufferTimeout},
+		{50 * time.Millisecond, false, 50 * time.Millisecond},
+		{time.Hour, false, MaxBufferTimeout},
+		{-time.Hour, false, MaxBufferTimeout},
+		{-time.Nanosecond, false, MinBufferTimeout},
+		{-50 * time.Millisecond, false, 50 * time.Millisecond},
+	} {
+		in := &api.CaptureRequest{TimeoutNanoseconds: int64(test.timeout), ImmediateMode: test.immediate}
+		if timeout := bufferTimeout(in); timeout != test.expected {
+			t.Errorf("timeout %v: expected %v, got %v", test.timeout, test.expected, timeout)
+		}
+	}
+}
+
+func TestBufferTimeoutWarning(t *testing.T) {
+	for _, test := range []struct {
+		timeout   time.Duration
+		immediate bool
+		warns     bool
+	}{
+		{0, false, true},
+		{0, true, false},
+		{50 * time.Millisecond, false, false},
+	} {
+		in := &api.CaptureRequest{TimeoutNanoseconds: int64(test.timeout), ImmediateMode: test.immediate}
+		warning := bufferTimeoutWarning(in)
+		if (len(warning) > 0) != test.warns || test.warns && !strings.Contains(warning, DefaultBufferTimeout.String()) {
+			t.Errorf("timeout %v, immediate mode %t: unexpected warning %q", test.timeout, test.immediate, warning)
+		}
+	}
+}
+
+func TestLiveCaptureContinuesAfterBufferTimeout(t *testing.T) {
+	// Simulate a read that times out without any packets, followed by a packet and the end of the
+	// capture. The capture must keep reading rather than treating the timeout as an error.
+	path := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(path)
+	defer func() { openLiveHandle = openLive }()
+	openLiveHandle = func(in *api.CaptureRequest) (*pcap.Handle, []*api.PcapStatus, error) {
+		handle, err := pcap.OpenOffline(path)
+		return handle, nil, err
+	}
+	defer func() { readPacketData = (*pcap.Handle).ReadPacketData }()
+	timedOut := false
+	readPacketData = func(h *pcap.Handle) ([]byte, gopacket.CaptureInfo, error) {
+		if !timedOut {
+			timedOut = true
+			return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+		}
+		return h.ReadPacketData()
+	}
+	stream := newFakeCaptureStream()
+	s := &Server{}
+	if err := s.LiveCapture(&api.CaptureRequest{Interface: "eth0", TimeoutNanoseconds: int64(time.Millisecond)}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if !timedOut || len(stream.packets()) != 1 {
+		t.Errorf("expected the capture to continue after the timeout")
+	}
+}
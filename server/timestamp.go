@@ -0,0 +1,53 @@
+package server
+
+import (
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// setTimestampSource selects the requested timestamp source. Sources the interface doesn't
+// support are refused, since libpcap would otherwise only warn, and fall back to the host clock.
+func setTimestampSource(handle *pcap.InactiveHandle, in *api.CaptureRequest) error {
+	if len(in.TimestampSource) == 0 {
+		return nil
+	}
+	source, err := pcap.TimestampSourceFromString(in.TimestampSource)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "unknown timestamp source: %q", in.TimestampSource)
+	}
+	supported := timestampSourceNames(handle.SupportedTimestamps())
+	for _, name := range supported {
+		if name == source.String() {
+			return handle.SetTimestampSource(source)
+		}
+	}
+	return status.Errorf(codes.InvalidArgument, "%s does not support the %s timestamp source (supported: %s)",
+		in.Interface, source, strings.Join(supported, ", "))
+}
+
+// timestampSourceNames names the timestamp sources supported by an interface. libpcap lists none
+// if the host clock is the only one available.
+func timestampSourceNames(sources []pcap.TimestampSource) []string {
+	if len(sources) == 0 {
+		return []string{"host"}
+	}
+	names := make([]string, len(sources))
+	for i, source := range sources {
+		names[i] = source.String()
+	}
+	return names
+}
+
+// interfaceTimestampSources lists the timestamp sources supported by the named interface, or
+// nil if they can't be determined. It can be replaced in tests.
+var interfaceTimestampSources = func(name string) []string {
+	handle, err := pcap.NewInactiveHandle(name)
+	if err != nil {
+		return nil
+	}
+	defer handle.CleanUp()
+	return timestampSourceNames(handle.SupportedTimestamps())
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"github.com/google/gopacket/pcap"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestOpenLiveRejectsUnknownTimestampSource(t *testing.T) {
+	_, _, err := openLive(&api.CaptureRequest{Interface: "lo", TimestampSource: "sundial"})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "sundial") {
+		t.Errorf("expected InvalidArgument naming the source, got %v", err)
+	}
+}
+
+func TestOpenLiveRejectsUnsupportedTimestampSource(t *testing.T) {
+	supported := interfaceTimestampSources("lo")
+	for _, name := range supported {
+		if name == "adapter_unsynced" {
+			t.Skip("loopback supports adapter timestamps")
+		}
+	}
+	_, _, err := openLive(&api.CaptureRequest{Interface: "lo", TimestampSource: "adapter_unsynced"})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), strings.Join(supported, ", ")) {
+		t.Errorf("expected InvalidArgument listing the supported sources, got %v", err)
+	}
+}
+
+func TestTimestampSourceNamesDefaultsToHost(t *testing.T) {
+	if names := timestampSourceNames(nil); len(names) != 1 || names[0] != "host" {
+		t.Errorf("expected only the host clock, got %v", names)
+	}
+	source, err := pcap.TimestampSourceFromString("adapter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := timestampSourceNames([]pcap.TimestampSource{source}); len(names) != 1 || names[0] != "adapter" {
+		t.Errorf("unexpected names: %v", names)
+	}
+}
+
+func TestInterfaceListReportsTimestampSources(t *testing.T) {
+	defer func() { listInterfaces = net.Interfaces }()
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Index: 2, Name: "eth0", Flags: net.FlagUp}}, nil
+	}
+	defer func(original func(string) []string) { interfaceTimestampSources = original }(interfaceTimestampSources)
+	interfaceTimestampSources = func(name string) []string {
+		return []string{"host", "adapter", "adapter_unsynced"}
+	}
+	reply, err := (&Server{}).InterfaceList(context.Background(), &api.InterfaceListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Interfaces) != 1 || strings.Join(reply.Interfaces[0].TimestampSources, ",") != "host,adapter,adapter_unsynced" {
+		t.Errorf("unexpected interfaces: %+v", reply.Interfaces)
+	}
+}
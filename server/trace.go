@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"strings"
+)
+
+// SpanContext identifies a span in a distributed trace, as propagated by a W3C Trace Context
+// "traceparent" header.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// Tracer creates a span for each RPC handled by the server. It is intended to be backed by a
+// tracing library such as OpenTelemetry, by programs embedding the server.
+type Tracer interface {
+	// Start begins a span. The parent is the span context propagated by the client in the
+	// "traceparent" request metadata, or nil if there was none.
+	Start(ctx context.Context, name string, parent *SpanContext) Span
+}
+
+// Span records the attributes of, and events during, an RPC.
+type Span interface {
+	SetAttributes(attributes map[string]interface{})
+	AddEvent(name string, attributes map[string]interface{})
+	End()
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(map[string]interface{})    {}
+func (noopSpan) AddEvent(string, map[string]interface{}) {}
+func (noopSpan) End()                                    {}
+
+type spanKey struct{}
+
+// spanFromContext returns the span for an RPC, or a span that discards everything if the server
+// has no tracer.
+func spanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+// parseTraceparent parses a W3C Trace Context "traceparent" header, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(value string) (*SpanContext, bool) {
+	fields := strings.Split(strings.TrimSpace(value), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" {
+		return nil, false
+	}
+	var spanContext SpanContext
+	var flags [1]byte
+	for _, field := range []struct {
+		text string
+		into []byte
+	}{
+		{fields[1], spanContext.TraceID[:]},
+		{fields[2], spanContext.SpanID[:]},
+		{fields[3], flags[:]},
+	} {
+		if len(field.text) != 2*len(field.into) {
+			return nil, false
+		}
+		if _, err := hex.Decode(field.into, []byte(field.text)); err != nil {
+			return nil, false
+		}
+	}
+	if spanContext.TraceID == [16]byte{} || spanContext.SpanID == [8]byte{} {
+		return nil, false
+	}
+	spanContext.Sampled = flags[0]&1 != 0
+	return &spanContext, true
+}
+
+// remoteSpanContext returns the span context propagated by the client, if any.
+func remoteSpanContext(ctx context.Context) *SpanContext {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil
+	}
+	for _, value := range md.Get("traceparent") {
+		if spanContext, ok := parseTraceparent(value); ok {
+			return spanContext
+		}
+	}
+	return nil
+}
+
+func startSpan(tracer Tracer, ctx context.Context, method string) (context.Context, Span) {
+	span := tracer.Start(ctx, method, remoteSpanContext(ctx))
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// tracedStream replaces the context of a stream with one carrying its span.
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// tracingStreamInterceptor creates a span for each streaming RPC, and hands the handler a
+// stream whose context carries it.
+func tracingStreamInterceptor(tracer Tracer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := startSpan(tracer, ss.Context(), info.FullMethod)
+		defer span.End()
+		err := handler(srv, &tracedStream{ServerStream: ss, ctx: ctx})
+		if err != nil {
+			span.SetAttributes(map[string]interface{}{"error": err.Error()})
+		}
+		return err
+	}
+}
+
+// tracingInterceptors returns server options that create a span for each RPC.
+func tracingInterceptors(tracer Tracer) []grpc.ServerOption {
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := startSpan(tracer, ctx, info.FullMethod)
+		defer span.End()
+		reply, err := handler(ctx, req)
+		if err != nil {
+			span.SetAttributes(map[string]interface{}{"error": err.Error()})
+		}
+		return reply, err
+	}
+	return []grpc.ServerOption{grpc.UnaryInterceptor(unary), grpc.StreamInterceptor(tracingStreamInterceptor(tracer))}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"github.com/pcapme/pcap/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"os"
+	"testing"
+)
+
+type fakeSpan struct {
+	name       string
+	parent     *SpanContext
+	attributes map[string]interface{}
+	events     []string
+	ended      bool
+}
+
+func (s *fakeSpan) SetAttributes(attributes map[string]interface{}) {
+	for key, value := range attributes {
+		s.attributes[key] = value
+	}
+}
+
+func (s *fakeSpan) AddEvent(name string, attributes map[string]interface{}) {
+	s.events = append(s.events, name)
+}
+
+func (s *fakeSpan) End() {
+	s.ended = true
+}
+
+type fakeTracer struct {
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string, parent *SpanContext) Span {
+	span := &fakeSpan{name: name, parent: parent, attributes: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+// liveCaptureStream adapts a grpc.ServerStream for LiveCapture, as the generated code does.
+type liveCaptureStream struct {
+	grpc.ServerStream
+}
+
+func (s *liveCaptureStream) Send(reply *api.CaptureReply) error {
+	return s.ServerStream.SendMsg(reply)
+}
+
+func TestLiveCaptureSpan(t *testing.T) {
+	path := writePcapFile(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})
+	defer os.Remove(path)
+	tracer := &fakeTracer{}
+	stream := newFakeCaptureStream()
+	stream.ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	s := &Server{Config: offlineConfig()}
+	err := tracingStreamInterceptor(tracer)(s, stream, &grpc.StreamServerInfo{FullMethod: "/pcapd.PCAP/LiveCapture"},
+		func(srv interface{}, ss grpc.ServerStream) error {
+			return s.LiveCapture(&api.CaptureRequest{OfflineSource: path}, &liveCaptureStream{ss})
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(tracer.spans))
+	}
+	span := tracer.spans[0]
+	if span.name != "/pcapd.PCAP/LiveCapture" || !span.ended {
+		t.Errorf("unexpected span: %+v", span)
+	}
+	if span.parent == nil || span.parent.SpanID != [8]byte{0, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7} || !span.parent.Sampled {
+		t.Errorf("expected the client's trace context to be the parent, got %+v", span.parent)
+	}
+	if span.attributes["offline_source"] != path || span.attributes["packets"] != uint64(1) ||
+		span.attributes["link_type"] != "Ethernet" {
+		t.Errorf("unexpected attributes: %+v", span.attributes)
+	}
+	if len(span.events) != 2 || span.events[0] != "capture started" || span.events[1] != "capture ended" {
+		t.Errorf("unexpected events: %+v", span.events)
+	}
+}
+
+func TestParseTraceparentRejectsInvalidValues(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+	} {
+		if _, ok := parseTraceparent(value); ok {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
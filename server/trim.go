@@ -0,0 +1,35 @@
+package server
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// trimPayload truncates the application payload of a packet to at most maxPayload bytes, keeping
+// all of the protocol headers before it. Packets without a decoded application layer are left
+// untouched. The original length in the capture info is preserved, so the packet is recorded as
+// truncated. Packets that can't be decoded are also left untouched.
+func trimPayload(data []byte, ci gopacket.CaptureInfo, linkType layers.LinkType, maxPayload int) (trimmed []byte, trimmedCI gopacket.CaptureInfo) {
+	defer func() {
+		if recoverDecodePanic(recover()) {
+			trimmed, trimmedCI = data, ci
+		}
+	}()
+	packet := gopacket.NewPacket(data, linkTypeDecoder(linkType), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	if packet.ApplicationLayer() == nil {
+		return data, ci
+	}
+	offset := 0
+	for _, layer := range packet.Layers() {
+		if layer.LayerType() == packet.ApplicationLayer().LayerType() {
+			break
+		}
+		offset += len(layer.LayerContents())
+	}
+	if offset+maxPayload >= len(data) {
+		return data, ci
+	}
+	data = data[:offset+maxPayload]
+	ci.CaptureLength = len(data)
+	return data, ci
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pcapme/pcap/api"
+	"testing"
+)
+
+func TestTrimPayloadKeepsHeaders(t *testing.T) {
+	stream := newFakeCaptureStream()
+	capture := newLiveCapture(&api.CaptureRequest{MaxPayloadBytes: 3}, stream, &Config{})
+	capture.linkType = layers.LinkTypeEthernet
+	// Ethernet (14) + IPv4 (20) + UDP (8) headers, followed by a 7-byte payload.
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 2000)
+	ci := captureInfoFor(data)
+	if err := capture.queuePacket(&packetData{data: data, ci: ci}); err != nil {
+		t.Fatal(err)
+	}
+	received := stream.packets()
+	if len(received) != 1 {
+		t.Fatalf("expected one packet, got %d", len(received))
+	}
+	packet := received[0]
+	if len(packet.Data) != 14+20+8+3 || !bytes.Equal(packet.Data, data[:len(packet.Data)]) {
+		t.Errorf("unexpected data: %x", packet.Data)
+	}
+	if packet.OriginalLength != uint32(len(data)) || packet.CapturedLength != uint32(len(packet.Data)) {
+		t.Errorf("unexpected lengths: original %d, captured %d", packet.OriginalLength, packet.CapturedLength)
+	}
+	decoded := gopacket.NewPacket(packet.Data, layers.LinkTypeEthernet, gopacket.Default)
+	udp, ok := decoded.TransportLayer().(*layers.UDP)
+	if !ok || udp.DstPort != 2000 {
+		t.Errorf("expected the UDP header to be intact: %v", decoded)
+	}
+	if app := decoded.ApplicationLayer(); app == nil || string(app.Payload()) != "pay" {
+		t.Errorf("expected the payload to be trimmed to 3 bytes: %v", decoded)
+	}
+}
+
+func TestTrimPayloadShorterThanLimit(t *testing.T) {
+	data := udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 2000)
+	trimmed, ci := trimPayload(data, captureInfoFor(data), layers.LinkTypeEthernet, 100)
+	if !bytes.Equal(trimmed, data) || ci.CaptureLength != len(data) {
+		t.Error("expected a packet with a short payload to be left untouched")
+	}
+}
@@ -1,7 +1,7 @@
 package server
 
 import (
-	"context"
+	"fmt"
 	"github.com/pcapme/pcap/api"
 	"google.golang.org/grpc"
 	"log"
@@ -10,21 +10,84 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 )
 
-func registerSigQuitHandler() {
+func registerSigQuitHandler(config *Config) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGQUIT)
 	buf := make([]byte, 1<<20)
 	for {
 		<-sigs
-		stacklen := runtime.Stack(buf, true)
+		dumpGoroutines(config, buf)
+	}
+}
+
+// dumpGoroutines writes the stacks of all goroutines to the log, or to the configured file.
+func dumpGoroutines(config *Config, buf []byte) {
+	if config.DisableGoroutineDump {
+		log.Printf("=== received SIGQUIT === (goroutine dump disabled)")
+		return
+	}
+	stacklen := runtime.Stack(buf, true)
+	if len(config.GoroutineDumpPath) == 0 {
 		log.Printf("=== received SIGQUIT ===\n*** goroutine dump...\n%s\n*** end\n", buf[:stacklen])
+		return
 	}
+	file, err := openGoroutineDump(config.GoroutineDumpPath)
+	if err != nil {
+		log.Printf("=== received SIGQUIT === (unable to write goroutine dump: %v)", err)
+		return
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "*** goroutine dump at %s...\n%s\n*** end\n", time.Now().Format(time.RFC3339), buf[:stacklen])
+	log.Printf("=== received SIGQUIT === (goroutine dump written to %s)", config.GoroutineDumpPath)
+}
+
+// openGoroutineDump opens the file goroutine dumps are appended to. A symbolic link isn't followed,
+// so that the dump can't be redirected somewhere else readable, and a file that already exists is
+// made readable only by its owner, as if it had just been created.
+func openGoroutineDump(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// shutdownSignals cause the server to stop gracefully. SIGTERM is included since it's the signal
+// used by service managers such as systemd and Kubernetes to stop a process.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// handleShutdownSignals calls stop when one of the shutdownSignals is received.
+func handleShutdownSignals(stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, shutdownSignals...)
+	go func() {
+		sig := <-c
+		signal.Stop(c)
+		log.Printf("Received %v; stopping gracefully...", sig)
+		stop()
+	}()
+}
+
+// handleReloadSignals rotates capture files and reloads the configuration on SIGHUP.
+func handleReloadSignals(s *Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			log.Printf("Received SIGHUP; rotating files and reloading configuration...")
+			s.reload()
+		}
+	}()
 }
 
 func StartUnixSocketServer() {
-	go registerSigQuitHandler()
 	listener, err := net.Listen("unix", DefaultSocketPath)
 	if err != nil {
 		log.Fatalf("Failed to Listen(): %v", err)
@@ -33,21 +96,23 @@ func StartUnixSocketServer() {
 	if err := os.Chmod(DefaultSocketPath, 0770); err != nil {
 		log.Fatal(err)
 	}
-	s := grpc.NewServer()
+	serve(listener, append(ServerConfig.grpcServerOptions(), grpc.Creds(peerCredentials{})))
+}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+// serve runs the server on the listener until it is stopped by one of the shutdownSignals.
+func serve(listener net.Listener, options []grpc.ServerOption) {
+	go registerSigQuitHandler(&ServerConfig)
+	s := grpc.NewServer(options...)
 
-	context.WithCancel(context.Background())
-	go func() {
-		<-c
-		log.Println("Interrupt received; stopping gracefully...")
+	handleShutdownSignals(func() {
 		// Before we stop the service, we need to notify any streams that we're shutting down.
 		close(ShuttingDown)
 		s.GracefulStop()
-	}()
+	})
 
-	api.RegisterPCAPServer(s, &Server{})
+	server := NewServer(ServerConfig)
+	handleReloadSignals(server)
+	api.RegisterPCAPServer(s, server)
 	if err := s.Serve(listener); err != nil {
 		log.Fatalf("Failed to Serve(): %v", err)
 	}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/pcapme/pcap/api"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSIGTERMInitiatesGracefulShutdown(t *testing.T) {
+	stopped := make(chan bool)
+	handleShutdownSignals(func() { close(stopped) })
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("graceful shutdown was not initiated by SIGTERM")
+	}
+}
+
+func TestSIGHUPRotatesFilesAndReloadsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer fakeIdleInterface(t, [][]byte{udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000, 53)})()
+	reloaded := Config{OutputDirectory: dir, MaxInterfaceAddresses: 1}
+	s := NewServer(Config{
+		OutputDirectory: dir,
+		Reload:          func() (Config, error) { return reloaded, nil },
+	})
+	handleReloadSignals(s)
+	result := make(chan error)
+	go func() {
+		in := &api.CaptureRequest{Interface: "eth0", OutputPath: "out.pcap"}
+		result <- s.LiveCapture(in, newFakeCaptureStream())
+	}()
+	path := filepath.Join(dir, "out.pcap")
+	waitForFileCapture(t, s, path)
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.config().MaxInterfaceAddresses != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("configuration was not reloaded by SIGHUP")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s.config().Reload == nil {
+		t.Error("expected the reload function to be kept")
+	}
+	reply, err := s.FinalizeCapture(context.Background(), &api.FinalizeCaptureRequest{OutputPath: "out.pcap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	// Rotated files have a timestamp appended, unlike the sidecar (see writeSidecar).
+	rotated, err := filepath.Glob(path + ".2*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("expected one rotated file, got %v", rotated)
+	}
+	// The packet was written before the rotation; the new file must still be a valid capture.
+	if count := countPcapPackets(t, rotated[0]) + countPcapPackets(t, path); count != reply.Record.Packets {
+		t.Errorf("expected %d packets across both files, got %d", reply.Record.Packets, count)
+	}
+}
+
+func TestReloadErrorKeepsConfig(t *testing.T) {
+	s := NewServer(Config{
+		MaxInterfaceAddresses: 7,
+		Reload:                func() (Config, error) { return Config{}, errors.New("bad config") },
+	})
+	output := captureLog(s.reload)
+	if s.config().MaxInterfaceAddresses != 7 {
+		t.Error("expected the configuration to be kept after a failed reload")
+	}
+	if !strings.Contains(output, "bad config") {
+		t.Errorf("expected the reload error to be logged, got: %s", output)
+	}
+}
+
+// captureLog returns everything logged while f runs.
+func captureLog(f func()) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	f()
+	return buf.String()
+}
+
+func TestGoroutineDumpDisabled(t *testing.T) {
+	output := captureLog(func() {
+		dumpGoroutines(&Config{DisableGoroutineDump: true}, make([]byte, 1<<16))
+	})
+	if strings.Contains(output, "[running]") {
+		t.Errorf("expected no goroutine dump in the log, got: %s", output)
+	}
+}
+
+func TestGoroutineDumpRedirectedToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goroutines.txt")
+	output := captureLog(func() {
+		dumpGoroutines(&Config{GoroutineDumpPath: path}, make([]byte, 1<<16))
+	})
+	if strings.Contains(output, "[running]") {
+		t.Errorf("expected no goroutine dump in the log, got: %s", output)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the dump to be readable only by its owner, got %v", info.Mode())
+	}
+	dump, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dump), "TestGoroutineDumpRedirectedToFile") {
+		t.Error("expected the dump to include the stack of this test")
+	}
+}
+
+func TestGoroutineDumpFileIsProtected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goroutines.txt")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dumpGoroutines(&Config{GoroutineDumpPath: path}, make([]byte, 1<<16))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected an existing dump file to be made readable only by its owner, got %v", info.Mode())
+	}
+	target := filepath.Join(dir, "target.txt")
+	if err := ioutil.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.txt")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	output := captureLog(func() {
+		dumpGoroutines(&Config{GoroutineDumpPath: link}, make([]byte, 1<<16))
+	})
+	if dump, err := ioutil.ReadFile(target); err != nil || len(dump) > 0 {
+		t.Errorf("expected the dump not to be written through a symbolic link (%v)", err)
+	}
+	if !strings.Contains(output, "unable to write goroutine dump") {
+		t.Errorf("expected the failure to be logged, got: %s", output)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pcapme/pcap/api"
+	"log"
+	"regexp"
+)
+
+// vlanOffloadSource reports whether an interface strips VLAN tags in hardware. It is a variable so
+// that tests can substitute a fake source.
+var vlanOffloadSource = readVLANOffload
+
+var vlanFilterPattern = regexp.MustCompile(`\bvlan\b`)
+
+// vlanOffloadWarning returns a warning if the filter matches on VLAN tags but the interface strips
+// them in hardware. The tag is then only available as packet metadata, so depending on the kernel
+// and libpcap versions, "vlan" filters may silently match nothing.
+func vlanOffloadWarning(iface string, filter string) *api.CaptureStatus {
+	if !vlanFilterPattern.MatchString(filter) {
+		return nil
+	}
+	stripped, err := vlanOffloadSource(iface)
+	if err != nil {
+		log.Printf("%s: unable to check for VLAN offload: %v", iface, err)
+		return nil
+	}
+	if !stripped {
+		return nil
+	}
+	return &api.CaptureStatus{
+		Message: fmt.Sprintf("%s strips VLAN tags in hardware, so VLAN filters may not match; "+
+			"consider disabling it with 'ethtool -K %s rxvlan off'", iface, iface),
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"golang.org/x/sys/unix"
+	"unsafe"
+)
+
+// See 'linux/ethtool.h'.
+const (
+	ethtoolGetFlags   = 0x00000025
+	ethtoolFlagRXVLAN = 1 << 8
+)
+
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+// ethtoolRequest is a 'struct ifreq' holding a pointer to the ethtool command. The kernel copies
+// the whole of the struct, whose union is 24 bytes long, so it's padded to match.
+type ethtoolRequest struct {
+	name [unix.IFNAMSIZ]byte
+	data uintptr
+	_    [ifreqUnionSize - unsafe.Sizeof(uintptr(0))]byte
+}
+
+const ifreqUnionSize = 24
+
+func readVLANOffload(iface string) (bool, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(fd)
+	value := ethtoolValue{cmd: ethtoolGetFlags}
+	var request ethtoolRequest
+	copy(request.name[:unix.IFNAMSIZ-1], iface)
+	request.data = uintptr(unsafe.Pointer(&value))
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&request)))
+	if errno != 0 {
+		return false, errno
+	}
+	return value.data&ethtoolFlagRXVLAN != 0, nil
+}
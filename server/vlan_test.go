@@ -0,0 +1,36 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func fakeVLANOffload(stripped bool, err error) (restore func()) {
+	vlanOffloadSource = func(iface string) (bool, error) {
+		return stripped, err
+	}
+	return func() { vlanOffloadSource = readVLANOffload }
+}
+
+func TestVLANOffloadWarning(t *testing.T) {
+	defer fakeVLANOffload(true, nil)()
+	warning := vlanOffloadWarning("eth0", "(vlan 100 and udp)")
+	if warning == nil || !strings.Contains(warning.Message, "eth0 strips VLAN tags") {
+		t.Errorf("expected a VLAN offload warning, got %+v", warning)
+	}
+	if warning := vlanOffloadWarning("eth0", "(udp port 53)"); warning != nil {
+		t.Errorf("expected no warning for a filter without VLANs, got %+v", warning)
+	}
+}
+
+func TestVLANOffloadWarningWithoutOffload(t *testing.T) {
+	defer fakeVLANOffload(false, nil)()
+	if warning := vlanOffloadWarning("eth0", "vlan"); warning != nil {
+		t.Errorf("expected no warning, got %+v", warning)
+	}
+	defer fakeVLANOffload(false, errors.New("operation not supported"))()
+	if warning := vlanOffloadWarning("eth0", "vlan"); warning != nil {
+		t.Errorf("expected no warning if offload can't be checked, got %+v", warning)
+	}
+}
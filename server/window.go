@@ -0,0 +1,36 @@
+package server
+
+import "time"
+
+// timeWindow is the range of packet timestamps a client asked for. A nil window includes all
+// packets.
+type timeWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// newTimeWindow creates a window from Unix timestamps in nanoseconds, where zero leaves that side
+// of the window unbounded. It returns nil if both sides are unbounded.
+func newTimeWindow(startNanoseconds, endNanoseconds int64) *timeWindow {
+	if startNanoseconds == 0 && endNanoseconds == 0 {
+		return nil
+	}
+	window := &timeWindow{}
+	if startNanoseconds != 0 {
+		window.start = time.Unix(0, startNanoseconds)
+	}
+	if endNanoseconds != 0 {
+		window.end = time.Unix(0, endNanoseconds)
+	}
+	return window
+}
+
+// before returns true if the timestamp is before the start of the window.
+func (w *timeWindow) before(timestamp time.Time) bool {
+	return w != nil && !w.start.IsZero() && timestamp.Before(w.start)
+}
+
+// after returns true if the timestamp is at or after the end of the window.
+func (w *timeWindow) after(timestamp time.Time) bool {
+	return w != nil && !w.end.IsZero() && !timestamp.Before(w.end)
+}
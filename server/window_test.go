@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"github.com/pcapme/pcap/api"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLiveCaptureTimeWindow(t *testing.T) {
+	packets := make([][]byte, 5)
+	for i := range packets {
+		packets[i] = udp4Fixture(t, "192.0.2.1", "192.0.2.2", 1000+i, 53)
+	}
+	// writePcapFixture spaces the packets one second apart, starting at this time.
+	base := time.Unix(1500000000, 0)
+	path := writePcapFile(t, packets)
+	defer os.Remove(path)
+	stream := newFakeCaptureStream()
+	s := &Server{Config: offlineConfig()}
+	err := s.LiveCapture(&api.CaptureRequest{
+		OfflineSource:          path,
+		WindowStartNanoseconds: base.Add(time.Second).UnixNano(),
+		WindowEndNanoseconds:   base.Add(3 * time.Second).UnixNano(),
+	}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := stream.packets()
+	if len(received) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(received))
+	}
+	for i, packet := range received {
+		if !bytes.Equal(packet.Data, packets[i+1]) {
+			t.Errorf("packet %d: expected packet %d from the fixture", i, i+1)
+		}
+	}
+}
+
+func TestTimeWindowUnbounded(t *testing.T) {
+	if newTimeWindow(0, 0) != nil {
+		t.Error("expected no window")
+	}
+	window := newTimeWindow(int64(time.Second), 0)
+	if !window.before(time.Unix(0, 0)) || window.before(time.Unix(1, 0)) || window.after(time.Unix(1<<40, 0)) {
+		t.Error("unexpected window bounds")
+	}
+}